@@ -1,10 +1,22 @@
 package burner
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // ErrMessageDoesntExist is returned by GetMessagesByID when it cant find that specific message
 var ErrMessageDoesntExist = errors.New("message doesn't exist")
 
+// ErrDuplicateMessage is returned by SaveNewMessageOnce when the inbox already has a message with the same
+// EmailProviderID received within DuplicateWindow. Providers and MTAs redeliver messages they aren't sure were
+// accepted, so callers should treat the message as saved.
+var ErrDuplicateMessage = errors.New("message is a duplicate")
+
+// DuplicateWindow is how long after a message is received that another with the same EmailProviderID is treated as a
+// redelivery of it. Messages without an EmailProviderID are never duplicates.
+const DuplicateWindow = 24 * time.Hour
+
 // Database lists methods needed to implement a db
 type Database interface {
 	// Start is where you should do schema creation and launch gorountines for background operations
@@ -13,9 +25,24 @@ type Database interface {
 	GetInboxByID(id string) (Inbox, error)
 	GetInboxByAddress(address string) (Inbox, error)
 	EmailAddressExists(address string) (bool, error)
+	// GetPatternInbox returns the pattern inbox with the longest prefix matching address. It is called for mail to
+	// every address without an inbox so it must not make a query for each of the address's PatternCandidates.
+	GetPatternInbox(address string) (Inbox, bool, error)
 	SetInboxCreated(inbox Inbox) error
 	SetInboxFailed(inbox Inbox) error
+	SetInboxAllowedSenders(inbox Inbox) error
 	SaveNewMessage(message Message) error
+	// SaveNewMessageOnce saves message unless it is a duplicate, in which case it returns ErrDuplicateMessage. The
+	// check and save must be atomic so that concurrent redeliveries can't both be saved.
+	SaveNewMessageOnce(message Message) error
 	GetMessagesByInboxID(id string) ([]Message, error)
 	GetMessageByID(inboxID string, messageID string) (Message, error)
+	GetInboxesWithMessages() ([]Inbox, error)
+	DeleteAllMessages() error
+}
+
+// ExpiryNotifier is implemented by databases which delete expired inboxes themselves. f is called with each inbox as
+// it is deleted so the routes of the email providers can be removed with it.
+type ExpiryNotifier interface {
+	NotifyExpired(f func(i Inbox))
 }
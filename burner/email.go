@@ -1,38 +1,117 @@
 package burner
 
 import (
-	"strings"
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
 	log "github.com/sirupsen/logrus"
 )
 
 //EmailProvider represents a mail provider that burner.kiwi can use to receive mail from
 type EmailProvider interface {
-	Start(websiteAddr string, db Database, r *mux.Router, isBlacklistedDomain func(string) bool) error
+	Start(websiteAddr string, db Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error
 	Stop() error
 	RegisterRoute(i Inbox) (string, error)
+	// DeleteRoute removes the route with id returned by RegisterRoute once its inbox has been deleted or expired.
+	// Providers without routes to remove return nil.
+	DeleteRoute(id string) error
 }
 
-type EmailGenerator interface {
-	NewRandom() string
-	NewFromUserAndHost(user string, host string) (string, error)
+// NamedEmailProvider is an email provider and the name its route ids are stored under
+type NamedEmailProvider struct {
+	Name     string
+	Provider EmailProvider
+}
+
+// EmailProviders runs several email providers at once, e.g. SMTP alongside Mailgun while migrating from one to the
+// other. Inboxes are registered with every provider.
+type EmailProviders []NamedEmailProvider
+
+// Start starts each provider in order. If one fails to start those already started are stopped.
+func (e EmailProviders) Start(websiteAddr string, db Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error {
+	for n, p := range e {
+		err := p.Provider.Start(websiteAddr, db, r, checkPolicy)
+		if err != nil {
+			stopErr := e[:n].Stop()
+			if stopErr != nil {
+				log.WithError(stopErr).Error("EmailProviders.Start: failed to stop started providers")
+			}
+			return fmt.Errorf("failed to start %s email provider: %w", p.Name, err)
+		}
+	}
+	return nil
 }
 
-func (s *Server) isBlacklistedDomain(email string) bool {
-	for _, domain := range s.cfg.BlacklistedDomains {
-		if strings.Contains(email, domain) {
-			return true
+// Stop stops every provider in the reverse order they were started
+func (e EmailProviders) Stop() error {
+	var errs []error
+	for n := len(e) - 1; n >= 0; n-- {
+		err := e[n].Provider.Stop()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop %s email provider: %w", e[n].Name, err))
 		}
 	}
-	return false
+	return errors.Join(errs...)
 }
 
-//createRouteAndUpdate is intended to be run in a goroutine. It creates an email route and updates the db with
-//the result. Otherwise it fails silently and this failure is picked up in the next request.
+// RegisterRoutes registers i with every provider. The ids of the routes which were registered are returned even if
+// another provider fails.
+func (e EmailProviders) RegisterRoutes(i Inbox) (RouteIDs, error) {
+	ids := RouteIDs{}
+	var errs []error
+
+	for _, p := range e {
+		id, err := p.Provider.RegisterRoute(i)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+			continue
+		}
+		ids[p.Name] = id
+	}
+
+	return ids, errors.Join(errs...)
+}
+
+// DeleteRoutes removes the routes of i from every provider it was registered with. Every route is attempted even if
+// another provider fails.
+func (e EmailProviders) DeleteRoutes(i Inbox) error {
+	var errs []error
+
+	for _, p := range e {
+		id, ok := i.EmailProviderRouteIDs[p.Name]
+		if !ok {
+			continue
+		}
+
+		err := p.Provider.DeleteRoute(id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// LambdaEventHandler is implemented by email providers which can receive mail from lambda events other than API
+// Gateway requests. handled is false if the event isn't one the provider receives mail from.
+type LambdaEventHandler interface {
+	HandleLambdaEvent(ctx context.Context, payload []byte) (handled bool, err error)
+}
+
+type EmailGenerator interface {
+	NewRandom() string
+	NewFromUserAndHost(user string, host string) (string, error)
+	NewPatternFromPrefixAndHost(prefix string, host string) (string, error)
+}
+
+//createRouteAndUpdate is intended to be run in a goroutine. It creates a route with each email provider and updates
+//the db with the result. Otherwise it fails silently and this failure is picked up in the next request.
 func (s *Server) createRouteAndUpdate(i Inbox) {
-	routeID, err := s.email.RegisterRoute(i)
+	routeIDs, err := s.email.RegisterRoutes(i)
 	if err != nil {
 		log.WithField("inbox", i.ID).WithError(err).Error("createRouteAndUpdate: failed to create route")
 
@@ -45,7 +124,7 @@ func (s *Server) createRouteAndUpdate(i Inbox) {
 		return
 	}
 
-	i.EmailProviderRouteID = routeID
+	i.EmailProviderRouteIDs = routeIDs
 	i.FailedToCreate = false
 	err = s.db.SetInboxCreated(i)
 	if err != nil {
@@ -59,3 +138,12 @@ func (s *Server) lambdaCreateRouteAndUpdate(wg *sync.WaitGroup, i Inbox) {
 	defer wg.Done()
 	s.createRouteAndUpdate(i)
 }
+
+// deleteRoutes removes the routes of i from the email providers. It is called when i is deleted or expires and fails
+// silently as providers which keep routes also remove them once they expire.
+func (s *Server) deleteRoutes(i Inbox) {
+	err := s.email.DeleteRoutes(i)
+	if err != nil {
+		log.WithField("inbox", i.ID).WithError(err).Error("deleteRoutes: failed to delete routes")
+	}
+}
@@ -0,0 +1,99 @@
+package burner
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEmailProviders_RegisterRoutes(t *testing.T) {
+	smtp := new(MockEmailProvider)
+	smtp.On("RegisterRoute", mock.Anything).Return("smtp", nil)
+
+	mailgun := new(MockEmailProvider)
+	mailgun.On("RegisterRoute", mock.Anything).Return("4f3bad2335335426750048c6", nil).Once()
+	mailgun.On("RegisterRoute", mock.Anything).Return("", errors.New("unavailable")).Once()
+
+	e := EmailProviders{{Name: "smtp", Provider: smtp}, {Name: "mailgun", Provider: mailgun}}
+
+	ids, err := e.RegisterRoutes(Inbox{ID: "1234"})
+	assert.NoError(t, err)
+	assert.Equal(t, RouteIDs{"smtp": "smtp", "mailgun": "4f3bad2335335426750048c6"}, ids)
+
+	// the routes which were registered are still returned
+	ids, err = e.RegisterRoutes(Inbox{ID: "1234"})
+	assert.EqualError(t, err, "mailgun: unavailable")
+	assert.Equal(t, RouteIDs{"smtp": "smtp"}, ids)
+
+	smtp.AssertExpectations(t)
+	mailgun.AssertExpectations(t)
+}
+
+func TestEmailProviders_Start(t *testing.T) {
+	var order []string
+
+	smtp := new(MockEmailProvider)
+	smtp.On("Start", "https://burner.kiwi", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	smtp.On("Stop").Run(func(mock.Arguments) { order = append(order, "smtp") }).Return(nil)
+
+	mailgun := new(MockEmailProvider)
+	mailgun.On("Start", "https://burner.kiwi", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mailgun.On("Stop").Run(func(mock.Arguments) { order = append(order, "mailgun") }).Return(errors.New("timed out"))
+
+	e := EmailProviders{{Name: "smtp", Provider: smtp}, {Name: "mailgun", Provider: mailgun}}
+
+	err := e.Start("https://burner.kiwi", new(MockDatabase), mux.NewRouter(), func(policy.Request) policy.Decision { return policy.Decision{Allowed: true} })
+	assert.NoError(t, err)
+
+	err = e.Stop()
+	assert.EqualError(t, err, "failed to stop mailgun email provider: timed out")
+	assert.Equal(t, []string{"mailgun", "smtp"}, order)
+
+	smtp.AssertExpectations(t)
+	mailgun.AssertExpectations(t)
+}
+
+func TestEmailProviders_Start_Failed(t *testing.T) {
+	smtp := new(MockEmailProvider)
+	smtp.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	smtp.On("Stop").Return(nil)
+
+	mailgun := new(MockEmailProvider)
+	mailgun.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(errors.New("bad key"))
+
+	ses := new(MockEmailProvider)
+
+	e := EmailProviders{{Name: "smtp", Provider: smtp}, {Name: "mailgun", Provider: mailgun}, {Name: "ses", Provider: ses}}
+
+	// providers already started are stopped and later ones aren't started
+	err := e.Start("https://burner.kiwi", new(MockDatabase), mux.NewRouter(), func(policy.Request) policy.Decision { return policy.Decision{Allowed: true} })
+	assert.EqualError(t, err, "failed to start mailgun email provider: bad key")
+
+	smtp.AssertExpectations(t)
+	mailgun.AssertExpectations(t)
+	ses.AssertExpectations(t)
+}
+
+func TestEmailProviders_DeleteRoutes(t *testing.T) {
+	smtp := new(MockEmailProvider)
+	smtp.On("DeleteRoute", "smtp").Return(nil)
+
+	mailgun := new(MockEmailProvider)
+	mailgun.On("DeleteRoute", "4f3bad2335335426750048c6").Return(errors.New("unavailable"))
+
+	// ses was added after the inbox was created so has no route to delete
+	ses := new(MockEmailProvider)
+
+	e := EmailProviders{{Name: "smtp", Provider: smtp}, {Name: "mailgun", Provider: mailgun}, {Name: "ses", Provider: ses}}
+
+	err := e.DeleteRoutes(Inbox{ID: "1234", EmailProviderRouteIDs: RouteIDs{"smtp": "smtp", "mailgun": "4f3bad2335335426750048c6"}})
+	assert.EqualError(t, err, "mailgun: unavailable")
+
+	smtp.AssertExpectations(t)
+	mailgun.AssertExpectations(t)
+	ses.AssertExpectations(t)
+}
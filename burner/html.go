@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -60,10 +61,14 @@ func (s *Server) getInbox(session *session, w http.ResponseWriter, r *http.Reque
 		return msgs[i].ReceivedAt > msgs[j].ReceivedAt
 	})
 
+	subaddress := r.URL.Query().Get("subaddress")
+
 	vars := inboxOut{
-		Static:   s.getStaticDetails(),
-		Messages: transformMessagesForTemplate(msgs),
-		Inbox:    transformInboxForTemplate(i),
+		Static:             s.getStaticDetails(),
+		Messages:           transformMessagesForTemplate(filterSelectedSubaddress(msgs, subaddress)),
+		Inbox:              transformInboxForTemplate(i),
+		Subaddresses:       getSubaddresses(msgs),
+		SelectedSubaddress: subaddress,
 	}
 
 	err = s.getIndexTemplate().ExecuteTemplate(w, "base", vars)
@@ -75,6 +80,11 @@ func (s *Server) getInbox(session *session, w http.ResponseWriter, r *http.Reque
 
 // newRandomInbox generates a new Inbox with a random route and host from availabile options.
 func (s *Server) newRandomInbox(session *session, w http.ResponseWriter, r *http.Request) {
+	// only limit here rather than in middleware as the index also shows existing inboxes
+	if !checkRateLimit(s.cfg.InboxRateLimit, w, r) {
+		return
+	}
+
 	i := NewInbox()
 	i.Address = s.eg.NewRandom()
 
@@ -213,12 +223,25 @@ func (s *Server) IndividualMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if msg.BodyHTML != "" {
+		msg.BodyURL, err = s.bodyURL(msg.Message)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"inboxID": inboxID, "messageID": messageID}).Error("IndividualMessage: failed to get body url")
+			http.Error(w, "Failed to get message", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	subaddress := r.URL.Query().Get("subaddress")
+
 	vars := inboxOut{
 		Static:             s.getStaticDetails(),
-		Messages:           transformMessagesForTemplate(msgs),
+		Messages:           transformMessagesForTemplate(filterSelectedSubaddress(msgs, subaddress)),
 		Inbox:              transformInboxForTemplate(inbox),
 		SelectedMessage:    msg,
 		HasSelectedMessage: true,
+		Subaddresses:       getSubaddresses(msgs),
+		SelectedSubaddress: subaddress,
 	}
 
 	err = s.getIndexTemplate().ExecuteTemplate(w, "base", vars)
@@ -228,6 +251,160 @@ func (s *Server) IndividualMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// bodyPurpose is the purpose of tokens which authorise reading a message body
+const bodyPurpose = "body"
+
+// bodyToken authorises reading the html body of a single message. Bodies may be served from another origin which can't
+// read the session cookie so the token is put in the url instead.
+type bodyToken struct {
+	Purpose   string `json:"__purpose,omitempty"`
+	InboxID   string `json:"body_inbox_id"`
+	MessageID string `json:"body_message_id"`
+}
+
+// bodyURL returns the url the html body of msg is served from. It is valid for as long as the message is kept.
+func (s *Server) bodyURL(msg Message) (string, error) {
+	token, err := s.notariser.Sign(bodyPurpose, bodyToken{InboxID: msg.InboxID, MessageID: msg.ID}, msg.TTL)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign body token: %w", err)
+	}
+
+	return strings.TrimSuffix(s.cfg.BodyURL, "/") + "/body/" + token, nil
+}
+
+// MessageBody returns the html body of the message named by the token in the url. The body was written by whoever
+// sent the message so it must be served with BodySecurityHeaders.
+func (s *Server) MessageBody(w http.ResponseWriter, r *http.Request) {
+	var token bodyToken
+	err := s.notariser.Verify(mux.Vars(r)["token"], &token)
+	if err != nil || token.Purpose != bodyPurpose {
+		http.Error(w, "Message not found on burner.kiwi", http.StatusNotFound)
+		return
+	}
+
+	msg, err := s.db.GetMessageByID(token.InboxID, token.MessageID)
+	if err == ErrMessageDoesntExist || (err == nil && msg.Viewable().BodyHTML == "") {
+		http.Error(w, "Message not found on burner.kiwi", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).WithFields(log.Fields{"inboxID": token.InboxID, "messageID": token.MessageID}).Error("MessageBody: failed to get message")
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	_, err = w.Write([]byte(msg.BodyHTML))
+	if err != nil {
+		log.WithError(err).Error("MessageBody: failed to write response")
+	}
+}
+
+// AllMail shows every message received by every inbox. Only available in mail trap mode.
+func (s *Server) AllMail(w http.ResponseWriter, r *http.Request) {
+	msgs, inboxes, err := s.getAllMail()
+	if err != nil {
+		log.WithError(err).Error("AllMail: failed to get all mail")
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	vars := inboxOut{
+		Static:     s.getStaticDetails(),
+		Messages:   transformMessagesForTemplate(msgs),
+		AllMail:    true,
+		InboxCount: inboxes,
+	}
+
+	err = s.getIndexTemplate().ExecuteTemplate(w, "base", vars)
+	if err != nil {
+		log.WithError(err).Error("AllMail: failed to write template response")
+		http.Error(w, "Failed to write response", http.StatusInternalServerError)
+	}
+}
+
+// AllMailMessage returns a singular message from the all mail view. Only available in mail trap mode.
+func (s *Server) AllMailMessage(w http.ResponseWriter, r *http.Request) {
+	inboxID := mux.Vars(r)["inboxID"]
+	messageID := mux.Vars(r)["messageID"]
+
+	msgs, inboxes, err := s.getAllMail()
+	if err != nil {
+		log.WithError(err).Error("AllMailMessage: failed to get all mail")
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	templateMsgs := transformMessagesForTemplate(msgs)
+
+	msg, ok := getIndividualMsgById(messageID, templateMsgs)
+	if !ok || msg.InboxID != inboxID {
+		http.Error(w, "Message not found on burner.kiwi", http.StatusNotFound)
+		return
+	}
+
+	if msg.BodyHTML != "" {
+		msg.BodyURL, err = s.bodyURL(msg.Message)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"inboxID": inboxID, "messageID": messageID}).Error("AllMailMessage: failed to get body url")
+			http.Error(w, "Failed to get message", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	vars := inboxOut{
+		Static:             s.getStaticDetails(),
+		Messages:           templateMsgs,
+		SelectedMessage:    msg,
+		HasSelectedMessage: true,
+		AllMail:            true,
+		InboxCount:         inboxes,
+	}
+
+	err = s.getIndexTemplate().ExecuteTemplate(w, "base", vars)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"inboxID": inboxID, "messageID": messageID}).Error("AllMailMessage: failed to execute template")
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
+// getAllMail returns every message across all inboxes, newest first, and the number of inboxes they belong to
+func (s *Server) getAllMail() ([]Message, int, error) {
+	inboxes, err := s.db.GetInboxesWithMessages()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get inboxes with messages: %w", err)
+	}
+
+	var msgs []Message
+	for _, i := range inboxes {
+		m, err := s.db.GetMessagesByInboxID(i.ID)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to get messages for inbox %v: %w", i.ID, err)
+		}
+		for _, msg := range m {
+			// messages received before recipients were recorded were always sent to the inbox address
+			if msg.Recipient == "" {
+				msg.Recipient = i.Address
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].ReceivedAt > msgs[j].ReceivedAt
+	})
+
+	return msgs, len(inboxes), nil
+}
+
+// filterSelectedSubaddress filters msgs down to the subaddress selected in the ui, if any
+func filterSelectedSubaddress(msgs []Message, subaddress string) []Message {
+	if subaddress == "" {
+		return msgs
+	}
+	return FilterMessagesBySubaddress(msgs, subaddress)
+}
+
 func getIndividualMsgById(id string, haystack []templateMessage) (templateMessage, bool) {
 	for _, msg := range haystack {
 		if msg.ID == id {
@@ -279,6 +456,78 @@ func (s *Server) EditInbox(w http.ResponseWriter, r *http.Request) {
 	s.editInbox(w, r, "")
 }
 
+// EditAllowedSenders shows the senders the inbox is restricted to and allows them to be changed
+func (s *Server) EditAllowedSenders(w http.ResponseWriter, r *http.Request) {
+	session := s.getSessionFromCookie(r)
+	i, err := s.db.GetInboxByID(session.InboxID)
+	if err != nil {
+		log.WithField("inboxID", session.InboxID).WithError(err).Error("EditAllowedSenders: failed to get inbox")
+		http.Error(w, "Failed to get inbox", http.StatusInternalServerError)
+		return
+	}
+
+	s.allowedSenders(w, i, i.AllowedSenders, "")
+}
+
+// SaveAllowedSenders restricts the inbox to the senders given one per line
+func (s *Server) SaveAllowedSenders(w http.ResponseWriter, r *http.Request) {
+	session := s.getSessionFromCookie(r)
+	i, err := s.db.GetInboxByID(session.InboxID)
+	if err != nil {
+		log.WithField("inboxID", session.InboxID).WithError(err).Error("SaveAllowedSenders: failed to get inbox")
+		http.Error(w, "Failed to get inbox", http.StatusInternalServerError)
+		return
+	}
+
+	entries := strings.Split(r.PostFormValue("senders"), "\n")
+
+	senders, err := ParseSenderList(entries)
+	if err != nil {
+		log.WithError(err).Info("SaveAllowedSenders: invalid senders")
+		s.allowedSenders(w, i, entries, "Failed to save: "+strings.TrimPrefix(err.Error(), ErrInvalidSender.Error()+": "))
+		return
+	}
+
+	i.AllowedSenders = senders
+	err = s.db.SetInboxAllowedSenders(i)
+	if err != nil {
+		log.WithField("inboxID", i.ID).WithError(err).Error("SaveAllowedSenders: failed to save allowed senders")
+		s.allowedSenders(w, i, entries, "Failed to save: try again")
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (s *Server) allowedSenders(w http.ResponseWriter, i Inbox, senders []string, errMessage string) {
+	msgs, err := s.db.GetMessagesByInboxID(i.ID)
+	if err != nil {
+		log.WithField("inboxID", i.ID).WithError(err).Error("AllowedSenders: failed to get all messages for inbox")
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].ReceivedAt > msgs[j].ReceivedAt
+	})
+
+	vars := inboxOut{
+		Static:   s.getStaticDetails(),
+		Messages: transformMessagesForTemplate(msgs),
+		Inbox:    transformInboxForTemplate(i),
+		ModalData: sendersModalData{
+			Senders: senders,
+			Err:     errMessage,
+		},
+	}
+
+	err = s.getSendersTemplate().ExecuteTemplate(w, "base", vars)
+	if err != nil {
+		log.Printf("AllowedSenders: failed to execute template: %v", err)
+		http.Error(w, "Failed to execute template", http.StatusInternalServerError)
+	}
+}
+
 // DeleteInbox prompts for a confirmation to delete from the user
 func (s *Server) DeleteInbox(w http.ResponseWriter, r *http.Request) {
 	session := s.getSessionFromCookie(r)
@@ -313,7 +562,7 @@ func (s *Server) DeleteInbox(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// ConfirmDeleteInbox removes the user session cookie
+// ConfirmDeleteInbox removes the user session cookie and the routes of the inbox
 func (s *Server) ConfirmDeleteInbox(w http.ResponseWriter, r *http.Request) {
 	session := s.getSessionFromCookie(r)
 
@@ -326,6 +575,17 @@ func (s *Server) ConfirmDeleteInbox(w http.ResponseWriter, r *http.Request) {
 
 	if !dlt {
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	i, err := s.db.GetInboxByID(session.InboxID)
+	if err != nil {
+		log.WithField("inboxID", session.InboxID).WithError(err).Error("ConfirmDeleteInbox: failed to get inbox")
+	} else if s.cfg.UsingLambda {
+		// lambda is frozen once we return the response so the routes would never be deleted in the background
+		s.deleteRoutes(i)
+	} else {
+		go s.deleteRoutes(i)
 	}
 
 	err = session.Delete(w)
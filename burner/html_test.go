@@ -0,0 +1,217 @@
+package burner
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/haydenwoodhead/burner.kiwi/notary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_MessageBody(t *testing.T) {
+	ttl := time.Now().Add(time.Hour).Unix()
+
+	mDB := new(MockDatabase)
+	mDB.On("GetMessageByID", "1234", "5678").Return(Message{ID: "5678", InboxID: "1234", BodyHTML: "<p>Hello</p>", TTL: ttl}, nil)
+	mDB.On("GetMessageByID", "1234", "plain").Return(Message{ID: "plain", InboxID: "1234", BodyPlain: "Hello", TTL: ttl}, nil)
+	mDB.On("GetMessageByID", "1234", "gone").Return(Message{}, ErrMessageDoesntExist)
+	mDB.On("GetMessageByID", "1234", "broken").Return(Message{}, errors.New("db is down"))
+
+	s := Server{
+		db:        mDB,
+		notariser: notary.New("testexample12344"),
+		cfg: Config{
+			URL:     "https://burner.kiwi",
+			BodyURL: "https://burnerusercontent.kiwi/",
+		},
+	}
+
+	sign := func(purpose string, v interface{}) string {
+		token, err := s.notariser.Sign(purpose, v, ttl)
+		require.NoError(t, err)
+		return token
+	}
+
+	bodyURL, err := s.bodyURL(Message{ID: "5678", InboxID: "1234", TTL: ttl})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(bodyURL, "https://burnerusercontent.kiwi/body/"), bodyURL)
+
+	tests := []struct {
+		Name         string
+		Token        string
+		ExpectedCode int
+		ExpectedBody string
+	}{
+		{
+			Name:         "valid token",
+			Token:        strings.TrimPrefix(bodyURL, "https://burnerusercontent.kiwi/body/"),
+			ExpectedCode: http.StatusOK,
+			ExpectedBody: "<p>Hello</p>",
+		},
+		{
+			Name:         "api token",
+			Token:        sign("auth", jwtToken{InboxID: "1234"}),
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Name:         "wrong purpose",
+			Token:        sign("auth", bodyToken{InboxID: "1234", MessageID: "5678"}),
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Name:         "modified token",
+			Token:        "not-a-real-token",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Name:         "no html body",
+			Token:        sign(bodyPurpose, bodyToken{InboxID: "1234", MessageID: "plain"}),
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Name:         "message deleted",
+			Token:        sign(bodyPurpose, bodyToken{InboxID: "1234", MessageID: "gone"}),
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Name:         "database error",
+			Token:        sign(bodyPurpose, bodyToken{InboxID: "1234", MessageID: "broken"}),
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/body/"+test.Token, nil)
+			r = mux.SetURLVars(r, map[string]string{"token": test.Token})
+
+			s.MessageBody(rr, r)
+
+			assert.Equal(t, test.ExpectedCode, rr.Code)
+			if test.ExpectedCode == http.StatusOK {
+				assert.Equal(t, test.ExpectedBody, rr.Body.String())
+				assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestServer_InfectedMessage(t *testing.T) {
+	ttl := time.Now().Add(time.Hour).Unix()
+
+	infected := Message{
+		ID:          "infected",
+		InboxID:     "1234",
+		Sender:      "shop@store.example",
+		FromAddress: "shop@store.example",
+		Recipient:   "bobby@example.com",
+		Subject:     "Your receipt",
+		BodyPlain:   "plain EICAR payload",
+		BodyHTML:    "<p>html EICAR payload</p>",
+		TTL:         ttl,
+		Virus:       &VirusResult{Infected: true, Signature: "Eicar-Test-Signature"},
+	}
+
+	mDB := new(MockDatabase)
+	mDB.On("GetInboxByID", "1234").Return(Inbox{ID: "1234", Address: "bobby@example.com", TTL: ttl}, nil)
+	mDB.On("GetInboxesWithMessages").Return([]Inbox{{ID: "1234", Address: "bobby@example.com", TTL: ttl}}, nil)
+	mDB.On("GetMessagesByInboxID", "1234").Return([]Message{infected}, nil)
+	mDB.On("GetMessageByID", "1234", "infected").Return(infected, nil)
+
+	s := Server{
+		db:           mDB,
+		notariser:    notary.New("testexample12344"),
+		sessionStore: sessions.NewCookieStore([]byte("testexample12344")),
+		cfg: Config{
+			URL:        "https://burner.kiwi",
+			MailTrap:   true,
+			MailHogAPI: true,
+		},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/messages/{messageID}/", s.IndividualMessage)
+	router.HandleFunc("/body/{token}", s.MessageBody)
+	router.HandleFunc("/all/{inboxID}/{messageID}/", s.AllMailMessage)
+	router.HandleFunc("/api/v2/inbox/{inboxID}/messages", s.GetAllMessagesJSON)
+	router.HandleFunc("/api/v1/messages", s.MailHogMessagesV1)
+	router.HandleFunc("/api/v1/messages/{messageID}", s.MailHogMessageV1)
+	router.HandleFunc("/api/v2/messages", s.MailHogMessagesV2)
+	router.HandleFunc("/api/v2/search", s.MailHogSearchV2)
+
+	// the website reads the inbox from the session cookie
+	setCookie := httptest.NewRecorder()
+	require.NoError(t, s.getSessionFromCookie(httptest.NewRequest(http.MethodGet, "/", nil)).SetInboxID("1234", setCookie))
+
+	bodyURL, err := s.bodyURL(infected)
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name         string
+		Path         string
+		ExpectedCode int
+		Contains     string
+	}{
+		{Name: "message page", Path: "/messages/infected/", ExpectedCode: http.StatusOK, Contains: "Its content has been withheld"},
+		{Name: "body", Path: strings.TrimPrefix(bodyURL, "https://burner.kiwi"), ExpectedCode: http.StatusNotFound},
+		{Name: "all mail message page", Path: "/all/1234/infected/", ExpectedCode: http.StatusOK, Contains: "Its content has been withheld"},
+		{Name: "api messages", Path: "/api/v2/inbox/1234/messages", ExpectedCode: http.StatusOK, Contains: `"subject":"Your receipt"`},
+		{Name: "mailhog v1 messages", Path: "/api/v1/messages", ExpectedCode: http.StatusOK, Contains: `"Your receipt"`},
+		{Name: "mailhog v1 message", Path: "/api/v1/messages/infected", ExpectedCode: http.StatusOK, Contains: `"Your receipt"`},
+		{Name: "mailhog v2 messages", Path: "/api/v2/messages", ExpectedCode: http.StatusOK, Contains: `"Your receipt"`},
+		{Name: "mailhog v2 search", Path: "/api/v2/search?kind=containing&query=EICAR", ExpectedCode: http.StatusOK, Contains: `"total":0`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.Path, nil)
+			r.Header.Set("Cookie", setCookie.Header().Get("Set-Cookie"))
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, r)
+
+			assert.Equal(t, test.ExpectedCode, rr.Code)
+			assert.Contains(t, rr.Body.String(), test.Contains)
+			assert.NotContains(t, rr.Body.String(), "EICAR payload")
+		})
+	}
+}
+
+func TestServer_ConfirmDeleteInbox_Lambda(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("GetInboxByID", "1234").Return(Inbox{ID: "1234", Address: "bobby@example.com", EmailProviderRouteIDs: RouteIDs{"mock": "route-1"}}, nil)
+
+	mEP := new(MockEmailProvider)
+	mEP.On("DeleteRoute", "route-1").Return(nil).Once()
+
+	s := Server{
+		db:           mDB,
+		email:        EmailProviders{{Name: "mock", Provider: mEP}},
+		sessionStore: sessions.NewCookieStore([]byte("testexample12344")),
+		cfg: Config{
+			UsingLambda: true,
+		},
+	}
+
+	setCookie := httptest.NewRecorder()
+	require.NoError(t, s.getSessionFromCookie(httptest.NewRequest(http.MethodGet, "/", nil)).SetInboxID("1234", setCookie))
+
+	r := httptest.NewRequest(http.MethodPost, "/delete", strings.NewReader("really-delete=true"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Cookie", setCookie.Header().Get("Set-Cookie"))
+
+	rr := httptest.NewRecorder()
+	s.ConfirmDeleteInbox(rr, r)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	// the route is deleted before the response is returned as lambda is frozen after that
+	mEP.AssertExpectations(t)
+}
@@ -3,6 +3,7 @@ package burner
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -48,6 +49,50 @@ func (s *Server) NewInboxJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.createInboxJSON(w, r, i, "random")
+}
+
+// NewPatternInboxJSON creates a pattern inbox which receives mail sent to any address beginning with the given
+// prefix, e.g. "ci-build-" receives mail for ci-build-1234@example.com and ci-build-abcd@example.com
+func (s *Server) NewPatternInboxJSON(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+		Host   string `json:"host"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		returnJSONError(w, r, http.StatusBadRequest, "Failed to parse request body")
+		return
+	}
+
+	address, err := s.eg.NewPatternFromPrefixAndHost(req.Prefix, req.Host)
+	if err != nil {
+		log.WithError(err).Info("NewPatternInboxJSON: failed to create pattern address")
+		returnJSONError(w, r, http.StatusBadRequest, "Failed to create inbox: bad prefix or host")
+		return
+	}
+
+	i := NewInbox()
+	i.Address = address
+
+	exists, err := s.db.EmailAddressExists(i.Address)
+	if err != nil {
+		log.WithError(err).Error("NewPatternInboxJSON: failed to check if email exists")
+		returnJSONError(w, r, http.StatusInternalServerError, "Failed to create inbox")
+		return
+	}
+
+	if exists {
+		returnJSONError(w, r, http.StatusConflict, "Failed to create inbox: prefix in use")
+		return
+	}
+
+	s.createInboxJSON(w, r, i, "pattern")
+}
+
+// createInboxJSON saves the inbox, registers it with the email provider and writes out the inbox with its token
+func (s *Server) createInboxJSON(w http.ResponseWriter, r *http.Request, i Inbox, style string) {
 	i.ID = uuid.Must(uuid.NewRandom()).String()
 	i.CreatedAt = time.Now().Unix()
 	i.TTL = time.Now().Add(time.Hour * 24).Unix()
@@ -65,7 +110,7 @@ func (s *Server) NewInboxJSON(w http.ResponseWriter, r *http.Request) {
 		go s.createRouteAndUpdate(i)
 	}
 
-	err = s.db.SaveNewInbox(i)
+	err := s.db.SaveNewInbox(i)
 	if err != nil {
 		log.WithError(err).Error("JSON Index: failed to save email")
 		returnJSONError(w, r, http.StatusInternalServerError, "Failed to save email")
@@ -93,7 +138,7 @@ func (s *Server) NewInboxJSON(w http.ResponseWriter, r *http.Request) {
 		wg.Wait()
 	}
 
-	metrics.InboxesCreated.With(prometheus.Labels{"content_type": "json", "style": "random"}).Inc()
+	metrics.InboxesCreated.With(prometheus.Labels{"content_type": "json", "style": style}).Inc()
 
 	returnJSON(w, r, http.StatusOK, Response{
 		Result:  res,
@@ -129,12 +174,103 @@ func (s *Server) GetAllMessagesJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if subaddress := r.URL.Query().Get("subaddress"); subaddress != "" {
+		m = FilterMessagesBySubaddress(m, subaddress)
+	}
+
+	for n := range m {
+		m[n] = m[n].Viewable()
+	}
+
 	returnJSON(w, r, http.StatusOK, Response{
 		Success: true,
 		Result:  m,
 	})
 }
 
+// SetAllowedSendersJSON restricts the inbox to mail from the given sender addresses and domains. An empty list
+// accepts mail from anyone.
+func (s *Server) SetAllowedSendersJSON(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["inboxID"]
+
+	var req struct {
+		Senders []string `json:"senders"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		returnJSONError(w, r, http.StatusBadRequest, "Failed to parse request body")
+		return
+	}
+
+	senders, err := ParseSenderList(req.Senders)
+	if err != nil {
+		returnJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	i, err := s.db.GetInboxByID(id)
+	if err != nil {
+		log.WithError(err).WithField("inboxID", id).Error("SetAllowedSendersJSON: failed to get inbox")
+		returnJSONError(w, r, http.StatusInternalServerError, "Failed to get email details")
+		return
+	}
+
+	i.AllowedSenders = senders
+	err = s.db.SetInboxAllowedSenders(i)
+	if err != nil {
+		log.WithError(err).WithField("inboxID", id).Error("SetAllowedSendersJSON: failed to save allowed senders")
+		returnJSONError(w, r, http.StatusInternalServerError, "Failed to save allowed senders")
+		return
+	}
+
+	returnJSON(w, r, http.StatusOK, Response{
+		Success: true,
+		Result:  i,
+	})
+}
+
+// GetInboxesJSON lists every inbox the mail trap created that has received mail along with a token for each so that
+// the rest of the api can be used against them. Inboxes created through the website or api are left out as anyone
+// could otherwise take them over. Only available in mail trap mode.
+func (s *Server) GetInboxesJSON(w http.ResponseWriter, r *http.Request) {
+	inboxes, err := s.db.GetInboxesWithMessages()
+	if err != nil {
+		log.WithError(err).Error("GetInboxesJSON: failed to get inboxes with messages")
+		returnJSONError(w, r, http.StatusInternalServerError, "Failed to get inboxes")
+		return
+	}
+
+	type inboxWithToken struct {
+		Inbox Inbox  `json:"email"`
+		Token string `json:"token"`
+	}
+
+	res := make([]inboxWithToken, 0, len(inboxes))
+	for _, i := range inboxes {
+		if !i.CreatedByTrap() {
+			continue
+		}
+
+		token, err := s.notariser.Sign("auth", jwtToken{InboxID: i.ID}, i.TTL)
+		if err != nil {
+			log.WithError(err).WithField("inboxID", i.ID).Error("GetInboxesJSON: failed to generate auth token")
+			returnJSONError(w, r, http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		res = append(res, inboxWithToken{Inbox: i, Token: token})
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Inbox.CreatedAt > res[j].Inbox.CreatedAt
+	})
+
+	returnJSON(w, r, http.StatusOK, Response{
+		Success: true,
+		Result:  res,
+	})
+}
+
 // returnJSONError returns json with custom error message
 func returnJSONError(w http.ResponseWriter, r *http.Request, status int, msg string) {
 	returnJSON(w, r, status, Response{
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -21,9 +22,9 @@ func TestServer_NewInboxJSON(t *testing.T) {
 
 	mDB := new(MockDatabase)
 	inbox := Inbox{
-		Address:              "test@example.com",
-		CreatedBy:            "192.168.1.1",
-		EmailProviderRouteID: "1234",
+		Address:               "test@example.com",
+		CreatedBy:             "192.168.1.1",
+		EmailProviderRouteIDs: RouteIDs{"mock": "1234"},
 	}
 	mDB.On("EmailAddressExists", "test@example.com").Return(false, nil)
 	mDB.On("SaveNewInbox", mock.MatchedBy(InboxMatcher(inbox))).Return(nil)
@@ -34,7 +35,7 @@ func TestServer_NewInboxJSON(t *testing.T) {
 
 	s := Server{
 		db:        mDB,
-		email:     mEP,
+		email:     EmailProviders{{Name: "mock", Provider: mEP}},
 		eg:        mEG,
 		notariser: notary.New("testexample12344"),
 		cfg: Config{
@@ -78,16 +79,89 @@ func TestServer_NewInboxJSON(t *testing.T) {
 	mEG.AssertExpectations(t)
 }
 
+func TestServer_NewPatternInboxJSON(t *testing.T) {
+	mEG := new(MockEmailGenerator)
+	mEG.On("NewPatternFromPrefixAndHost", "ci-", "example.com").Return("ci-*@example.com", nil)
+	mEG.On("NewPatternFromPrefixAndHost", "taken-", "example.com").Return("taken-*@example.com", nil)
+	mEG.On("NewPatternFromPrefixAndHost", "!", "example.com").Return("", errors.New("bad prefix"))
+
+	mDB := new(MockDatabase)
+	inbox := Inbox{
+		Address:   "ci-*@example.com",
+		CreatedBy: "192.168.1.1",
+	}
+	mDB.On("EmailAddressExists", "ci-*@example.com").Return(false, nil)
+	mDB.On("EmailAddressExists", "taken-*@example.com").Return(true, nil)
+	mDB.On("SaveNewInbox", mock.MatchedBy(InboxMatcher(inbox))).Return(nil)
+	mDB.On("SetInboxCreated", mock.MatchedBy(InboxMatcher(inbox))).Return(nil)
+
+	mEP := new(MockEmailProvider)
+	mEP.On("RegisterRoute", mock.Anything).Return("1234", nil)
+
+	s := Server{
+		db:        mDB,
+		email:     EmailProviders{{Name: "mock", Provider: mEP}},
+		eg:        mEG,
+		notariser: notary.New("testexample12344"),
+		cfg: Config{
+			UsingLambda: true,
+		},
+	}
+
+	tests := []struct {
+		Name         string
+		Body         string
+		ExpectedCode int
+	}{
+		{
+			Name:         "created",
+			Body:         `{"prefix":"ci-","host":"example.com"}`,
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Name:         "prefix in use",
+			Body:         `{"prefix":"taken-","host":"example.com"}`,
+			ExpectedCode: http.StatusConflict,
+		},
+		{
+			Name:         "bad prefix",
+			Body:         `{"prefix":"!","host":"example.com"}`,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			Name:         "bad body",
+			Body:         `prefix=ci-`,
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", strings.NewReader(test.Body))
+			r.RemoteAddr = "192.168.1.1"
+
+			s.NewPatternInboxJSON(rr, r)
+
+			assert.Equal(t, test.ExpectedCode, rr.Code)
+		})
+	}
+
+	mEP.AssertExpectations(t)
+	mDB.AssertExpectations(t)
+	mEG.AssertExpectations(t)
+}
+
 func TestServer_GetInboxDetailsJSON(t *testing.T) {
 	mDB := new(MockDatabase)
 	mDB.On("GetInboxByID", "1234").Return(Inbox{
-		Address:              "1234@example.com",
-		ID:                   "1234",
-		CreatedAt:            1526186018,
-		CreatedBy:            "192.168.1.1",
-		TTL:                  1526189618,
-		EmailProviderRouteID: "1234",
-		FailedToCreate:       false,
+		Address:               "1234@example.com",
+		ID:                    "1234",
+		CreatedAt:             1526186018,
+		CreatedBy:             "192.168.1.1",
+		TTL:                   1526189618,
+		EmailProviderRouteIDs: RouteIDs{"mock": "1234"},
+		FailedToCreate:        false,
 	}, nil)
 	mDB.On("GetInboxByID", "Doesntexist").Return(Inbox{}, errors.New("inbox doesn't exist"))
 
@@ -171,9 +245,213 @@ func TestServer_GetAllMessagesJSON(t *testing.T) {
 
 	router.ServeHTTP(rr, r)
 
-	var expected = `{"success":true,"errors":null,"result":[{"id":"91991919","received_at":1526186100,"sender":"bob@example.com","from_name":"Bobby Tables","from_address":"bob@example.com","subject":"DELETE FROM MESSAGES;","body_html":"\u003chtml\u003e\u003cbody\u003e\u003cp\u003eHello there how are you!\u003c/p\u003e\u003c/body\u003e\u003c/html\u003e","body_plain":"Hello there how are you!","ttl":1526189618}]}`
+	var expected = `{"success":true,"errors":null,"result":[{"id":"91991919","received_at":1526186100,"sender":"bob@example.com","from_name":"Bobby Tables","from_address":"bob@example.com","subject":"DELETE FROM MESSAGES;","body_html":"\u003chtml\u003e\u003cbody\u003e\u003cp\u003eHello there how are you!\u003c/p\u003e\u003c/body\u003e\u003c/html\u003e","body_plain":"Hello there how are you!","ttl":1526189618,"subaddress":"","recipient":""}]}`
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, expected, rr.Body.String())
+
+	mDB.AssertExpectations(t)
+}
+
+func TestServer_GetAllMessagesJSON_Subaddress(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("GetMessagesByInboxID", "1234").Return([]Message{
+		{
+			InboxID:    "1234",
+			ID:         "1",
+			Subject:    "Plain",
+			TTL:        1526189618,
+			Subaddress: "",
+		},
+		{
+			InboxID:    "1234",
+			ID:         "2",
+			Subject:    "Case 42",
+			TTL:        1526189618,
+			Subaddress: "case42",
+		},
+	}, nil)
+
+	s := Server{
+		db: mDB,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{inboxID}", s.GetAllMessagesJSON)
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/1234?subaddress=case42", nil)
+
+	router.ServeHTTP(rr, r)
+
+	var expected = `{"success":true,"errors":null,"result":[{"id":"2","received_at":0,"sender":"","from_name":"","from_address":"","subject":"Case 42","body_html":"","body_plain":"","ttl":1526189618,"subaddress":"case42","recipient":""}]}`
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.JSONEq(t, expected, rr.Body.String())
 
 	mDB.AssertExpectations(t)
 }
+
+func TestServer_GetAllMessagesJSON_Spam(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("GetMessagesByInboxID", "1234").Return([]Message{
+		{
+			InboxID: "1234",
+			ID:      "1",
+			Subject: "Spammy",
+			TTL:     1526189618,
+			Spam: &SpamResult{
+				Score:     6.3,
+				Threshold: 5,
+				Rules:     []string{"HTML_MESSAGE", "URIBL_BLOCKED"},
+			},
+		},
+	}, nil)
+
+	s := Server{
+		db: mDB,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{inboxID}", s.GetAllMessagesJSON)
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/1234", nil)
+
+	router.ServeHTTP(rr, r)
+
+	var expected = `{"success":true,"errors":null,"result":[{"id":"1","received_at":0,"sender":"","from_name":"","from_address":"","subject":"Spammy","body_html":"","body_plain":"","ttl":1526189618,"subaddress":"","recipient":"","spam":{"score":6.3,"threshold":5,"rules":["HTML_MESSAGE","URIBL_BLOCKED"]}}]}`
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, expected, rr.Body.String())
+
+	mDB.AssertExpectations(t)
+}
+
+func TestServer_GetInboxesJSON(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("GetInboxesWithMessages").Return([]Inbox{
+		{
+			Address:   "old@example.com",
+			ID:        "1234",
+			CreatedAt: 1526186018,
+			CreatedBy: TrapCreatedBy("192.168.1.1:2525"),
+			TTL:       4102444800,
+		},
+		{
+			Address:   "new@example.org",
+			ID:        "5678",
+			CreatedAt: 1526186020,
+			CreatedBy: TrapCreatedBy("192.168.1.1:2525"),
+			TTL:       4102444800,
+		},
+		{
+			Address:   "user@example.com",
+			ID:        "9012",
+			CreatedAt: 1526186022,
+			CreatedBy: "192.168.1.1",
+			TTL:       4102444800,
+		},
+	}, nil)
+
+	n := notary.New("testexample12344")
+
+	s := Server{
+		db:        mDB,
+		notariser: n,
+	}
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/v2/inboxes", nil)
+
+	s.GetInboxesJSON(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Success bool `json:"success"`
+		Result  []struct {
+			Inbox Inbox  `json:"email"`
+			Token string `json:"token"`
+		} `json:"result"`
+	}
+
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Len(t, resp.Result, 2)
+
+	// newest first
+	assert.Equal(t, "new@example.org", resp.Result[0].Inbox.Address)
+	assert.Equal(t, "old@example.com", resp.Result[1].Inbox.Address)
+
+	for _, res := range resp.Result {
+		var token jwtToken
+		err := n.Verify(res.Token, &token)
+		assert.NoError(t, err)
+		assert.Equal(t, res.Inbox.ID, token.InboxID)
+	}
+
+	mDB.AssertExpectations(t)
+}
+
+func TestServer_SetAllowedSendersJSON(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("GetInboxByID", "1234").Return(Inbox{
+		Address:   "1234@example.com",
+		ID:        "1234",
+		CreatedAt: 1526186018,
+		TTL:       1526189618,
+	}, nil)
+	mDB.On("SetInboxAllowedSenders", Inbox{
+		Address:        "1234@example.com",
+		ID:             "1234",
+		CreatedAt:      1526186018,
+		TTL:            1526189618,
+		AllowedSenders: SenderList{"alice@example.com", "example.org"},
+	}).Return(nil)
+
+	s := Server{
+		db: mDB,
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/{inboxID}/senders", s.SetAllowedSendersJSON)
+
+	tests := []struct {
+		Name             string
+		Body             string
+		ExpectedCode     int
+		ExpectedResponse string
+	}{
+		{
+			Name:             "valid",
+			Body:             `{"senders":["Alice@example.com","example.org"]}`,
+			ExpectedCode:     http.StatusOK,
+			ExpectedResponse: `{"success":true,"errors":null,"result":{"address":"1234@example.com","id":"1234","created_at":1526186018,"ttl":1526189618,"allowed_senders":["alice@example.com","example.org"]}}`,
+		},
+		{
+			Name:             "invalid sender",
+			Body:             `{"senders":["not a domain"]}`,
+			ExpectedCode:     http.StatusBadRequest,
+			ExpectedResponse: `{"success":false,"errors":{"code":500,"msg":"invalid sender: \"not a domain\" is not a domain"},"result":null}`,
+		},
+		{
+			Name:             "bad body",
+			Body:             `{`,
+			ExpectedCode:     http.StatusBadRequest,
+			ExpectedResponse: `{"success":false,"errors":{"code":500,"msg":"Failed to parse request body"},"result":null}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/1234/senders", strings.NewReader(test.Body))
+
+			router.ServeHTTP(rr, r)
+
+			assert.Equal(t, test.ExpectedCode, rr.Code)
+			assert.JSONEq(t, test.ExpectedResponse, rr.Body.String())
+		})
+	}
+
+	mDB.AssertExpectations(t)
+}
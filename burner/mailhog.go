@@ -0,0 +1,334 @@
+package burner
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultMailHogLimit is the number of messages returned by the v2 api when no limit is given, same as MailHog
+const defaultMailHogLimit = 50
+
+// mailHogMessage mirrors the message format returned by the MailHog api so that tools written against MailHog
+// can read mail from burner
+type mailHogMessage struct {
+	ID      string           `json:"ID"`
+	From    *mailHogPath     `json:"From"`
+	To      []*mailHogPath   `json:"To"`
+	Content *mailHogContent  `json:"Content"`
+	Created time.Time        `json:"Created"`
+	MIME    *mailHogMIMEBody `json:"MIME"`
+	Raw     *mailHogRaw      `json:"Raw"`
+}
+
+type mailHogPath struct {
+	Relays  []string `json:"Relays"`
+	Mailbox string   `json:"Mailbox"`
+	Domain  string   `json:"Domain"`
+	Params  string   `json:"Params"`
+}
+
+type mailHogContent struct {
+	Headers map[string][]string `json:"Headers"`
+	Body    string              `json:"Body"`
+	Size    int                 `json:"Size"`
+	MIME    *mailHogMIMEBody    `json:"MIME"`
+}
+
+type mailHogMIMEBody struct {
+	Parts []*mailHogContent `json:"Parts"`
+}
+
+type mailHogRaw struct {
+	From string   `json:"From"`
+	To   []string `json:"To"`
+	Data string   `json:"Data"`
+	Helo string   `json:"Helo"`
+}
+
+// mailHogMessages is the paged response of the MailHog v2 api
+type mailHogMessages struct {
+	Total int               `json:"total"`
+	Count int               `json:"count"`
+	Start int               `json:"start"`
+	Items []*mailHogMessage `json:"items"`
+}
+
+// MailHogMessagesV1 returns every message in MailHog v1 format
+func (s *Server) MailHogMessagesV1(w http.ResponseWriter, r *http.Request) {
+	msgs, _, err := s.getAllMail()
+	if err != nil {
+		log.WithError(err).Error("MailHogMessagesV1: failed to get all mail")
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	returnJSON(w, r, http.StatusOK, toMailHogMessages(msgs))
+}
+
+// MailHogMessageV1 returns a single message in MailHog v1 format
+func (s *Server) MailHogMessageV1(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["messageID"]
+
+	msgs, _, err := s.getAllMail()
+	if err != nil {
+		log.WithError(err).WithField("messageID", id).Error("MailHogMessageV1: failed to get all mail")
+		http.Error(w, "Failed to get message", http.StatusInternalServerError)
+		return
+	}
+
+	for _, m := range msgs {
+		if m.ID == id {
+			returnJSON(w, r, http.StatusOK, toMailHogMessage(m))
+			return
+		}
+	}
+
+	http.Error(w, "Message not found", http.StatusNotFound)
+}
+
+// MailHogDeleteMessagesV1 deletes every message, leaving the inboxes in place
+func (s *Server) MailHogDeleteMessagesV1(w http.ResponseWriter, r *http.Request) {
+	err := s.db.DeleteAllMessages()
+	if err != nil {
+		log.WithError(err).Error("MailHogDeleteMessagesV1: failed to delete all messages")
+		http.Error(w, "Failed to delete messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// MailHogMessagesV2 returns a page of messages in MailHog v2 format
+func (s *Server) MailHogMessagesV2(w http.ResponseWriter, r *http.Request) {
+	msgs, _, err := s.getAllMail()
+	if err != nil {
+		log.WithError(err).Error("MailHogMessagesV2: failed to get all mail")
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	returnJSON(w, r, http.StatusOK, pageMailHogMessages(r, msgs))
+}
+
+// MailHogSearchV2 returns a page of messages matching the given kind (from, to or containing) and query in MailHog
+// v2 format
+func (s *Server) MailHogSearchV2(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	query := r.URL.Query().Get("query")
+
+	if kind != "from" && kind != "to" && kind != "containing" {
+		http.Error(w, "Invalid search kind", http.StatusBadRequest)
+		return
+	}
+
+	msgs, _, err := s.getAllMail()
+	if err != nil {
+		log.WithError(err).Error("MailHogSearchV2: failed to get all mail")
+		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
+		return
+	}
+
+	matched := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if matchesMailHogSearch(m, kind, query) {
+			matched = append(matched, m)
+		}
+	}
+
+	returnJSON(w, r, http.StatusOK, pageMailHogMessages(r, matched))
+}
+
+// matchesMailHogSearch does a case insensitive substring search of the message, as MailHog does
+func matchesMailHogSearch(m Message, kind string, query string) bool {
+	m = m.Viewable()
+	query = strings.ToLower(query)
+	contains := func(fields ...string) bool {
+		for _, f := range fields {
+			if strings.Contains(strings.ToLower(f), query) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch kind {
+	case "from":
+		return contains(m.Sender, m.FromAddress, m.FromName)
+	case "to":
+		return contains(m.Recipient)
+	case "containing":
+		return contains(m.Sender, m.FromAddress, m.FromName, m.Recipient, m.Subject, m.BodyPlain, m.BodyHTML)
+	}
+
+	return false
+}
+
+// pageMailHogMessages applies the start and limit query params to msgs
+func pageMailHogMessages(r *http.Request, msgs []Message) mailHogMessages {
+	start, err := strconv.Atoi(r.URL.Query().Get("start"))
+	if err != nil || start < 0 {
+		start = 0
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultMailHogLimit
+	}
+
+	if start > len(msgs) {
+		start = len(msgs)
+	}
+
+	end := start + limit
+	if end > len(msgs) {
+		end = len(msgs)
+	}
+
+	items := toMailHogMessages(msgs[start:end])
+
+	return mailHogMessages{
+		Total: len(msgs),
+		Count: len(items),
+		Start: start,
+		Items: items,
+	}
+}
+
+func toMailHogMessages(msgs []Message) []*mailHogMessage {
+	out := make([]*mailHogMessage, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, toMailHogMessage(m))
+	}
+	return out
+}
+
+// toMailHogMessage rebuilds a MailHog message from what we stored. We don't keep the raw message so the headers and
+// body are reconstructed from the parsed fields.
+func toMailHogMessage(m Message) *mailHogMessage {
+	m = m.Viewable()
+	created := time.Unix(m.ReceivedAt, 0).UTC()
+
+	from := (&mail.Address{Name: m.FromName, Address: m.FromAddress}).String()
+
+	headers := map[string][]string{
+		"From":       {from},
+		"To":         {m.Recipient},
+		"Subject":    {m.Subject},
+		"Date":       {created.Format(time.RFC1123Z)},
+		"Message-ID": {fmt.Sprintf("<%v>", m.ID)},
+	}
+	if m.EmailProviderID != "" {
+		headers["Message-ID"] = []string{m.EmailProviderID}
+	}
+
+	var body string
+	var mimeBody *mailHogMIMEBody
+
+	switch {
+	case m.BodyPlain != "" && m.BodyHTML != "":
+		body, mimeBody = buildMailHogMultipart(m, headers)
+	case m.BodyHTML != "":
+		headers["Content-Type"] = []string{"text/html; charset=UTF-8"}
+		body = m.BodyHTML
+	default:
+		headers["Content-Type"] = []string{"text/plain; charset=UTF-8"}
+		body = m.BodyPlain
+	}
+
+	sender := m.Sender
+	if sender == "" {
+		sender = m.FromAddress
+	}
+
+	raw := &mailHogRaw{
+		From: sender,
+		To:   []string{m.Recipient},
+	}
+	// the source of infected messages isn't handed out
+	if m.DownloadsAllowed() {
+		raw.Data = rawMailHogData(headers, body)
+	}
+
+	return &mailHogMessage{
+		ID:   m.ID,
+		From: toMailHogPath(sender),
+		To:   []*mailHogPath{toMailHogPath(m.Recipient)},
+		Content: &mailHogContent{
+			Headers: headers,
+			Body:    body,
+			Size:    len(body),
+			MIME:    mimeBody,
+		},
+		Created: created,
+		MIME:    mimeBody,
+		Raw:     raw,
+	}
+}
+
+// buildMailHogMultipart builds a multipart/alternative body from the plain and html bodies of m and sets the
+// Content-Type header to match
+func buildMailHogMultipart(m Message, headers map[string][]string) (string, *mailHogMIMEBody) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=UTF-8", m.BodyPlain},
+		{"text/html; charset=UTF-8", m.BodyHTML},
+	}
+
+	mimeBody := &mailHogMIMEBody{}
+	for _, p := range parts {
+		h := textproto.MIMEHeader{"Content-Type": {p.contentType}}
+		pw, _ := mw.CreatePart(h) // writes to a bytes.Buffer can't fail
+		_, _ = pw.Write([]byte(p.body))
+
+		mimeBody.Parts = append(mimeBody.Parts, &mailHogContent{
+			Headers: h,
+			Body:    p.body,
+			Size:    len(p.body),
+		})
+	}
+	_ = mw.Close()
+
+	headers["Content-Type"] = []string{"multipart/alternative; boundary=" + mw.Boundary()}
+
+	return buf.String(), mimeBody
+}
+
+func toMailHogPath(address string) *mailHogPath {
+	p := &mailHogPath{Relays: []string{}}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		p.Mailbox = address
+		return p
+	}
+
+	p.Mailbox, p.Domain = address[:at], address[at+1:]
+	return p
+}
+
+func rawMailHogData(headers map[string][]string, body string) string {
+	var b strings.Builder
+	for _, k := range []string{"Message-ID", "Date", "From", "To", "Subject", "Content-Type"} {
+		for _, v := range headers[k] {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return b.String()
+}
@@ -0,0 +1,233 @@
+package burner
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mailHogTestServer() (*Server, *MockDatabase) {
+	mDB := new(MockDatabase)
+	mDB.On("GetInboxesWithMessages").Return([]Inbox{
+		{ID: "1", Address: "alice@example.com"},
+		{ID: "2", Address: "bob@example.com"},
+	}, nil)
+	mDB.On("GetMessagesByInboxID", "1").Return([]Message{
+		{
+			ID:          "a1",
+			InboxID:     "1",
+			ReceivedAt:  1526186100,
+			Sender:      "shop@store.example",
+			FromName:    "Store",
+			FromAddress: "shop@store.example",
+			Subject:     "Your receipt",
+			BodyPlain:   "Thanks for your order",
+			BodyHTML:    "<p>Thanks for your order</p>",
+		},
+	}, nil)
+	mDB.On("GetMessagesByInboxID", "2").Return([]Message{
+		{
+			ID:          "b1",
+			InboxID:     "2",
+			ReceivedAt:  1526186200,
+			Sender:      "noreply@signup.example",
+			FromAddress: "noreply@signup.example",
+			Subject:     "Confirm your account",
+			BodyPlain:   "Click the link",
+			Recipient:   "bob+signup@example.com",
+		},
+	}, nil)
+
+	s := &Server{db: mDB}
+
+	return s, mDB
+}
+
+func TestServer_MailHogMessagesV2(t *testing.T) {
+	s, mDB := mailHogTestServer()
+
+	tests := []struct {
+		Name          string
+		Query         string
+		ExpectedTotal int
+		ExpectedStart int
+		ExpectedIDs   []string
+	}{
+		{
+			Name:          "all",
+			Query:         "",
+			ExpectedTotal: 2,
+			ExpectedIDs:   []string{"b1", "a1"},
+		},
+		{
+			Name:          "paged",
+			Query:         "?start=1&limit=1",
+			ExpectedTotal: 2,
+			ExpectedStart: 1,
+			ExpectedIDs:   []string{"a1"},
+		},
+		{
+			Name:          "past end",
+			Query:         "?start=5",
+			ExpectedTotal: 2,
+			ExpectedStart: 2,
+			ExpectedIDs:   []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.MailHogMessagesV2(rr, httptest.NewRequest(http.MethodGet, "/api/v2/messages"+test.Query, nil))
+			require.Equal(t, http.StatusOK, rr.Code)
+
+			var res mailHogMessages
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+
+			assert.Equal(t, test.ExpectedTotal, res.Total)
+			assert.Equal(t, test.ExpectedStart, res.Start)
+			assert.Equal(t, len(test.ExpectedIDs), res.Count)
+
+			ids := []string{}
+			for _, m := range res.Items {
+				ids = append(ids, m.ID)
+			}
+			assert.Equal(t, test.ExpectedIDs, ids)
+		})
+	}
+
+	mDB.AssertExpectations(t)
+}
+
+func TestServer_MailHogSearchV2(t *testing.T) {
+	s, _ := mailHogTestServer()
+
+	tests := []struct {
+		Name         string
+		Query        string
+		ExpectedCode int
+		ExpectedIDs  []string
+	}{
+		{
+			Name:         "from",
+			Query:        "?kind=from&query=STORE.example",
+			ExpectedCode: http.StatusOK,
+			ExpectedIDs:  []string{"a1"},
+		},
+		{
+			Name:         "to uses inbox address when recipient missing",
+			Query:        "?kind=to&query=alice@example.com",
+			ExpectedCode: http.StatusOK,
+			ExpectedIDs:  []string{"a1"},
+		},
+		{
+			Name:         "to subaddress",
+			Query:        "?kind=to&query=bob%2Bsignup",
+			ExpectedCode: http.StatusOK,
+			ExpectedIDs:  []string{"b1"},
+		},
+		{
+			Name:         "containing",
+			Query:        "?kind=containing&query=click",
+			ExpectedCode: http.StatusOK,
+			ExpectedIDs:  []string{"b1"},
+		},
+		{
+			Name:         "bad kind",
+			Query:        "?kind=subject&query=receipt",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.MailHogSearchV2(rr, httptest.NewRequest(http.MethodGet, "/api/v2/search"+test.Query, nil))
+			require.Equal(t, test.ExpectedCode, rr.Code)
+
+			if test.ExpectedCode != http.StatusOK {
+				return
+			}
+
+			var res mailHogMessages
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+
+			ids := []string{}
+			for _, m := range res.Items {
+				ids = append(ids, m.ID)
+			}
+			assert.Equal(t, test.ExpectedIDs, ids)
+		})
+	}
+}
+
+func TestServer_MailHogMessageV1(t *testing.T) {
+	s, _ := mailHogTestServer()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/messages/{messageID}", s.MailHogMessageV1)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages/a1", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var m mailHogMessage
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &m))
+
+	assert.Equal(t, "a1", m.ID)
+	assert.Equal(t, &mailHogPath{Relays: []string{}, Mailbox: "shop", Domain: "store.example"}, m.From)
+	assert.Equal(t, []*mailHogPath{{Relays: []string{}, Mailbox: "alice", Domain: "example.com"}}, m.To)
+	assert.Equal(t, []string{"Your receipt"}, m.Content.Headers["Subject"])
+	assert.Equal(t, []string{`"Store" <shop@store.example>`}, m.Content.Headers["From"])
+	assert.Contains(t, m.Content.Headers["Content-Type"][0], "multipart/alternative; boundary=")
+	require.NotNil(t, m.MIME)
+	require.Len(t, m.MIME.Parts, 2)
+	assert.Equal(t, "Thanks for your order", m.MIME.Parts[0].Body)
+	assert.Equal(t, "<p>Thanks for your order</p>", m.MIME.Parts[1].Body)
+	assert.Contains(t, m.Raw.Data, "Subject: Your receipt\r\n")
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/messages/doesntexist", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestToMailHogMessage_Infected(t *testing.T) {
+	m := toMailHogMessage(Message{
+		ID:          "a1",
+		Sender:      "shop@store.example",
+		FromAddress: "shop@store.example",
+		Subject:     "Your receipt",
+		BodyPlain:   "Thanks for your order",
+		Virus:       &VirusResult{Infected: true, Signature: "Eicar-Test-Signature"},
+	})
+
+	// the message is listed but none of its content is handed out
+	assert.Equal(t, []string{"Your receipt"}, m.Content.Headers["Subject"])
+	assert.Empty(t, m.Content.Body)
+	assert.Nil(t, m.MIME)
+	assert.Empty(t, m.Raw.Data)
+}
+
+func TestServer_MailHogDeleteMessagesV1(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("DeleteAllMessages").Return(nil).Once()
+	mDB.On("DeleteAllMessages").Return(errors.New("failed")).Once()
+
+	s := Server{db: mDB}
+
+	rr := httptest.NewRecorder()
+	s.MailHogDeleteMessagesV1(rr, httptest.NewRequest(http.MethodDelete, "/api/v1/messages", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	s.MailHogDeleteMessagesV1(rr, httptest.NewRequest(http.MethodDelete, "/api/v1/messages", nil))
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	mDB.AssertExpectations(t)
+}
@@ -2,10 +2,16 @@ package burner
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/haydenwoodhead/burner.kiwi/notary"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
 	"github.com/justinas/alice"
 )
 
@@ -90,6 +96,33 @@ func (s *Server) SecurityHeaders() alice.Constructor {
 	}
 }
 
+//BodySecurityHeaders sets the headers for message bodies. Bodies are written by whoever sent the message so they are
+//sandboxed, without scripts, forms or the site's origin, and may only be framed by the site.
+func (s *Server) BodySecurityHeaders() alice.Constructor {
+	frameAncestors := "'self'"
+	if u, err := url.Parse(s.cfg.URL); err == nil && u.Scheme != "" && u.Host != "" {
+		frameAncestors += " " + u.Scheme + "://" + u.Host
+	}
+
+	csp := "default-src 'none'; img-src * data:; media-src *; font-src * data:; style-src * 'unsafe-inline'; " +
+		"form-action 'none'; base-uri 'none'; frame-ancestors " + frameAncestors + "; " +
+		"sandbox allow-popups allow-popups-to-escape-sandbox;"
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.cfg.Developing {
+				w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+			}
+
+			w.Header().Set("Content-Security-Policy", csp)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Referrer-Policy", "no-referrer")
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
 //SetVersionHeader adds a header with the current version
 func SetVersionHeader(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -109,3 +142,45 @@ func RestoreRealIP(h http.Handler) http.Handler {
 		h.ServeHTTP(w, r)
 	})
 }
+
+//RateLimit limits requests from each client ip with l. Limited requests get a 429 and a Retry-After header, as
+//JSON for API routes.
+func RateLimit(l *ratelimit.Limiter) alice.Constructor {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !checkRateLimit(l, w, r) {
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkRateLimit takes a token from l for the client and writes out a 429 if there isn't one
+func checkRateLimit(l *ratelimit.Limiter, w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := l.Allow(clientIP(r))
+	if ok {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		returnJSONError(w, r, http.StatusTooManyRequests, "Too many requests: try again later")
+		return false
+	}
+
+	http.Error(w, "Too many requests. Please try again later.", http.StatusTooManyRequests)
+	return false
+}
+
+// clientIP returns the ip of the client without the port. RemoteAddr is only an ip when restored by RestoreRealIP.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -8,8 +8,12 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/haydenwoodhead/burner.kiwi/notary"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
 	"github.com/justinas/alice"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 const FAKEHANDLERRESP = "fake handler"
@@ -138,6 +142,31 @@ func TestServer_SecurityHeaders_SelfServe(t *testing.T) {
 	assert.Equal(t, "no-referrer", rr.Header().Get("Referrer-Policy"))
 }
 
+func TestServer_BodySecurityHeaders(t *testing.T) {
+	s := Server{
+		cfg: Config{
+			Developing: false,
+			URL:        "https://burner.kiwi/",
+		},
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/body/token", nil)
+
+	m := s.BodySecurityHeaders()
+	h := m(http.HandlerFunc(fakeHandler))
+
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, "default-src 'none'; img-src * data:; media-src *; font-src * data:; style-src * 'unsafe-inline'; "+
+		"form-action 'none'; base-uri 'none'; frame-ancestors 'self' https://burner.kiwi; "+
+		"sandbox allow-popups allow-popups-to-escape-sandbox;", rr.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "max-age=31536000; includeSubDomains", rr.Header().Get("Strict-Transport-Security"))
+	assert.Empty(t, rr.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", rr.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "no-referrer", rr.Header().Get("Referrer-Policy"))
+}
+
 func TestRestoreRealIP(t *testing.T) {
 	h := func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(r.RemoteAddr))
@@ -154,6 +183,81 @@ func TestRestoreRealIP(t *testing.T) {
 	assert.Equal(t, "1.1.1.1", rr.Body.String())
 }
 
+func TestRateLimit(t *testing.T) {
+	l := ratelimit.New("test", ratelimit.Limit{Count: 1, Period: time.Minute}, ratelimit.NewMemoryStore())
+	handler := RateLimit(l)(http.HandlerFunc(fakeHandler))
+
+	serve := func(path string, remoteAddr string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := serve("/", "192.0.2.1:1234")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, FAKEHANDLERRESP, rr.Body.String())
+
+	// the port is ignored so new connections from the same client share a bucket
+	rr = serve("/", "192.0.2.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "60", rr.Header().Get("Retry-After"))
+
+	rr = serve("/api/v2/inbox", "192.0.2.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), `"success":false`)
+
+	// restored ips have no port
+	rr = serve("/", "192.0.2.2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("/", "192.0.2.2")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// a nil limiter doesn't limit anything
+	handler = RateLimit(nil)(http.HandlerFunc(fakeHandler))
+	for i := 0; i < 3; i++ {
+		rr = serve("/", "192.0.2.1:1234")
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+}
+
 func fakeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(FAKEHANDLERRESP))
 }
+
+func TestNew_HTTPRateLimit(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("Start").Return(nil)
+
+	mEP := new(MockEmailProvider)
+	mEP.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(func(_ string, _ Database, r *mux.Router, _ func(policy.Request) policy.Decision) error {
+		r.HandleFunc("/webhook", fakeHandler)
+		return nil
+	})
+
+	s, err := New(Config{
+		Key:           "testexample12344",
+		Developing:    true,
+		HTTPRateLimit: ratelimit.New("http", ratelimit.Limit{Count: 1, Period: time.Minute}, ratelimit.NewMemoryStore()),
+	}, mDB, EmailProviders{{Name: "mock", Provider: mEP}})
+	require.NoError(t, err)
+
+	serve := func(path string) int {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		s.Router.ServeHTTP(rr, r)
+		return rr.Code
+	}
+
+	// provider webhooks aren't limited as mail arrives from only a few provider ips
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve("/webhook"))
+	}
+
+	assert.NotEqual(t, http.StatusTooManyRequests, serve("/api/v2/inbox/1234"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("/api/v2/inbox/1234"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("/"))
+}
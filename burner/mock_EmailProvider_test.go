@@ -4,19 +4,20 @@ package burner
 
 import mock "github.com/stretchr/testify/mock"
 import mux "github.com/gorilla/mux"
+import policy "github.com/haydenwoodhead/burner.kiwi/policy"
 
 // MockEmailProvider is an autogenerated mock type for the EmailProvider type
 type MockEmailProvider struct {
 	mock.Mock
 }
 
-// DeleteExpiredRoutes provides a mock function with given fields:
-func (_m *MockEmailProvider) DeleteExpiredRoutes() error {
-	ret := _m.Called()
+// DeleteRoute provides a mock function with given fields: id
+func (_m *MockEmailProvider) DeleteRoute(id string) error {
+	ret := _m.Called(id)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func() error); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(id)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -45,13 +46,13 @@ func (_m *MockEmailProvider) RegisterRoute(i Inbox) (string, error) {
 	return r0, r1
 }
 
-// Start provides a mock function with given fields: websiteAddr, db, r, isBlacklisted
-func (_m *MockEmailProvider) Start(websiteAddr string, db Database, r *mux.Router, isBlacklisted func(string) bool) error {
-	ret := _m.Called(websiteAddr, db, r, isBlacklisted)
+// Start provides a mock function with given fields: websiteAddr, db, r, checkPolicy
+func (_m *MockEmailProvider) Start(websiteAddr string, db Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error {
+	ret := _m.Called(websiteAddr, db, r, checkPolicy)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, Database, *mux.Router, func(string) bool) error); ok {
-		r0 = rf(websiteAddr, db, r, isBlacklisted)
+	if rf, ok := ret.Get(0).(func(string, Database, *mux.Router, func(policy.Request) policy.Decision) error); ok {
+		r0 = rf(websiteAddr, db, r, checkPolicy)
 	} else {
 		r0 = ret.Error(0)
 	}
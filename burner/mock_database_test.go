@@ -16,6 +16,11 @@ func (m *MockDatabase) EmailAddressExists(address string) (bool, error) {
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *MockDatabase) GetPatternInbox(address string) (Inbox, bool, error) {
+	args := m.Called(address)
+	return args.Get(0).(Inbox), args.Bool(1), args.Error(2)
+}
+
 func (m *MockDatabase) GetInboxByAddress(address string) (Inbox, error) {
 	args := m.Called(address)
 	return args.Get(0).(Inbox), args.Error(1)
@@ -26,6 +31,21 @@ func (m *MockDatabase) GetInboxByID(id string) (Inbox, error) {
 	return args.Get(0).(Inbox), args.Error(1)
 }
 
+func (m *MockDatabase) SetInboxAllowedSenders(i Inbox) error {
+	args := m.Called(i)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteAllMessages() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetInboxesWithMessages() ([]Inbox, error) {
+	args := m.Called()
+	return args.Get(0).([]Inbox), args.Error(1)
+}
+
 func (m *MockDatabase) GetMessageByID(inboxID string, messageID string) (Message, error) {
 	args := m.Called(inboxID, messageID)
 	return args.Get(0).(Message), args.Error(1)
@@ -41,6 +61,11 @@ func (m *MockDatabase) SaveNewInbox(inbox Inbox) error {
 	return args.Error(0)
 }
 
+func (m *MockDatabase) SaveNewMessageOnce(message Message) error {
+	args := m.Called(message)
+	return args.Error(0)
+}
+
 func (m *MockDatabase) SaveNewMessage(message Message) error {
 	args := m.Called(message)
 	return args.Error(0)
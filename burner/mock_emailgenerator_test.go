@@ -26,6 +26,11 @@ func (m *MockEmailGenerator) NewFromUserAndHost(r string, h string) (string, err
 	return args.String(0), args.Error(1)
 }
 
+func (m *MockEmailGenerator) NewPatternFromPrefixAndHost(p string, h string) (string, error) {
+	args := m.Called(p, h)
+	return args.String(0), args.Error(1)
+}
+
 func (m *MockEmailGenerator) VerifyUser(r string) error {
 	args := m.Called(r)
 	return args.Error(0)
@@ -1,35 +1,397 @@
 package burner
 
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PatternWildcard marks the end of the prefix in the address of a pattern inbox, e.g. "ci-build-*@example.com"
+const PatternWildcard = "*"
+
+// minPatternPrefixLength and maxPatternPrefixLength bound the prefix of a pattern inbox. The minimum stops one inbox
+// collecting mail for a large part of a domain.
+const (
+	minPatternPrefixLength = 4
+	maxPatternPrefixLength = 32
+)
+
 // Inbox contains data on a temporary inbox including its address and ttl
 type Inbox struct {
-	Address              string `dynamodbav:"email_address" json:"address" db:"address"`
-	ID                   string `dynamodbav:"id" json:"id" db:"id"`
-	CreatedAt            int64  `dynamodbav:"created_at" json:"created_at" db:"created_at"`
-	CreatedBy            string `dynamodbav:"created_by" json:"-" db:"created_by"`
-	TTL                  int64  `dynamodbav:"ttl" json:"ttl" db:"ttl"`
-	EmailProviderRouteID string `dynamodbav:"ep_routeid" json:"-" db:"ep_routeid"`
-	FailedToCreate       bool   `dynamodbav:"failed_to_create" json:"-" db:"failed_to_create"`
+	Address               string     `dynamodbav:"email_address" json:"address" db:"address"`
+	ID                    string     `dynamodbav:"id" json:"id" db:"id"`
+	CreatedAt             int64      `dynamodbav:"created_at" json:"created_at" db:"created_at"`
+	CreatedBy             string     `dynamodbav:"created_by" json:"-" db:"created_by"`
+	TTL                   int64      `dynamodbav:"ttl" json:"ttl" db:"ttl"`
+	EmailProviderRouteIDs RouteIDs   `dynamodbav:"ep_routeids" json:"-" db:"ep_routeids"`
+	FailedToCreate        bool       `dynamodbav:"failed_to_create" json:"-" db:"failed_to_create"`
+	AllowedSenders        SenderList `dynamodbav:"allowed_senders" json:"allowed_senders,omitempty" db:"allowed_senders"`
+}
+
+// RouteIDs maps the name of each email provider to the id of the route it registered for an inbox
+type RouteIDs map[string]string
+
+// Value implements driver.Valuer. SQL databases store the ids as JSON.
+func (r RouteIDs) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+// Scan implements sql.Scanner. Inboxes created before route ids were kept per provider have none.
+func (r *RouteIDs) Scan(src interface{}) error {
+	if src == nil {
+		*r = nil
+		return nil
+	}
+	return scanJSON(src, r)
+}
+
+// trapCreatedByPrefix prefixes the CreatedBy of inboxes the mail trap created for a recipient
+const trapCreatedByPrefix = "trap:"
+
+// TrapCreatedBy returns the CreatedBy of an inbox the mail trap created for mail from remoteAddr
+func TrapCreatedBy(remoteAddr string) string {
+	return trapCreatedByPrefix + remoteAddr
+}
+
+// CreatedByTrap reports whether the mail trap created the inbox rather than a user of the website or API
+func (i Inbox) CreatedByTrap() bool {
+	return strings.HasPrefix(i.CreatedBy, trapCreatedByPrefix)
+}
+
+// LegacyRouteIDs converts the single route id stored on inboxes created before more than one email provider could be
+// run. Only Mailgun registered routes, smtp stored "smtp" and failed inboxes "-", so any other id is Mailgun's.
+func LegacyRouteIDs(routeID string) RouteIDs {
+	switch routeID {
+	case "", "-", "smtp":
+		return RouteIDs{}
+	}
+	return RouteIDs{"mailgun": routeID}
+}
+
+// AcceptsSender reports whether mail from sender may be delivered to the inbox. Inboxes without any allowed senders
+// accept mail from anyone.
+func (i Inbox) AcceptsSender(sender string) bool {
+	return len(i.AllowedSenders) == 0 || i.AllowedSenders.Contains(sender)
+}
+
+// MaxAllowedSenders is the most senders an inbox may be restricted to
+const MaxAllowedSenders = 50
+
+// ErrInvalidSender is returned by ParseSenderList when an entry isn't an email address or domain
+var ErrInvalidSender = errors.New("invalid sender")
+
+var senderDomainRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$`)
+
+// ParseSenderList validates and normalises a list of sender addresses and domains. Blank and duplicate entries are
+// dropped.
+func ParseSenderList(entries []string) (SenderList, error) {
+	var l SenderList
+	seen := make(map[string]bool)
+
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || seen[e] {
+			continue
+		}
+
+		if strings.Contains(e, "@") {
+			a, err := mail.ParseAddress(e)
+			if err != nil || a.Address != e {
+				return nil, fmt.Errorf("%w: %q is not an email address", ErrInvalidSender, e)
+			}
+		} else if !senderDomainRegex.MatchString(e) {
+			return nil, fmt.Errorf("%w: %q is not a domain", ErrInvalidSender, e)
+		}
+
+		seen[e] = true
+		l = append(l, e)
+	}
+
+	if len(l) > MaxAllowedSenders {
+		return nil, fmt.Errorf("%w: at most %v senders are allowed", ErrInvalidSender, MaxAllowedSenders)
+	}
+
+	return l, nil
+}
+
+// SenderList is a list of sender addresses and domains. SQL databases store it as newline separated text.
+type SenderList []string
+
+// Contains reports whether sender is one of the addresses in the list or is at one of its domains or their
+// subdomains
+func (l SenderList) Contains(sender string) bool {
+	sender = strings.ToLower(sender)
+	at := strings.LastIndex(sender, "@")
+	if at < 0 {
+		return false
+	}
+	domain := sender[at+1:]
+
+	for _, allowed := range l {
+		allowed = strings.ToLower(allowed)
+		if strings.Contains(allowed, "@") {
+			if sender == allowed {
+				return true
+			}
+			continue
+		}
+
+		if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Value implements driver.Valuer
+func (l SenderList) Value() (driver.Value, error) {
+	return strings.Join(l, "\n"), nil
+}
+
+// Scan implements sql.Scanner
+func (l *SenderList) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("failed to scan sender list from %T", src)
+	}
+
+	if s == "" {
+		*l = nil
+		return nil
+	}
+
+	*l = strings.Split(s, "\n")
+	return nil
+}
+
+// IsPattern reports whether the inbox is a pattern inbox which receives mail for every address matching its prefix
+func (i Inbox) IsPattern() bool {
+	return strings.Contains(i.Address, PatternWildcard)
+}
+
+// PatternPrefix returns the local part prefix and domain of a pattern inbox
+func (i Inbox) PatternPrefix() (string, string) {
+	at := strings.LastIndex(i.Address, "@")
+	if at < 0 {
+		return strings.TrimSuffix(i.Address, PatternWildcard), ""
+	}
+	return strings.TrimSuffix(i.Address[:at], PatternWildcard), i.Address[at+1:]
+}
+
+// PatternCandidates returns the addresses of the pattern inboxes which could match address, longest prefix first.
+// Databases look these up together to find a matching pattern inbox without scanning every inbox.
+func PatternCandidates(address string) []string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return nil
+	}
+
+	local, domain := address[:at], address[at:]
+
+	var candidates []string
+	for l := min(len(local), maxPatternPrefixLength); l >= minPatternPrefixLength; l-- {
+		candidates = append(candidates, local[:l]+PatternWildcard+domain)
+	}
+
+	return candidates
 }
 
-// NewInbox returns an inbox with failed to create and route id set.
+// NewInbox returns an inbox with failed to create and route ids set.
 func NewInbox() Inbox {
 	return Inbox{
-		FailedToCreate:       false,
-		EmailProviderRouteID: "-",
+		FailedToCreate:        false,
+		EmailProviderRouteIDs: RouteIDs{},
 	}
 }
 
 // Message contains details of an individual email message received by the burner
 type Message struct {
-	InboxID         string `dynamodbav:"inbox_id" json:"-" db:"inbox_id"`
-	ID              string `dynamodbav:"message_id" json:"id" db:"message_id"`
-	ReceivedAt      int64  `dynamodbav:"received_at" json:"received_at" db:"received_at"`
-	EmailProviderID string `dynamodbav:"ep_id" json:"-" db:"ep_id"`
-	Sender          string `dynamodbav:"sender" json:"sender" db:"sender"`
-	FromName        string `dynamodbav:"fromName" json:"from_name" db:"from_name"`
-	FromAddress     string `dynamodbav:"fromEmail" json:"from_address" db:"from_address"`
-	Subject         string `dynamodbav:"subject" json:"subject" db:"subject"`
-	BodyHTML        string `dynamodbav:"body_html" json:"body_html" db:"body_html"`
-	BodyPlain       string `dynamodbav:"body_plain" json:"body_plain" db:"body_plain"`
-	TTL             int64  `dynamodbav:"ttl" json:"ttl" db:"ttl"`
+	InboxID         string            `dynamodbav:"inbox_id" json:"-" db:"inbox_id"`
+	ID              string            `dynamodbav:"message_id" json:"id" db:"message_id"`
+	ReceivedAt      int64             `dynamodbav:"received_at" json:"received_at" db:"received_at"`
+	EmailProviderID string            `dynamodbav:"ep_id" json:"-" db:"ep_id"`
+	Sender          string            `dynamodbav:"sender" json:"sender" db:"sender"`
+	FromName        string            `dynamodbav:"fromName" json:"from_name" db:"from_name"`
+	FromAddress     string            `dynamodbav:"fromEmail" json:"from_address" db:"from_address"`
+	Subject         string            `dynamodbav:"subject" json:"subject" db:"subject"`
+	BodyHTML        string            `dynamodbav:"body_html" json:"body_html" db:"body_html"`
+	BodyPlain       string            `dynamodbav:"body_plain" json:"body_plain" db:"body_plain"`
+	TTL             int64             `dynamodbav:"ttl" json:"ttl" db:"ttl"`
+	Subaddress      string            `dynamodbav:"subaddress" json:"subaddress" db:"subaddress"`
+	Recipient       string            `dynamodbav:"recipient" json:"recipient" db:"recipient"`
+	Spam            *SpamResult       `dynamodbav:"spam,omitempty" json:"spam,omitempty" db:"spam"`
+	Virus           *VirusResult      `dynamodbav:"virus,omitempty" json:"virus,omitempty" db:"virus"`
+	Reputation      *ReputationResult `dynamodbav:"reputation,omitempty" json:"reputation,omitempty" db:"reputation"`
+	Attachments     *AttachmentList   `dynamodbav:"attachments,omitempty" json:"attachments,omitempty" db:"attachments"`
+}
+
+// DownloadsAllowed reports whether the message's content may be viewed or downloaded. Messages a virus scanner found
+// to be infected may be stored but their content isn't served.
+func (m Message) DownloadsAllowed() bool {
+	return m.Virus == nil || !m.Virus.Infected
+}
+
+// Viewable returns m with its bodies removed if DownloadsAllowed is false. Every view of a message should go through
+// it so that the content of infected messages is withheld everywhere.
+func (m Message) Viewable() Message {
+	if !m.DownloadsAllowed() {
+		m.BodyPlain = ""
+		m.BodyHTML = ""
+	}
+	return m
+}
+
+// SpamResult is how a spam checker scored a message. Threshold is the score at which the checker considers a
+// message spam.
+type SpamResult struct {
+	Score     float64  `dynamodbav:"score" json:"score"`
+	Threshold float64  `dynamodbav:"threshold" json:"threshold"`
+	Rules     []string `dynamodbav:"rules" json:"rules"`
+}
+
+// IsSpam reports whether the checker considers the message spam
+func (r SpamResult) IsSpam() bool {
+	return r.Score >= r.Threshold
+}
+
+// Value implements driver.Valuer. SQL databases store the result as JSON.
+func (r SpamResult) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+// Scan implements sql.Scanner
+func (r *SpamResult) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+// VirusResult is the verdict of a virus scanner on a message. Signature names the virus found in infected messages.
+type VirusResult struct {
+	Infected  bool   `dynamodbav:"infected" json:"infected"`
+	Signature string `dynamodbav:"signature" json:"signature,omitempty"`
+}
+
+// Value implements driver.Valuer. SQL databases store the result as JSON.
+func (r VirusResult) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+// Scan implements sql.Scanner
+func (r *VirusResult) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+// ReputationResult records the sender reputation checks a message's sending server failed but which were set to tag
+// rather than reject
+type ReputationResult struct {
+	Failures []ReputationFailure `dynamodbav:"failures" json:"failures"`
+}
+
+// ReputationFailure is a failed reputation check. Check is one of "dnsbl", "fcrdns" or "helo".
+type ReputationFailure struct {
+	Check  string `dynamodbav:"check" json:"check"`
+	Reason string `dynamodbav:"reason" json:"reason"`
+}
+
+// Value implements driver.Valuer. SQL databases store the result as JSON.
+func (r ReputationResult) Value() (driver.Value, error) {
+	return jsonValue(r)
+}
+
+// Scan implements sql.Scanner
+func (r *ReputationResult) Scan(src interface{}) error {
+	return scanJSON(src, r)
+}
+
+// AttachmentList describes the files attached to a message. Only the metadata is kept, not the files themselves.
+type AttachmentList struct {
+	Files []Attachment `dynamodbav:"files" json:"files"`
+}
+
+// Attachment describes a file attached to a message
+type Attachment struct {
+	Filename    string `dynamodbav:"filename" json:"filename"`
+	ContentType string `dynamodbav:"content_type" json:"content_type"`
+	Size        int64  `dynamodbav:"size" json:"size"`
+}
+
+// HumanSize returns the size of the file in B, KB or MB
+func (a Attachment) HumanSize() string {
+	switch {
+	case a.Size < 1024:
+		return fmt.Sprintf("%d B", a.Size)
+	case a.Size < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(a.Size)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(a.Size)/(1024*1024))
+	}
+}
+
+// Value implements driver.Valuer. SQL databases store the list as JSON.
+func (a AttachmentList) Value() (driver.Value, error) {
+	return jsonValue(a)
+}
+
+// Scan implements sql.Scanner
+func (a *AttachmentList) Scan(src interface{}) error {
+	return scanJSON(src, a)
+}
+
+func jsonValue(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %T: %w", v, err)
+	}
+	return string(b), nil
+}
+
+func scanJSON(src interface{}, dest interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("failed to scan %T from %T", dest, src)
+	}
+
+	return json.Unmarshal(b, dest)
+}
+
+// FilterMessagesBySubaddress returns the messages which were delivered to the given subaddress
+func FilterMessagesBySubaddress(msgs []Message, subaddress string) []Message {
+	filtered := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Subaddress == subaddress {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// getSubaddresses returns the sorted set of non-empty subaddresses messages were delivered to
+func getSubaddresses(msgs []Message) []string {
+	seen := make(map[string]bool)
+	var subaddresses []string
+	for _, m := range msgs {
+		if m.Subaddress == "" || seen[m.Subaddress] {
+			continue
+		}
+		seen[m.Subaddress] = true
+		subaddresses = append(subaddresses, m.Subaddress)
+	}
+	sort.Strings(subaddresses)
+	return subaddresses
 }
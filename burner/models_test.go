@@ -1,7 +1,10 @@
 package burner
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewInbox(t *testing.T) {
@@ -11,7 +14,145 @@ func TestNewInbox(t *testing.T) {
 		t.Errorf("TestNewInbox: failed to create not true")
 	}
 
-	if i.EmailProviderRouteID != "-" {
-		t.Errorf("TestNewInbox: route id not -")
+	if i.EmailProviderRouteIDs == nil || len(i.EmailProviderRouteIDs) != 0 {
+		t.Errorf("TestNewInbox: route ids not empty")
+	}
+}
+
+func TestPatternCandidates(t *testing.T) {
+	assert.Equal(t, []string{
+		"ci-42*@example.com",
+		"ci-4*@example.com",
+	}, PatternCandidates("ci-42@example.com"))
+
+	// prefixes are no longer than 32 characters
+	assert.Len(t, PatternCandidates(strings.Repeat("a", 64)+"@example.com"), 29)
+
+	assert.Nil(t, PatternCandidates("not-an-address"))
+}
+
+func TestInbox_PatternPrefix(t *testing.T) {
+	i := Inbox{Address: "ci-*@example.com"}
+	assert.True(t, i.IsPattern())
+
+	prefix, domain := i.PatternPrefix()
+	assert.Equal(t, "ci-", prefix)
+	assert.Equal(t, "example.com", domain)
+
+	assert.False(t, Inbox{Address: "ci@example.com"}.IsPattern())
+}
+
+func TestInbox_AcceptsSender(t *testing.T) {
+	tests := []struct {
+		Allowed  SenderList
+		Sender   string
+		Expected bool
+	}{
+		{Allowed: nil, Sender: "anyone@example.com", Expected: true},
+		{Allowed: SenderList{"alice@example.com"}, Sender: "Alice@Example.com", Expected: true},
+		{Allowed: SenderList{"alice@example.com"}, Sender: "bob@example.com", Expected: false},
+		{Allowed: SenderList{"example.com"}, Sender: "bob@example.com", Expected: true},
+		{Allowed: SenderList{"example.com"}, Sender: "bob@mail.example.com", Expected: true},
+		{Allowed: SenderList{"example.com"}, Sender: "bob@badexample.com", Expected: false},
+		{Allowed: SenderList{"example.com"}, Sender: "", Expected: false},
 	}
+
+	for _, test := range tests {
+		i := Inbox{AllowedSenders: test.Allowed}
+		assert.Equal(t, test.Expected, i.AcceptsSender(test.Sender), "%v %v", test.Allowed, test.Sender)
+	}
+}
+
+func TestParseSenderList(t *testing.T) {
+	l, err := ParseSenderList([]string{" Alice@Example.com ", "", "example.org", "example.org\r"})
+	assert.NoError(t, err)
+	assert.Equal(t, SenderList{"alice@example.com", "example.org"}, l)
+
+	l, err = ParseSenderList(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+
+	for _, bad := range []string{"not a domain", "Alice <alice@example.com>", "localhost", "-example.com"} {
+		_, err := ParseSenderList([]string{bad})
+		assert.ErrorIs(t, err, ErrInvalidSender, bad)
+	}
+}
+
+func TestSenderList_ScanValue(t *testing.T) {
+	v, err := SenderList{"alice@example.com", "example.org"}.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com\nexample.org", v)
+
+	var l SenderList
+	assert.NoError(t, l.Scan([]byte("alice@example.com\nexample.org")))
+	assert.Equal(t, SenderList{"alice@example.com", "example.org"}, l)
+
+	assert.NoError(t, l.Scan(""))
+	assert.Nil(t, l)
+
+	assert.Error(t, l.Scan(42))
+}
+
+func TestVirusResult_ScanValue(t *testing.T) {
+	v, err := (&VirusResult{Infected: true, Signature: "Eicar-Test-Signature"}).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"infected":true,"signature":"Eicar-Test-Signature"}`, v)
+
+	var r VirusResult
+	assert.NoError(t, r.Scan([]byte(`{"infected":true,"signature":"Eicar-Test-Signature"}`)))
+	assert.Equal(t, VirusResult{Infected: true, Signature: "Eicar-Test-Signature"}, r)
+}
+
+func TestAttachmentList_ScanValue(t *testing.T) {
+	a := AttachmentList{Files: []Attachment{{Filename: "invoice.pdf", ContentType: "application/pdf", Size: 10240}}}
+
+	v, err := a.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"files":[{"filename":"invoice.pdf","content_type":"application/pdf","size":10240}]}`, v)
+
+	var r AttachmentList
+	assert.NoError(t, r.Scan(v))
+	assert.Equal(t, a, r)
+}
+
+func TestMessage_DownloadsAllowed(t *testing.T) {
+	assert.True(t, Message{}.DownloadsAllowed())
+	assert.True(t, Message{Virus: &VirusResult{Infected: false}}.DownloadsAllowed())
+	assert.False(t, Message{Virus: &VirusResult{Infected: true}}.DownloadsAllowed())
+}
+
+func TestMessage_Viewable(t *testing.T) {
+	clean := Message{Subject: "Hi", BodyPlain: "Hello", BodyHTML: "<p>Hello</p>", Virus: &VirusResult{Infected: false}}
+	assert.Equal(t, clean, clean.Viewable())
+
+	infected := Message{Subject: "Hi", BodyPlain: "Hello", BodyHTML: "<p>Hello</p>", Virus: &VirusResult{Infected: true}}
+	assert.Equal(t, Message{Subject: "Hi", Virus: &VirusResult{Infected: true}}, infected.Viewable())
+}
+
+func TestAttachment_HumanSize(t *testing.T) {
+	assert.Equal(t, "512 B", Attachment{Size: 512}.HumanSize())
+	assert.Equal(t, "10.0 KB", Attachment{Size: 10240}.HumanSize())
+	assert.Equal(t, "2.5 MB", Attachment{Size: 5 * 512 * 1024}.HumanSize())
+}
+
+func TestRouteIDs_ScanValue(t *testing.T) {
+	ids := RouteIDs{"mailgun": "4f3bad2335335426750048c6", "smtp": "smtp"}
+
+	v, err := ids.Value()
+	assert.NoError(t, err)
+
+	var scanned RouteIDs
+	assert.NoError(t, scanned.Scan(v))
+	assert.Equal(t, ids, scanned)
+
+	// inboxes from before route ids were kept per provider
+	assert.NoError(t, scanned.Scan(nil))
+	assert.Nil(t, scanned)
+}
+
+func TestLegacyRouteIDs(t *testing.T) {
+	assert.Equal(t, RouteIDs{"mailgun": "5f1a3e"}, LegacyRouteIDs("5f1a3e"))
+	assert.Equal(t, RouteIDs{}, LegacyRouteIDs("smtp"))
+	assert.Equal(t, RouteIDs{}, LegacyRouteIDs("-"))
+	assert.Equal(t, RouteIDs{}, LegacyRouteIDs(""))
 }
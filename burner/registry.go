@@ -0,0 +1,268 @@
+package burner
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
+)
+
+// Setting describes an env var a database or email provider is configured with
+type Setting struct {
+	Name        string
+	Description string
+	Required    bool
+	Default     string
+}
+
+// Settings holds the values of the settings a database or email provider was registered with
+type Settings struct {
+	values map[string]string
+}
+
+// NewSettings reads the value of each setting in schema with getenv, falling back to its default. An error naming
+// every required setting which is empty is returned.
+func NewSettings(schema []Setting, getenv func(string) string) (Settings, error) {
+	s := Settings{values: make(map[string]string, len(schema))}
+
+	var missing []string
+	for _, setting := range schema {
+		v := strings.TrimSpace(getenv(setting.Name))
+		if v == "" {
+			v = setting.Default
+		}
+
+		if v == "" && setting.Required {
+			missing = append(missing, fmt.Sprintf("%v (%v)", setting.Name, setting.Description))
+		}
+
+		s.values[setting.Name] = v
+	}
+
+	switch len(missing) {
+	case 0:
+		return s, nil
+	case 1:
+		return Settings{}, fmt.Errorf("env var %v cannot be empty", missing[0])
+	default:
+		return Settings{}, fmt.Errorf("env vars %v cannot be empty", strings.Join(missing, ", "))
+	}
+}
+
+// String returns the value of name. It panics if name wasn't in the schema as that is a mistake in the caller.
+func (s Settings) String(name string) string {
+	v, ok := s.values[name]
+	if !ok {
+		panic("burner: setting " + name + " isn't in the schema")
+	}
+	return v
+}
+
+// Slice returns the comma separated values of name
+func (s Settings) Slice(name string) []string {
+	var out []string
+	for _, v := range strings.Split(s.String(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Bool returns the value of name as a bool. It is false if name is empty.
+func (s Settings) Bool(name string) (bool, error) {
+	v := s.String(name)
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("env var %v is invalid: must be true or false", name)
+	}
+	return b, nil
+}
+
+// Int returns the value of name as a whole number. It is 0 if name is empty.
+func (s Settings) Int(name string) (int, error) {
+	v := s.String(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("env var %v is invalid: must be a whole number", name)
+	}
+	return i, nil
+}
+
+// Duration returns the value of name as a duration. It is 0 if name is empty.
+func (s Settings) Duration(name string) (time.Duration, error) {
+	v := s.String(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("env var %v is invalid: must be a positive duration e.g. 5m", name)
+	}
+	return d, nil
+}
+
+// Spooler saves messages to the database in the background, retrying while it is unavailable. It is implemented by
+// spool.Spool.
+type Spooler interface {
+	Add(msg Message) error
+	Stop()
+}
+
+// Components are shared by every email provider which is configured
+type Components struct {
+	DB     Database
+	DBType string
+	// RateLimitStore is where rate limits are kept
+	RateLimitStore ratelimit.Store
+	// IngestQueue is nil if messages should be saved while the sender waits. Providers must not stop it, the server
+	// does once they have all stopped.
+	IngestQueue *ingest.Queue
+	// Spool is nil if messages should be saved directly. Like IngestQueue it is stopped by the server rather than the
+	// providers.
+	Spool Spooler
+	// MailTrap is set when mail for any recipient should be accepted, creating inboxes as it arrives
+	MailTrap bool
+	// Lambda is set when running on AWS Lambda, where providers may be invoked directly rather than by webhook
+	Lambda bool
+}
+
+// DatabaseFactory creates a database from its settings
+type DatabaseFactory func(s Settings) (Database, error)
+
+// EmailProviderFactory creates an email provider from its settings and the components shared between providers
+type EmailProviderFactory func(s Settings, c Components) (EmailProvider, error)
+
+type databaseEntry struct {
+	schema  []Setting
+	factory DatabaseFactory
+}
+
+type emailProviderEntry struct {
+	schema  []Setting
+	factory EmailProviderFactory
+}
+
+// registry holds the databases and email providers registered under each name
+var registry = struct {
+	m              sync.RWMutex
+	databases      map[string]databaseEntry
+	emailProviders map[string]emailProviderEntry
+}{
+	databases:      map[string]databaseEntry{},
+	emailProviders: map[string]emailProviderEntry{},
+}
+
+// RegisterDatabase makes a database available as DB_TYPE name. It is meant to be called from the init function of
+// the package implementing the database and panics if name is already registered.
+func RegisterDatabase(name string, schema []Setting, factory DatabaseFactory) {
+	registry.m.Lock()
+	defer registry.m.Unlock()
+
+	if _, ok := registry.databases[name]; ok {
+		panic("burner: database " + name + " is already registered")
+	}
+
+	registry.databases[name] = databaseEntry{schema: schema, factory: factory}
+}
+
+// RegisterEmailProvider makes an email provider available in EMAIL_TYPE as name. It is meant to be called from the
+// init function of the package implementing the provider and panics if name is already registered.
+func RegisterEmailProvider(name string, schema []Setting, factory EmailProviderFactory) {
+	registry.m.Lock()
+	defer registry.m.Unlock()
+
+	if _, ok := registry.emailProviders[name]; ok {
+		panic("burner: email provider " + name + " is already registered")
+	}
+
+	registry.emailProviders[name] = emailProviderEntry{schema: schema, factory: factory}
+}
+
+// DatabaseTypes returns the names of the registered databases in order
+func DatabaseTypes() []string {
+	registry.m.RLock()
+	defer registry.m.RUnlock()
+
+	var names []string
+	for name := range registry.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// EmailProviderTypes returns the names of the registered email providers in order
+func EmailProviderTypes() []string {
+	registry.m.RLock()
+	defer registry.m.RUnlock()
+
+	var names []string
+	for name := range registry.emailProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// NewDatabase creates the database registered as name with settings read by getenv
+func NewDatabase(name string, getenv func(string) string) (Database, error) {
+	registry.m.RLock()
+	e, ok := registry.databases[name]
+	registry.m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q, must be one of %v", name, strings.Join(DatabaseTypes(), ", "))
+	}
+
+	s, err := NewSettings(e.schema, getenv)
+	if err != nil {
+		return nil, fmt.Errorf("database %v is misconfigured: %w", name, err)
+	}
+
+	db, err := e.factory(s)
+	if err != nil {
+		return nil, fmt.Errorf("database %v is misconfigured: %w", name, err)
+	}
+
+	return db, nil
+}
+
+// NewEmailProvider creates the email provider registered as name with settings read by getenv
+func NewEmailProvider(name string, getenv func(string) string, c Components) (EmailProvider, error) {
+	registry.m.RLock()
+	e, ok := registry.emailProviders[name]
+	registry.m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown email provider %q, must be one of %v", name, strings.Join(EmailProviderTypes(), ", "))
+	}
+
+	s, err := NewSettings(e.schema, getenv)
+	if err != nil {
+		return nil, fmt.Errorf("email provider %v is misconfigured: %w", name, err)
+	}
+
+	p, err := e.factory(s, c)
+	if err != nil {
+		return nil, fmt.Errorf("email provider %v is misconfigured: %w", name, err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,117 @@
+package burner
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getenv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestNewSettings(t *testing.T) {
+	schema := []Setting{
+		{Name: "TEST_URL", Description: "url to connect to", Required: true},
+		{Name: "TEST_WORKERS", Default: "4"},
+		{Name: "TEST_TIMEOUT"},
+		{Name: "TEST_ENABLED"},
+		{Name: "TEST_ZONES"},
+	}
+
+	s, err := NewSettings(schema, getenv(map[string]string{
+		"TEST_URL":     " https://example.com ",
+		"TEST_TIMEOUT": "5m",
+		"TEST_ZONES":   "zen.example.com, ,bl.example.com",
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "https://example.com", s.String("TEST_URL"))
+	assert.Equal(t, []string{"zen.example.com", "bl.example.com"}, s.Slice("TEST_ZONES"))
+
+	workers, err := s.Int("TEST_WORKERS")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, workers)
+
+	timeout, err := s.Duration("TEST_TIMEOUT")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, timeout)
+
+	enabled, err := s.Bool("TEST_ENABLED")
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	// reading a setting outside the schema is a bug in the caller
+	assert.Panics(t, func() { s.String("TEST_UNKNOWN") })
+}
+
+func TestNewSettings_Invalid(t *testing.T) {
+	schema := []Setting{
+		{Name: "TEST_URL", Description: "url to connect to", Required: true},
+		{Name: "TEST_TABLE", Description: "table to use", Required: true},
+		{Name: "TEST_WORKERS"},
+	}
+
+	_, err := NewSettings(schema, getenv(nil))
+	assert.EqualError(t, err, "env vars TEST_URL (url to connect to), TEST_TABLE (table to use) cannot be empty")
+
+	s, err := NewSettings(schema, getenv(map[string]string{"TEST_URL": "a", "TEST_TABLE": "b", "TEST_WORKERS": "-1"}))
+	require.NoError(t, err)
+
+	_, err = s.Int("TEST_WORKERS")
+	assert.EqualError(t, err, "env var TEST_WORKERS is invalid: must be a whole number")
+}
+
+func TestNewDatabase(t *testing.T) {
+	db := new(MockDatabase)
+
+	RegisterDatabase("test-db", []Setting{{Name: "TEST_DB_URL", Description: "url of the database", Required: true}}, func(s Settings) (Database, error) {
+		if s.String("TEST_DB_URL") == "bad" {
+			return nil, errors.New("failed to connect")
+		}
+		return db, nil
+	})
+
+	got, err := NewDatabase("test-db", getenv(map[string]string{"TEST_DB_URL": "postgres://localhost"}))
+	assert.NoError(t, err)
+	assert.Equal(t, db, got)
+
+	_, err = NewDatabase("test-db", getenv(nil))
+	assert.EqualError(t, err, "database test-db is misconfigured: env var TEST_DB_URL (url of the database) cannot be empty")
+
+	_, err = NewDatabase("test-db", getenv(map[string]string{"TEST_DB_URL": "bad"}))
+	assert.EqualError(t, err, "database test-db is misconfigured: failed to connect")
+
+	_, err = NewDatabase("nope", getenv(nil))
+	assert.EqualError(t, err, `unknown database "nope", must be one of test-db`)
+
+	assert.Panics(t, func() { RegisterDatabase("test-db", nil, nil) })
+}
+
+func TestNewEmailProvider(t *testing.T) {
+	ep := new(MockEmailProvider)
+	db := new(MockDatabase)
+
+	RegisterEmailProvider("test-b", nil, func(s Settings, c Components) (EmailProvider, error) {
+		assert.Equal(t, db, c.DB)
+		return ep, nil
+	})
+	RegisterEmailProvider("test-a", nil, func(s Settings, c Components) (EmailProvider, error) {
+		return nil, errors.New("no route")
+	})
+
+	got, err := NewEmailProvider("test-b", getenv(nil), Components{DB: db})
+	assert.NoError(t, err)
+	assert.Equal(t, ep, got)
+
+	_, err = NewEmailProvider("test-a", getenv(nil), Components{DB: db})
+	assert.EqualError(t, err, "email provider test-a is misconfigured: no route")
+
+	_, err = NewEmailProvider("nope", getenv(nil), Components{DB: db})
+	assert.EqualError(t, err, `unknown email provider "nope", must be one of test-a, test-b`)
+}
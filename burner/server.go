@@ -9,7 +9,10 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/haydenwoodhead/burner.kiwi/emailgenerator"
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
 	"github.com/haydenwoodhead/burner.kiwi/notary"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
 	"github.com/justinas/alice"
 )
 
@@ -20,10 +23,12 @@ var version = "dev"
 type Server struct {
 	sessionStore *sessions.CookieStore
 	eg           EmailGenerator
-	email        EmailProvider
+	email        EmailProviders
 	db           Database
 	Router       *mux.Router
 	notariser    *notary.Notary
+	policy       policy.Checker
+	policyFile   *policy.File // nil unless the policy is loaded from a file
 
 	cfg Config
 }
@@ -33,6 +38,7 @@ type Config struct {
 	Key                string
 	URL                string
 	StaticURL          string
+	BodyURL            string // origin message bodies are served from, empty for the site's own
 	Email              EmailProvider
 	Domains            []string
 	Developing         bool
@@ -40,12 +46,19 @@ type Config struct {
 	RestoreRealIP      bool
 	Database           Database
 	BlacklistedDomains []string
+	PolicyFile         string
 	EmitMetrics        bool
 	MetricPort         string
+	MailTrap           bool
+	MailHogAPI         bool
+	HTTPRateLimit      *ratelimit.Limiter // applied to the website and API, nil for no limit
+	InboxRateLimit     *ratelimit.Limiter // applied to inbox creation, nil for no limit
+	IngestQueue        *ingest.Queue      // shared by the email providers, nil if messages are saved while senders wait
+	Spool              Spooler            // shared by the email providers, nil if messages are saved directly
 }
 
 // New returns a burner with the given settings
-func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
+func New(cfg Config, db Database, email EmailProviders) (*Server, error) {
 	s := Server{
 		sessionStore: sessions.NewCookieStore([]byte(cfg.Key)),
 		eg:           emailgenerator.New(cfg.Domains, 8),
@@ -59,26 +72,51 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 		s.getIndexTemplate()
 		s.getDeleteTemplate()
 		s.getEditTemplate()
+		s.getSendersTemplate()
 	}
 
 	s.sessionStore.MaxAge(86402) // set max cookie age to 24 hours + 2 seconds
 
+	// blacklisted domains are kept for backwards compatibility and are evaluated after any rules in the policy file
+	blacklist := policy.DenySenderDomains(cfg.BlacklistedDomains, "blacklisted")
+	if cfg.PolicyFile != "" {
+		f, err := policy.LoadFile(cfg.PolicyFile, policy.DefaultReloadInterval, blacklist...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load policy: %w", err)
+		}
+		s.policy = f
+		s.policyFile = f
+	} else {
+		s.policy = policy.New(blacklist...)
+	}
+
+	if n, ok := s.db.(ExpiryNotifier); ok {
+		n.NotifyExpired(s.deleteRoutes)
+	}
+
 	err := s.db.Start()
 	if err != nil {
+		s.closePolicyFile()
 		return nil, fmt.Errorf("failed to start database: %w", err)
 	}
 
-	err = s.email.Start(cfg.URL, s.db, s.Router, s.isBlacklistedDomain)
+	s.Router = mux.NewRouter()
+	s.Router.StrictSlash(true) // means router will match both "/path" and "/path/"
+
+	// providers add their webhook routes to the router so it has to exist before they're started
+	err = s.email.Start(cfg.URL, s.db, s.Router, s.policy.Check)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start email provider: %w", err)
+		s.closePolicyFile()
+		return nil, fmt.Errorf("failed to start email providers: %w", err)
 	}
 
-	s.Router = mux.NewRouter()
-	s.Router.StrictSlash(true) // means router will match both "/path" and "/path/"
+	// the provider webhooks added above aren't given the http limit as mail arrives from only a few provider ips
+	httpLimit := RateLimit(cfg.HTTPRateLimit)
 
 	// HTML - trying to make middleware flow/handler declaration a little more readable
 	s.Router.Handle("/",
 		alice.New( //Middleware below
+			httpLimit,
 			Refresh(20),
 			SetVersionHeader,
 			s.SecurityHeaders(),
@@ -87,6 +125,7 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 
 	s.Router.Handle("/messages/{messageID}/",
 		alice.New(
+			httpLimit,
 			s.CheckSessionCookieExists,
 			SetVersionHeader,
 			s.SecurityHeaders(),
@@ -95,6 +134,7 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 
 	s.Router.Handle("/edit",
 		alice.New(
+			httpLimit,
 			s.CheckSessionCookieExists,
 			SetVersionHeader,
 			s.SecurityHeaders(),
@@ -103,14 +143,35 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 
 	s.Router.Handle("/edit",
 		alice.New(
+			httpLimit,
 			s.CheckSessionCookieExists,
 			SetVersionHeader,
 			s.SecurityHeaders(),
+			RateLimit(cfg.InboxRateLimit),
 		).ThenFunc(s.NewNamedInbox),
 	).Methods(http.MethodPost)
 
+	s.Router.Handle("/senders",
+		alice.New(
+			httpLimit,
+			s.CheckSessionCookieExists,
+			SetVersionHeader,
+			s.SecurityHeaders(),
+		).ThenFunc(s.EditAllowedSenders),
+	).Methods(http.MethodGet)
+
+	s.Router.Handle("/senders",
+		alice.New(
+			httpLimit,
+			s.CheckSessionCookieExists,
+			SetVersionHeader,
+			s.SecurityHeaders(),
+		).ThenFunc(s.SaveAllowedSenders),
+	).Methods(http.MethodPost)
+
 	s.Router.Handle("/delete",
 		alice.New(
+			httpLimit,
 			s.CheckSessionCookieExists,
 			SetVersionHeader,
 			s.SecurityHeaders(),
@@ -119,16 +180,59 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 
 	s.Router.Handle("/delete",
 		alice.New(
+			httpLimit,
 			s.CheckSessionCookieExists,
 			SetVersionHeader,
 			s.SecurityHeaders(),
 		).ThenFunc(s.ConfirmDeleteInbox),
 	).Methods(http.MethodPost)
 
+	s.Router.Handle("/body/{token}",
+		alice.New(
+			httpLimit,
+			SetVersionHeader,
+			s.BodySecurityHeaders(),
+		).ThenFunc(s.MessageBody),
+	).Methods(http.MethodGet)
+
+	if cfg.MailTrap {
+		s.Router.Handle("/all",
+			alice.New(
+				httpLimit,
+				Refresh(20),
+				SetVersionHeader,
+				s.SecurityHeaders(),
+			).ThenFunc(s.AllMail),
+		).Methods(http.MethodGet)
+
+		s.Router.Handle("/all/{inboxID}/{messageID}/",
+			alice.New(
+				httpLimit,
+				SetVersionHeader,
+				s.SecurityHeaders(),
+			).ThenFunc(s.AllMailMessage),
+		).Methods(http.MethodGet)
+	}
+
 	// JSON API
-	s.Router.Handle("/api/v2/inbox", alice.New(JSONContentType).ThenFunc(s.NewInboxJSON)).Methods(http.MethodGet)
-	s.Router.Handle("/api/v2/inbox/{inboxID}", alice.New(JSONContentType, s.CheckPermissionJSON).ThenFunc(s.GetInboxDetailsJSON)).Methods(http.MethodGet)
-	s.Router.Handle("/api/v2/inbox/{inboxID}/messages", alice.New(JSONContentType, s.CheckPermissionJSON).ThenFunc(s.GetAllMessagesJSON)).Methods(http.MethodGet)
+	s.Router.Handle("/api/v2/inbox", alice.New(httpLimit, JSONContentType, RateLimit(cfg.InboxRateLimit)).ThenFunc(s.NewInboxJSON)).Methods(http.MethodGet)
+	s.Router.Handle("/api/v2/inbox/pattern", alice.New(httpLimit, JSONContentType, RateLimit(cfg.InboxRateLimit)).ThenFunc(s.NewPatternInboxJSON)).Methods(http.MethodPost)
+	s.Router.Handle("/api/v2/inbox/{inboxID}", alice.New(httpLimit, JSONContentType, s.CheckPermissionJSON).ThenFunc(s.GetInboxDetailsJSON)).Methods(http.MethodGet)
+	s.Router.Handle("/api/v2/inbox/{inboxID}/messages", alice.New(httpLimit, JSONContentType, s.CheckPermissionJSON).ThenFunc(s.GetAllMessagesJSON)).Methods(http.MethodGet)
+	s.Router.Handle("/api/v2/inbox/{inboxID}/senders", alice.New(httpLimit, JSONContentType, s.CheckPermissionJSON).ThenFunc(s.SetAllowedSendersJSON)).Methods(http.MethodPut)
+
+	if cfg.MailTrap {
+		s.Router.Handle("/api/v2/inboxes", alice.New(httpLimit, JSONContentType).ThenFunc(s.GetInboxesJSON)).Methods(http.MethodGet)
+	}
+
+	// MailHog compatible API - serves every message so only intended for local development and CI
+	if cfg.MailHogAPI {
+		s.Router.Handle("/api/v1/messages", alice.New(httpLimit, JSONContentType).ThenFunc(s.MailHogMessagesV1)).Methods(http.MethodGet)
+		s.Router.Handle("/api/v1/messages", alice.New(httpLimit, JSONContentType).ThenFunc(s.MailHogDeleteMessagesV1)).Methods(http.MethodDelete)
+		s.Router.Handle("/api/v1/messages/{messageID}", alice.New(httpLimit, JSONContentType).ThenFunc(s.MailHogMessageV1)).Methods(http.MethodGet)
+		s.Router.Handle("/api/v2/messages", alice.New(httpLimit, JSONContentType).ThenFunc(s.MailHogMessagesV2)).Methods(http.MethodGet)
+		s.Router.Handle("/api/v2/search", alice.New(httpLimit, JSONContentType).ThenFunc(s.MailHogSearchV2)).Methods(http.MethodGet)
+	}
 
 	// Static File Serving
 	fs := http.StripPrefix("/static/", http.FileServer(s.getStaticFS()))
@@ -139,6 +243,7 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 		s.Router.PathPrefix("/static/").Handler(alice.New(CacheControl(15778463)).Then(fs))
 	}
 
+	// router middleware runs before each route's own so clients are limited rather than the proxy in front of us
 	if cfg.RestoreRealIP {
 		s.Router.Use(RestoreRealIP)
 	}
@@ -148,6 +253,25 @@ func New(cfg Config, db Database, email EmailProvider) (*Server, error) {
 	return &s, nil
 }
 
+// Stop stops the email providers, waiting for the mail they have accepted to be saved, and stops reloading the
+// policy file. The ingest queue is stopped once every provider has stopped as any of them may still be submitting to
+// it until then. The spool is stopped last as queued messages are written to it.
+func (s *Server) Stop() error {
+	defer s.closePolicyFile()
+	err := s.email.Stop()
+	s.cfg.IngestQueue.Stop()
+	if s.cfg.Spool != nil {
+		s.cfg.Spool.Stop()
+	}
+	return err
+}
+
+func (s *Server) closePolicyFile() {
+	if s.policyFile != nil {
+		s.policyFile.Close()
+	}
+}
+
 // Ping returns PONG when called
 func (s *Server) Ping(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write([]byte("PONG"))
@@ -1,17 +1,29 @@
 package burner
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIsBlackListed(t *testing.T) {
-	s := Server{
-		cfg: Config{
-			BlacklistedDomains: []string{"example.com"},
-		},
-	}
+	mDB := new(MockDatabase)
+	mDB.On("Start").Return(nil)
+
+	mEP := new(MockEmailProvider)
+	mEP.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	s, err := New(Config{
+		Key:                "testexample12344",
+		Developing:         true,
+		BlacklistedDomains: []string{"example.com", "ail.com"},
+	}, mDB, EmailProviders{{Name: "mock", Provider: mEP}})
+	require.NoError(t, err)
 
 	tests := []struct {
 		Email    string
@@ -25,9 +37,115 @@ func TestIsBlackListed(t *testing.T) {
 			Email:    "test@example.org",
 			Expected: false,
 		},
+		{
+			Email:    "test@mail.example.com",
+			Expected: true,
+		},
+		{
+			Email:    "test@notexample.com",
+			Expected: false,
+		},
+		{
+			Email:    "test@ail.com",
+			Expected: true,
+		},
+		{
+			Email:    "test@gmail.com",
+			Expected: false,
+		},
 	}
 
 	for _, test := range tests {
-		assert.Equal(t, test.Expected, s.isBlacklistedDomain(test.Email))
+		decision := s.policy.Check(policy.Request{Sender: test.Email})
+		assert.Equal(t, test.Expected, !decision.Allowed, test.Email)
+		if test.Expected {
+			assert.Equal(t, "blacklisted", decision.Reason, test.Email)
+		}
+	}
+}
+
+func TestServer_Stop_IngestQueue(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("Start").Return(nil)
+
+	q := ingest.New(1, 1)
+
+	// the first provider to stop must not stop the queue for the other, which is stopped after it
+	saved := false
+	var submitErr error
+
+	first := new(MockEmailProvider)
+	first.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	first.On("Stop").Return(func() error {
+		submitErr = q.Submit(func() { saved = true })
+		return nil
+	})
+
+	second := new(MockEmailProvider)
+	second.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	second.On("Stop").Return(nil)
+
+	s, err := New(Config{
+		Key:         "testexample12344",
+		Developing:  true,
+		IngestQueue: q,
+	}, mDB, EmailProviders{{Name: "first", Provider: first}, {Name: "second", Provider: second}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Stop())
+
+	require.NoError(t, submitErr)
+	assert.True(t, saved, "queued message wasn't saved before Stop returned")
+}
+
+// fakeSpool records whether it has been stopped
+type fakeSpool struct {
+	stopped bool
+}
+
+func (f *fakeSpool) Add(msg Message) error {
+	if f.stopped {
+		return errors.New("spool stopped")
 	}
+	return nil
+}
+
+func (f *fakeSpool) Stop() {
+	f.stopped = true
+}
+
+func TestServer_Stop_Spool(t *testing.T) {
+	mDB := new(MockDatabase)
+	mDB.On("Start").Return(nil)
+
+	sp := &fakeSpool{}
+	q := ingest.New(1, 1)
+
+	// a message queued while the providers stop is written to the spool once they have stopped
+	var addErr error
+	first := new(MockEmailProvider)
+	first.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	first.On("Stop").Return(func() error {
+		return q.Submit(func() { addErr = sp.Add(Message{}) })
+	})
+
+	second := new(MockEmailProvider)
+	second.On("Start", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	second.On("Stop").Return(func() error {
+		assert.False(t, sp.stopped, "spool stopped before every provider had stopped")
+		return nil
+	})
+
+	s, err := New(Config{
+		Key:         "testexample12344",
+		Developing:  true,
+		IngestQueue: q,
+		Spool:       sp,
+	}, mDB, EmailProviders{{Name: "first", Provider: first}, {Name: "second", Provider: second}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.Stop())
+
+	assert.NoError(t, addErr)
+	assert.True(t, sp.stopped)
 }
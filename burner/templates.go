@@ -20,6 +20,7 @@ type templateMessage struct {
 	ReceivedAt   string
 	AvatarLetter string
 	AvatarColor  string
+	BodyURL      string // only set on the selected message
 }
 
 type templateInbox struct {
@@ -38,6 +39,10 @@ type inboxOut struct {
 	Inbox              templateInbox
 	SelectedMessage    templateMessage
 	HasSelectedMessage bool
+	Subaddresses       []string
+	SelectedSubaddress string
+	AllMail            bool
+	InboxCount         int
 	ModalData          interface{}
 }
 
@@ -46,6 +51,11 @@ type editModalData struct {
 	Err   string
 }
 
+type sendersModalData struct {
+	Senders []string
+	Err     string
+}
+
 func transformMessagesForTemplate(msgs []Message) []templateMessage {
 	transformedMsgs := make([]templateMessage, 0, len(msgs))
 
@@ -55,7 +65,7 @@ func transformMessagesForTemplate(msgs []Message) []templateMessage {
 		received := calculateReceivedAt(m.ReceivedAt)
 		avatarLetter, avatarColor := getAvatarDetails(m.FromName)
 		transformedMsgs = append(transformedMsgs, templateMessage{
-			Message:      m,
+			Message:      m.Viewable(),
 			ReceivedAt:   received,
 			AvatarLetter: avatarLetter,
 			AvatarColor:  avatarColor,
@@ -134,6 +144,9 @@ var editTemplateOnce sync.Once
 var deleteTemplate *template.Template
 var deleteTemplateOnce sync.Once
 
+var sendersTemplate *template.Template
+var sendersTemplateOnce sync.Once
+
 func (s *Server) parseTemplate(name string, parts ...string) (*template.Template, error) {
 	t := template.New(name)
 
@@ -220,3 +233,26 @@ func (s *Server) getDeleteTemplate() *template.Template {
 
 	return deleteTemplate
 }
+
+func (s *Server) getSendersTemplate() *template.Template {
+	gen := func() *template.Template {
+		t, err := s.parseTemplate("index", "base.html", "inbox.html", "senders.html")
+		if err != nil {
+			log.WithError(err).Fatal("getSendersTemplate: failed to get")
+			return nil
+		}
+		return t
+	}
+
+	if s.cfg.Developing {
+		t := gen()
+		return t
+	}
+
+	sendersTemplateOnce.Do(func() {
+		t := gen()
+		sendersTemplate = t
+	})
+
+	return sendersTemplate
+}
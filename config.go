@@ -5,49 +5,60 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/haydenwoodhead/burner.kiwi/burner"
-	"github.com/haydenwoodhead/burner.kiwi/data/dynamodb"
-	"github.com/haydenwoodhead/burner.kiwi/data/inmemory"
-	"github.com/haydenwoodhead/burner.kiwi/data/postgresql"
-	"github.com/haydenwoodhead/burner.kiwi/data/sqlite3"
-	"github.com/haydenwoodhead/burner.kiwi/email/mailgunmail"
-	"github.com/haydenwoodhead/burner.kiwi/email/smtpmail"
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
+	"github.com/haydenwoodhead/burner.kiwi/spool"
 )
 
 const inMemory = "memory"
-const postgreSQL = "postgres"
-const dynamoDB = "dynamo"
-const sqLite3 = "sqlite3"
 
-const mailgunProvider = "mailgun"
-const smtpProvider = "smtp"
+const memoryRateLimitStore = "memory"
+const dbRateLimitStore = "db"
 
-func mustParseConfig() (burner.Config, burner.Database, burner.EmailProvider, string) {
+func mustParseConfig() (burner.Config, burner.Database, burner.EmailProviders, string) {
 	dbType := parseStringVarWithDefault("DB_TYPE", inMemory)
 
-	var db burner.Database
+	db, err := burner.NewDatabase(dbType, os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	rateLimitStore := parseRateLimitStore(dbType, db)
 
-	switch dbType {
-	case inMemory:
-		db = inmemory.GetInMemoryDB()
-	case postgreSQL:
-		db = postgresql.GetPostgreSQLDB(mustParseStringVar("DATABASE_URL"))
-	case dynamoDB:
-		db = dynamodb.GetNewDynamoDB(mustParseStringVar("DYNAMO_TABLE"))
-	case sqLite3:
-		db = sqlite3.GetSQLite3DB(mustParseStringVar("DATABASE_URL"))
+	mailTrap := parseBoolVarWithDefault("MAIL_TRAP", false)
+	usingLambda := parseBoolVarWithDefault("LAMBDA", false)
+
+	ingestQueue := parseIngestQueue()
+	sp := parseSpool(db)
+
+	components := burner.Components{
+		DB:             db,
+		DBType:         dbType,
+		RateLimitStore: rateLimitStore,
+		IngestQueue:    ingestQueue,
+		Spool:          sp,
+		MailTrap:       mailTrap,
+		Lambda:         usingLambda,
 	}
 
-	emailType := mustParseStringVar("EMAIL_TYPE")
+	var email burner.EmailProviders
+
+	for _, emailType := range mustParseSliceVar("EMAIL_TYPE") {
+		for _, e := range email {
+			if e.Name == emailType {
+				log.Fatalf("Env var EMAIL_TYPE is invalid: %v is listed more than once", emailType)
+			}
+		}
 
-	var email burner.EmailProvider
+		provider, err := burner.NewEmailProvider(emailType, os.Getenv, components)
+		if err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
 
-	switch emailType {
-	case mailgunProvider:
-		email = mailgunmail.NewMailProvider(mustParseStringVar("MG_DOMAIN"), mustParseStringVar("MG_KEY"))
-	case smtpProvider:
-		email = smtpmail.NewMailProvider(parseStringVarWithDefault("SMTP_LISTEN", ":25"))
+		email = append(email, burner.NamedEmailProvider{Name: emailType, Provider: provider})
 	}
 
 	listenAddr := parseStringVarWithDefault("LISTEN", ":8080")
@@ -56,16 +67,86 @@ func mustParseConfig() (burner.Config, burner.Database, burner.EmailProvider, st
 		Key:                mustParseStringVar("KEY"),
 		URL:                mustParseStringVar("WEBSITE_URL"),
 		StaticURL:          mustParseStringVar("STATIC_URL"),
+		BodyURL:            parseStringVar("BODY_URL"),
 		Developing:         parseBoolVarWithDefault("DEVELOPING", false),
 		Domains:            mustParseSliceVar("DOMAINS"),
-		UsingLambda:        parseBoolVarWithDefault("LAMBDA", false),
+		UsingLambda:        usingLambda,
 		RestoreRealIP:      parseBoolVarWithDefault("RESTOREREALIP", false),
 		BlacklistedDomains: parseSliceVar("BLACKLISTED"),
+		PolicyFile:         parseStringVar("POLICY_FILE"),
 		EmitMetrics:        parseBoolVarWithDefault("METRICS", false),
 		MetricPort:         parseStringVarWithDefault("METRIC_PORT", ":9091"),
+		MailTrap:           mailTrap,
+		MailHogAPI:         parseBoolVarWithDefault("MAILHOG_API", false),
+		HTTPRateLimit:      parseRateLimit("RATE_LIMIT_HTTP", "http", rateLimitStore),
+		InboxRateLimit:     parseRateLimit("RATE_LIMIT_INBOX", "inbox", rateLimitStore),
+		IngestQueue:        ingestQueue,
+		Spool:              sp,
 	}, db, email, listenAddr
 }
 
+// parseRateLimitStore returns the store rate limits are kept in. Keeping them in the database shares them between
+// instances.
+func parseRateLimitStore(dbType string, db burner.Database) ratelimit.Store {
+	storeType := parseStringVarWithDefault("RATE_LIMIT_STORE", memoryRateLimitStore)
+
+	switch storeType {
+	case memoryRateLimitStore:
+		return ratelimit.NewMemoryStore()
+	case dbRateLimitStore:
+		store, ok := db.(ratelimit.Store)
+		if !ok {
+			log.Fatalf("Env var RATE_LIMIT_STORE is invalid: DB_TYPE %v can't store rate limits, use %v", dbType, memoryRateLimitStore)
+		}
+		return store
+	default:
+		log.Fatalf("Env var RATE_LIMIT_STORE is invalid: must be one of %v or %v", memoryRateLimitStore, dbRateLimitStore)
+	}
+
+	return nil
+}
+
+// parseIngestQueue returns a queue for saving messages in the background or nil if messages should be saved while
+// the sender waits
+func parseIngestQueue() *ingest.Queue {
+	workers := parseIntVarWithDefault("INGEST_WORKERS", 0)
+	if workers == 0 {
+		return nil
+	}
+
+	return ingest.New(workers, parseIntVarWithDefault("INGEST_QUEUE_DEPTH", 100))
+}
+
+// parseSpool opens the spool accepted messages are written to before being saved to db or returns nil if messages
+// should be saved directly
+func parseSpool(db burner.Database) burner.Spooler {
+	dir := parseStringVar("SPOOL_DIR")
+	if dir == "" {
+		return nil
+	}
+
+	sp, err := spool.Open(dir, db, spool.WithMaxAge(parseDurationVarWithDefault("SPOOL_MAX_AGE", spool.DefaultMaxAge)))
+	if err != nil {
+		log.Fatalf("Env var SPOOL_DIR is invalid: %v", err)
+	}
+
+	return sp
+}
+
+// parseRateLimit returns a limiter for the limit in key or nil if it isn't set
+func parseRateLimit(key string, name string, store ratelimit.Store) *ratelimit.Limiter {
+	l, err := ratelimit.ParseLimit(parseStringVar(key))
+	if err != nil {
+		log.Fatalf("Env var %v is invalid: %v", key, err)
+	}
+
+	if !l.Enabled() {
+		return nil
+	}
+
+	return ratelimit.New(name, l, store)
+}
+
 func parseStringVar(key string) string {
 	return os.Getenv(key)
 }
@@ -113,6 +194,34 @@ func parseBoolVarWithDefault(key string, def bool) bool {
 	return v
 }
 
+func parseIntVarWithDefault(key string, def int) int {
+	val := parseStringVar(key)
+	if val == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil || i < 0 {
+		log.Fatalf("Env var %v is invalid: must be a whole number", key)
+	}
+
+	return i
+}
+
+func parseDurationVarWithDefault(key string, def time.Duration) time.Duration {
+	val := parseStringVar(key)
+	if val == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		log.Fatalf("Env var %v is invalid: must be a positive duration e.g. 5m", key)
+	}
+
+	return d
+}
+
 func parseStringVarWithDefault(key, def string) string {
 	v := parseStringVar(key)
 	if v == "" {
@@ -3,16 +3,22 @@ package dynamodb
 import (
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/greylist"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
 )
 
 var _ burner.Database = &DynamoDB{}
+var _ ratelimit.Store = &DynamoDB{}
 
 // DynamoDB implements the db interface
 type DynamoDB struct {
@@ -21,6 +27,14 @@ type DynamoDB struct {
 	emailAddressIndexName string
 }
 
+func init() {
+	burner.RegisterDatabase("dynamo", []burner.Setting{
+		{Name: "DYNAMO_TABLE", Description: "name of the dynamodb table", Required: true},
+	}, func(s burner.Settings) (burner.Database, error) {
+		return GetNewDynamoDB(s.String("DYNAMO_TABLE")), nil
+	})
+}
+
 //GetNewDynamoDB gets a new dynamodb database or panics
 func GetNewDynamoDB(table string) *DynamoDB {
 	awsSession := session.Must(session.NewSession())
@@ -57,13 +71,106 @@ func (d *DynamoDB) SaveNewInbox(i burner.Inbox) error {
 		return fmt.Errorf("DynamoDB - failed to put new inbox to dynamodb: %w", err)
 	}
 
+	if i.IsPattern() {
+		err = d.savePattern(i)
+		if err != nil {
+			return fmt.Errorf("DynamoDB - failed to put pattern of new inbox: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// patternPrefix prefixes the ids of the items indexing pattern inboxes by address so they can share the table with
+// inboxes. Every candidate for an address can then be fetched at once, which the email address index doesn't allow.
+const patternPrefix = "pattern:"
+
+type patternEntry struct {
+	ID      string `dynamodbav:"id"`
+	InboxID string `dynamodbav:"inbox_id"`
+	TTL     int64  `dynamodbav:"ttl"`
+}
+
+func (d *DynamoDB) savePattern(i burner.Inbox) error {
+	item, err := dynamodbattribute.MarshalMap(patternEntry{
+		ID:      patternPrefix + strings.ToLower(i.Address),
+		InboxID: i.ID,
+		TTL:     i.TTL,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal pattern: %w", err)
+	}
+
+	_, err = d.dynDB.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.emailsTableName),
+		Item:      item,
+	})
+	return err
+}
+
+// GetPatternInbox returns the pattern inbox with the longest prefix matching address
+func (d *DynamoDB) GetPatternInbox(address string) (burner.Inbox, bool, error) {
+	candidates := burner.PatternCandidates(strings.ToLower(address))
+	if len(candidates) == 0 {
+		return burner.Inbox{}, false, nil
+	}
+
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(candidates))
+	for _, c := range candidates {
+		keys = append(keys, map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(patternPrefix + c),
+			},
+		})
+	}
+
+	found := make(map[string]string)
+	request := map[string]*dynamodb.KeysAndAttributes{
+		d.emailsTableName: {Keys: keys},
+	}
+	for len(request) > 0 {
+		o, err := d.dynDB.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: request})
+		if err != nil {
+			return burner.Inbox{}, false, fmt.Errorf("DynamoDB - failed to get patterns: %w", err)
+		}
+
+		var entries []patternEntry
+		err = dynamodbattribute.UnmarshalListOfMaps(o.Responses[d.emailsTableName], &entries)
+		if err != nil {
+			return burner.Inbox{}, false, fmt.Errorf("DynamoDB - failed to unmarshal patterns: %w", err)
+		}
+
+		for _, e := range entries {
+			found[strings.TrimPrefix(e.ID, patternPrefix)] = e.InboxID
+		}
+
+		request = o.UnprocessedKeys
+	}
+
+	for _, c := range candidates {
+		id, ok := found[c]
+		if !ok {
+			continue
+		}
+
+		inbox, err := d.GetInboxByID(id)
+		if err != nil {
+			return burner.Inbox{}, false, err
+		}
+
+		// the table's ttl may have removed the inbox before its pattern
+		if inbox.ID == "" {
+			continue
+		}
+
+		return inbox, true, nil
+	}
+
+	return burner.Inbox{}, false, nil
+}
+
 //GetInboxByID gets an inbox by the given inbox id
 func (d *DynamoDB) GetInboxByID(id string) (burner.Inbox, error) {
-	var inbox burner.Inbox
-
 	o, err := d.dynDB.GetItem(&dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -76,7 +183,7 @@ func (d *DynamoDB) GetInboxByID(id string) (burner.Inbox, error) {
 		return burner.Inbox{}, fmt.Errorf("DynamoDB - failed to get inbox: %w", err)
 	}
 
-	err = dynamodbattribute.UnmarshalMap(o.Item, &inbox)
+	inbox, err := unmarshalInbox(o.Item)
 	if err != nil {
 		return burner.Inbox{}, fmt.Errorf("DynamoDB - failed to unmarshal inbox: %w", err)
 	}
@@ -84,6 +191,24 @@ func (d *DynamoDB) GetInboxByID(id string) (burner.Inbox, error) {
 	return inbox, nil
 }
 
+// unmarshalInbox unmarshals an inbox item. Inboxes created before route ids were kept per provider only have the
+// single ep_routeid attribute so their route ids are taken from that.
+func unmarshalInbox(item map[string]*dynamodb.AttributeValue) (burner.Inbox, error) {
+	var inbox burner.Inbox
+	err := dynamodbattribute.UnmarshalMap(item, &inbox)
+	if err != nil {
+		return burner.Inbox{}, err
+	}
+
+	if _, ok := item["ep_routeids"]; !ok {
+		if old, ok := item["ep_routeid"]; ok && old.S != nil {
+			inbox.EmailProviderRouteIDs = burner.LegacyRouteIDs(*old.S)
+		}
+	}
+
+	return inbox, nil
+}
+
 type secondaryIndexInbox struct {
 	ID           string `dynamodbav:"id"`
 	EmailAddress string `dynamodbav:"email_address"`
@@ -140,18 +265,21 @@ func (d *DynamoDB) EmailAddressExists(a string) (bool, error) {
 
 // SetInboxCreated updates the given inbox to reflect its created status
 func (d *DynamoDB) SetInboxCreated(i burner.Inbox) error {
+	routeIDs, err := dynamodbattribute.Marshal(i.EmailProviderRouteIDs)
+	if err != nil {
+		return fmt.Errorf("DynamoDB - failed to marshal route ids: %w", err)
+	}
+
 	u := &dynamodb.UpdateItemInput{
 		ExpressionAttributeNames: map[string]*string{
 			"#F": aws.String("failed_to_create"),
-			"#M": aws.String("ep_routeid"),
+			"#M": aws.String("ep_routeids"),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":f": {
 				BOOL: aws.Bool(false),
 			},
-			":m": {
-				S: aws.String(i.EmailProviderRouteID),
-			},
+			":m": routeIDs,
 		},
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -162,7 +290,7 @@ func (d *DynamoDB) SetInboxCreated(i burner.Inbox) error {
 		UpdateExpression: aws.String("SET #F = :f, #M = :m"),
 	}
 
-	_, err := d.dynDB.UpdateItem(u)
+	_, err = d.dynDB.UpdateItem(u)
 	if err != nil {
 		return fmt.Errorf("DynamoDB - failed to update inbox item: %w", err)
 	}
@@ -198,14 +326,64 @@ func (d *DynamoDB) SetInboxFailed(i burner.Inbox) error {
 	return nil
 }
 
+//SetInboxAllowedSenders sets the senders an inbox accepts mail from
+func (d *DynamoDB) SetInboxAllowedSenders(i burner.Inbox) error {
+	senders, err := dynamodbattribute.Marshal(i.AllowedSenders)
+	if err != nil {
+		return fmt.Errorf("DynamoDB - failed to marshal allowed senders: %w", err)
+	}
+
+	u := &dynamodb.UpdateItemInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#S": aws.String("allowed_senders"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": senders,
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(i.ID),
+			},
+		},
+		TableName:        aws.String(d.emailsTableName),
+		UpdateExpression: aws.String("SET #S = :s"),
+	}
+
+	_, err = d.dynDB.UpdateItem(u)
+	if err != nil {
+		return fmt.Errorf("DynamoDB - failed to update inbox item: %w", err)
+	}
+
+	return nil
+}
+
+// dedupPrefix prefixes the ids of the items recording until when each EmailProviderID received by an inbox is a
+// duplicate so they can share the table with inboxes. They are removed by the table's ttl.
+const dedupPrefix = "dedup:"
+
+type dedupEntry struct {
+	ID  string `dynamodbav:"id"`
+	TTL int64  `dynamodbav:"ttl"`
+}
+
 //SaveNewMessage saves a given message to dynamodb
 func (d *DynamoDB) SaveNewMessage(m burner.Message) error {
+	return d.saveNewMessage(m, false)
+}
+
+//SaveNewMessageOnce saves a given message to dynamodb unless it is a duplicate. The message's EmailProviderID is
+//recorded in the same transaction so that concurrent redeliveries can't both be saved.
+func (d *DynamoDB) SaveNewMessageOnce(m burner.Message) error {
+	return d.saveNewMessage(m, true)
+}
+
+func (d *DynamoDB) saveNewMessage(m burner.Message, once bool) error {
 	mv, err := dynamodbattribute.MarshalMap(m)
 	if err != nil {
 		return fmt.Errorf("DynamoDB - failed to marshal new message to attribute value: %w", err)
 	}
 
-	_, err = d.dynDB.UpdateItem(&dynamodb.UpdateItemInput{
+	update := &dynamodb.Update{
 		ExpressionAttributeNames: map[string]*string{
 			"#M":   aws.String("messages"),
 			"#MID": aws.String(m.ID),
@@ -222,7 +400,58 @@ func (d *DynamoDB) SaveNewMessage(m burner.Message) error {
 		},
 		TableName:        aws.String(d.emailsTableName),
 		UpdateExpression: aws.String("SET #M.#MID = :m"),
+	}
+
+	if !once || m.EmailProviderID == "" {
+		_, err = d.dynDB.UpdateItem(&dynamodb.UpdateItemInput{
+			ExpressionAttributeNames:  update.ExpressionAttributeNames,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+			Key:                       update.Key,
+			TableName:                 update.TableName,
+			UpdateExpression:          update.UpdateExpression,
+		})
+		if err != nil {
+			return fmt.Errorf("DynamoDB - failed to save new message: %w", err)
+		}
+		return nil
+	}
+
+	dedup, err := dynamodbattribute.MarshalMap(dedupEntry{
+		ID:  dedupPrefix + m.InboxID + ":" + m.EmailProviderID,
+		TTL: m.ReceivedAt + int64(burner.DuplicateWindow.Seconds()),
 	})
+	if err != nil {
+		return fmt.Errorf("DynamoDB - failed to marshal dedup entry: %w", err)
+	}
+
+	_, err = d.dynDB.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				// the table's ttl can take a while to remove expired entries so they're checked here too
+				Put: &dynamodb.Put{
+					ConditionExpression: aws.String("attribute_not_exists(id) OR #T <= :r"),
+					ExpressionAttributeNames: map[string]*string{
+						"#T": aws.String("ttl"),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":r": {
+							N: aws.String(strconv.FormatInt(m.ReceivedAt, 10)),
+						},
+					},
+					Item:      dedup,
+					TableName: aws.String(d.emailsTableName),
+				},
+			},
+			{
+				Update: update,
+			},
+		},
+	})
+	var cancelled *dynamodb.TransactionCanceledException
+	if errors.As(err, &cancelled) && len(cancelled.CancellationReasons) > 0 &&
+		aws.StringValue(cancelled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return burner.ErrDuplicateMessage
+	}
 	if err != nil {
 		return fmt.Errorf("DynamoDB - failed to save new message: %w", err)
 	}
@@ -298,6 +527,262 @@ func (d *DynamoDB) GetMessageByID(i, m string) (burner.Message, error) {
 	return msg, nil
 }
 
+//GetInboxesWithMessages returns every inbox which has received at least one message. This requires a scan of
+//the table so should only be used for small deployments e.g. mail trap mode.
+func (d *DynamoDB) GetInboxesWithMessages() ([]burner.Inbox, error) {
+	inboxes := []burner.Inbox{}
+
+	input := &dynamodb.ScanInput{
+		ExpressionAttributeNames: map[string]*string{
+			"#M":  aws.String("messages"),
+			"#T":  aws.String("ttl"),
+			"#ID": aws.String("id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":z": {
+				N: aws.String("0"),
+			},
+		},
+		FilterExpression:     aws.String("size(#M) > :z"),
+		ProjectionExpression: aws.String("#ID, email_address, created_at, created_by, #T, ep_routeids, ep_routeid, failed_to_create, allowed_senders"),
+		TableName:            aws.String(d.emailsTableName),
+	}
+
+	var unmarshalErr error
+	err := d.dynDB.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var inbox burner.Inbox
+			inbox, unmarshalErr = unmarshalInbox(item)
+			if unmarshalErr != nil {
+				return false
+			}
+			inboxes = append(inboxes, inbox)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DynamoDB - failed to scan for inboxes with messages: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("DynamoDB - failed to unmarshal inboxes: %w", unmarshalErr)
+	}
+
+	return inboxes, nil
+}
+
+//DeleteAllMessages deletes every message in every inbox, leaving the inboxes in place
+func (d *DynamoDB) DeleteAllMessages() error {
+	inboxes, err := d.GetInboxesWithMessages()
+	if err != nil {
+		return err
+	}
+
+	for _, i := range inboxes {
+		_, err := d.dynDB.UpdateItem(&dynamodb.UpdateItemInput{
+			ExpressionAttributeNames: map[string]*string{
+				"#M": aws.String("messages"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":m": {
+					M: map[string]*dynamodb.AttributeValue{},
+				},
+			},
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {
+					S: aws.String(i.ID),
+				},
+			},
+			TableName:        aws.String(d.emailsTableName),
+			UpdateExpression: aws.String("SET #M = :m"),
+		})
+		if err != nil {
+			return fmt.Errorf("DynamoDB - failed to delete messages in inbox: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// rateLimitPrefix prefixes the ids of rate limit buckets so they can share the table with inboxes
+const rateLimitPrefix = "ratelimit:"
+
+// rateLimitAttempts is how many times a rate limit bucket or greylist entry update is retried when it loses a race
+// with another instance
+const rateLimitAttempts = 5
+
+type rateLimitBucket struct {
+	ID        string  `dynamodbav:"id"`
+	Tokens    float64 `dynamodbav:"tokens"`
+	UpdatedAt int64   `dynamodbav:"updated_at"`
+	TTL       int64   `dynamodbav:"ttl"`
+}
+
+//TakeToken takes a token from the rate limit bucket for key so that limits are shared between instances. Buckets
+//are updated with a conditional put and expire through the table's ttl once they have refilled.
+func (d *DynamoDB) TakeToken(key string, l ratelimit.Limit, now time.Time) (bool, time.Duration, error) {
+	id := rateLimitPrefix + key
+
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		o, err := d.dynDB.GetItem(&dynamodb.GetItemInput{
+			ConsistentRead: aws.Bool(true),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {
+					S: aws.String(id),
+				},
+			},
+			TableName: aws.String(d.emailsTableName),
+		})
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to get rate limit bucket: %w", err)
+		}
+
+		var stored rateLimitBucket
+		err = dynamodbattribute.UnmarshalMap(o.Item, &stored)
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to unmarshal rate limit bucket: %w", err)
+		}
+
+		var b ratelimit.Bucket
+		if o.Item != nil {
+			b = ratelimit.Bucket{Tokens: stored.Tokens, Updated: time.Unix(0, stored.UpdatedAt)}
+		}
+
+		allowed, wait := b.Take(l, now)
+
+		item, err := dynamodbattribute.MarshalMap(rateLimitBucket{
+			ID:        id,
+			Tokens:    b.Tokens,
+			UpdatedAt: b.Updated.UnixNano(),
+			TTL:       b.FullAt(l).Unix() + 1,
+		})
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to marshal rate limit bucket: %w", err)
+		}
+
+		// only write the bucket if nobody else has since we read it
+		input := &dynamodb.PutItemInput{
+			Item:      item,
+			TableName: aws.String(d.emailsTableName),
+		}
+		if o.Item == nil {
+			input.ConditionExpression = aws.String("attribute_not_exists(id)")
+		} else {
+			input.ConditionExpression = aws.String("updated_at = :u")
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":u": {
+					N: aws.String(strconv.FormatInt(stored.UpdatedAt, 10)),
+				},
+			}
+		}
+
+		_, err = d.dynDB.PutItem(input)
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to put rate limit bucket: %w", err)
+		}
+
+		return allowed, wait, nil
+	}
+
+	return false, 0, fmt.Errorf("DynamoDB - failed to update rate limit bucket after %d attempts", rateLimitAttempts)
+}
+
+// greylistPrefix prefixes the ids of greylist entries so they can share the table with inboxes
+const greylistPrefix = "greylist:"
+
+type greylistEntry struct {
+	ID        string `dynamodbav:"id"`
+	FirstSeen int64  `dynamodbav:"first_seen"`
+	PassedAt  int64  `dynamodbav:"passed_at"`
+	TTL       int64  `dynamodbav:"ttl"`
+}
+
+// CheckGreylist checks the greylist entry for key so that greylisting is shared between instances. Like rate limit
+// buckets entries are updated with a conditional put and expire through the table's ttl.
+func (d *DynamoDB) CheckGreylist(key string, w greylist.Windows, now time.Time) (bool, time.Duration, error) {
+	id := greylistPrefix + key
+
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		o, err := d.dynDB.GetItem(&dynamodb.GetItemInput{
+			ConsistentRead: aws.Bool(true),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id": {
+					S: aws.String(id),
+				},
+			},
+			TableName: aws.String(d.emailsTableName),
+		})
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to get greylist entry: %w", err)
+		}
+
+		var stored greylistEntry
+		err = dynamodbattribute.UnmarshalMap(o.Item, &stored)
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to unmarshal greylist entry: %w", err)
+		}
+
+		var e greylist.Entry
+		if o.Item != nil {
+			e.FirstSeen = time.Unix(0, stored.FirstSeen)
+			if stored.PassedAt != 0 {
+				e.Passed = time.Unix(0, stored.PassedAt)
+			}
+		}
+
+		allowed, wait := e.Check(w, now)
+
+		updated := greylistEntry{
+			ID:        id,
+			FirstSeen: e.FirstSeen.UnixNano(),
+			TTL:       e.ExpiresAt(w).Unix() + 1,
+		}
+		if !e.Passed.IsZero() {
+			updated.PassedAt = e.Passed.UnixNano()
+		}
+
+		item, err := dynamodbattribute.MarshalMap(updated)
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to marshal greylist entry: %w", err)
+		}
+
+		// only write the entry if nobody else has since we read it
+		input := &dynamodb.PutItemInput{
+			Item:      item,
+			TableName: aws.String(d.emailsTableName),
+		}
+		if o.Item == nil {
+			input.ConditionExpression = aws.String("attribute_not_exists(id)")
+		} else {
+			input.ConditionExpression = aws.String("first_seen = :f AND passed_at = :p")
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":f": {
+					N: aws.String(strconv.FormatInt(stored.FirstSeen, 10)),
+				},
+				":p": {
+					N: aws.String(strconv.FormatInt(stored.PassedAt, 10)),
+				},
+			}
+		}
+
+		_, err = d.dynDB.PutItem(input)
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		if err != nil {
+			return false, 0, fmt.Errorf("DynamoDB - failed to put greylist entry: %w", err)
+		}
+
+		return allowed, wait, nil
+	}
+
+	return false, 0, fmt.Errorf("DynamoDB - failed to update greylist entry after %d attempts", rateLimitAttempts)
+}
+
 //createDatabase creates a new database for testing, real creation is done by the cloudformation stack
 func (d *DynamoDB) createDatabase() error {
 	emails := &dynamodb.CreateTableInput{
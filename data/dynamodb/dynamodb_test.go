@@ -81,4 +81,7 @@ func TestDynamoDB(t *testing.T) {
 	for _, f := range data.TestingFuncs {
 		f(t, db)
 	}
+
+	data.TestRateLimitStore(t, db)
+	data.TestGreylistStore(t, db)
 }
@@ -10,14 +10,23 @@ import (
 )
 
 var _ burner.Database = &InMemory{}
+var _ burner.ExpiryNotifier = &InMemory{}
+
+func init() {
+	burner.RegisterDatabase("memory", nil, func(s burner.Settings) (burner.Database, error) {
+		return GetInMemoryDB(), nil
+	})
+}
 
 var errInboxDoesntExist = errors.New("failed to get inbox. It doesn't exist")
 
 // InMemory implements an in memory database
 type InMemory struct {
-	emails   map[string]burner.Inbox
-	messages map[string]map[string]burner.Message
-	m        sync.RWMutex
+	emails    map[string]burner.Inbox
+	addresses map[string]string // lower case address to inbox id, for looking up pattern inboxes
+	messages  map[string]map[string]burner.Message
+	m         sync.RWMutex
+	expired   func(i burner.Inbox)
 }
 
 // GetInMemoryDB returns a new InMemoryDB to use
@@ -26,6 +35,7 @@ func GetInMemoryDB() *InMemory {
 
 	im.messages = make(map[string]map[string]burner.Message)
 	im.emails = make(map[string]burner.Inbox)
+	im.addresses = make(map[string]string)
 
 	return im
 }
@@ -41,10 +51,26 @@ func (im *InMemory) Start() error {
 	return nil
 }
 
+// NotifyExpired implements burner.ExpiryNotifier. It must be called before Start.
+func (im *InMemory) NotifyExpired(f func(i burner.Inbox)) {
+	im.expired = f
+}
+
 // DeleteExpiredData deletes data that has expired according to its TTL
 func (im *InMemory) DeleteExpiredData() {
+	var expired []burner.Inbox
+
 	im.m.Lock()
-	defer im.m.Unlock()
+	defer func() {
+		im.m.Unlock()
+
+		// call after unlocking so f can use the db
+		if im.expired != nil {
+			for _, i := range expired {
+				im.expired(i)
+			}
+		}
+	}()
 
 	for k, v := range im.emails {
 		t := time.Unix(v.TTL, 0)
@@ -52,6 +78,8 @@ func (im *InMemory) DeleteExpiredData() {
 		// if our emails ttl is before now then delete it
 		if t.Before(time.Now()) {
 			delete(im.emails, k)
+			delete(im.addresses, strings.ToLower(v.Address))
+			expired = append(expired, v)
 		}
 	}
 
@@ -75,7 +103,7 @@ func (im *InMemory) SaveNewInbox(i burner.Inbox) error {
 	im.m.Lock()
 	defer im.m.Unlock()
 
-	im.emails[i.ID] = i
+	im.putInbox(i)
 
 	if im.messages[i.ID] == nil {
 		im.messages[i.ID] = make(map[string]burner.Message)
@@ -112,6 +140,27 @@ func (im *InMemory) GetInboxByAddress(address string) (burner.Inbox, error) {
 	return burner.Inbox{}, errInboxDoesntExist
 }
 
+// putInbox saves i and indexes it by address. The lock must be held.
+func (im *InMemory) putInbox(i burner.Inbox) {
+	im.emails[i.ID] = i
+	im.addresses[strings.ToLower(i.Address)] = i.ID
+}
+
+// GetPatternInbox returns the pattern inbox with the longest prefix matching address. Candidates are returned longest
+// first so the first one with an inbox is the match.
+func (im *InMemory) GetPatternInbox(address string) (burner.Inbox, bool, error) {
+	im.m.RLock()
+	defer im.m.RUnlock()
+
+	for _, c := range burner.PatternCandidates(strings.ToLower(address)) {
+		if id, ok := im.addresses[c]; ok {
+			return im.emails[id], true, nil
+		}
+	}
+
+	return burner.Inbox{}, false, nil
+}
+
 //EmailAddressExists returns a bool depending on whether or not the given email address
 // is already assigned to an inbox
 func (im *InMemory) EmailAddressExists(a string) (bool, error) {
@@ -133,7 +182,7 @@ func (im *InMemory) SetInboxCreated(i burner.Inbox) error {
 	defer im.m.Unlock()
 
 	i.FailedToCreate = false
-	im.emails[i.ID] = i
+	im.putInbox(i)
 
 	return nil
 }
@@ -144,13 +193,39 @@ func (im *InMemory) SetInboxFailed(i burner.Inbox) error {
 	defer im.m.Unlock()
 
 	i.FailedToCreate = true
-	im.emails[i.ID] = i
+	im.putInbox(i)
+
+	return nil
+}
+
+// SetInboxAllowedSenders sets the senders an inbox accepts mail from
+func (im *InMemory) SetInboxAllowedSenders(i burner.Inbox) error {
+	im.m.Lock()
+	defer im.m.Unlock()
+
+	inbox, ok := im.emails[i.ID]
+	if !ok {
+		return errInboxDoesntExist
+	}
+
+	inbox.AllowedSenders = i.AllowedSenders
+	im.putInbox(inbox)
 
 	return nil
 }
 
 //SaveNewMessage saves a given message to memory
 func (im *InMemory) SaveNewMessage(m burner.Message) error {
+	return im.saveNewMessage(m, false)
+}
+
+// SaveNewMessageOnce saves a given message to memory unless the inbox has a message with the same EmailProviderID
+// received within burner.DuplicateWindow
+func (im *InMemory) SaveNewMessageOnce(m burner.Message) error {
+	return im.saveNewMessage(m, true)
+}
+
+func (im *InMemory) saveNewMessage(m burner.Message, once bool) error {
 	im.m.Lock()
 	defer im.m.Unlock()
 
@@ -158,11 +233,28 @@ func (im *InMemory) SaveNewMessage(m burner.Message) error {
 		im.messages[m.InboxID] = make(map[string]burner.Message)
 	}
 
+	if once && m.EmailProviderID != "" {
+		for _, saved := range im.messages[m.InboxID] {
+			if saved.EmailProviderID == m.EmailProviderID && isWithinDuplicateWindow(saved.ReceivedAt, m.ReceivedAt) {
+				return burner.ErrDuplicateMessage
+			}
+		}
+	}
+
 	im.messages[m.InboxID][m.ID] = m
 
 	return nil
 }
 
+// isWithinDuplicateWindow reports whether messages received at a and b are close enough to be duplicates
+func isWithinDuplicateWindow(a int64, b int64) bool {
+	d := time.Duration(b-a) * time.Second
+	if d < 0 {
+		d = -d
+	}
+	return d < burner.DuplicateWindow
+}
+
 //GetMessagesByInboxID returns all messages in a given inbox
 func (im *InMemory) GetMessagesByInboxID(id string) ([]burner.Message, error) {
 	im.m.RLock()
@@ -196,3 +288,38 @@ func (im *InMemory) GetMessageByID(i, m string) (burner.Message, error) {
 
 	return msg, nil
 }
+
+//GetInboxesWithMessages returns every inbox which has received at least one message
+func (im *InMemory) GetInboxesWithMessages() ([]burner.Inbox, error) {
+	im.m.RLock()
+	defer im.m.RUnlock()
+
+	inboxes := []burner.Inbox{}
+
+	for id, msgs := range im.messages {
+		if len(msgs) == 0 {
+			continue
+		}
+
+		i, ok := im.emails[id]
+		if !ok {
+			continue
+		}
+
+		inboxes = append(inboxes, i)
+	}
+
+	return inboxes, nil
+}
+
+//DeleteAllMessages deletes every message in every inbox, leaving the inboxes in place
+func (im *InMemory) DeleteAllMessages() error {
+	im.m.Lock()
+	defer im.m.Unlock()
+
+	for id := range im.messages {
+		im.messages[id] = make(map[string]burner.Message)
+	}
+
+	return nil
+}
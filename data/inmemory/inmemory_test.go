@@ -94,3 +94,37 @@ func TestInMemory_DeleteExpiredData(t *testing.T) {
 		}
 	}
 }
+
+func TestInMemory_NotifyExpired(t *testing.T) {
+	db := GetInMemoryDB()
+
+	var expired []burner.Inbox
+	db.NotifyExpired(func(i burner.Inbox) {
+		// the db is unlocked while f is called
+		_, err := db.GetInboxByID(i.ID)
+		if err != errInboxDoesntExist {
+			t.Errorf("TestInMemory_NotifyExpired: expected expired inbox to be deleted, got %v", err)
+		}
+		expired = append(expired, i)
+	})
+
+	i1 := burner.Inbox{
+		ID:                    "1234",
+		TTL:                   time.Now().Add(-1 * time.Second).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"mailgun": "4f3bad2335335426750048c6"},
+	}
+
+	i2 := burner.Inbox{
+		ID:  "5678",
+		TTL: time.Now().Add(1 * time.Hour).Unix(),
+	}
+
+	_ = db.SaveNewInbox(i1)
+	_ = db.SaveNewInbox(i2)
+
+	db.DeleteExpiredData()
+
+	if len(expired) != 1 || expired[0].ID != "1234" || expired[0].EmailProviderRouteIDs["mailgun"] != "4f3bad2335335426750048c6" {
+		t.Errorf("TestInMemory_NotifyExpired: expected only inbox 1234 to expire, got %v", expired)
+	}
+}
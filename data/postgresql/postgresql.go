@@ -1,6 +1,7 @@
 package postgresql
 
 import (
+	"github.com/haydenwoodhead/burner.kiwi/burner"
 	"github.com/haydenwoodhead/burner.kiwi/data/sqldb"
 
 	_ "github.com/lib/pq" // import lib pq here rather than main
@@ -15,3 +16,11 @@ type PostgreSQL struct {
 func GetPostgreSQLDB(dbURL string) *PostgreSQL {
 	return &PostgreSQL{sqldb.New("postgres", dbURL)}
 }
+
+func init() {
+	burner.RegisterDatabase("postgres", []burner.Setting{
+		{Name: "DATABASE_URL", Description: "postgres connection url", Required: true},
+	}, func(s burner.Settings) (burner.Database, error) {
+		return GetPostgreSQLDB(s.String("DATABASE_URL")), nil
+	})
+}
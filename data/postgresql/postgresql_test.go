@@ -64,6 +64,8 @@ func TestPostgreSQL(t *testing.T) {
 	}
 
 	testTTLDelete(t, db)
+	data.TestRateLimitStore(t, db)
+	data.TestGreylistStore(t, db)
 }
 
 func testTTLDelete(t *testing.T, db *PostgreSQL) {
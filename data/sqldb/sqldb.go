@@ -3,22 +3,29 @@ package sqldb
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/greylist"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 )
 
+var _ ratelimit.Store = &SQLDatabase{}
+var _ burner.ExpiryNotifier = &SQLDatabase{}
+
 // SQLDatabase implements the database interface for sqldb
 type SQLDatabase struct {
 	*sqlx.DB
-	dbType string
+	dbType  string
+	expired func(i burner.Inbox)
 }
 
 // New returns a new db or panics
 func New(dbType string, dbURL string) *SQLDatabase {
-	s := &SQLDatabase{sqlx.MustOpen(dbType, dbURL), dbType}
+	s := &SQLDatabase{DB: sqlx.MustOpen(dbType, dbURL), dbType: dbType}
 	if dbType == "sqlite3" {
 		s.SetMaxOpenConns(1)
 	}
@@ -33,6 +40,11 @@ func (s *SQLDatabase) Start() error {
 		return fmt.Errorf("%s - failed to create tables: %w", s.dbType, err)
 	}
 
+	err = s.migrate()
+	if err != nil {
+		return fmt.Errorf("%s - failed to migrate tables: %w", s.dbType, err)
+	}
+
 	go func() {
 		t := time.Now().Unix()
 		var active int
@@ -63,9 +75,10 @@ func (s *SQLDatabase) createTables() error {
 		address text not null unique,
 		created_at numeric,
 		created_by text,
-		ep_routeid text,
+		ep_routeids text,
 		ttl numeric,
 		failed_to_create bool,
+		allowed_senders text not null default '',
 		primary key (id)
 	);
 	
@@ -81,23 +94,136 @@ func (s *SQLDatabase) createTables() error {
 		body_html text,
 		body_plain text,
 		ttl numeric,
+		subaddress text not null default '',
+		recipient text not null default '',
+		spam text,
+		virus text,
+		reputation text,
+		attachments text,
 		primary key (message_id)
+	);
+
+	create table if not exists message_dedup (
+		inbox_id uuid references inbox(id) on delete cascade,
+		ep_id text not null,
+		ttl numeric,
+		primary key (inbox_id, ep_id)
+	);
+
+	create table if not exists rate_limit (
+		id text not null,
+		tokens double precision not null,
+		updated_at bigint not null,
+		ttl numeric,
+		primary key (id)
+	);
+
+	create table if not exists greylist (
+		id text not null,
+		first_seen bigint not null,
+		passed_at bigint not null,
+		ttl numeric,
+		primary key (id)
 	);`)
 	return err
 }
 
+type column struct {
+	table      string
+	name       string
+	definition string
+}
+
+// columns lists columns added after the initial schema. These are added to existing databases by migrate.
+var columns = []column{
+	{table: "message", name: "subaddress", definition: "text not null default ''"},
+	{table: "message", name: "recipient", definition: "text not null default ''"},
+	{table: "inbox", name: "allowed_senders", definition: "text not null default ''"},
+	{table: "message", name: "spam", definition: "text"},
+	{table: "message", name: "virus", definition: "text"},
+	{table: "message", name: "reputation", definition: "text"},
+	{table: "message", name: "attachments", definition: "text"},
+	{table: "inbox", name: "ep_routeids", definition: "text"},
+}
+
+// migrate adds any columns missing from tables created by an older version
+func (s *SQLDatabase) migrate() error {
+	for _, c := range columns {
+		exists, err := s.columnExists(c.table, c.name)
+		if err != nil {
+			return fmt.Errorf("failed to check for column %s.%s: %w", c.table, c.name, err)
+		}
+
+		if exists {
+			continue
+		}
+
+		_, err = s.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.name, c.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", c.table, c.name, err)
+		}
+	}
+
+	return s.migrateRouteIDs()
+}
+
+// migrateRouteIDs copies the route id of inboxes created before route ids were kept per provider into ep_routeids so
+// their routes can still be removed
+func (s *SQLDatabase) migrateRouteIDs() error {
+	exists, err := s.columnExists("inbox", "ep_routeid")
+	if err != nil {
+		return fmt.Errorf("failed to check for column inbox.ep_routeid: %w", err)
+	}
+
+	if !exists {
+		return nil
+	}
+
+	var old []struct {
+		ID      string         `db:"id"`
+		RouteID sql.NullString `db:"ep_routeid"`
+	}
+	err = s.Select(&old, "SELECT id, ep_routeid FROM inbox WHERE ep_routeids IS NULL")
+	if err != nil {
+		return fmt.Errorf("failed to get inboxes to migrate route ids: %w", err)
+	}
+
+	for _, i := range old {
+		_, err = s.Exec("UPDATE inbox SET ep_routeids = $1 WHERE id = $2", burner.LegacyRouteIDs(i.RouteID.String), i.ID)
+		if err != nil {
+			return fmt.Errorf("failed to migrate route ids of inbox %s: %w", i.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLDatabase) columnExists(table string, name string) (bool, error) {
+	var count int
+	var err error
+
+	if s.dbType == "sqlite3" {
+		err = s.Get(&count, "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, name)
+	} else {
+		err = s.Get(&count, "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2", table, name)
+	}
+
+	return count > 0, err
+}
+
 // SaveNewInbox saves a new inbox
 func (s *SQLDatabase) SaveNewInbox(i burner.Inbox) error {
 	_, err := s.NamedExec(
-		"INSERT INTO inbox (id, address, created_at, created_by, ep_routeid, ttl, failed_to_create) VALUES (:id, lower(:address), :created_at, :created_by, :ep_routeid, :ttl, :failed_to_create)",
+		"INSERT INTO inbox (id, address, created_at, created_by, ep_routeids, ttl, failed_to_create, allowed_senders) VALUES (:id, lower(:address), :created_at, :created_by, :ep_routeids, :ttl, :failed_to_create, :allowed_senders)",
 		map[string]interface{}{
 			"id":               i.ID,
 			"address":          i.Address,
 			"created_at":       i.CreatedAt,
 			"created_by":       i.CreatedBy,
-			"ep_routeid":       i.EmailProviderRouteID,
+			"ep_routeids":      i.EmailProviderRouteIDs,
 			"ttl":              i.TTL,
 			"failed_to_create": i.FailedToCreate,
+			"allowed_senders":  i.AllowedSenders,
 		},
 	)
 
@@ -107,14 +233,14 @@ func (s *SQLDatabase) SaveNewInbox(i burner.Inbox) error {
 // GetInboxByID gets an inbox by id
 func (s *SQLDatabase) GetInboxByID(id string) (burner.Inbox, error) {
 	var i burner.Inbox
-	err := s.Get(&i, "SELECT id, address, created_at, created_by, ep_routeid, ttl, failed_to_create FROM inbox WHERE id = $1", id)
+	err := s.Get(&i, "SELECT id, address, created_at, created_by, ep_routeids, ttl, failed_to_create, allowed_senders FROM inbox WHERE id = $1", id)
 	return i, err
 }
 
 // GetInboxByAddress gets an inbox by address
 func (s *SQLDatabase) GetInboxByAddress(address string) (burner.Inbox, error) {
 	var i burner.Inbox
-	err := s.Get(&i, "SELECT id, address, created_at, created_by, ep_routeid, ttl, failed_to_create FROM inbox WHERE lower(address) = lower($1)", address)
+	err := s.Get(&i, "SELECT id, address, created_at, created_by, ep_routeids, ttl, failed_to_create, allowed_senders FROM inbox WHERE lower(address) = lower($1)", address)
 	return i, err
 }
 
@@ -125,9 +251,33 @@ func (s *SQLDatabase) EmailAddressExists(email string) (bool, error) {
 	return count > 0, err
 }
 
+// GetPatternInbox returns the pattern inbox with the longest prefix matching address. Addresses are saved in lower
+// case so the candidates are found with one lookup on the address index.
+func (s *SQLDatabase) GetPatternInbox(address string) (burner.Inbox, bool, error) {
+	candidates := burner.PatternCandidates(strings.ToLower(address))
+	if len(candidates) == 0 {
+		return burner.Inbox{}, false, nil
+	}
+
+	query, args, err := sqlx.In("SELECT id, address, created_at, created_by, ep_routeids, ttl, failed_to_create, allowed_senders FROM inbox WHERE address IN (?) ORDER BY length(address) DESC LIMIT 1", candidates)
+	if err != nil {
+		return burner.Inbox{}, false, fmt.Errorf("failed to build pattern inbox query: %w", err)
+	}
+
+	var i burner.Inbox
+	err = s.Get(&i, s.Rebind(query), args...)
+	if err == sql.ErrNoRows {
+		return burner.Inbox{}, false, nil
+	} else if err != nil {
+		return burner.Inbox{}, false, err
+	}
+
+	return i, true, nil
+}
+
 // SetInboxCreated creates a new inbox
 func (s *SQLDatabase) SetInboxCreated(i burner.Inbox) error {
-	_, err := s.Exec("UPDATE inbox SET failed_to_create = 'false', ep_routeid = $1 WHERE id = $2", i.EmailProviderRouteID, i.ID)
+	_, err := s.Exec("UPDATE inbox SET failed_to_create = 'false', ep_routeids = $1 WHERE id = $2", i.EmailProviderRouteIDs, i.ID)
 	return err
 }
 
@@ -137,9 +287,51 @@ func (s *SQLDatabase) SetInboxFailed(i burner.Inbox) error {
 	return err
 }
 
+// SetInboxAllowedSenders sets the senders an inbox accepts mail from
+func (s *SQLDatabase) SetInboxAllowedSenders(i burner.Inbox) error {
+	_, err := s.Exec("UPDATE inbox SET allowed_senders = $1 WHERE id = $2", i.AllowedSenders, i.ID)
+	return err
+}
+
 // SaveNewMessage saves a new message to the db
 func (s *SQLDatabase) SaveNewMessage(m burner.Message) error {
-	_, err := s.NamedExec("INSERT INTO message (inbox_id, message_id, received_at, ep_id, sender, from_name, from_address, subject, body_html, body_plain, ttl) VALUES (:inbox_id, :message_id, :received_at, :ep_id, :sender, :from_name, :from_address, :subject, :body_html, :body_plain, :ttl)",
+	return s.saveNewMessage(m, false)
+}
+
+// SaveNewMessageOnce saves a new message to the db unless it is a duplicate. The message's EmailProviderID is claimed
+// for the inbox in the same transaction so that concurrent redeliveries can't both be saved.
+func (s *SQLDatabase) SaveNewMessageOnce(m burner.Message) error {
+	return s.saveNewMessage(m, true)
+}
+
+func (s *SQLDatabase) saveNewMessage(m burner.Message, once bool) error {
+	tx, err := s.Beginx()
+	if err != nil {
+		return fmt.Errorf("%s - failed to begin message transaction: %w", s.dbType, err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if once && m.EmailProviderID != "" {
+		// a claim which has expired is taken over, otherwise nothing is updated
+		res, err := tx.Exec(
+			"INSERT INTO message_dedup (inbox_id, ep_id, ttl) VALUES ($1, $2, $3) ON CONFLICT (inbox_id, ep_id) DO UPDATE SET ttl = excluded.ttl WHERE message_dedup.ttl <= $4",
+			m.InboxID, m.EmailProviderID, m.ReceivedAt+int64(burner.DuplicateWindow.Seconds()), m.ReceivedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("%s - failed to claim message: %w", s.dbType, err)
+		}
+
+		count, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("%s - failed to claim message: %w", s.dbType, err)
+		}
+
+		if count == 0 {
+			return burner.ErrDuplicateMessage
+		}
+	}
+
+	_, err = tx.NamedExec("INSERT INTO message (inbox_id, message_id, received_at, ep_id, sender, from_name, from_address, subject, body_html, body_plain, ttl, subaddress, recipient, spam, virus, reputation, attachments) VALUES (:inbox_id, :message_id, :received_at, :ep_id, :sender, :from_name, :from_address, :subject, :body_html, :body_plain, :ttl, :subaddress, :recipient, :spam, :virus, :reputation, :attachments)",
 		map[string]interface{}{
 			"inbox_id":     m.InboxID,
 			"message_id":   m.ID,
@@ -152,9 +344,19 @@ func (s *SQLDatabase) SaveNewMessage(m burner.Message) error {
 			"body_html":    m.BodyHTML,
 			"body_plain":   m.BodyPlain,
 			"ttl":          m.TTL,
+			"subaddress":   m.Subaddress,
+			"recipient":    m.Recipient,
+			"spam":         m.Spam,
+			"virus":        m.Virus,
+			"reputation":   m.Reputation,
+			"attachments":  m.Attachments,
 		},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // GetMessagesByInboxID gets all messages for an inbox
@@ -169,19 +371,173 @@ func (s *SQLDatabase) GetMessageByID(i, m string) (burner.Message, error) {
 	var msg burner.Message
 	err := s.Get(&msg, "SELECT * FROM message WHERE inbox_id = $1 and message_id = $2", i, m)
 	if err == sql.ErrNoRows {
-		return msg, burner.ErrMessageDoesntExist
+		return burner.Message{}, burner.ErrMessageDoesntExist
 	}
 
 	return msg, err
 }
 
+// GetInboxesWithMessages gets every inbox which has received at least one message
+func (s *SQLDatabase) GetInboxesWithMessages() ([]burner.Inbox, error) {
+	inboxes := []burner.Inbox{}
+	err := s.Select(&inboxes, "SELECT id, address, created_at, created_by, ep_routeids, ttl, failed_to_create, allowed_senders FROM inbox WHERE EXISTS (SELECT 1 FROM message WHERE message.inbox_id = inbox.id)")
+	return inboxes, err
+}
+
+// DeleteAllMessages deletes every message in every inbox, leaving the inboxes in place
+func (s *SQLDatabase) DeleteAllMessages() error {
+	_, err := s.Exec("DELETE FROM message")
+	if err != nil {
+		return fmt.Errorf("%s - failed to delete all messages: %w", s.dbType, err)
+	}
+	return nil
+}
+
+// NotifyExpired implements burner.ExpiryNotifier. It must be called before Start.
+func (s *SQLDatabase) NotifyExpired(f func(i burner.Inbox)) {
+	s.expired = f
+}
+
 // RunTTLDelete runs the TTL delete process
 func (s *SQLDatabase) RunTTLDelete() (int, error) {
 	t := time.Now().Unix()
+
+	var expired []burner.Inbox
+	if s.expired != nil {
+		err := s.Select(&expired, "SELECT id, address, created_at, created_by, ep_routeids, ttl, failed_to_create, allowed_senders FROM inbox WHERE ttl < $1", t)
+		if err != nil {
+			return -1, fmt.Errorf("%s - failed to get expired inboxes: %w", s.dbType, err)
+		}
+	}
+
 	res, err := s.Exec("DELETE from inbox WHERE ttl < $1", t)
 	if err != nil {
 		return -1, fmt.Errorf("%s - failed to delete expired inboxes: %w", s.dbType, err)
 	}
 	count, err := res.RowsAffected()
-	return int(count), err
+	if err != nil {
+		return -1, err
+	}
+
+	for _, i := range expired {
+		s.expired(i)
+	}
+
+	// rate limit buckets expire once they have refilled
+	_, err = s.Exec("DELETE from rate_limit WHERE ttl < $1", t)
+	if err != nil {
+		return -1, fmt.Errorf("%s - failed to delete expired rate limits: %w", s.dbType, err)
+	}
+
+	_, err = s.Exec("DELETE from greylist WHERE ttl < $1", t)
+	if err != nil {
+		return -1, fmt.Errorf("%s - failed to delete expired greylist entries: %w", s.dbType, err)
+	}
+
+	_, err = s.Exec("DELETE from message_dedup WHERE ttl < $1", t)
+	if err != nil {
+		return -1, fmt.Errorf("%s - failed to delete expired message claims: %w", s.dbType, err)
+	}
+
+	return int(count), nil
+}
+
+// TakeToken takes a token from the rate limit bucket for key so that limits are shared between instances
+func (s *SQLDatabase) TakeToken(key string, l ratelimit.Limit, now time.Time) (bool, time.Duration, error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return false, 0, fmt.Errorf("%s - failed to begin rate limit transaction: %w", s.dbType, err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	query := "SELECT tokens, updated_at FROM rate_limit WHERE id = $1"
+	if s.dbType != "sqlite3" {
+		query += " FOR UPDATE"
+	}
+
+	var row struct {
+		Tokens    float64 `db:"tokens"`
+		UpdatedAt int64   `db:"updated_at"`
+	}
+
+	var b ratelimit.Bucket
+	err = tx.Get(&row, query, key)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return false, 0, fmt.Errorf("%s - failed to get rate limit bucket: %w", s.dbType, err)
+	default:
+		b = ratelimit.Bucket{Tokens: row.Tokens, Updated: time.Unix(0, row.UpdatedAt)}
+	}
+
+	allowed, wait := b.Take(l, now)
+
+	_, err = tx.Exec(
+		"INSERT INTO rate_limit (id, tokens, updated_at, ttl) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at, ttl = excluded.ttl",
+		key, b.Tokens, b.Updated.UnixNano(), b.FullAt(l).Unix()+1,
+	)
+	if err != nil {
+		return false, 0, fmt.Errorf("%s - failed to save rate limit bucket: %w", s.dbType, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, 0, fmt.Errorf("%s - failed to commit rate limit bucket: %w", s.dbType, err)
+	}
+
+	return allowed, wait, nil
+}
+
+// CheckGreylist checks the greylist entry for key so that greylisting is shared between instances
+func (s *SQLDatabase) CheckGreylist(key string, w greylist.Windows, now time.Time) (bool, time.Duration, error) {
+	tx, err := s.Beginx()
+	if err != nil {
+		return false, 0, fmt.Errorf("%s - failed to begin greylist transaction: %w", s.dbType, err)
+	}
+	defer tx.Rollback() // no-op once committed
+
+	query := "SELECT first_seen, passed_at FROM greylist WHERE id = $1"
+	if s.dbType != "sqlite3" {
+		query += " FOR UPDATE"
+	}
+
+	var row struct {
+		FirstSeen int64 `db:"first_seen"`
+		PassedAt  int64 `db:"passed_at"`
+	}
+
+	var e greylist.Entry
+	err = tx.Get(&row, query, key)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return false, 0, fmt.Errorf("%s - failed to get greylist entry: %w", s.dbType, err)
+	default:
+		e.FirstSeen = time.Unix(0, row.FirstSeen)
+		if row.PassedAt != 0 {
+			e.Passed = time.Unix(0, row.PassedAt)
+		}
+	}
+
+	allowed, wait := e.Check(w, now)
+
+	var passedAt int64
+	if !e.Passed.IsZero() {
+		passedAt = e.Passed.UnixNano()
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO greylist (id, first_seen, passed_at, ttl) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET first_seen = excluded.first_seen, passed_at = excluded.passed_at, ttl = excluded.ttl",
+		key, e.FirstSeen.UnixNano(), passedAt, e.ExpiresAt(w).Unix()+1,
+	)
+	if err != nil {
+		return false, 0, fmt.Errorf("%s - failed to save greylist entry: %w", s.dbType, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, 0, fmt.Errorf("%s - failed to commit greylist entry: %w", s.dbType, err)
+	}
+
+	return allowed, wait, nil
 }
@@ -1,6 +1,7 @@
 package sqlite3
 
 import (
+	"github.com/haydenwoodhead/burner.kiwi/burner"
 	"github.com/haydenwoodhead/burner.kiwi/data/sqldb"
 
 	_ "github.com/mattn/go-sqlite3" // import go-sqlite3 here rather than main
@@ -15,3 +16,11 @@ type SQLite3 struct {
 func GetSQLite3DB(dbURL string) *SQLite3 {
 	return &SQLite3{sqldb.New("sqlite3", dbURL)}
 }
+
+func init() {
+	burner.RegisterDatabase("sqlite3", []burner.Setting{
+		{Name: "DATABASE_URL", Description: "path of the sqlite3 database file", Required: true},
+	}, func(s burner.Settings) (burner.Database, error) {
+		return GetSQLite3DB(s.String("DATABASE_URL")), nil
+	})
+}
@@ -26,6 +26,8 @@ func TestSQLite3(t *testing.T) {
 	}
 
 	testTTLDelete(t, db)
+	data.TestRateLimitStore(t, db)
+	data.TestGreylistStore(t, db)
 
 	// remove test database
 	err = os.Remove("test.sqlite3")
@@ -61,3 +63,37 @@ func testTTLDelete(t *testing.T, db *SQLite3) {
 	_, err = db.GetInboxByID(i1.ID)
 	assert.Equal(t, sql.ErrNoRows, err)
 }
+
+func TestSQLite3_MigrateRouteIDs(t *testing.T) {
+	defer os.Remove("migrate.sqlite3")
+
+	// inbox table as created before route ids were kept per provider
+	db := GetSQLite3DB("migrate.sqlite3")
+	db.MustExec(`create table inbox (
+		id uuid not null unique,
+		address text not null unique,
+		created_at numeric,
+		created_by text,
+		ep_routeid text,
+		ttl numeric,
+		failed_to_create bool,
+		primary key (id)
+	)`)
+
+	ttl := time.Now().Add(time.Hour).Unix()
+	mailgunID := uuid.Must(uuid.NewRandom()).String()
+	smtpID := uuid.Must(uuid.NewRandom()).String()
+	db.MustExec("INSERT INTO inbox (id, address, created_at, created_by, ep_routeid, ttl, failed_to_create) VALUES ($1, 'mg@example.com', 0, '', '5f1a3e', $2, false)", mailgunID, ttl)
+	db.MustExec("INSERT INTO inbox (id, address, created_at, created_by, ep_routeid, ttl, failed_to_create) VALUES ($1, 'smtp@example.com', 0, '', 'smtp', $2, false)", smtpID, ttl)
+
+	err := db.Start()
+	require.NoError(t, err)
+
+	i, err := db.GetInboxByID(mailgunID)
+	require.NoError(t, err)
+	assert.Equal(t, burner.RouteIDs{"mailgun": "5f1a3e"}, i.EmailProviderRouteIDs)
+
+	i, err = db.GetInboxByID(smtpID)
+	require.NoError(t, err)
+	assert.Empty(t, i.EmailProviderRouteIDs)
+}
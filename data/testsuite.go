@@ -7,6 +7,8 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/greylist"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,22 +21,27 @@ var TestingFuncs = []TestFunction{
 	TestGetInboxByID,
 	TestGetInboxByAddress,
 	TestEmailAddressExists,
+	TestGetPatternInbox,
 	TestSetInboxCreated,
 	TestSaveNewMessage,
+	TestSaveNewMessageDuplicate,
 	TestGetMessageByID,
 	TestGetMessagesByInboxID,
+	TestGetInboxesWithMessages,
+	TestSetInboxAllowedSenders,
+	TestDeleteAllMessages, // must be last as it removes every message saved by the tests above
 }
 
 // TestSaveNewInbox verifies that SaveNewInbox works
 func TestSaveNewInbox(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.1@example.com",
-		ID:                   uuid.Must(uuid.NewRandom()).String(),
-		CreatedBy:            "192.168.1.1",
-		CreatedAt:            time.Now().Unix(),
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "-",
-		FailedToCreate:       true,
+		Address:               "test.1@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedBy:             "192.168.1.1",
+		CreatedAt:             time.Now().Unix(),
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        true,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -57,13 +64,13 @@ func TestSaveNewInbox(t *testing.T, db burner.Database) {
 // TestGetInboxByID verifies that GetInboxByID works
 func TestGetInboxByID(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.2@example.com",
-		ID:                   uuid.Must(uuid.NewRandom()).String(),
-		CreatedBy:            "192.168.1.1",
-		CreatedAt:            time.Now().Unix(),
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "-",
-		FailedToCreate:       true,
+		Address:               "test.2@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedBy:             "192.168.1.1",
+		CreatedAt:             time.Now().Unix(),
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        true,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -86,13 +93,13 @@ func TestGetInboxByID(t *testing.T, db burner.Database) {
 // TestGetInboxByID verifies that GetInboxByID works
 func TestGetInboxByAddress(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.8@example.com",
-		ID:                   uuid.Must(uuid.NewRandom()).String(),
-		CreatedBy:            "192.168.1.1",
-		CreatedAt:            time.Now().Unix(),
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "-",
-		FailedToCreate:       true,
+		Address:               "test.8@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedBy:             "192.168.1.1",
+		CreatedAt:             time.Now().Unix(),
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        true,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -115,13 +122,13 @@ func TestGetInboxByAddress(t *testing.T, db burner.Database) {
 // TestEmailAddressExists verifies that EmailAddressExists works
 func TestEmailAddressExists(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.3@example.com",
-		ID:                   uuid.Must(uuid.NewRandom()).String(),
-		CreatedAt:            time.Now().Unix(),
-		CreatedBy:            "192.168.1.1",
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "-",
-		FailedToCreate:       true,
+		Address:               "test.3@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        true,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -151,16 +158,52 @@ func TestEmailAddressExists(t *testing.T, db burner.Database) {
 	}
 }
 
+// TestGetPatternInbox verifies that GetPatternInbox finds the pattern inbox with the longest matching prefix
+func TestGetPatternInbox(t *testing.T, db burner.Database) {
+	var ids []string
+	for _, address := range []string{"pattern-*@example.com", "pattern-long-*@example.com"} {
+		i := burner.Inbox{
+			Address:               address,
+			ID:                    uuid.Must(uuid.NewRandom()).String(),
+			CreatedAt:             time.Now().Unix(),
+			CreatedBy:             "192.168.1.1",
+			TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+			EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		}
+
+		err := db.SaveNewInbox(i)
+		assert.NoError(t, err, "%v - TestGetPatternInbox: failed to save", reflect.TypeOf(db))
+		ids = append(ids, i.ID)
+	}
+
+	tests := []struct {
+		Address  string
+		ExpectID string
+	}{
+		{"pattern-1234@example.com", ids[0]},
+		{"Pattern-Long-1234@example.com", ids[1]},
+		{"pattern-1234@example.org", ""},
+		{"patter@example.com", ""},
+	}
+
+	for _, test := range tests {
+		i, ok, err := db.GetPatternInbox(test.Address)
+		assert.NoError(t, err, "%v - TestGetPatternInbox: %v", reflect.TypeOf(db), test.Address)
+		assert.Equal(t, test.ExpectID != "", ok, "%v - TestGetPatternInbox: %v", reflect.TypeOf(db), test.Address)
+		assert.Equal(t, test.ExpectID, i.ID, "%v - TestGetPatternInbox: %v", reflect.TypeOf(db), test.Address)
+	}
+}
+
 //TestSetInboxCreated verifies that SetInboxCreated works
 func TestSetInboxCreated(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.4@example.com",
-		ID:                   uuid.Must(uuid.NewRandom()).String(),
-		CreatedAt:            time.Now().Unix(),
-		CreatedBy:            "192.168.1.1",
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "-",
-		FailedToCreate:       true,
+		Address:               "test.4@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        true,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -169,7 +212,7 @@ func TestSetInboxCreated(t *testing.T, db burner.Database) {
 		t.Errorf("%v - TestSetInboxCreated: failed to save: %v", reflect.TypeOf(db), err)
 	}
 
-	i.EmailProviderRouteID = "mg12345"
+	i.EmailProviderRouteIDs = burner.RouteIDs{"mailgun": "mg12345", "smtp": "smtp"}
 
 	err = db.SetInboxCreated(i)
 
@@ -183,8 +226,8 @@ func TestSetInboxCreated(t *testing.T, db burner.Database) {
 		t.Errorf("%v - TestSetInboxCreated: failed to get inbox back: %v", reflect.TypeOf(db), err)
 	}
 
-	if ret.EmailProviderRouteID != i.EmailProviderRouteID {
-		t.Errorf("%v - TestSetInboxCreated: mg route id not same. Expected %v, got %v", reflect.TypeOf(db), i.EmailProviderRouteID, ret.EmailProviderRouteID)
+	if !reflect.DeepEqual(ret.EmailProviderRouteIDs, i.EmailProviderRouteIDs) {
+		t.Errorf("%v - TestSetInboxCreated: route ids not same. Expected %v, got %v", reflect.TypeOf(db), i.EmailProviderRouteIDs, ret.EmailProviderRouteIDs)
 	}
 
 	if ret.FailedToCreate {
@@ -195,13 +238,13 @@ func TestSetInboxCreated(t *testing.T, db burner.Database) {
 //TestSaveNewMessage verifies that SaveNewMessage works
 func TestSaveNewMessage(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.5@example.com",
-		ID:                   uuid.Must(uuid.NewRandom()).String(),
-		CreatedAt:            time.Now().Unix(),
-		CreatedBy:            "192.168.1.1",
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "-",
-		FailedToCreate:       true,
+		Address:               "test.5@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        true,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -221,6 +264,23 @@ func TestSaveNewMessage(t *testing.T, db burner.Database) {
 		BodyPlain:       "Hello there how are you!",
 		BodyHTML:        "<html><body><p>Hello there how are you!</p></body></html>",
 		TTL:             time.Now().Add(5 * time.Minute).Unix(),
+		Subaddress:      "case42",
+		Recipient:       "test.5+case42@example.com",
+		Spam: &burner.SpamResult{
+			Score:     6.3,
+			Threshold: 5,
+			Rules:     []string{"HTML_MESSAGE", "URIBL_BLOCKED"},
+		},
+		Virus: &burner.VirusResult{
+			Infected:  true,
+			Signature: "Eicar-Test-Signature",
+		},
+		Reputation: &burner.ReputationResult{
+			Failures: []burner.ReputationFailure{{Check: "fcrdns", Reason: "no PTR record"}},
+		},
+		Attachments: &burner.AttachmentList{
+			Files: []burner.Attachment{{Filename: "invoice.pdf", ContentType: "application/pdf", Size: 10240}},
+		},
 	}
 
 	err = db.SaveNewMessage(m)
@@ -237,6 +297,98 @@ func TestSaveNewMessage(t *testing.T, db burner.Database) {
 	assert.Equal(t, m, ret, "%v - TestSaveNewMessage: saved message not the same as returned.", reflect.TypeOf(db))
 }
 
+//TestSaveNewMessageDuplicate verifies that SaveNewMessageOnce refuses redeliveries of a message to the same inbox within
+//burner.DuplicateWindow
+func TestSaveNewMessageDuplicate(t *testing.T, db burner.Database) {
+	i1 := burner.Inbox{
+		ID:      uuid.Must(uuid.NewRandom()).String(),
+		Address: "test.13@example.com",
+		TTL:     time.Now().Add(5 * time.Minute).Unix(),
+	}
+
+	i2 := burner.Inbox{
+		ID:      uuid.Must(uuid.NewRandom()).String(),
+		Address: "test.14@example.com",
+		TTL:     time.Now().Add(5 * time.Minute).Unix(),
+	}
+
+	for _, i := range []burner.Inbox{i1, i2} {
+		err := db.SaveNewInbox(i)
+		if err != nil {
+			t.Fatalf("%v - TestSaveNewMessageDuplicate: failed to insert new inbox: %v", reflect.TypeOf(db), err)
+		}
+	}
+
+	now := time.Now()
+
+	message := func(inboxID string, epID string, receivedAt time.Time) burner.Message {
+		return burner.Message{
+			InboxID:         inboxID,
+			ID:              uuid.Must(uuid.NewRandom()).String(),
+			ReceivedAt:      receivedAt.Unix(),
+			EmailProviderID: epID,
+			Subject:         "Hello there",
+			TTL:             now.Add(5 * time.Minute).Unix(),
+		}
+	}
+
+	tests := []struct {
+		Name        string
+		Message     burner.Message
+		ExpectedErr error
+	}{
+		{
+			Name:    "first delivery",
+			Message: message(i1.ID, "<1@example.com>", now.Add(-burner.DuplicateWindow)),
+		},
+		{
+			Name:        "redelivery within the window",
+			Message:     message(i1.ID, "<1@example.com>", now.Add(-burner.DuplicateWindow).Add(time.Minute)),
+			ExpectedErr: burner.ErrDuplicateMessage,
+		},
+		{
+			Name:    "redelivery after the window",
+			Message: message(i1.ID, "<1@example.com>", now),
+		},
+		{
+			Name:        "redelivery within the new window",
+			Message:     message(i1.ID, "<1@example.com>", now.Add(time.Minute)),
+			ExpectedErr: burner.ErrDuplicateMessage,
+		},
+		{
+			Name:    "same id to another inbox",
+			Message: message(i2.ID, "<1@example.com>", now),
+		},
+		{
+			Name:    "another id",
+			Message: message(i1.ID, "<2@example.com>", now),
+		},
+		{
+			Name:    "no id",
+			Message: message(i1.ID, "", now),
+		},
+		{
+			Name:    "no id again",
+			Message: message(i1.ID, "", now),
+		},
+	}
+
+	for _, test := range tests {
+		err := db.SaveNewMessageOnce(test.Message)
+		if err != test.ExpectedErr {
+			t.Errorf("%v - TestSaveNewMessageDuplicate - %v: expected error %v, got %v", reflect.TypeOf(db), test.Name, test.ExpectedErr, err)
+		}
+
+		_, err = db.GetMessageByID(test.Message.InboxID, test.Message.ID)
+		if test.ExpectedErr == nil && err != nil {
+			t.Errorf("%v - TestSaveNewMessageDuplicate - %v: failed to get back saved message: %v", reflect.TypeOf(db), test.Name, err)
+		}
+		if test.ExpectedErr != nil && err != burner.ErrMessageDoesntExist {
+			t.Errorf("%v - TestSaveNewMessageDuplicate - %v: duplicate was saved", reflect.TypeOf(db), test.Name)
+		}
+	}
+}
+
 //TestGetMessageByID verifies that GetMessageByID works
 func TestGetMessageByID(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
@@ -304,13 +456,13 @@ func TestGetMessageByID(t *testing.T, db burner.Database) {
 //nolint
 func TestGetMessagesByInboxID(t *testing.T, db burner.Database) {
 	i := burner.Inbox{
-		Address:              "test.7@example.com",
-		ID:                   "ddb9ec88-2c11-4731-a433-36a04661de83",
-		CreatedAt:            time.Now().Unix(),
-		CreatedBy:            "192.168.1.1",
-		TTL:                  time.Now().Add(5 * time.Minute).Unix(),
-		EmailProviderRouteID: "ddb9ec88-2c11-4731-a433-36a04661de83",
-		FailedToCreate:       false,
+		Address:               "test.7@example.com",
+		ID:                    "ddb9ec88-2c11-4731-a433-36a04661de83",
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"mailgun": "ddb9ec88-2c11-4731-a433-36a04661de83"},
+		FailedToCreate:        false,
 	}
 
 	err := db.SaveNewInbox(i)
@@ -373,3 +525,213 @@ func TestGetMessagesByInboxID(t *testing.T, db burner.Database) {
 		t.Errorf("%v - TestGetMessagesByInboxID: returned messages for a non existent key", reflect.TypeOf(db))
 	}
 }
+
+//TestGetInboxesWithMessages verifies that GetInboxesWithMessages only returns inboxes which have received mail
+func TestGetInboxesWithMessages(t *testing.T, db burner.Database) {
+	withMail := burner.Inbox{
+		Address:               "test.9@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+	}
+
+	withoutMail := burner.Inbox{
+		Address:               "test.10@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+	}
+
+	for _, i := range []burner.Inbox{withMail, withoutMail} {
+		err := db.SaveNewInbox(i)
+		if err != nil {
+			t.Fatalf("%v - TestGetInboxesWithMessages: failed to save inbox: %v", reflect.TypeOf(db), err)
+		}
+	}
+
+	err := db.SaveNewMessage(burner.Message{
+		InboxID:    withMail.ID,
+		ID:         uuid.Must(uuid.NewRandom()).String(),
+		ReceivedAt: time.Now().Unix(),
+		TTL:        withMail.TTL,
+	})
+	if err != nil {
+		t.Fatalf("%v - TestGetInboxesWithMessages: failed to save message: %v", reflect.TypeOf(db), err)
+	}
+
+	inboxes, err := db.GetInboxesWithMessages()
+	if err != nil {
+		t.Fatalf("%v - TestGetInboxesWithMessages: failed to get inboxes: %v", reflect.TypeOf(db), err)
+	}
+
+	assert.Contains(t, inboxes, withMail, "%v - TestGetInboxesWithMessages: inbox with mail missing", reflect.TypeOf(db))
+	assert.NotContains(t, inboxes, withoutMail, "%v - TestGetInboxesWithMessages: inbox without mail returned", reflect.TypeOf(db))
+}
+
+//TestSetInboxAllowedSenders verifies that allowed senders are saved and can be cleared
+func TestSetInboxAllowedSenders(t *testing.T, db burner.Database) {
+	i := burner.Inbox{
+		Address:               "test.12@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		AllowedSenders:        burner.SenderList{"example.org"},
+	}
+
+	err := db.SaveNewInbox(i)
+	if err != nil {
+		t.Fatalf("%v - TestSetInboxAllowedSenders: failed to save inbox: %v", reflect.TypeOf(db), err)
+	}
+
+	ri, err := db.GetInboxByID(i.ID)
+	if err != nil {
+		t.Fatalf("%v - TestSetInboxAllowedSenders: failed to get inbox: %v", reflect.TypeOf(db), err)
+	}
+	assert.Equal(t, i, ri, "%v - TestSetInboxAllowedSenders: inbox not the same after save", reflect.TypeOf(db))
+
+	for _, senders := range []burner.SenderList{{"bob@example.com", "example.net"}, nil} {
+		i.AllowedSenders = senders
+
+		err = db.SetInboxAllowedSenders(i)
+		if err != nil {
+			t.Fatalf("%v - TestSetInboxAllowedSenders: failed to set allowed senders: %v", reflect.TypeOf(db), err)
+		}
+
+		ri, err = db.GetInboxByAddress(i.Address)
+		if err != nil {
+			t.Fatalf("%v - TestSetInboxAllowedSenders: failed to get inbox: %v", reflect.TypeOf(db), err)
+		}
+		assert.Equal(t, i, ri, "%v - TestSetInboxAllowedSenders: allowed senders not updated", reflect.TypeOf(db))
+	}
+}
+
+//TestDeleteAllMessages verifies that DeleteAllMessages removes every message but leaves inboxes in place
+func TestDeleteAllMessages(t *testing.T, db burner.Database) {
+	i := burner.Inbox{
+		Address:               "test.11@example.com",
+		ID:                    uuid.Must(uuid.NewRandom()).String(),
+		CreatedAt:             time.Now().Unix(),
+		CreatedBy:             "192.168.1.1",
+		TTL:                   time.Now().Add(5 * time.Minute).Unix(),
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+	}
+
+	err := db.SaveNewInbox(i)
+	if err != nil {
+		t.Fatalf("%v - TestDeleteAllMessages: failed to save inbox: %v", reflect.TypeOf(db), err)
+	}
+
+	err = db.SaveNewMessage(burner.Message{
+		InboxID:    i.ID,
+		ID:         uuid.Must(uuid.NewRandom()).String(),
+		ReceivedAt: time.Now().Unix(),
+		TTL:        i.TTL,
+	})
+	if err != nil {
+		t.Fatalf("%v - TestDeleteAllMessages: failed to save message: %v", reflect.TypeOf(db), err)
+	}
+
+	err = db.DeleteAllMessages()
+	if err != nil {
+		t.Fatalf("%v - TestDeleteAllMessages: failed to delete messages: %v", reflect.TypeOf(db), err)
+	}
+
+	msgs, err := db.GetMessagesByInboxID(i.ID)
+	if err != nil {
+		t.Fatalf("%v - TestDeleteAllMessages: failed to get messages: %v", reflect.TypeOf(db), err)
+	}
+	assert.Empty(t, msgs, "%v - TestDeleteAllMessages: messages not deleted", reflect.TypeOf(db))
+
+	inboxes, err := db.GetInboxesWithMessages()
+	if err != nil {
+		t.Fatalf("%v - TestDeleteAllMessages: failed to get inboxes: %v", reflect.TypeOf(db), err)
+	}
+	assert.Empty(t, inboxes, "%v - TestDeleteAllMessages: inboxes still have messages", reflect.TypeOf(db))
+
+	exists, err := db.EmailAddressExists(i.Address)
+	if err != nil {
+		t.Fatalf("%v - TestDeleteAllMessages: failed to check inbox exists: %v", reflect.TypeOf(db), err)
+	}
+	assert.True(t, exists, "%v - TestDeleteAllMessages: inbox deleted", reflect.TypeOf(db))
+}
+
+// TestRateLimitStore verifies that a database shared rate limit store takes and refills tokens
+func TestRateLimitStore(t *testing.T, store ratelimit.Store) {
+	l := ratelimit.Limit{Count: 2, Period: time.Minute}
+	key := "test:" + uuid.Must(uuid.NewRandom()).String()
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		ok, _, err := store.TakeToken(key, l, now)
+		if err != nil {
+			t.Fatalf("%v - TestRateLimitStore: failed to take token: %v", reflect.TypeOf(store), err)
+		}
+		assert.True(t, ok, "%v - TestRateLimitStore: token %v not taken", reflect.TypeOf(store), i)
+	}
+
+	ok, wait, err := store.TakeToken(key, l, now)
+	if err != nil {
+		t.Fatalf("%v - TestRateLimitStore: failed to take token: %v", reflect.TypeOf(store), err)
+	}
+	assert.False(t, ok, "%v - TestRateLimitStore: token taken from empty bucket", reflect.TypeOf(store))
+	assert.Equal(t, 30*time.Second, wait.Round(time.Second), "%v - TestRateLimitStore: unexpected wait", reflect.TypeOf(store))
+
+	// other keys have their own bucket
+	ok, _, err = store.TakeToken(key+"-other", l, now)
+	if err != nil {
+		t.Fatalf("%v - TestRateLimitStore: failed to take token: %v", reflect.TypeOf(store), err)
+	}
+	assert.True(t, ok, "%v - TestRateLimitStore: token not taken from other bucket", reflect.TypeOf(store))
+
+	ok, _, err = store.TakeToken(key, l, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatalf("%v - TestRateLimitStore: failed to take token: %v", reflect.TypeOf(store), err)
+	}
+	assert.True(t, ok, "%v - TestRateLimitStore: token not taken after refill", reflect.TypeOf(store))
+}
+
+// TestGreylistStore verifies that a database shared greylist store delays and then accepts triplets
+func TestGreylistStore(t *testing.T, store greylist.Store) {
+	w := greylist.Windows{Delay: 5 * time.Minute, Whitelist: 24 * time.Hour}
+	key := "test:" + uuid.Must(uuid.NewRandom()).String()
+	now := time.Now()
+
+	ok, wait, err := store.CheckGreylist(key, w, now)
+	if err != nil {
+		t.Fatalf("%v - TestGreylistStore: failed to check greylist: %v", reflect.TypeOf(store), err)
+	}
+	assert.False(t, ok, "%v - TestGreylistStore: new triplet accepted", reflect.TypeOf(store))
+	assert.Equal(t, 5*time.Minute, wait, "%v - TestGreylistStore: unexpected wait", reflect.TypeOf(store))
+
+	ok, wait, err = store.CheckGreylist(key, w, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("%v - TestGreylistStore: failed to check greylist: %v", reflect.TypeOf(store), err)
+	}
+	assert.False(t, ok, "%v - TestGreylistStore: triplet accepted before delay", reflect.TypeOf(store))
+	assert.Equal(t, 4*time.Minute, wait, "%v - TestGreylistStore: unexpected wait", reflect.TypeOf(store))
+
+	ok, _, err = store.CheckGreylist(key, w, now.Add(5*time.Minute))
+	if err != nil {
+		t.Fatalf("%v - TestGreylistStore: failed to check greylist: %v", reflect.TypeOf(store), err)
+	}
+	assert.True(t, ok, "%v - TestGreylistStore: triplet not accepted after delay", reflect.TypeOf(store))
+
+	ok, _, err = store.CheckGreylist(key, w, now.Add(12*time.Hour))
+	if err != nil {
+		t.Fatalf("%v - TestGreylistStore: failed to check greylist: %v", reflect.TypeOf(store), err)
+	}
+	assert.True(t, ok, "%v - TestGreylistStore: whitelisted triplet not accepted", reflect.TypeOf(store))
+
+	// other keys are greylisted separately
+	ok, _, err = store.CheckGreylist(key+"-other", w, now.Add(12*time.Hour))
+	if err != nil {
+		t.Fatalf("%v - TestGreylistStore: failed to check greylist: %v", reflect.TypeOf(store), err)
+	}
+	assert.False(t, ok, "%v - TestGreylistStore: other triplet accepted", reflect.TypeOf(store))
+}
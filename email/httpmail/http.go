@@ -0,0 +1,295 @@
+package httpmail
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ burner.EmailProvider = &HTTPMail{}
+
+// DefaultMaxSize is the largest message accepted unless WithMaxSize is given
+const DefaultMaxSize = 25 * 1024 * 1024
+
+// maxSkew is how far the timestamp of a signed request may be from now
+const maxSkew = 5 * time.Minute
+
+// Headers describing a posted message. Recipients and sender may also be given as the recipient and sender query
+// parameters.
+const (
+	RecipientHeader = "X-Burner-Recipient"
+	SenderHeader    = "X-Burner-Sender"
+	TimestampHeader = "X-Burner-Timestamp"
+	SignatureHeader = "X-Burner-Signature"
+)
+
+// HTTPMail is an implementation of the EmailProvider interface which accepts raw messages posted to /http/incoming/.
+// It lets anything which can make an http request, such as an email worker or a procmail rule, deliver mail without
+// exposing an SMTP port.
+type HTTPMail struct {
+	deliverer           *inbound.Deliverer
+	secret              string
+	hmacKey             []byte
+	maxSize             int64
+	subaddressSeparator string
+	spamFilter          *spam.Filter
+	virusFilter         *virus.Filter
+	spool               burner.Spooler
+}
+
+// Option configures optional behaviour of HTTPMail
+type Option func(h *HTTPMail)
+
+// WithSecret accepts requests with an "Authorization: Bearer secret" header
+func WithSecret(secret string) Option {
+	return func(h *HTTPMail) {
+		h.secret = secret
+	}
+}
+
+// WithHMACKey accepts requests signed with key. The X-Burner-Signature header must be the hex encoded HMAC-SHA256 of
+// the X-Burner-Timestamp header, the comma separated recipients and the message, each separated by a newline. The
+// timestamp is in unix seconds and must be within five minutes of now.
+func WithHMACKey(key string) Option {
+	return func(h *HTTPMail) {
+		h.hmacKey = []byte(key)
+	}
+}
+
+// WithMaxSize refuses messages larger than size bytes
+func WithMaxSize(size int64) Option {
+	return func(h *HTTPMail) {
+		h.maxSize = size
+	}
+}
+
+// WithSubaddressSeparator delivers posted mail for subaddressed recipients, e.g. "user+detail@example.com", to the
+// inbox of their base address. The detail is kept on the message.
+func WithSubaddressSeparator(separator string) Option {
+	return func(h *HTTPMail) {
+		h.subaddressSeparator = separator
+	}
+}
+
+// WithSpamFilter scores each posted message with f, storing the result on the message. Mail f says to reject is
+// dropped but the post still gets a 204, the same as delivered mail.
+func WithSpamFilter(f *spam.Filter) Option {
+	return func(h *HTTPMail) {
+		h.spamFilter = f
+	}
+}
+
+// WithVirusFilter scans each posted message with f, storing the verdict on the message. As with WithSpamFilter mail
+// f says to reject is dropped without failing the post.
+func WithVirusFilter(f *virus.Filter) Option {
+	return func(h *HTTPMail) {
+		h.virusFilter = f
+	}
+}
+
+// WithSpool makes a post succeed once its message is written to sp, which saves it to the database in the background
+// and retries while the database is unavailable.
+func WithSpool(sp burner.Spooler) Option {
+	return func(h *HTTPMail) {
+		h.spool = sp
+	}
+}
+
+// NewMailProvider creates a new HTTP EmailProvider. At least one of WithSecret or WithHMACKey must be given,
+// otherwise every request is refused.
+func NewMailProvider(opts ...Option) *HTTPMail {
+	h := &HTTPMail{
+		maxSize: DefaultMaxSize,
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// Start implements EmailProvider Start()
+func (h *HTTPMail) Start(websiteAddr string, db burner.Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error {
+	h.deliverer = &inbound.Deliverer{
+		Provider:            "http",
+		DB:                  db,
+		CheckPolicy:         checkPolicy,
+		SubaddressSeparator: h.subaddressSeparator,
+		SpamFilter:          h.spamFilter,
+		VirusFilter:         h.virusFilter,
+		Spool:               h.spool,
+	}
+	r.HandleFunc("/http/incoming/", h.httpIncoming).Methods(http.MethodPost)
+	return nil
+}
+
+// Stop implements EmailProvider Stop(). There is nothing to stop, the spool is shared with other providers and stopped
+// by the caller.
+func (h *HTTPMail) Stop() error {
+	return nil
+}
+
+// RegisterRoute implements RegisterRoute(). Recipients are given with each request so there is nothing to register.
+func (h *HTTPMail) RegisterRoute(i burner.Inbox) (string, error) {
+	return "http", nil
+}
+
+// DeleteRoute implements DeleteRoute(). No route was registered so there is nothing to delete.
+func (h *HTTPMail) DeleteRoute(id string) error {
+	return nil
+}
+
+func (h *HTTPMail) httpIncoming(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.WithError(err).Error("HTTPIncoming: failed to read request")
+		http.Error(w, "failed to read message", http.StatusBadRequest)
+		return
+	}
+
+	recipients := values(r, RecipientHeader, "recipient")
+
+	if !h.authorized(r, recipients, raw) {
+		log.WithField("remote", r.RemoteAddr).Info("HTTPIncoming: unauthorized request")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if len(recipients) == 0 {
+		http.Error(w, "no recipients, set the "+RecipientHeader+" header or recipient query parameter", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := email.ParseMessage(raw)
+	if err != nil {
+		log.WithError(err).Info("HTTPIncoming: failed to parse message")
+		http.Error(w, "failed to parse message", http.StatusBadRequest)
+		return
+	}
+
+	header := headers(raw)
+
+	msg.EmailProviderID = strings.Trim(header.Get("Message-Id"), "<> ")
+	msg.Sender = sender(r, header, msg)
+
+	err = h.deliverer.Deliver(raw, msg, recipients)
+	if err != nil {
+		log.WithError(err).WithField("sender", msg.Sender).Error("HTTPIncoming: failed to deliver message")
+		http.Error(w, "failed to deliver message, try again later", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized reports whether r carries the shared secret or a valid signature
+func (h *HTTPMail) authorized(r *http.Request, recipients []string, raw []byte) bool {
+	if h.secret != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if hmac.Equal([]byte(token), []byte(h.secret)) {
+			return true
+		}
+	}
+
+	if len(h.hmacKey) > 0 {
+		return h.verifySignature(r, recipients, raw)
+	}
+
+	return false
+}
+
+// verifySignature reports whether r's signature is valid for its timestamp, recipients and message and its timestamp
+// is recent enough
+func (h *HTTPMail) verifySignature(r *http.Request, recipients []string, raw []byte) bool {
+	timestamp := r.Header.Get(TimestampHeader)
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	skew := time.Since(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return false
+	}
+
+	sig, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(sig, Sign(h.hmacKey, timestamp, recipients, raw))
+}
+
+// Sign returns the HMAC-SHA256 signature of a request with key
+func Sign(key []byte, timestamp string, recipients []string, raw []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + strings.Join(recipients, ",") + "\n"))
+	mac.Write(raw)
+	return mac.Sum(nil)
+}
+
+// values returns the comma separated values of header, or of the query parameter if the header isn't set
+func values(r *http.Request, header string, param string) []string {
+	vs := r.Header.Values(header)
+	if len(vs) == 0 {
+		vs = r.URL.Query()[param]
+	}
+
+	var out []string
+	for _, v := range vs {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+
+	return out
+}
+
+// sender returns the envelope sender given with r, or the Return-Path or From address of the message if it wasn't
+// given
+func sender(r *http.Request, header mail.Header, msg burner.Message) string {
+	if s := values(r, SenderHeader, "sender"); len(s) > 0 {
+		return s[0]
+	}
+
+	if s := strings.Trim(header.Get("Return-Path"), "<> "); s != "" {
+		return s
+	}
+
+	return msg.FromAddress
+}
+
+// headers returns the headers of raw. ParseMessage has already checked they parse.
+func headers(raw []byte) mail.Header {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return mail.Header{}
+	}
+	return m.Header
+}
@@ -0,0 +1,199 @@
+package httpmail
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/data/inmemory"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testRaw = "Return-Path: <bounce@example.org>\r\n" +
+	"From: Hayden Woodhead <hayden@example.com>\r\n" +
+	"To: bobby@example.com\r\n" +
+	"Subject: Gophers!\r\n" +
+	"Message-ID: <CAOQ4dq1h=4LdXfrfTbUJqJ2mCnGN2v6tUJ5wJ6rwMvq5BQT_Sw@mail.gmail.com>\r\n" +
+	"\r\n" +
+	"Hello there\r\n"
+
+func newTestHTTPMail(t *testing.T, opts ...Option) (*HTTPMail, *mux.Router) {
+	h := NewMailProvider(opts...)
+
+	r := mux.NewRouter()
+	err := h.Start("example.com", inmemory.GetInMemoryDB(), r, func(r policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	})
+	require.NoError(t, err)
+
+	for _, i := range []burner.Inbox{
+		{Address: "bobby@example.com", ID: "bobby", CreatedAt: time.Now().Unix(), TTL: time.Now().Add(1 * time.Hour).Unix()},
+		{Address: "alice@example.com", ID: "alice", CreatedAt: time.Now().Unix(), TTL: time.Now().Add(1 * time.Hour).Unix()},
+	} {
+		require.NoError(t, h.deliverer.DB.SaveNewInbox(i))
+	}
+
+	return h, r
+}
+
+func serve(r *mux.Router, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func messages(t *testing.T, h *HTTPMail, inboxID string) []burner.Message {
+	msgs, err := h.deliverer.DB.GetMessagesByInboxID(inboxID)
+	require.NoError(t, err)
+	return msgs
+}
+
+func TestHTTPMail_HTTPIncoming_Secret(t *testing.T) {
+	h, r := newTestHTTPMail(t, WithSecret("s3cret"))
+
+	req := httptest.NewRequest(http.MethodPost, "/http/incoming/", strings.NewReader(testRaw))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set(RecipientHeader, "bobby@example.com")
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	msgs := messages(t, h, "bobby")
+	require.Len(t, msgs, 1)
+
+	msg := msgs[0]
+	assert.Equal(t, "CAOQ4dq1h=4LdXfrfTbUJqJ2mCnGN2v6tUJ5wJ6rwMvq5BQT_Sw@mail.gmail.com", msg.EmailProviderID)
+	assert.Equal(t, "bounce@example.org", msg.Sender)
+	assert.Equal(t, "hayden@example.com", msg.FromAddress)
+	assert.Equal(t, "Hayden Woodhead", msg.FromName)
+	assert.Equal(t, "bobby@example.com", msg.Recipient)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, "Hello there", msg.BodyPlain)
+
+	assert.Empty(t, messages(t, h, "alice"))
+}
+
+func TestHTTPMail_HTTPIncoming_QueryParams(t *testing.T) {
+	h, r := newTestHTTPMail(t, WithSecret("s3cret"))
+
+	req := httptest.NewRequest(http.MethodPost, "/http/incoming/?recipient=bobby@example.com,alice@example.com&sender=ci@example.org", strings.NewReader(testRaw))
+	req.Header.Set("Authorization", "Bearer s3cret")
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	for _, id := range []string{"bobby", "alice"} {
+		msgs := messages(t, h, id)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "ci@example.org", msgs[0].Sender)
+	}
+}
+
+func TestHTTPMail_HTTPIncoming_HMAC(t *testing.T) {
+	key := []byte("hmac-key")
+	rcpts := []string{"bobby@example.com"}
+
+	sign := func(req *http.Request, ts time.Time, recipients []string) {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, hex.EncodeToString(Sign(key, timestamp, recipients, []byte(testRaw))))
+	}
+
+	tests := []struct {
+		name string
+		ts   time.Time
+		rcpt []string
+		code int
+	}{
+		{name: "valid", ts: time.Now(), rcpt: rcpts, code: http.StatusNoContent},
+		{name: "stale", ts: time.Now().Add(-10 * time.Minute), rcpt: rcpts, code: http.StatusUnauthorized},
+		{name: "future", ts: time.Now().Add(10 * time.Minute), rcpt: rcpts, code: http.StatusUnauthorized},
+		{name: "recipient changed", ts: time.Now(), rcpt: []string{"alice@example.com"}, code: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, r := newTestHTTPMail(t, WithHMACKey(string(key)))
+
+			req := httptest.NewRequest(http.MethodPost, "/http/incoming/", strings.NewReader(testRaw))
+			req.Header.Set(RecipientHeader, "bobby@example.com")
+			sign(req, test.ts, test.rcpt)
+
+			w := serve(r, req)
+			assert.Equal(t, test.code, w.Code)
+		})
+	}
+}
+
+func TestHTTPMail_HTTPIncoming_Refused(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		target string
+		auth   string
+		body   string
+		code   int
+	}{
+		{name: "unconfigured", target: "/http/incoming/?recipient=bobby@example.com", auth: "Bearer ", body: testRaw, code: http.StatusUnauthorized},
+		{name: "wrong secret", opts: []Option{WithSecret("s3cret")}, target: "/http/incoming/?recipient=bobby@example.com", auth: "Bearer guess", body: testRaw, code: http.StatusUnauthorized},
+		{name: "no recipients", opts: []Option{WithSecret("s3cret")}, target: "/http/incoming/", auth: "Bearer s3cret", body: testRaw, code: http.StatusBadRequest},
+		{name: "too large", opts: []Option{WithSecret("s3cret"), WithMaxSize(16)}, target: "/http/incoming/?recipient=bobby@example.com", auth: "Bearer s3cret", body: testRaw, code: http.StatusRequestEntityTooLarge},
+		{name: "not a message", opts: []Option{WithSecret("s3cret")}, target: "/http/incoming/?recipient=bobby@example.com", auth: "Bearer s3cret", body: "not a message", code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, r := newTestHTTPMail(t, test.opts...)
+
+			req := httptest.NewRequest(http.MethodPost, test.target, strings.NewReader(test.body))
+			req.Header.Set("Authorization", test.auth)
+
+			w := serve(r, req)
+			assert.Equal(t, test.code, w.Code)
+			assert.Empty(t, messages(t, h, "bobby"))
+		})
+	}
+}
+
+func TestHTTPMail_Stop_SharedSpool(t *testing.T) {
+	db := inmemory.GetInMemoryDB()
+	require.NoError(t, db.SaveNewInbox(burner.Inbox{Address: "bobby@example.com", ID: "bobby", CreatedAt: time.Now().Unix(), TTL: time.Now().Add(1 * time.Hour).Unix()}))
+
+	sp, err := spool.Open(t.TempDir(), db)
+	require.NoError(t, err)
+	defer sp.Stop()
+
+	allowAll := func(r policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	}
+
+	first := NewMailProvider(WithSecret("s3cret"), WithSpool(sp))
+	require.NoError(t, first.Start("example.com", db, mux.NewRouter(), allowAll))
+
+	second := NewMailProvider(WithSecret("s3cret"), WithSpool(sp))
+	r := mux.NewRouter()
+	require.NoError(t, second.Start("example.com", db, r, allowAll))
+
+	// the spool is shared so stopping one provider mustn't stop it delivering mail accepted by the other
+	require.NoError(t, first.Stop())
+
+	req := httptest.NewRequest(http.MethodPost, "/http/incoming/?recipient=bobby@example.com", strings.NewReader(testRaw))
+	req.Header.Set("Authorization", "Bearer s3cret")
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	require.Eventually(t, func() bool {
+		msgs, err := db.GetMessagesByInboxID("bobby")
+		return err == nil && len(msgs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
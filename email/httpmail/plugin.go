@@ -0,0 +1,58 @@
+package httpmail
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+)
+
+func init() {
+	burner.RegisterEmailProvider("http", inbound.WithSettings(
+		burner.Setting{Name: "HTTP_SECRET", Description: "bearer token requests must carry"},
+		burner.Setting{Name: "HTTP_HMAC_KEY", Description: "key requests must be signed with"},
+		burner.Setting{Name: "HTTP_MAX_SIZE", Description: "largest message accepted in bytes", Default: strconv.Itoa(DefaultMaxSize)},
+	), newFromSettings)
+}
+
+func newFromSettings(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+	secret, key := s.String("HTTP_SECRET"), s.String("HTTP_HMAC_KEY")
+
+	if secret == "" && key == "" {
+		return nil, errors.New("env var HTTP_SECRET or HTTP_HMAC_KEY cannot be empty")
+	}
+
+	maxSize, err := s.Int("HTTP_MAX_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	spamFilter, err := inbound.SpamFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	virusFilter, err := inbound.VirusFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithMaxSize(int64(maxSize)),
+		WithSpool(c.Spool),
+		WithSubaddressSeparator(s.String("SUBADDRESS_SEPARATOR")),
+		WithSpamFilter(spamFilter),
+		WithVirusFilter(virusFilter),
+	}
+
+	if secret != "" {
+		opts = append(opts, WithSecret(secret))
+	}
+
+	if key != "" {
+		opts = append(opts, WithHMACKey(key))
+	}
+
+	return NewMailProvider(opts...), nil
+}
@@ -0,0 +1,37 @@
+package inbound
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Credentials authenticate webhook posts. A post is accepted if it carries the basic auth username and password or
+// its route's {secret} variable matches the secret. Posts are refused when neither is set.
+type Credentials struct {
+	Username string
+	Password string
+	Secret   string
+}
+
+// Authorized reports whether r carries valid credentials
+func (c Credentials) Authorized(r *http.Request) bool {
+	if c.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if ok && equal(username, c.Username) && equal(password, c.Password) {
+			return true
+		}
+	}
+
+	if c.Secret != "" && equal(mux.Vars(r)["secret"], c.Secret) {
+		return true
+	}
+
+	return false
+}
+
+// equal compares a and b in constant time
+func equal(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
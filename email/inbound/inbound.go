@@ -0,0 +1,182 @@
+// Package inbound delivers mail posted to us by services which have already accepted it, such as SES or SendGrid,
+// into inboxes. These services give us the envelope along with the message so recipients are resolved the same way
+// as by the SMTP server, but mail which is refused can only be dropped as there is no sender waiting to bounce it.
+package inbound
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email"
+	"github.com/haydenwoodhead/burner.kiwi/metrics"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Deliverer delivers messages to the inboxes of their recipients
+type Deliverer struct {
+	// Provider names the provider in logs and metrics
+	Provider            string
+	DB                  burner.Database
+	CheckPolicy         func(policy.Request) policy.Decision
+	SubaddressSeparator string
+	SpamFilter          *spam.Filter
+	VirusFilter         *virus.Filter
+	Spool               burner.Spooler
+}
+
+// recipient is an inbox mail is being delivered to. original is the address the mail was sent to which differs from
+// the inbox address when subaddressing or pattern inboxes are used.
+type recipient struct {
+	inbox      burner.Inbox
+	original   string
+	subaddress string
+}
+
+// Deliver saves a copy of partialMsg to the inbox of each of recipients which has one. partialMsg should have its
+// sender and content set. raw is the message as received, or rebuilt from its parts, for the spam and virus filters.
+// An error is only returned if delivery should be retried.
+func (d *Deliverer) Deliver(raw []byte, partialMsg burner.Message, recipients []string) error {
+	var rcpts []recipient
+
+	for _, to := range recipients {
+		decision := d.CheckPolicy(policy.Request{Sender: partialMsg.Sender, Recipient: to})
+		if !decision.Allowed {
+			log.WithFields(log.Fields{"provider": d.Provider, "sender": partialMsg.Sender, "reason": decision.Reason}).Info("Inbound: rejected mail by policy")
+			metrics.EmailsRejected.With(prometheus.Labels{"provider": d.Provider, "reason": "policy"}).Inc()
+			continue
+		}
+
+		rcpt, ok, err := d.resolveRecipient(to)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			log.WithFields(log.Fields{"provider": d.Provider, "recipient": to}).Info("Inbound: no inbox for recipient")
+			continue
+		}
+
+		if !rcpt.inbox.AcceptsSender(partialMsg.Sender) {
+			log.WithFields(log.Fields{"provider": d.Provider, "sender": partialMsg.Sender, "id": rcpt.inbox.ID}).Info("Inbound: rejected mail from sender not allowed by inbox")
+			metrics.EmailsRejected.With(prometheus.Labels{"provider": d.Provider, "reason": "inbox_allowed_senders"}).Inc()
+			continue
+		}
+
+		rcpts = append(rcpts, rcpt)
+	}
+
+	if len(rcpts) == 0 {
+		return nil
+	}
+
+	virusResult, reject := d.VirusFilter.Check(raw)
+	if reject {
+		log.WithFields(log.Fields{"provider": d.Provider, "sender": partialMsg.Sender, "signature": virusResult.Signature}).Info("Inbound: rejected message containing a virus")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": d.Provider, "reason": "virus"}).Inc()
+		return nil
+	}
+
+	spamResult, reject := d.SpamFilter.Check(raw)
+	if reject {
+		log.WithFields(log.Fields{"provider": d.Provider, "sender": partialMsg.Sender, "score": spamResult.Score}).Info("Inbound: rejected message as spam")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": d.Provider, "reason": "spam"}).Inc()
+		return nil
+	}
+
+	partialMsg.ReceivedAt = time.Now().Unix()
+	partialMsg.Spam = spamResult
+	partialMsg.Virus = virusResult
+
+	for _, rcpt := range rcpts {
+		msg := partialMsg
+		msg.ID = uuid.Must(uuid.NewRandom()).String()
+		msg.InboxID = rcpt.inbox.ID
+		msg.TTL = rcpt.inbox.TTL
+		msg.Subaddress = rcpt.subaddress
+		msg.Recipient = rcpt.original
+
+		err := d.save(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// save saves msg, or spools it if there is a spool. A duplicate of a message already saved is dropped.
+func (d *Deliverer) save(msg burner.Message) error {
+	if d.Spool != nil {
+		err := d.Spool.Add(msg)
+		if err != nil {
+			return fmt.Errorf("%s - failed to spool message: %w", d.Provider, err)
+		}
+		return nil
+	}
+
+	err := d.DB.SaveNewMessageOnce(msg)
+	if errors.Is(err, burner.ErrDuplicateMessage) {
+		log.WithFields(log.Fields{"provider": d.Provider, "id": msg.InboxID, "ep_id": msg.EmailProviderID}).Info("Inbound: dropped duplicate message")
+		metrics.EmailsDeduplicated.With(prometheus.Labels{"provider": d.Provider}).Inc()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s - failed to save message: %w", d.Provider, err)
+	}
+
+	metrics.EmailsReceived.Inc()
+
+	return nil
+}
+
+// resolveRecipient finds the inbox mail for address should be delivered to. An exact match is preferred, then the
+// base address of a subaddress and finally the pattern inbox with the longest matching prefix.
+func (d *Deliverer) resolveRecipient(address string) (recipient, bool, error) {
+	rcpt := recipient{original: address}
+
+	candidates := []string{address}
+	base, detail := email.SplitSubaddress(address, d.SubaddressSeparator)
+	if base != address {
+		candidates = append(candidates, base)
+	}
+
+	for _, c := range candidates {
+		exists, err := d.DB.EmailAddressExists(c)
+		if err != nil {
+			return recipient{}, false, fmt.Errorf("%s - failed to query if email exists: %w", d.Provider, err)
+		}
+
+		if !exists {
+			continue
+		}
+
+		rcpt.inbox, err = d.DB.GetInboxByAddress(c)
+		if err != nil {
+			return recipient{}, false, fmt.Errorf("%s - failed to get inbox: %w", d.Provider, err)
+		}
+
+		if c == base && base != address {
+			rcpt.subaddress = detail
+		}
+
+		return rcpt, true, nil
+	}
+
+	i, ok, err := d.DB.GetPatternInbox(address)
+	if err != nil {
+		return recipient{}, false, fmt.Errorf("%s - failed to get pattern inbox: %w", d.Provider, err)
+	}
+	if ok {
+		rcpt.inbox = i
+		return rcpt, true, nil
+	}
+
+	return recipient{}, false, nil
+}
@@ -0,0 +1,166 @@
+package inbound
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/data/inmemory"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliverer_Deliver(t *testing.T) {
+	db := inmemory.GetInMemoryDB()
+
+	d := &Deliverer{
+		Provider:            "test",
+		DB:                  db,
+		SubaddressSeparator: "+",
+		CheckPolicy: func(r policy.Request) policy.Decision {
+			if r.Recipient == "denied@example.com" {
+				return policy.Decision{Allowed: false, Reason: "test"}
+			}
+			return policy.Decision{Allowed: true}
+		},
+	}
+
+	for _, i := range []burner.Inbox{
+		{Address: "bobby@example.com", ID: "bobby", TTL: time.Now().Add(1 * time.Hour).Unix()},
+		{Address: "alice@example.com", ID: "alice", TTL: time.Now().Add(1 * time.Hour).Unix()},
+		{Address: "denied@example.com", ID: "denied", TTL: time.Now().Add(1 * time.Hour).Unix()},
+	} {
+		require.NoError(t, db.SaveNewInbox(i))
+	}
+
+	raw := []byte("From: hayden@example.com\r\nSubject: Hi\r\n\r\nHello")
+	msg := burner.Message{Sender: "hayden@example.com", Subject: "Hi", BodyPlain: "Hello"}
+
+	err := d.Deliver(raw, msg, []string{"bobby+news@example.com", "alice@example.com", "nobody@example.com", "denied@example.com"})
+	require.NoError(t, err)
+
+	msgs, err := db.GetMessagesByInboxID("bobby")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "news", msgs[0].Subaddress)
+	assert.Equal(t, "bobby+news@example.com", msgs[0].Recipient)
+	assert.Equal(t, "Hi", msgs[0].Subject)
+	assert.NotZero(t, msgs[0].ReceivedAt)
+
+	msgs, err = db.GetMessagesByInboxID("alice")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "alice@example.com", msgs[0].Recipient)
+	assert.Empty(t, msgs[0].Subaddress)
+
+	msgs, err = db.GetMessagesByInboxID("denied")
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestDeliverer_Deliver_Pattern(t *testing.T) {
+	db := inmemory.GetInMemoryDB()
+	d := &Deliverer{Provider: "test", DB: db, CheckPolicy: func(policy.Request) policy.Decision { return policy.Decision{Allowed: true} }}
+
+	require.NoError(t, db.SaveNewInbox(burner.Inbox{Address: "ci-build-*@example.com", ID: "ci", TTL: time.Now().Add(1 * time.Hour).Unix()}))
+
+	raw := []byte("From: hayden@example.com\r\nSubject: Hi\r\n\r\nHello")
+	msg := burner.Message{Sender: "hayden@example.com", Subject: "Hi", BodyPlain: "Hello"}
+
+	err := d.Deliver(raw, msg, []string{"ci-build-42@example.com", "ci-test-42@example.com"})
+	require.NoError(t, err)
+
+	msgs, err := db.GetMessagesByInboxID("ci")
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "ci-build-42@example.com", msgs[0].Recipient)
+}
+
+func TestDeliverer_Deliver_AllowedSenders(t *testing.T) {
+	db := inmemory.GetInMemoryDB()
+
+	d := &Deliverer{
+		Provider: "test",
+		DB:       db,
+		CheckPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
+		},
+	}
+
+	require.NoError(t, db.SaveNewInbox(burner.Inbox{
+		Address:        "bobby@example.com",
+		ID:             "bobby",
+		TTL:            time.Now().Add(1 * time.Hour).Unix(),
+		AllowedSenders: []string{"friend@example.org"},
+	}))
+
+	err := d.Deliver([]byte("Subject: Hi\r\n\r\nHello"), burner.Message{Sender: "stranger@example.org"}, []string{"bobby@example.com"})
+	require.NoError(t, err)
+
+	msgs, err := db.GetMessagesByInboxID("bobby")
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestDeliverer_Deliver_Duplicate(t *testing.T) {
+	db := inmemory.GetInMemoryDB()
+
+	d := &Deliverer{
+		Provider:            "test",
+		DB:                  db,
+		SubaddressSeparator: "+",
+		CheckPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
+		},
+	}
+
+	require.NoError(t, db.SaveNewInbox(burner.Inbox{Address: "bobby@example.com", ID: "bobby", TTL: time.Now().Add(1 * time.Hour).Unix()}))
+
+	raw := []byte("From: hayden@example.com\r\nMessage-ID: <1@example.com>\r\nSubject: Hi\r\n\r\nHello")
+	msg := burner.Message{Sender: "hayden@example.com", Subject: "Hi", BodyPlain: "Hello", EmailProviderID: "1@example.com"}
+
+	// the provider retries after the first delivery timed out
+	require.NoError(t, d.Deliver(raw, msg, []string{"bobby@example.com"}))
+	require.NoError(t, d.Deliver(raw, msg, []string{"bobby@example.com"}))
+
+	// both recipients resolve to the same inbox
+	require.NoError(t, d.Deliver(raw, msg, []string{"bobby+a@example.com", "bobby+b@example.com"}))
+
+	msgs, err := db.GetMessagesByInboxID("bobby")
+	require.NoError(t, err)
+	assert.Len(t, msgs, 1)
+}
+
+func TestCredentials_Authorized(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/incoming/", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/incoming/{secret}/", func(w http.ResponseWriter, r *http.Request) {})
+
+	authorized := func(c Credentials, target string, user string, pass string) bool {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+
+		var match mux.RouteMatch
+		require.True(t, r.Match(req, &match))
+		req = mux.SetURLVars(req, match.Vars)
+
+		return c.Authorized(req)
+	}
+
+	c := Credentials{Username: "user", Password: "hunter2", Secret: "s3cret"}
+	assert.True(t, authorized(c, "/incoming/", "user", "hunter2"))
+	assert.True(t, authorized(c, "/incoming/s3cret/", "", ""))
+	assert.False(t, authorized(c, "/incoming/", "user", "hunter3"))
+	assert.False(t, authorized(c, "/incoming/guess/", "", ""))
+	assert.False(t, authorized(c, "/incoming/", "", ""))
+
+	// nothing configured refuses everything
+	assert.False(t, authorized(Credentials{}, "/incoming/", "", ""))
+	assert.False(t, authorized(Credentials{Password: "hunter2"}, "/incoming/", "", "hunter2"))
+}
@@ -0,0 +1,79 @@
+package inbound
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+)
+
+const spamdChecker = "spamd"
+const rspamdChecker = "rspamd"
+
+// Settings configure the subaddressing and filtering every email provider does. Providers add them to the settings
+// they register.
+var Settings = []burner.Setting{
+	{Name: "SUBADDRESS_SEPARATOR", Description: "separator of subaddressed mail e.g. +, disabled if empty"},
+	{Name: "SPAM_CHECK", Description: "spam checker to score mail with, spamd or rspamd"},
+	{Name: "SPAM_CHECK_ADDRESS", Description: "address of the spam checker"},
+	{Name: "RSPAMD_PASSWORD", Description: "password for the rspamd controller"},
+	{Name: "SPAM_REJECT_SCORE", Description: "score at which mail is rejected as spam"},
+	{Name: "CLAMD_ADDRESS", Description: "address of clamd to scan mail with, disabled if empty"},
+	{Name: "CLAMD_ACTION", Description: "what to do with infected mail, reject or flag", Default: string(virus.Reject)},
+}
+
+// WithSettings returns settings followed by the Settings shared by every email provider
+func WithSettings(settings ...burner.Setting) []burner.Setting {
+	return append(settings, Settings...)
+}
+
+// SpamFilter returns a filter for the spam checker configured by s or nil if spam checking is disabled
+func SpamFilter(s burner.Settings) (*spam.Filter, error) {
+	var checker spam.Checker
+
+	switch checkerType := s.String("SPAM_CHECK"); checkerType {
+	case "":
+		return nil, nil
+	case spamdChecker:
+		checker = spam.NewSpamd(stringWithDefault(s, "SPAM_CHECK_ADDRESS", "localhost:783"))
+	case rspamdChecker:
+		checker = spam.NewRspamd(stringWithDefault(s, "SPAM_CHECK_ADDRESS", "http://localhost:11333"), s.String("RSPAMD_PASSWORD"))
+	default:
+		return nil, fmt.Errorf("env var SPAM_CHECK is invalid: must be one of %v or %v", spamdChecker, rspamdChecker)
+	}
+
+	var opts []spam.FilterOption
+	if score := s.String("SPAM_REJECT_SCORE"); score != "" {
+		f, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return nil, fmt.Errorf("env var SPAM_REJECT_SCORE is invalid: %w", err)
+		}
+		opts = append(opts, spam.WithRejectScore(f))
+	}
+
+	return spam.NewFilter(checker, opts...), nil
+}
+
+// VirusFilter returns a filter which scans mail with the clamd configured by s or nil if virus scanning is disabled
+func VirusFilter(s burner.Settings) (*virus.Filter, error) {
+	addr := s.String("CLAMD_ADDRESS")
+	if addr == "" {
+		return nil, nil
+	}
+
+	action, err := virus.ParseAction(s.String("CLAMD_ACTION"))
+	if err != nil {
+		return nil, fmt.Errorf("env var CLAMD_ACTION is invalid: %w", err)
+	}
+
+	return virus.NewFilter(virus.NewClamd(addr), action), nil
+}
+
+func stringWithDefault(s burner.Settings, name string, def string) string {
+	if v := s.String(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,44 @@
+package inbound
+
+import (
+	"testing"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func settings(t *testing.T, env map[string]string) burner.Settings {
+	s, err := burner.NewSettings(Settings, func(key string) string { return env[key] })
+	require.NoError(t, err)
+	return s
+}
+
+func TestSpamFilter(t *testing.T) {
+	f, err := SpamFilter(settings(t, nil))
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	f, err = SpamFilter(settings(t, map[string]string{"SPAM_CHECK": "rspamd", "SPAM_REJECT_SCORE": "12.5"}))
+	assert.NoError(t, err)
+	assert.NotNil(t, f)
+
+	_, err = SpamFilter(settings(t, map[string]string{"SPAM_CHECK": "spamassassin"}))
+	assert.EqualError(t, err, "env var SPAM_CHECK is invalid: must be one of spamd or rspamd")
+
+	_, err = SpamFilter(settings(t, map[string]string{"SPAM_CHECK": "spamd", "SPAM_REJECT_SCORE": "high"}))
+	assert.Error(t, err)
+}
+
+func TestVirusFilter(t *testing.T) {
+	f, err := VirusFilter(settings(t, nil))
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	f, err = VirusFilter(settings(t, map[string]string{"CLAMD_ADDRESS": "localhost:3310"}))
+	assert.NoError(t, err)
+	assert.NotNil(t, f)
+
+	_, err = VirusFilter(settings(t, map[string]string{"CLAMD_ADDRESS": "localhost:3310", "CLAMD_ACTION": "ignore"}))
+	assert.Error(t, err)
+}
@@ -1,23 +1,39 @@
 package mailgunmail
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/mail"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
 	"github.com/haydenwoodhead/burner.kiwi/email"
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
 	"github.com/haydenwoodhead/burner.kiwi/metrics"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	mailgun "gopkg.in/mailgun/mailgun-go.v1"
 )
 
 var _ burner.EmailProvider = &MailgunMail{}
 
+// routesPageSize is the number of routes fetched at a time, the most mailgun allows
+const routesPageSize = 1000
+
+// janitorInterval is how often routes of expired inboxes are deleted
+const janitorInterval = 1 * time.Hour
+
 type mailgunAPI interface {
 	DeleteRoute(id string) error
 	GetRoutes(limit, skip int) (int, []mailgun.Route, error)
@@ -30,81 +46,241 @@ type MailgunMail struct {
 	websiteAddr         string
 	mg                  mailgunAPI
 	db                  burner.Database
-	isBlacklistedDomain func(string) bool
+	checkPolicy         func(policy.Request) policy.Decision
+	subaddressSeparator string
+	spamFilter          *spam.Filter
+	virusFilter         *virus.Filter
+	queue               *ingest.Queue
+	spool               burner.Spooler
+	rawMIME             bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Option configures optional behaviour of MailgunMail
+type Option func(m *MailgunMail)
+
+// WithSubaddressSeparator makes routes match subaddressed recipients, e.g. "user+detail@example.com", as well as
+// the inbox address itself. The detail is kept on the message.
+func WithSubaddressSeparator(separator string) Option {
+	return func(m *MailgunMail) {
+		m.subaddressSeparator = separator
+	}
+}
+
+// WithSpamFilter scores each message with f, storing the result on the message and answering mailgun with a 406 if f
+// says to reject it, which stops mailgun retrying. Unless WithRawMIME is set mailgun doesn't forward the original
+// message so it is rebuilt from the headers, bodies and attachments for scoring.
+func WithSpamFilter(f *spam.Filter) Option {
+	return func(m *MailgunMail) {
+		m.spamFilter = f
+	}
+}
+
+// WithVirusFilter scans each message with f, storing the verdict on the message and answering mailgun with a 406 if
+// f says to reject it. Like WithSpamFilter parsed messages are rebuilt, including their attachments, for scanning.
+func WithVirusFilter(f *virus.Filter) Option {
+	return func(m *MailgunMail) {
+		m.virusFilter = f
+	}
+}
+
+// WithIngestQueue saves accepted messages on q's workers rather than while mailgun waits. Mailgun is asked to retry
+// when q is full.
+func WithIngestQueue(q *ingest.Queue) Option {
+	return func(m *MailgunMail) {
+		m.queue = q
+	}
+}
+
+// WithSpool makes the webhook answer mailgun once a message is written to sp rather than saved to the database, so
+// a database outage doesn't leave mailgun retrying until it gives up.
+func WithSpool(sp burner.Spooler) Option {
+	return func(m *MailgunMail) {
+		m.spool = sp
+	}
+}
+
+// WithRawMIME makes routes forward the original message rather than the fields mailgun parses from it. The message is
+// then parsed the same way as mail received over SMTP and the spam and virus filters check the original. Routes
+// registered before this was set keep forwarding parsed fields, which are still accepted.
+func WithRawMIME() Option {
+	return func(m *MailgunMail) {
+		m.rawMIME = true
+	}
 }
 
 // NewMailProvider creates a new Mailgun EmailProvider
-func NewMailProvider(domain string, key string) *MailgunMail {
-	return &MailgunMail{
+func NewMailProvider(domain string, key string, opts ...Option) *MailgunMail {
+	m := &MailgunMail{
 		mg: mailgun.NewMailgun(domain, key, ""),
 	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
 }
 
 // Start implements EmailProvider Start()
-func (m *MailgunMail) Start(websiteAddr string, db burner.Database, r *mux.Router, isBlacklistedDomain func(string) bool) error {
+func (m *MailgunMail) Start(websiteAddr string, db burner.Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error {
 	m.db = db
-	m.isBlacklistedDomain = isBlacklistedDomain
+	m.checkPolicy = checkPolicy
 	m.websiteAddr = websiteAddr
 	r.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming).Methods(http.MethodPost)
+	// mailgun posts the original message to forwarding urls ending in mime
+	r.HandleFunc("/mg/incoming/{inboxID}/mime", m.mailgunIncoming).Methods(http.MethodPost)
 
-	go func() {
-		for {
-			log.Info("Mailgun: deleting expired routes")
-			err := m.deleteExpiredRoutes()
-			if err != nil {
-				log.WithError(err).Error("Mailgun: failed to delete expired routes")
-			}
-			log.Info("Mailgun: deleted expired routes")
-			time.Sleep(1 * time.Hour)
-		}
-	}()
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.runJanitor()
 
 	return nil
 }
 
-// Stop implements EmailProvider Stop()
+// Stop implements EmailProvider Stop(). It stops deleting expired routes. The ingest queue and spool are shared with
+// other providers so they are left for the caller to stop once every provider has stopped.
 func (m *MailgunMail) Stop() error {
+	if m.stop != nil {
+		close(m.stop)
+		<-m.done
+		m.stop = nil
+	}
+
 	return nil
 }
 
+// runJanitor deletes the routes of expired inboxes every janitorInterval until stopped. Routes are removed when their
+// inbox is deleted or expires, this catches those which weren't, e.g. inboxes expired by DynamoDB's TTL.
+func (m *MailgunMail) runJanitor() {
+	defer close(m.done)
+
+	t := time.NewTicker(janitorInterval)
+	defer t.Stop()
+
+	for {
+		log.Info("Mailgun: deleting expired routes")
+		err := m.deleteExpiredRoutes()
+		if err != nil {
+			log.WithError(err).Error("Mailgun: failed to delete expired routes")
+		} else {
+			log.Info("Mailgun: deleted expired routes")
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// stopping reports whether Stop has been called so a sweep can finish early
+func (m *MailgunMail) stopping() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
 // RegisterRoute implements RegisterRoute()
 func (m *MailgunMail) RegisterRoute(i burner.Inbox) (string, error) {
 	routeAddr := m.websiteAddr + "/mg/incoming/" + i.ID + "/"
+	if m.rawMIME {
+		routeAddr += "mime"
+	}
 	route, err := m.mg.CreateRoute(mailgun.Route{
 		Priority:    1,
 		Description: strconv.Itoa(int(i.TTL)),
-		Expression:  "match_recipient(\"" + i.Address + "\")",
+		Expression:  m.routeExpression(i),
 		Actions:     []string{"forward(\"" + routeAddr + "\")", "store()", "stop()"},
 	})
-	return route.ID, fmt.Errorf("Mailgun - failed to create route: %w", err)
+	if err != nil {
+		return "", fmt.Errorf("Mailgun - failed to create route: %w", err)
+	}
+	return route.ID, nil
 }
 
+// DeleteRoute implements DeleteRoute(). A route which has already been deleted isn't an error.
+func (m *MailgunMail) DeleteRoute(id string) error {
+	err := m.mg.DeleteRoute(id)
+	if err != nil && mailgun.GetStatusFromErr(err) != http.StatusNotFound {
+		return fmt.Errorf("Mailgun - failed to delete route: %w", err)
+	}
+	return nil
+}
+
+// routeExpression returns the mailgun filter expression matching mail for the inbox
+func (m *MailgunMail) routeExpression(i burner.Inbox) string {
+	if i.IsPattern() {
+		prefix, domain := i.PatternPrefix()
+		return "match_recipient(\"^" + regexp.QuoteMeta(prefix) + ".*@" + regexp.QuoteMeta(domain) + "$\")"
+	}
+
+	if m.subaddressSeparator == "" {
+		return "match_recipient(\"" + i.Address + "\")"
+	}
+
+	at := strings.LastIndex(i.Address, "@")
+	local, domain := i.Address[:at], i.Address[at:]
+
+	return "match_recipient(\"^" + regexp.QuoteMeta(local) + "(" + regexp.QuoteMeta(m.subaddressSeparator) + ".*)?" + regexp.QuoteMeta(domain) + "$\")"
+}
+
+// deleteExpiredRoutes deletes every route whose inbox has expired. Routes are deleted once they have all been listed
+// as deleting them while paging would shift those not yet seen into pages already fetched.
 func (m *MailgunMail) deleteExpiredRoutes() error {
-	_, routes, err := m.mg.GetRoutes(1000, 0)
+	expired, err := m.expiredRoutes(time.Now())
 	if err != nil {
-		return fmt.Errorf("Mailgun - failed to get routes to delete: %w", err)
+		return err
 	}
 
-	for _, r := range routes {
-		tInt, err := strconv.ParseInt(r.Description, 10, 64)
+	for _, id := range expired {
+		if m.stopping() {
+			return nil
+		}
+
+		err := m.DeleteRoute(id)
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{"desc": r.Description, "id": r.ID}).Error("Mailgun.deleteExpiredRoutes: failed to parse route description as int")
+			log.WithError(err).WithField("id", id).Error("Mailgun.deleteExpiredRoutes: failed to delete route")
 			continue
 		}
+	}
 
-		t := time.Unix(tInt, 0)
+	return nil
+}
+
+// expiredRoutes pages through every route returning the ids of those whose ttl (expiration time) is before now
+func (m *MailgunMail) expiredRoutes(now time.Time) ([]string, error) {
+	var expired []string
+
+	for skip := 0; ; {
+		total, routes, err := m.mg.GetRoutes(routesPageSize, skip)
+		if err != nil {
+			return nil, fmt.Errorf("Mailgun - failed to get routes to delete: %w", err)
+		}
 
-		// if our route's ttl (expiration time) is before now... then delete it
-		if t.Before(time.Now()) {
-			err := m.mg.DeleteRoute(r.ID)
+		for _, r := range routes {
+			tInt, err := strconv.ParseInt(r.Description, 10, 64)
 			if err != nil {
-				log.WithError(err).WithField("id", r.ID).Error("Mailgun.deleteExpiredRoutes: failed to delete route")
+				log.WithError(err).WithFields(log.Fields{"desc": r.Description, "id": r.ID}).Error("Mailgun.deleteExpiredRoutes: failed to parse route description as int")
 				continue
 			}
+
+			if time.Unix(tInt, 0).Before(now) {
+				expired = append(expired, r.ID)
+			}
 		}
-	}
 
-	return nil
+		skip += len(routes)
+		if len(routes) == 0 || skip >= total || m.stopping() {
+			return expired, nil
+		}
+	}
 }
 
 func (m *MailgunMail) mailgunIncoming(w http.ResponseWriter, r *http.Request) {
@@ -121,7 +297,16 @@ func (m *MailgunMail) mailgunIncoming(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if m.isBlacklistedDomain(r.FormValue("sender")) {
+	// verifying parsed the form, attachments beyond what fits in memory are in temporary files
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+
+	// mailgun doesn't tell us the ip of the sending server so ip rules never match here
+	decision := m.checkPolicy(policy.Request{Sender: r.FormValue("sender"), Recipient: r.FormValue("recipient")})
+	if !decision.Allowed {
+		log.WithFields(log.Fields{"sender": r.FormValue("sender"), "reason": decision.Reason}).Info("MailgunIncoming: rejected mail by policy")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "mailgun", "reason": "policy"}).Inc()
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
@@ -136,43 +321,70 @@ func (m *MailgunMail) mailgunIncoming(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	address, err := mail.ParseAddress(r.FormValue("from"))
+	if !inbox.AcceptsSender(r.FormValue("sender")) {
+		log.WithFields(log.Fields{"sender": r.FormValue("sender"), "id": id}).Info("MailgunIncoming: rejected mail from sender not allowed by inbox")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "mailgun", "reason": "inbox_allowed_senders"}).Inc()
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	raw, msg, err := message(r)
 	if err != nil {
-		log.WithError(err).WithField("id", id).Error("MailgunIncoming: failed to parse from address")
+		// mailgun retries on any status other than 200 and 406, which won't help
+		log.WithError(err).WithField("id", id).Error("MailgunIncoming: failed to parse message")
 		return
 	}
 
-	msg := burner.Message{
-		ID:              uuid.Must(uuid.NewRandom()).String(),
-		InboxID:         inbox.ID,
-		TTL:             inbox.TTL,
-		ReceivedAt:      time.Now().Unix(),
-		EmailProviderID: r.FormValue("message-id"),
-		Sender:          r.FormValue("sender"),
-		FromName:        address.Name,
-		FromAddress:     address.Address,
-		Subject:         r.FormValue("subject"),
-		BodyPlain:       r.FormValue("body-plain"),
+	virusResult, reject := m.virusFilter.Check(raw)
+	if reject {
+		log.WithFields(log.Fields{"sender": r.FormValue("sender"), "id": id, "signature": virusResult.Signature}).Info("MailgunIncoming: rejected message containing a virus")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "mailgun", "reason": "virus"}).Inc()
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
 	}
 
-	html := r.FormValue("body-html")
+	spamResult, reject := m.spamFilter.Check(raw)
+	if reject {
+		log.WithFields(log.Fields{"sender": r.FormValue("sender"), "id": id, "score": spamResult.Score}).Info("MailgunIncoming: rejected message as spam")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "mailgun", "reason": "spam"}).Inc()
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
 
-	// Check to see if there is anything in html before we modify it. Otherwise we end up setting a blank html doc
-	// on all plaintext emails preventing them from being displayed.
-	if html != "" {
-		modifiedHTML, err := email.AddTargetBlank(html)
+	msg.ID = uuid.Must(uuid.NewRandom()).String()
+	msg.InboxID = inbox.ID
+	msg.TTL = inbox.TTL
+	msg.ReceivedAt = time.Now().Unix()
+	msg.Sender = r.FormValue("sender")
+	msg.Recipient = r.FormValue("recipient")
+	msg.Spam = spamResult
+	msg.Virus = virusResult
+
+	if base, detail := email.SplitSubaddress(r.FormValue("recipient"), m.subaddressSeparator); strings.EqualFold(base, inbox.Address) {
+		msg.Subaddress = detail
+	}
+
+	if m.queue != nil {
+		err = m.queue.Submit(func() {
+			err := m.save(msg)
+			if err != nil {
+				log.WithError(err).WithField("id", id).Error("MailgunIncoming: failed to save queued message")
+			}
+		})
 		if err != nil {
-			log.WithError(err).Error("MailgunIncoming: failed to AddTargetBlank")
+			// mailgun retries on any status other than 200 and 406
+			log.WithError(err).WithField("id", id).Info("MailgunIncoming: failed to queue message")
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		err = m.save(msg)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Error("MailgunIncoming: failed to save message")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
-		msg.BodyHTML = modifiedHTML
-	}
-
-	err = m.db.SaveNewMessage(msg)
-	if err != nil {
-		log.WithError(err).Error("MailgunIncoming: failed to save message to db")
 	}
 
 	_, err = w.Write([]byte(id))
@@ -181,6 +393,146 @@ func (m *MailgunMail) mailgunIncoming(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
+
+// save saves msg, or spools it if there is a spool. A duplicate of a message already saved, e.g. because mailgun
+// retried a post which timed out, is dropped.
+func (m *MailgunMail) save(msg burner.Message) error {
+	if m.spool != nil {
+		err := m.spool.Add(msg)
+		if err != nil {
+			return fmt.Errorf("failed to spool message: %w", err)
+		}
+		return nil
+	}
+
+	err := m.db.SaveNewMessageOnce(msg)
+	if errors.Is(err, burner.ErrDuplicateMessage) {
+		log.WithFields(log.Fields{"id": msg.InboxID, "ep_id": msg.EmailProviderID}).Info("MailgunIncoming: dropped duplicate message")
+		metrics.EmailsDeduplicated.With(prometheus.Labels{"provider": "mailgun"}).Inc()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save message: %w", err)
+	}
 
 	metrics.EmailsReceived.Inc()
+
+	return nil
+}
+
+// message returns the message mailgun posted along with the raw message for the spam and virus filters. Routes
+// forwarding to a url ending in mime post the original message as body-mime. Otherwise mailgun posts the fields it
+// parsed from the message and its attachments, from which the message is rebuilt. Either way the message is keyed
+// on its Message-Id header for deduplication and only the names, types and sizes of attachments are kept.
+func message(r *http.Request) ([]byte, burner.Message, error) {
+	if body := r.FormValue("body-mime"); body != "" {
+		raw := []byte(body)
+
+		msg, err := email.ParseMessage(raw)
+		if err != nil {
+			return nil, burner.Message{}, err
+		}
+
+		msg.EmailProviderID = email.MessageID(raw)
+
+		return raw, msg, nil
+	}
+
+	address, err := mail.ParseAddress(r.FormValue("from"))
+	if err != nil {
+		return nil, burner.Message{}, fmt.Errorf("failed to parse from address: %w", err)
+	}
+
+	msg := burner.Message{
+		FromName:    address.Name,
+		FromAddress: address.Address,
+		Subject:     r.FormValue("subject"),
+		BodyPlain:   r.FormValue("body-plain"),
+	}
+
+	// Check to see if there is anything in html before we modify it. Otherwise we end up setting a blank html doc
+	// on all plaintext emails preventing them from being displayed.
+	if html := r.FormValue("body-html"); html != "" {
+		modifiedHTML, err := email.SanitizeHTML(html)
+		if err != nil {
+			return nil, burner.Message{}, fmt.Errorf("failed to sanitize html: %w", err)
+		}
+		msg.BodyHTML = modifiedHTML
+	}
+
+	files, err := attachments(r)
+	if err != nil {
+		return nil, burner.Message{}, err
+	}
+
+	for _, f := range files {
+		if msg.Attachments == nil {
+			msg.Attachments = &burner.AttachmentList{}
+		}
+		msg.Attachments.Files = append(msg.Attachments.Files, burner.Attachment{
+			Filename:    f.Filename,
+			ContentType: f.ContentType,
+			Size:        int64(len(f.Data)),
+		})
+	}
+
+	headers := messageHeaders(r)
+
+	for _, h := range headers {
+		if strings.EqualFold(h[0], "Message-Id") {
+			msg.EmailProviderID = strings.Trim(h[1], "<> ")
+		}
+	}
+
+	return email.BuildRawWithFiles(headers, r.FormValue("body-plain"), r.FormValue("body-html"), files), msg, nil
+}
+
+// messageHeaders returns the headers of the message from the message-headers json mailgun posts, or the few it
+// posts as fields if they're missing
+func messageHeaders(r *http.Request) [][2]string {
+	var headers [][2]string
+	err := json.Unmarshal([]byte(r.FormValue("message-headers")), &headers)
+	if err != nil {
+		log.WithError(err).Debug("MailgunIncoming: failed to parse message headers")
+		headers = [][2]string{
+			{"From", r.FormValue("from")},
+			{"To", r.FormValue("recipient")},
+			{"Subject", r.FormValue("subject")},
+		}
+	}
+
+	return headers
+}
+
+// attachments reads the files mailgun posts as attachment-1, attachment-2 ... attachment-count
+func attachments(r *http.Request) ([]email.File, error) {
+	count, _ := strconv.Atoi(r.FormValue("attachment-count"))
+
+	var files []email.File
+
+	for n := 1; n <= count; n++ {
+		key := "attachment-" + strconv.Itoa(n)
+
+		var fhs []*multipart.FileHeader
+		if r.MultipartForm != nil {
+			fhs = r.MultipartForm.File[key]
+		}
+		if len(fhs) == 0 {
+			return nil, fmt.Errorf("%v is missing", key)
+		}
+
+		data, err := email.ReadFile(fhs[0])
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, email.File{
+			Filename:    fhs[0].Filename,
+			ContentType: fhs[0].Header.Get("Content-Type"),
+			Data:        data,
+		})
+	}
+
+	return files, nil
 }
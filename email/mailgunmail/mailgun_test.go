@@ -1,14 +1,24 @@
 package mailgunmail
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -26,18 +36,18 @@ func TestMailgun_MailgunIncoming_Verified(t *testing.T) {
 	m := MailgunMail{
 		mg: mockMailgun,
 		db: inmemory.GetInMemoryDB(),
-		isBlacklistedDomain: func(email string) bool {
-			return false
+		checkPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
 		},
 	}
 
 	m.db.SaveNewInbox(burner.Inbox{
-		Address:              "bobby@example.com",
-		ID:                   "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
-		CreatedAt:            time.Now().Unix(),
-		TTL:                  time.Now().Add(1 * time.Hour).Unix(),
-		FailedToCreate:       false,
-		EmailProviderRouteID: "1234",
+		Address:               "bobby@example.com",
+		ID:                    "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+		CreatedAt:             time.Now().Unix(),
+		TTL:                   time.Now().Add(1 * time.Hour).Unix(),
+		FailedToCreate:        false,
+		EmailProviderRouteIDs: burner.RouteIDs{"mailgun": "1234"},
 	})
 
 	router := mux.NewRouter()
@@ -46,12 +56,12 @@ func TestMailgun_MailgunIncoming_Verified(t *testing.T) {
 	httpServer := httptest.NewServer(router)
 
 	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
-		"message-id": {"1234"},
-		"sender":     {"hayden@example.com"},
-		"from":       {"Hayden Woodhead <hayden@example.com>"},
-		"subject":    {"Subject line"},
-		"body-plain": {"Hello there"},
-		"body-html":  {`<html><body><a href="https://example.com">Hello there</a></body></html>`},
+		"message-headers": {`[["From", "Hayden Woodhead <hayden@example.com>"], ["Subject", "Subject line"], ["Message-Id", "<1234>"]]`},
+		"sender":          {"hayden@example.com"},
+		"from":            {"Hayden Woodhead <hayden@example.com>"},
+		"subject":         {"Subject line"},
+		"body-plain":      {"Hello there"},
+		"body-html":       {`<html><body><a href="https://example.com">Hello there</a></body></html>`},
 	})
 	require.NoError(t, err)
 
@@ -71,25 +81,97 @@ func TestMailgun_MailgunIncoming_Verified(t *testing.T) {
 	assert.Equal(t, expectedHTML, msg.BodyHTML)
 }
 
-func TestMailgun_MailgunIncoming_Blacklisted(t *testing.T) {
+func TestMailgun_MailgunIncoming_Subaddress(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
+
+	m := MailgunMail{
+		mg: mockMailgun,
+		db: inmemory.GetInMemoryDB(),
+		checkPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
+		},
+		subaddressSeparator: "+",
+	}
+
+	m.db.SaveNewInbox(burner.Inbox{
+		Address: "bobby@example.com",
+		ID:      "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+		TTL:     time.Now().Add(1 * time.Hour).Unix(),
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming)
+
+	httpServer := httptest.NewServer(router)
+
+	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
+		"message-id": {"1234"},
+		"recipient":  {"bobby+case42@example.com"},
+		"sender":     {"hayden@example.com"},
+		"from":       {"hayden@example.com"},
+		"subject":    {"Subject line"},
+		"body-plain": {"Hello there"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, "case42", msgs[0].Subaddress)
+	assert.Equal(t, "bobby+case42@example.com", msgs[0].Recipient)
+}
+
+func TestMailgun_RouteExpression(t *testing.T) {
+	tests := []struct {
+		Address   string
+		Separator string
+		Expected  string
+	}{
+		{
+			Address:   "bobby@example.com",
+			Separator: "",
+			Expected:  `match_recipient("bobby@example.com")`,
+		},
+		{
+			Address:   "bobby@example.com",
+			Separator: "+",
+			Expected:  `match_recipient("^bobby(\+.*)?@example\.com$")`,
+		},
+		{
+			Address:   "ci.*@example.com",
+			Separator: "+",
+			Expected:  `match_recipient("^ci\..*@example\.com$")`,
+		},
+	}
+
+	for _, test := range tests {
+		m := MailgunMail{subaddressSeparator: test.Separator}
+		assert.Equal(t, test.Expected, m.routeExpression(burner.Inbox{Address: test.Address}))
+	}
+}
+
+func TestMailgun_MailgunIncoming_Denied(t *testing.T) {
 	mockMailgun := new(MockMailgun)
 	mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
 
+	var checked policy.Request
 	m := MailgunMail{
 		mg: mockMailgun,
 		db: inmemory.GetInMemoryDB(),
-		isBlacklistedDomain: func(email string) bool {
-			return true
+		checkPolicy: func(r policy.Request) policy.Decision {
+			checked = r
+			return policy.Decision{Allowed: false, Reason: "blacklisted"}
 		},
 	}
 
 	m.db.SaveNewInbox(burner.Inbox{
-		Address:              "bobby@example.com",
-		ID:                   "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
-		CreatedAt:            time.Now().Unix(),
-		TTL:                  time.Now().Add(1 * time.Hour).Unix(),
-		FailedToCreate:       false,
-		EmailProviderRouteID: "1234",
+		Address:               "bobby@example.com",
+		ID:                    "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+		CreatedAt:             time.Now().Unix(),
+		TTL:                   time.Now().Add(1 * time.Hour).Unix(),
+		FailedToCreate:        false,
+		EmailProviderRouteIDs: burner.RouteIDs{"mailgun": "1234"},
 	})
 
 	router := mux.NewRouter()
@@ -99,6 +181,7 @@ func TestMailgun_MailgunIncoming_Blacklisted(t *testing.T) {
 
 	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
 		"message-id": {"1234"},
+		"recipient":  {"bobby@example.com"},
 		"sender":     {"hayden@example.com"},
 		"from":       {"hayden@example.com"},
 		"subject":    {"Hello there"},
@@ -108,6 +191,437 @@ func TestMailgun_MailgunIncoming_Blacklisted(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	assert.Equal(t, policy.Request{Sender: "hayden@example.com", Recipient: "bobby@example.com"}, checked)
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	assert.Empty(t, msgs)
+}
+
+func TestMailgun_MailgunIncoming_SenderNotAllowed(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
+
+	m := MailgunMail{
+		mg: mockMailgun,
+		db: inmemory.GetInMemoryDB(),
+		checkPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
+		},
+	}
+
+	m.db.SaveNewInbox(burner.Inbox{
+		Address:        "bobby@example.com",
+		ID:             "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+		TTL:            time.Now().Add(1 * time.Hour).Unix(),
+		AllowedSenders: burner.SenderList{"example.org"},
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming)
+
+	httpServer := httptest.NewServer(router)
+
+	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
+		"message-id": {"1234"},
+		"recipient":  {"bobby@example.com"},
+		"sender":     {"hayden@example.com"},
+		"from":       {"hayden@example.com"},
+		"subject":    {"Hello there"},
+		"body-plain": {"Hello there"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	assert.Empty(t, msgs)
+}
+
+type fakeSpamChecker struct {
+	score    float64
+	received string
+}
+
+func (f *fakeSpamChecker) Check(ctx context.Context, raw []byte) (burner.SpamResult, error) {
+	f.received = string(raw)
+	return burner.SpamResult{Score: f.score, Threshold: 5, Rules: []string{"HTML_MESSAGE"}}, nil
+}
+
+func TestMailgun_MailgunIncoming_Spam(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Score          float64
+		ExpectedStatus int
+		ExpectedSaved  bool
+	}{
+		{Name: "accepted", Score: 3.2, ExpectedStatus: http.StatusOK, ExpectedSaved: true},
+		{Name: "rejected", Score: 12.5, ExpectedStatus: http.StatusNotAcceptable, ExpectedSaved: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			mockMailgun := new(MockMailgun)
+			mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
+
+			checker := &fakeSpamChecker{score: test.Score}
+
+			m := MailgunMail{
+				mg: mockMailgun,
+				db: inmemory.GetInMemoryDB(),
+				checkPolicy: func(r policy.Request) policy.Decision {
+					return policy.Decision{Allowed: true}
+				},
+				spamFilter: spam.NewFilter(checker, spam.WithRejectScore(10)),
+			}
+
+			m.db.SaveNewInbox(burner.Inbox{
+				Address: "bobby@example.com",
+				ID:      "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+				TTL:     time.Now().Add(1 * time.Hour).Unix(),
+			})
+
+			router := mux.NewRouter()
+			router.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming)
+
+			httpServer := httptest.NewServer(router)
+			defer httpServer.Close()
+
+			resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
+				"message-id":      {"1234"},
+				"recipient":       {"bobby@example.com"},
+				"sender":          {"hayden@example.com"},
+				"from":            {"hayden@example.com"},
+				"subject":         {"Hello there"},
+				"body-plain":      {"Hello there"},
+				"message-headers": {`[["From", "hayden@example.com"], ["Subject", "Hello there"], ["X-Mailgun-Spf", "Pass"]]`},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, test.ExpectedStatus, resp.StatusCode)
+
+			assert.Contains(t, checker.received, "X-Mailgun-Spf: Pass\r\n")
+			assert.Contains(t, checker.received, "\r\n\r\nHello there")
+
+			msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+			if !test.ExpectedSaved {
+				assert.Empty(t, msgs)
+				return
+			}
+
+			require.Len(t, msgs, 1)
+			assert.Equal(t, &burner.SpamResult{Score: test.Score, Threshold: 5, Rules: []string{"HTML_MESSAGE"}}, msgs[0].Spam)
+		})
+	}
+}
+
+type fakeVirusScanner struct {
+	signature string
+}
+
+func (f fakeVirusScanner) Scan(ctx context.Context, raw []byte) (burner.VirusResult, error) {
+	return burner.VirusResult{Infected: f.signature != "", Signature: f.signature}, nil
+}
+
+func TestMailgun_MailgunIncoming_Virus(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Signature      string
+		Action         virus.Action
+		ExpectedStatus int
+		ExpectedSaved  bool
+	}{
+		{Name: "clean", Action: virus.Reject, ExpectedStatus: http.StatusOK, ExpectedSaved: true},
+		{Name: "rejected", Signature: "Eicar-Test-Signature", Action: virus.Reject, ExpectedStatus: http.StatusNotAcceptable, ExpectedSaved: false},
+		{Name: "flagged", Signature: "Eicar-Test-Signature", Action: virus.Flag, ExpectedStatus: http.StatusOK, ExpectedSaved: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			mockMailgun := new(MockMailgun)
+			mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
+
+			m := MailgunMail{
+				mg: mockMailgun,
+				db: inmemory.GetInMemoryDB(),
+				checkPolicy: func(r policy.Request) policy.Decision {
+					return policy.Decision{Allowed: true}
+				},
+				virusFilter: virus.NewFilter(fakeVirusScanner{signature: test.Signature}, test.Action),
+			}
+
+			m.db.SaveNewInbox(burner.Inbox{
+				Address: "bobby@example.com",
+				ID:      "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+				TTL:     time.Now().Add(1 * time.Hour).Unix(),
+			})
+
+			router := mux.NewRouter()
+			router.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming)
+
+			httpServer := httptest.NewServer(router)
+			defer httpServer.Close()
+
+			resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
+				"message-id": {"1234"},
+				"recipient":  {"bobby@example.com"},
+				"sender":     {"hayden@example.com"},
+				"from":       {"hayden@example.com"},
+				"subject":    {"Hello there"},
+				"body-plain": {"Hello there"},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, test.ExpectedStatus, resp.StatusCode)
+
+			msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+			if !test.ExpectedSaved {
+				assert.Empty(t, msgs)
+				return
+			}
+
+			require.Len(t, msgs, 1)
+			assert.Equal(t, &burner.VirusResult{Infected: test.Signature != "", Signature: test.Signature}, msgs[0].Virus)
+		})
+	}
+}
+
+func TestMailgun_MailgunIncoming_IngestQueue(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
+
+	q := ingest.New(1, 1)
+
+	m := MailgunMail{
+		mg: mockMailgun,
+		db: inmemory.GetInMemoryDB(),
+		checkPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
+		},
+		queue: q,
+	}
+
+	m.db.SaveNewInbox(burner.Inbox{
+		Address: "bobby@example.com",
+		ID:      "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+		TTL:     time.Now().Add(1 * time.Hour).Unix(),
+	})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming)
+
+	httpServer := httptest.NewServer(router)
+	defer httpServer.Close()
+
+	form := url.Values{
+		"message-id": {"1234"},
+		"recipient":  {"bobby@example.com"},
+		"sender":     {"hayden@example.com"},
+		"from":       {"hayden@example.com"},
+		"subject":    {"Hello there"},
+		"body-html":  {`<a href="https://example.com">Hello there</a>`},
+	}
+
+	// occupy the only worker and fill the queue so there is no room
+	started := make(chan struct{})
+	release := make(chan struct{})
+	require.NoError(t, q.Submit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	require.NoError(t, q.Submit(func() {}))
+
+	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", form)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	close(release)
+
+	// wait for there to be room again
+	require.Eventually(t, func() bool {
+		resp, err = http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", form)
+		return err == nil && resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, m.Stop())
+	q.Stop()
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	require.Len(t, msgs, 1)
+	assert.Contains(t, msgs[0].BodyHTML, `target="_blank"`)
+}
+
+func newTestMailgunMail(t *testing.T, checker *fakeSpamChecker) (*MailgunMail, *httptest.Server) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("VerifyWebhookRequest", mock.Anything).Return(true, nil)
+
+	m := &MailgunMail{
+		mg: mockMailgun,
+		db: inmemory.GetInMemoryDB(),
+		checkPolicy: func(r policy.Request) policy.Decision {
+			return policy.Decision{Allowed: true}
+		},
+		spamFilter: spam.NewFilter(checker),
+	}
+
+	require.NoError(t, m.db.SaveNewInbox(burner.Inbox{
+		Address: "bobby@example.com",
+		ID:      "17b79467-f409-4e7d-86a9-0dc79b77f7c3",
+		TTL:     time.Now().Add(1 * time.Hour).Unix(),
+	}))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/mg/incoming/{inboxID}/", m.mailgunIncoming)
+	router.HandleFunc("/mg/incoming/{inboxID}/mime", m.mailgunIncoming)
+
+	httpServer := httptest.NewServer(router)
+	t.Cleanup(httpServer.Close)
+
+	return m, httpServer
+}
+
+func TestMailgun_MailgunIncoming_Attachments(t *testing.T) {
+	checker := &fakeSpamChecker{score: 1}
+	m, httpServer := newTestMailgunMail(t, checker)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range map[string]string{
+		"recipient":        "bobby@example.com",
+		"sender":           "bounce@example.org",
+		"from":             "Hayden Woodhead <hayden@example.com>",
+		"subject":          "Gophers!",
+		"body-plain":       "Hello there",
+		"attachment-count": "2",
+		"message-headers":  `[["From", "Hayden Woodhead <hayden@example.com>"], ["Subject", "Gophers!"], ["Message-Id", "<20240101120000.1@example.com>"], ["Content-Type", "multipart/mixed; boundary=\"abc\""]]`,
+	} {
+		require.NoError(t, mw.WriteField(k, v))
+	}
+
+	for _, f := range []struct{ field, name, contentType, data string }{
+		{"attachment-1", "notes.txt", "text/plain", "notes!\n"},
+		{"attachment-2", "gopher.png", "image/png", "\x89PNG\r\n"},
+	} {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="`+f.field+`"; filename="`+f.name+`"`)
+		h.Set("Content-Type", f.contentType)
+		w, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(f.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	resp, err := http.Post(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", mw.FormDataContentType(), &body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	require.Len(t, msgs, 1)
+
+	msg := msgs[0]
+	assert.Equal(t, "20240101120000.1@example.com", msg.EmailProviderID)
+	assert.Equal(t, "bounce@example.org", msg.Sender)
+	assert.Equal(t, "Hello there", msg.BodyPlain)
+	assert.Equal(t, &burner.AttachmentList{Files: []burner.Attachment{
+		{Filename: "notes.txt", ContentType: "text/plain", Size: 7},
+		{Filename: "gopher.png", ContentType: "image/png", Size: 6},
+	}}, msg.Attachments)
+
+	// the rebuilt message checked by the filters includes the attachments
+	assert.Contains(t, checker.received, "Content-Type: multipart/mixed; boundary=")
+	assert.Contains(t, checker.received, "filename=gopher.png")
+}
+
+func TestMailgun_MailgunIncoming_Attachments_Missing(t *testing.T) {
+	m, httpServer := newTestMailgunMail(t, &fakeSpamChecker{})
+
+	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", url.Values{
+		"recipient":        {"bobby@example.com"},
+		"sender":           {"hayden@example.com"},
+		"from":             {"hayden@example.com"},
+		"subject":          {"Hello there"},
+		"attachment-count": {"1"},
+	})
+	require.NoError(t, err)
+
+	// retrying won't help
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	assert.Empty(t, msgs)
+}
+
+func TestMailgun_MailgunIncoming_Duplicate(t *testing.T) {
+	m, httpServer := newTestMailgunMail(t, &fakeSpamChecker{})
+
+	form := url.Values{
+		"recipient":       {"bobby@example.com"},
+		"sender":          {"hayden@example.com"},
+		"from":            {"hayden@example.com"},
+		"subject":         {"Hello there"},
+		"message-headers": {`[["Message-Id", "<20240101120000.1@example.com>"]]`},
+	}
+
+	// mailgun retries when the first post times out
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/", form)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	assert.Len(t, msgs, 1)
+}
+
+func TestMailgun_MailgunIncoming_RawMIME(t *testing.T) {
+	checker := &fakeSpamChecker{score: 1}
+	m, httpServer := newTestMailgunMail(t, checker)
+
+	raw := "From: Hayden Woodhead <hayden@example.com>\r\n" +
+		"To: bobby@example.com\r\n" +
+		"Subject: Gophers!\r\n" +
+		"Message-ID: <20240101120000.1@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<a href=\"https://example.com\">Hello there</a>\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain; name=\"notes.txt\"\r\n" +
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"bm90ZXMhCg==\r\n" +
+		"--outer--\r\n"
+
+	resp, err := http.PostForm(httpServer.URL+"/mg/incoming/17b79467-f409-4e7d-86a9-0dc79b77f7c3/mime", url.Values{
+		"recipient": {"bobby@example.com"},
+		"sender":    {"bounce@example.org"},
+		"from":      {"Hayden Woodhead <hayden@example.com>"},
+		"subject":   {"Gophers!"},
+		"body-mime": {raw},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the filters check the original message
+	assert.Equal(t, raw, checker.received)
+
+	msgs, _ := m.db.GetMessagesByInboxID("17b79467-f409-4e7d-86a9-0dc79b77f7c3")
+	require.Len(t, msgs, 1)
+
+	msg := msgs[0]
+	assert.Equal(t, "20240101120000.1@example.com", msg.EmailProviderID)
+	assert.Equal(t, "bounce@example.org", msg.Sender)
+	assert.Equal(t, "hayden@example.com", msg.FromAddress)
+	assert.Equal(t, "Hayden Woodhead", msg.FromName)
+	assert.Equal(t, "bobby@example.com", msg.Recipient)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, `<html><head></head><body><a href="https://example.com" target="_blank" rel="noopener noreferrer">Hello there</a></body></html>`, msg.BodyHTML)
+	assert.Equal(t, &burner.AttachmentList{Files: []burner.Attachment{
+		{Filename: "notes.txt", ContentType: "text/plain", Size: 7},
+	}}, msg.Attachments)
 }
 
 func TestMailgun_MailgunIncoming_UnVerified(t *testing.T) {
@@ -168,6 +682,144 @@ func TestMailgun_DeleteExpiredRoutes(t *testing.T) {
 	mockMailgun.AssertExpectations(t)
 }
 
+func TestMailgun_DeleteExpiredRoutes_Paging(t *testing.T) {
+	expired := fmt.Sprintf("%v", time.Now().Add(-1*time.Second).Unix())
+	live := fmt.Sprintf("%v", time.Now().Add(1*time.Hour).Unix())
+
+	page := func(start int, n int) []mailgun.Route {
+		var routes []mailgun.Route
+		for id := start; id < start+n; id++ {
+			desc := live
+			if id%2 == 0 {
+				desc = expired
+			}
+			routes = append(routes, mailgun.Route{ID: strconv.Itoa(id), Description: desc})
+		}
+		return routes
+	}
+
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("GetRoutes", routesPageSize, 0).Return(1002, page(0, routesPageSize), nil).Once()
+	mockMailgun.On("GetRoutes", routesPageSize, routesPageSize).Return(1002, page(routesPageSize, 2), nil).Once()
+
+	// routes are only deleted once every page has been fetched
+	deleted := 0
+	mockMailgun.On("DeleteRoute", mock.Anything).Run(func(args mock.Arguments) {
+		mockMailgun.AssertNumberOfCalls(t, "GetRoutes", 2)
+		deleted++
+	}).Return(nil)
+
+	m := MailgunMail{mg: mockMailgun}
+	err := m.deleteExpiredRoutes()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 501, deleted)
+	mockMailgun.AssertCalled(t, "DeleteRoute", "1000")
+	mockMailgun.AssertNotCalled(t, "DeleteRoute", "1001")
+	mockMailgun.AssertExpectations(t)
+}
+
+func TestMailgun_DeleteExpiredRoutes_Failed(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("GetRoutes", routesPageSize, 0).Return(0, []mailgun.Route(nil), errors.New("unavailable"))
+
+	m := MailgunMail{mg: mockMailgun}
+	err := m.deleteExpiredRoutes()
+	assert.Error(t, err)
+
+	mockMailgun.AssertNotCalled(t, "DeleteRoute", mock.Anything)
+}
+
+func TestMailgun_DeleteRoute(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("DeleteRoute", "4f3bad2335335426750048c6").Return(nil).Once()
+	mockMailgun.On("DeleteRoute", "4f3bad2335335426750048c6").Return(&mailgun.UnexpectedResponseError{Expected: []int{http.StatusOK}, Actual: http.StatusNotFound}).Once()
+	mockMailgun.On("DeleteRoute", "4f3bad2335335426750048c6").Return(errors.New("unavailable")).Once()
+
+	m := MailgunMail{mg: mockMailgun}
+
+	assert.NoError(t, m.DeleteRoute("4f3bad2335335426750048c6"))
+
+	// already deleted, e.g. by the janitor
+	assert.NoError(t, m.DeleteRoute("4f3bad2335335426750048c6"))
+
+	assert.Error(t, m.DeleteRoute("4f3bad2335335426750048c6"))
+
+	mockMailgun.AssertExpectations(t)
+}
+
+func TestMailgun_Stop(t *testing.T) {
+	swept := make(chan struct{})
+
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("GetRoutes", routesPageSize, 0).Run(func(mock.Arguments) { close(swept) }).Return(0, []mailgun.Route{}, nil).Once()
+
+	m := MailgunMail{mg: mockMailgun}
+	err := m.Start("https://burner.kiwi", inmemory.GetInMemoryDB(), mux.NewRouter(), func(policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	})
+	require.NoError(t, err)
+
+	// the janitor sweeps as soon as it starts
+	select {
+	case <-swept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("janitor didn't sweep routes")
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- m.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("janitor didn't stop")
+	}
+
+	// stopping again is a no-op
+	assert.NoError(t, m.Stop())
+	mockMailgun.AssertExpectations(t)
+}
+
+func TestMailgun_RegisterRoute(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("CreateRoute", mock.MatchedBy(func(r mailgun.Route) bool {
+		return r.Expression == "match_recipient(\"bobby@example.com\")" && r.Description == "1526189618"
+	})).Return(mailgun.Route{ID: "4f3bad2335335426750048c6"}, nil).Once()
+	mockMailgun.On("CreateRoute", mock.Anything).Return(mailgun.Route{}, errors.New("unavailable")).Once()
+
+	m := MailgunMail{websiteAddr: "https://burner.kiwi", mg: mockMailgun}
+	i := burner.Inbox{ID: "1234", Address: "bobby@example.com", TTL: 1526189618}
+
+	id, err := m.RegisterRoute(i)
+	assert.NoError(t, err)
+	assert.Equal(t, "4f3bad2335335426750048c6", id)
+
+	_, err = m.RegisterRoute(i)
+	assert.Error(t, err)
+
+	mockMailgun.AssertExpectations(t)
+}
+
+func TestMailgun_RegisterRoute_RawMIME(t *testing.T) {
+	mockMailgun := new(MockMailgun)
+	mockMailgun.On("CreateRoute", mock.MatchedBy(func(r mailgun.Route) bool {
+		return r.Actions[0] == `forward("https://burner.kiwi/mg/incoming/1234/mime")`
+	})).Return(mailgun.Route{ID: "4f3bad2335335426750048c6"}, nil)
+
+	m := NewMailProvider("example.com", "key", WithRawMIME())
+	m.mg = mockMailgun
+	m.websiteAddr = "https://burner.kiwi"
+
+	_, err := m.RegisterRoute(burner.Inbox{ID: "1234", Address: "bobby@example.com"})
+	assert.NoError(t, err)
+
+	mockMailgun.AssertExpectations(t)
+}
+
 type MockMailgun struct {
 	mock.Mock
 }
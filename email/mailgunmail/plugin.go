@@ -0,0 +1,45 @@
+package mailgunmail
+
+import (
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+)
+
+func init() {
+	burner.RegisterEmailProvider("mailgun", inbound.WithSettings(
+		burner.Setting{Name: "MG_DOMAIN", Description: "mailgun domain mail is received on", Required: true},
+		burner.Setting{Name: "MG_KEY", Description: "mailgun api key", Required: true},
+		burner.Setting{Name: "MG_RAW_MIME", Description: "forward the original message rather than its parsed fields", Default: "false"},
+	), newFromSettings)
+}
+
+func newFromSettings(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+	rawMIME, err := s.Bool("MG_RAW_MIME")
+	if err != nil {
+		return nil, err
+	}
+
+	spamFilter, err := inbound.SpamFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	virusFilter, err := inbound.VirusFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithIngestQueue(c.IngestQueue),
+		WithSpool(c.Spool),
+		WithSubaddressSeparator(s.String("SUBADDRESS_SEPARATOR")),
+		WithSpamFilter(spamFilter),
+		WithVirusFilter(virusFilter),
+	}
+
+	if rawMIME {
+		opts = append(opts, WithRawMIME())
+	}
+
+	return NewMailProvider(s.String("MG_DOMAIN"), s.String("MG_KEY"), opts...), nil
+}
@@ -0,0 +1,76 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/parsemail"
+)
+
+// ParseMessage parses a raw MIME message into a message with its from, subject, bodies and attachments set. The html
+// body is sanitized by SanitizeHTML. Providers which receive the original message should use this so that all
+// messages are displayed the same way.
+func ParseMessage(raw []byte) (burner.Message, error) {
+	parsedEmail, err := parsemail.Parse(bytes.NewReader(raw))
+	if err != nil {
+		return burner.Message{}, fmt.Errorf("failed to parse message: %w", err)
+	}
+
+	from := firstFrom(parsedEmail.From)
+
+	msg := burner.Message{
+		FromAddress: from.Address,
+		FromName:    from.Name,
+		Subject:     parsedEmail.Subject,
+		BodyPlain:   strings.TrimSpace(parsedEmail.TextBody),
+	}
+
+	if parsedEmail.HTMLBody != "" {
+		modifiedHTML, err := SanitizeHTML(strings.TrimSpace(parsedEmail.HTMLBody))
+		if err != nil {
+			return burner.Message{}, fmt.Errorf("failed to sanitize html: %w", err)
+		}
+		msg.BodyHTML = modifiedHTML
+	}
+
+	for _, a := range parsedEmail.Attachments {
+		size, err := io.Copy(io.Discard, a.Data)
+		if err != nil {
+			return burner.Message{}, fmt.Errorf("failed to read attachment: %w", err)
+		}
+
+		if msg.Attachments == nil {
+			msg.Attachments = &burner.AttachmentList{}
+		}
+		msg.Attachments.Files = append(msg.Attachments.Files, burner.Attachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        size,
+		})
+	}
+
+	return msg, nil
+}
+
+// MessageID returns the Message-ID header of raw without its angle brackets or an empty string if it has none
+func MessageID(raw []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	return strings.Trim(m.Header.Get("Message-Id"), "<> ")
+}
+
+func firstFrom(from []*mail.Address) mail.Address {
+	for _, f := range from {
+		if f != nil {
+			return *f
+		}
+	}
+	return mail.Address{}
+}
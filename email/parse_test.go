@@ -0,0 +1,53 @@
+package email
+
+import (
+	"testing"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMessage(t *testing.T) {
+	raw := []byte("From: Bob <bob@example.org>\r\n" +
+		"To: bobby@example.com\r\n" +
+		"Subject: Gophers!\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"  This is the email body.\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<a href=\"https://example.com\">This is the email body.</a>\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"JVBERi0xLjQK\r\n" +
+		"--b--\r\n")
+
+	msg, err := ParseMessage(raw)
+	require.NoError(t, err)
+
+	assert.Equal(t, "bob@example.org", msg.FromAddress)
+	assert.Equal(t, "Bob", msg.FromName)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, "This is the email body.", msg.BodyPlain)
+	assert.Equal(t, `<html><head></head><body><a href="https://example.com" target="_blank" rel="noopener noreferrer">This is the email body.</a></body></html>`, msg.BodyHTML)
+	assert.Equal(t, &burner.AttachmentList{Files: []burner.Attachment{{Filename: "invoice.pdf", ContentType: "application/pdf", Size: 9}}}, msg.Attachments)
+}
+
+func TestParseMessage_NoFrom(t *testing.T) {
+	msg, err := ParseMessage([]byte("Subject: Hi\r\n\r\nHello"))
+	require.NoError(t, err)
+
+	assert.Empty(t, msg.FromAddress)
+	assert.Empty(t, msg.BodyHTML)
+	assert.Equal(t, "Hello", msg.BodyPlain)
+	assert.Nil(t, msg.Attachments)
+}
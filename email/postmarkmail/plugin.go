@@ -0,0 +1,64 @@
+package postmarkmail
+
+import (
+	"errors"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+)
+
+func init() {
+	burner.RegisterEmailProvider("postmark", inbound.WithSettings(
+		burner.Setting{Name: "POSTMARK_USER", Description: "basic auth username in the webhook url"},
+		burner.Setting{Name: "POSTMARK_PASSWORD", Description: "basic auth password in the webhook url"},
+		burner.Setting{Name: "POSTMARK_SECRET", Description: "secret path segment in the webhook url"},
+		burner.Setting{Name: "POSTMARK_STRIPPED_REPLIES", Description: "keep only the reply of plain text bodies", Default: "false"},
+	), newFromSettings)
+}
+
+func newFromSettings(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+	user, password, secret := s.String("POSTMARK_USER"), s.String("POSTMARK_PASSWORD"), s.String("POSTMARK_SECRET")
+
+	if user == "" && secret == "" {
+		return nil, errors.New("env var POSTMARK_USER or POSTMARK_SECRET cannot be empty")
+	}
+
+	strippedReplies, err := s.Bool("POSTMARK_STRIPPED_REPLIES")
+	if err != nil {
+		return nil, err
+	}
+
+	spamFilter, err := inbound.SpamFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	virusFilter, err := inbound.VirusFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithSpool(c.Spool),
+		WithSubaddressSeparator(s.String("SUBADDRESS_SEPARATOR")),
+		WithSpamFilter(spamFilter),
+		WithVirusFilter(virusFilter),
+	}
+
+	if user != "" {
+		if password == "" {
+			return nil, errors.New("env var POSTMARK_PASSWORD cannot be empty when POSTMARK_USER is set")
+		}
+		opts = append(opts, WithBasicAuth(user, password))
+	}
+
+	if secret != "" {
+		opts = append(opts, WithURLSecret(secret))
+	}
+
+	if strippedReplies {
+		opts = append(opts, WithStrippedReplies())
+	}
+
+	return NewMailProvider(opts...), nil
+}
@@ -0,0 +1,172 @@
+package postmarkmail
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/data/inmemory"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPostmarkMail(t *testing.T, opts ...Option) (*PostmarkMail, *mux.Router) {
+	p := NewMailProvider(append([]Option{WithURLSecret("s3cret"), WithSubaddressSeparator("+")}, opts...)...)
+
+	r := mux.NewRouter()
+	err := p.Start("example.com", inmemory.GetInMemoryDB(), r, func(r policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	})
+	require.NoError(t, err)
+
+	for _, i := range []burner.Inbox{
+		{Address: "bobby@example.com", ID: "bobby", CreatedAt: time.Now().Unix(), TTL: time.Now().Add(1 * time.Hour).Unix()},
+		{Address: "alice@example.com", ID: "alice", CreatedAt: time.Now().Unix(), TTL: time.Now().Add(1 * time.Hour).Unix()},
+	} {
+		require.NoError(t, p.deliverer.DB.SaveNewInbox(i))
+	}
+
+	return p, r
+}
+
+func loadWebhook(t *testing.T) map[string]interface{} {
+	b, err := os.ReadFile(filepath.Join("testdata", "inbound.json"))
+	require.NoError(t, err)
+
+	var hook map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &hook))
+	return hook
+}
+
+func post(t *testing.T, r *mux.Router, target string, hook interface{}) *httptest.ResponseRecorder {
+	b, err := json.Marshal(hook)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(b)))
+	return w
+}
+
+func messages(t *testing.T, p *PostmarkMail, inboxID string) []burner.Message {
+	msgs, err := p.deliverer.DB.GetMessagesByInboxID(inboxID)
+	require.NoError(t, err)
+	return msgs
+}
+
+func TestPostmarkMail_PostmarkIncoming(t *testing.T) {
+	p, r := newTestPostmarkMail(t)
+
+	w := post(t, r, "/postmark/incoming/s3cret/", loadWebhook(t))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msgs := messages(t, p, "bobby")
+	require.Len(t, msgs, 1)
+
+	msg := msgs[0]
+	assert.Equal(t, "73e6d360-66eb-11e1-8e72-a8904824019b", msg.EmailProviderID)
+	assert.Equal(t, "bounce@example.org", msg.Sender)
+	assert.Equal(t, "hayden@example.com", msg.FromAddress)
+	assert.Equal(t, "Hayden Woodhead", msg.FromName)
+	assert.Equal(t, "bobby+news@example.com", msg.Recipient)
+	assert.Equal(t, "news", msg.Subaddress)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, "Hello there\n\n> On Thursday Bobby wrote:\n> Hi", msg.BodyPlain)
+	assert.Equal(t, `<html><head></head><body><a href="https://example.com" target="_blank" rel="noopener noreferrer">Hello there</a></body></html>`, msg.BodyHTML)
+	assert.Equal(t, &burner.AttachmentList{Files: []burner.Attachment{
+		{Filename: "notes.txt", ContentType: "text/plain", Size: 7},
+		{Filename: "gopher.png", ContentType: "image/png", Size: 6},
+	}}, msg.Attachments)
+
+	// the original recipient is the only one delivered to
+	assert.Empty(t, messages(t, p, "alice"))
+}
+
+func TestPostmarkMail_PostmarkIncoming_StrippedReplies(t *testing.T) {
+	p, r := newTestPostmarkMail(t, WithStrippedReplies())
+
+	w := post(t, r, "/postmark/incoming/s3cret/", loadWebhook(t))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msgs := messages(t, p, "bobby")
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "Hello there", msgs[0].BodyPlain)
+}
+
+func TestPostmarkMail_PostmarkIncoming_NoOriginalRecipient(t *testing.T) {
+	p, r := newTestPostmarkMail(t)
+
+	hook := loadWebhook(t)
+	delete(hook, "OriginalRecipient")
+	hook["Headers"] = []interface{}{}
+
+	w := post(t, r, "/postmark/incoming/s3cret/", hook)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	bobby := messages(t, p, "bobby")
+	require.Len(t, bobby, 1)
+	assert.Equal(t, "hayden@example.com", bobby[0].Sender)
+
+	alice := messages(t, p, "alice")
+	require.Len(t, alice, 1)
+	assert.Equal(t, "alice@example.com", alice[0].Recipient)
+}
+
+func TestPostmarkMail_PostmarkIncoming_Auth(t *testing.T) {
+	p, r := newTestPostmarkMail(t, WithBasicAuth("postmark", "hunter2"))
+
+	w := post(t, r, "/postmark/incoming/guess/", loadWebhook(t))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = post(t, r, "/postmark/incoming/", loadWebhook(t))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Empty(t, messages(t, p, "bobby"))
+
+	b, err := json.Marshal(loadWebhook(t))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/postmark/incoming/", bytes.NewReader(b))
+	req.SetBasicAuth("postmark", "hunter2")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Len(t, messages(t, p, "bobby"), 1)
+}
+
+func TestPostmarkMail_PostmarkIncoming_Invalid(t *testing.T) {
+	p, r := newTestPostmarkMail(t)
+
+	hook := loadWebhook(t)
+	hook["Attachments"] = []interface{}{map[string]interface{}{"Name": "bad.bin", "Content": "not base64!"}}
+
+	// postmark doesn't retry a 403
+	w := post(t, r, "/postmark/incoming/s3cret/", hook)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, messages(t, p, "bobby"))
+}
+
+func TestHeaders(t *testing.T) {
+	var hook webhook
+	b, err := os.ReadFile(filepath.Join("testdata", "inbound.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &hook))
+
+	hs := headers(hook)
+	assert.Equal(t, [][2]string{
+		{"From", `"Hayden Woodhead" <hayden@example.com>`},
+		{"To", `"Bobby" <bobby+news@example.com>`},
+		{"Cc", `"Alice" <alice@example.com>, nobody@example.com`},
+		{"Subject", "Gophers!"},
+		{"Date", "Fri, 1 Aug 2014 16:45:32 -04:00"},
+	}, hs[:5])
+	assert.Len(t, hs, 10)
+}
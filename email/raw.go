@@ -0,0 +1,150 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// contentHeaders describe the original body so are dropped by BuildRaw
+var contentHeaders = map[string]bool{
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Content-Length":            true,
+	"Mime-Version":              true,
+}
+
+// File is an attachment to include in a rebuilt message
+type File struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// ReadFile reads a file uploaded with a provider's post
+func ReadFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open attachment %v: %w", fh.Filename, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment %v: %w", fh.Filename, err)
+	}
+
+	return data, nil
+}
+
+// BuildRaw rebuilds a message from its headers and plain and html bodies for providers which don't pass on the
+// original. The original content headers are replaced with ones describing the rebuilt body.
+func BuildRaw(headers [][2]string, plain string, html string) []byte {
+	return BuildRawWithFiles(headers, plain, html, nil)
+}
+
+// BuildRawWithFiles is like BuildRaw but also attaches files. When there are files the body and files are sent as
+// a multipart/mixed message.
+func BuildRawWithFiles(headers [][2]string, plain string, html string, files []File) []byte {
+	var buf bytes.Buffer
+
+	for _, h := range headers {
+		if contentHeaders[textproto.CanonicalMIMEHeaderKey(h[0])] {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], strings.NewReplacer("\r", "", "\n", "").Replace(h[1]))
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	h, body := buildBody(plain, html)
+
+	if len(files) == 0 {
+		for _, k := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			if v := h.Get(k); v != "" {
+				fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+			}
+		}
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes()
+	}
+
+	var mixed bytes.Buffer
+	mw := multipart.NewWriter(&mixed)
+
+	// writing to a bytes.Buffer can't fail
+	w, _ := mw.CreatePart(h)
+	_, _ = w.Write(body)
+
+	for _, f := range files {
+		writeFile(mw, f)
+	}
+	mw.Close()
+
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	buf.Write(mixed.Bytes())
+
+	return buf.Bytes()
+}
+
+// buildBody returns the content headers and body for the given plain and html bodies
+func buildBody(plain string, html string) (textproto.MIMEHeader, []byte) {
+	h := textproto.MIMEHeader{}
+
+	switch {
+	case plain != "" && html != "":
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		writePart(mw, "text/plain", plain)
+		writePart(mw, "text/html", html)
+		mw.Close()
+
+		h.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+		return h, body.Bytes()
+	case html != "":
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		h.Set("Content-Transfer-Encoding", "8bit")
+		return h, []byte(html)
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Transfer-Encoding", "8bit")
+		return h, []byte(plain)
+	}
+}
+
+func writePart(mw *multipart.Writer, contentType string, body string) {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "8bit")
+
+	// writing to a bytes.Buffer can't fail
+	w, _ := mw.CreatePart(h)
+	_, _ = w.Write([]byte(body))
+}
+
+func writeFile(mw *multipart.Writer, f File) {
+	contentType := f.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Filename}))
+
+	// writing to a bytes.Buffer can't fail
+	w, _ := mw.CreatePart(h)
+
+	enc := base64.StdEncoding.EncodeToString(f.Data)
+	for len(enc) > 76 {
+		_, _ = w.Write([]byte(enc[:76] + "\r\n"))
+		enc = enc[76:]
+	}
+	_, _ = w.Write([]byte(enc + "\r\n"))
+}
@@ -0,0 +1,81 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/haydenwoodhead/parsemail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRaw(t *testing.T) {
+	headers := [][2]string{
+		{"From", "Bob <bob@example.org>"},
+		{"To", "bobby@example.com"},
+		{"Subject", "Gophers!"},
+		{"Content-Type", "multipart/mixed; boundary=original"},
+		{"X-Injected", "value\r\nBcc: evil@example.com"},
+	}
+
+	tests := []struct {
+		Name  string
+		Plain string
+		HTML  string
+	}{
+		{Name: "plain", Plain: "This is the email body."},
+		{Name: "html", HTML: "<p>This is the email body.</p>"},
+		{Name: "both", Plain: "This is the email body.", HTML: "<p>This is the email body.</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			raw := BuildRaw(headers, test.Plain, test.HTML)
+
+			e, err := parsemail.Parse(bytes.NewReader(raw))
+			require.NoError(t, err)
+
+			assert.Equal(t, "Gophers!", e.Subject)
+			require.Len(t, e.From, 1)
+			assert.Equal(t, "bob@example.org", e.From[0].Address)
+			assert.Equal(t, test.Plain, e.TextBody)
+			assert.Equal(t, test.HTML, e.HTMLBody)
+			assert.NotContains(t, string(raw), "boundary=original")
+			assert.NotContains(t, string(raw), "\r\nBcc:")
+		})
+	}
+}
+
+func TestBuildRawWithFiles(t *testing.T) {
+	headers := [][2]string{
+		{"From", "Bob <bob@example.org>"},
+		{"Subject", "Gophers!"},
+	}
+
+	files := []File{
+		{Filename: "gopher.txt", ContentType: "text/plain", Data: []byte("gophers are great")},
+		{Filename: "report \"final\".bin", Data: bytes.Repeat([]byte{0, 1, 2}, 100)},
+	}
+
+	raw := BuildRawWithFiles(headers, "This is the email body.", "<p>This is the email body.</p>", files)
+
+	e, err := parsemail.Parse(bytes.NewReader(raw))
+	require.NoError(t, err)
+
+	assert.Equal(t, "This is the email body.", e.TextBody)
+	assert.Equal(t, "<p>This is the email body.</p>", e.HTMLBody)
+	require.Len(t, e.Attachments, 2)
+
+	assert.Equal(t, "gopher.txt", e.Attachments[0].Filename)
+	assert.Equal(t, "text/plain", e.Attachments[0].ContentType)
+	b, err := io.ReadAll(e.Attachments[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, "gophers are great", string(b))
+
+	assert.Equal(t, `report "final".bin`, e.Attachments[1].Filename)
+	assert.Equal(t, "application/octet-stream", e.Attachments[1].ContentType)
+	b, err = io.ReadAll(e.Attachments[1].Data)
+	require.NoError(t, err)
+	assert.Equal(t, files[1].Data, b)
+}
@@ -0,0 +1,54 @@
+package sendgridmail
+
+import (
+	"errors"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+)
+
+func init() {
+	burner.RegisterEmailProvider("sendgrid", inbound.WithSettings(
+		burner.Setting{Name: "SENDGRID_USER", Description: "basic auth username in the Inbound Parse url"},
+		burner.Setting{Name: "SENDGRID_PASSWORD", Description: "basic auth password in the Inbound Parse url"},
+		burner.Setting{Name: "SENDGRID_SECRET", Description: "secret path segment in the Inbound Parse url"},
+	), newFromSettings)
+}
+
+func newFromSettings(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+	user, password, secret := s.String("SENDGRID_USER"), s.String("SENDGRID_PASSWORD"), s.String("SENDGRID_SECRET")
+
+	if user == "" && secret == "" {
+		return nil, errors.New("env var SENDGRID_USER or SENDGRID_SECRET cannot be empty")
+	}
+
+	spamFilter, err := inbound.SpamFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	virusFilter, err := inbound.VirusFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithSpool(c.Spool),
+		WithSubaddressSeparator(s.String("SUBADDRESS_SEPARATOR")),
+		WithSpamFilter(spamFilter),
+		WithVirusFilter(virusFilter),
+	}
+
+	if user != "" {
+		if password == "" {
+			return nil, errors.New("env var SENDGRID_PASSWORD cannot be empty when SENDGRID_USER is set")
+		}
+		opts = append(opts, WithBasicAuth(user, password))
+	}
+
+	if secret != "" {
+		opts = append(opts, WithURLSecret(secret))
+	}
+
+	return NewMailProvider(opts...), nil
+}
@@ -0,0 +1,249 @@
+package sendgridmail
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/data/inmemory"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testInboxID = "17b79467-f409-4e7d-86a9-0dc79b77f7c3"
+
+const testEnvelope = `{"to":["bobby@example.com"],"from":"hayden@example.com"}`
+
+const testHeaders = "Received: by mx0047p1mdw1.sendgrid.net with SMTP id 6WCVv7KAWn Wed, 27 Jul 2016 20:53:06 +0000 (UTC)\n" +
+	"From: Hayden Woodhead <hayden@example.com>\n" +
+	"To: bobby@example.com\n" +
+	"Subject: Gophers!\n" +
+	"Message-ID: <CAOQ4dq1h=4LdXfrfTbUJqJ2mCnGN2v6tUJ5wJ6rwMvq5BQT_Sw@mail.gmail.com>\n" +
+	"Content-Type: multipart/alternative;\n" +
+	"\tboundary=001a113df448cad2d00538a0e1a3\n"
+
+const testRaw = "From: Hayden Woodhead <hayden@example.com>\r\n" +
+	"To: bobby@example.com\r\n" +
+	"Subject: Gophers!\r\n" +
+	"Message-ID: <CAOQ4dq1h=4LdXfrfTbUJqJ2mCnGN2v6tUJ5wJ6rwMvq5BQT_Sw@mail.gmail.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello there\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<a href=\"https://example.com\">Hello there</a>\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"Z29waGVycw==\r\n" +
+	"--b--\r\n"
+
+type file struct {
+	field       string
+	filename    string
+	contentType string
+	data        string
+}
+
+func newTestSendGridMail(t *testing.T, opts ...Option) (*SendGridMail, *mux.Router) {
+	s := NewMailProvider(append([]Option{WithURLSecret("s3cret")}, opts...)...)
+
+	r := mux.NewRouter()
+	err := s.Start("example.com", inmemory.GetInMemoryDB(), r, func(r policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	})
+	require.NoError(t, err)
+
+	err = s.deliverer.DB.SaveNewInbox(burner.Inbox{
+		Address:   "bobby@example.com",
+		ID:        testInboxID,
+		CreatedAt: time.Now().Unix(),
+		TTL:       time.Now().Add(1 * time.Hour).Unix(),
+	})
+	require.NoError(t, err)
+
+	return s, r
+}
+
+func newRequest(t *testing.T, target string, fields map[string]string, files []file) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for k, v := range fields {
+		require.NoError(t, mw.WriteField(k, v))
+	}
+
+	for _, f := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="`+f.field+`"; filename="`+f.filename+`"`)
+		h.Set("Content-Type", f.contentType)
+		w, err := mw.CreatePart(h)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(f.data))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func serve(r *mux.Router, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func getMessage(t *testing.T, s *SendGridMail) burner.Message {
+	msgs, err := s.deliverer.DB.GetMessagesByInboxID(testInboxID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	return msgs[0]
+}
+
+func TestSendGridMail_Parsed(t *testing.T) {
+	s, r := newTestSendGridMail(t)
+
+	req := newRequest(t, "/sendgrid/incoming/s3cret/", map[string]string{
+		"headers":         testHeaders,
+		"envelope":        testEnvelope,
+		"from":            "Hayden Woodhead <hayden@example.com>",
+		"to":              "bobby@example.com",
+		"subject":         "Gophers!",
+		"text":            "Hello there\n",
+		"html":            `<a href="https://example.com">Hello there</a>`,
+		"attachments":     "2",
+		"attachment-info": `{"attachment2":{"filename":"gopher.png","name":"gopher.png","type":"image/png"},"attachment1":{"filename":"notes.txt","name":"notes.txt","type":"text/plain"}}`,
+	}, []file{
+		{field: "attachment1", filename: "notes.txt", contentType: "text/plain", data: "gophers"},
+		{field: "attachment2", filename: "gopher.png", contentType: "image/png", data: "\x89PNG\r\n"},
+	})
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msg := getMessage(t, s)
+	assert.Equal(t, "CAOQ4dq1h=4LdXfrfTbUJqJ2mCnGN2v6tUJ5wJ6rwMvq5BQT_Sw@mail.gmail.com", msg.EmailProviderID)
+	assert.Equal(t, "hayden@example.com", msg.Sender)
+	assert.Equal(t, "hayden@example.com", msg.FromAddress)
+	assert.Equal(t, "Hayden Woodhead", msg.FromName)
+	assert.Equal(t, "bobby@example.com", msg.Recipient)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, "Hello there", msg.BodyPlain)
+	assert.Equal(t, `<html><head></head><body><a href="https://example.com" target="_blank" rel="noopener noreferrer">Hello there</a></body></html>`, msg.BodyHTML)
+	assert.Equal(t, &burner.AttachmentList{Files: []burner.Attachment{
+		{Filename: "notes.txt", ContentType: "text/plain", Size: 7},
+		{Filename: "gopher.png", ContentType: "image/png", Size: 6},
+	}}, msg.Attachments)
+}
+
+func TestSendGridMail_Raw(t *testing.T) {
+	s, r := newTestSendGridMail(t)
+
+	req := newRequest(t, "/sendgrid/incoming/s3cret/", map[string]string{
+		"envelope": testEnvelope,
+		"email":    testRaw,
+	}, nil)
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msg := getMessage(t, s)
+	assert.Equal(t, "CAOQ4dq1h=4LdXfrfTbUJqJ2mCnGN2v6tUJ5wJ6rwMvq5BQT_Sw@mail.gmail.com", msg.EmailProviderID)
+	assert.Equal(t, "hayden@example.com", msg.Sender)
+	assert.Equal(t, "Hayden Woodhead", msg.FromName)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, "Hello there", msg.BodyPlain)
+	assert.Equal(t, &burner.AttachmentList{Files: []burner.Attachment{{Filename: "notes.txt", ContentType: "text/plain", Size: 7}}}, msg.Attachments)
+}
+
+func TestSendGridMail_EnvelopeRecipients(t *testing.T) {
+	s, r := newTestSendGridMail(t)
+
+	// the envelope decides who receives the message, not the to header
+	req := newRequest(t, "/sendgrid/incoming/s3cret/", map[string]string{
+		"envelope": `{"to":["nobody@example.com"],"from":"hayden@example.com"}`,
+		"email":    testRaw,
+	}, nil)
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msgs, err := s.deliverer.DB.GetMessagesByInboxID(testInboxID)
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestSendGridMail_Auth(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		target string
+		user   string
+		pass   string
+		code   int
+	}{
+		{name: "secret", target: "/sendgrid/incoming/s3cret/", code: http.StatusOK},
+		{name: "wrong secret", target: "/sendgrid/incoming/guess/", code: http.StatusUnauthorized},
+		{name: "no secret", target: "/sendgrid/incoming/", code: http.StatusUnauthorized},
+		{name: "basic auth", opts: []Option{WithBasicAuth("sendgrid", "hunter2")}, target: "/sendgrid/incoming/", user: "sendgrid", pass: "hunter2", code: http.StatusOK},
+		{name: "wrong password", opts: []Option{WithBasicAuth("sendgrid", "hunter2")}, target: "/sendgrid/incoming/", user: "sendgrid", pass: "hunter3", code: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, r := newTestSendGridMail(t, test.opts...)
+
+			req := newRequest(t, test.target, map[string]string{
+				"envelope": testEnvelope,
+				"email":    testRaw,
+			}, nil)
+			if test.user != "" {
+				req.SetBasicAuth(test.user, test.pass)
+			}
+
+			w := serve(r, req)
+			assert.Equal(t, test.code, w.Code)
+		})
+	}
+}
+
+func TestSendGridMail_Unconfigured(t *testing.T) {
+	s := NewMailProvider()
+
+	r := mux.NewRouter()
+	err := s.Start("example.com", inmemory.GetInMemoryDB(), r, func(r policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	})
+	require.NoError(t, err)
+
+	req := newRequest(t, "/sendgrid/incoming/", map[string]string{"envelope": testEnvelope, "email": testRaw}, nil)
+	req.SetBasicAuth("", "")
+
+	w := serve(r, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers := parseHeaders(testHeaders)
+
+	assert.Equal(t, [2]string{"From", "Hayden Woodhead <hayden@example.com>"}, headers[1])
+	assert.Equal(t, [2]string{"Content-Type", "multipart/alternative; boundary=001a113df448cad2d00538a0e1a3"}, headers[5])
+	assert.Len(t, headers, 6)
+}
@@ -0,0 +1,133 @@
+package sesmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// recipientHeaders are checked for recipients of messages received through S3 events as these don't include the
+// envelope
+var recipientHeaders = []string{"Delivered-To", "X-Original-To", "To", "Cc"}
+
+// HandleLambdaEvent implements burner.LambdaEventHandler. It receives mail from SES events, where the message is
+// fetched from the configured bucket, and from S3 events for objects the receipt rule's S3 action stores.
+func (s *SESMail) HandleLambdaEvent(ctx context.Context, payload []byte) (bool, error) {
+	var probe struct {
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+
+	err := json.Unmarshal(payload, &probe)
+	if err != nil || len(probe.Records) == 0 {
+		return false, nil
+	}
+
+	switch probe.Records[0].EventSource {
+	case "aws:ses":
+		var e events.SimpleEmailEvent
+		err = json.Unmarshal(payload, &e)
+		if err != nil {
+			return true, fmt.Errorf("SES - failed to unmarshal ses event: %w", err)
+		}
+		return true, s.sesEvent(ctx, e)
+	case "aws:s3":
+		var e events.S3Event
+		err = json.Unmarshal(payload, &e)
+		if err != nil {
+			return true, fmt.Errorf("SES - failed to unmarshal s3 event: %w", err)
+		}
+		return true, s.s3Event(ctx, e)
+	default:
+		return false, nil
+	}
+}
+
+// sesEvent receives the messages in an SES event. SES events don't include the message so it is fetched from where
+// an earlier S3 action in the receipt rule stored it.
+func (s *SESMail) sesEvent(ctx context.Context, e events.SimpleEmailEvent) error {
+	if s.bucket == "" {
+		return errors.New("SES - no bucket is configured to fetch messages in ses events from")
+	}
+
+	for _, r := range e.Records {
+		raw, err := s.getObject(ctx, s.bucket, s.prefix+r.SES.Mail.MessageID)
+		if err != nil {
+			return err
+		}
+
+		err = s.receive(raw, r.SES.Mail.Source, r.SES.Receipt.Recipients, r.SES.Mail.MessageID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// s3Event receives messages stored in S3. Only the message is available so the sender and recipients are taken from
+// its headers.
+func (s *SESMail) s3Event(ctx context.Context, e events.S3Event) error {
+	for _, r := range e.Records {
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return fmt.Errorf("SES - failed to unescape object key %v: %w", r.S3.Object.Key, err)
+		}
+
+		raw, err := s.getObject(ctx, r.S3.Bucket.Name, key)
+		if err != nil {
+			return err
+		}
+
+		sender, recipients, err := envelopeFromHeaders(raw)
+		if err != nil {
+			return fmt.Errorf("SES - failed to read headers of %v: %w", key, err)
+		}
+
+		err = s.receive(raw, sender, recipients, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// envelopeFromHeaders returns the sender and recipients of raw from its Return-Path and recipient headers
+func envelopeFromHeaders(raw []byte) (string, []string, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var sender string
+	if rp, err := mail.ParseAddress(m.Header.Get("Return-Path")); err == nil {
+		sender = rp.Address
+	}
+
+	seen := make(map[string]bool)
+	var recipients []string
+
+	for _, h := range recipientHeaders {
+		addrs, err := m.Header.AddressList(h)
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if !seen[a.Address] {
+				seen[a.Address] = true
+				recipients = append(recipients, a.Address)
+			}
+		}
+	}
+
+	return sender, recipients, nil
+}
@@ -0,0 +1,50 @@
+package sesmail
+
+import (
+	"errors"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+)
+
+var settings = inbound.WithSettings(
+	burner.Setting{Name: "SES_TOPIC_ARNS", Description: "SNS topics notifications are accepted from, required unless running on lambda"},
+	burner.Setting{Name: "SES_S3_BUCKET", Description: "bucket the receipt rule stores messages in"},
+	burner.Setting{Name: "SES_S3_PREFIX", Description: "key prefix the receipt rule stores messages under"},
+)
+
+func init() {
+	burner.RegisterEmailProvider("ses", settings, newFromSettings)
+}
+
+func newFromSettings(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+	// without any topics every notification posted to the webhook would be refused
+	topics := s.Slice("SES_TOPIC_ARNS")
+	if len(topics) == 0 && !c.Lambda {
+		return nil, errors.New("env var SES_TOPIC_ARNS cannot be empty unless running on lambda")
+	}
+
+	spamFilter, err := inbound.SpamFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	virusFilter, err := inbound.VirusFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithTopics(topics),
+		WithSpool(c.Spool),
+		WithSubaddressSeparator(s.String("SUBADDRESS_SEPARATOR")),
+		WithSpamFilter(spamFilter),
+		WithVirusFilter(virusFilter),
+	}
+
+	if bucket := s.String("SES_S3_BUCKET"); bucket != "" {
+		opts = append(opts, WithBucket(bucket, s.String("SES_S3_PREFIX")))
+	}
+
+	return NewMailProvider(opts...), nil
+}
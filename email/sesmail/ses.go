@@ -0,0 +1,308 @@
+package sesmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ burner.EmailProvider = &SESMail{}
+var _ burner.LambdaEventHandler = &SESMail{}
+
+// maxNotificationSize is the largest SNS notification accepted. SES only includes messages up to 150KB in
+// notifications, larger messages have to be stored in S3.
+const maxNotificationSize = 1024 * 1024
+
+// s3API is the part of the S3 client used to fetch messages SES has stored
+type s3API interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+// SESMail is an Amazon SES implementation of the EmailProvider interface. SES receipt rules deliver mail either as
+// SNS notifications posted to /ses/incoming/ or, when running on lambda, as SES or S3 events.
+type SESMail struct {
+	deliverer           *inbound.Deliverer
+	subaddressSeparator string
+	spamFilter          *spam.Filter
+	virusFilter         *virus.Filter
+	spool               burner.Spooler
+	topics              []string
+	bucket              string
+	prefix              string
+	s3                  s3API
+	sns                 *verifier
+}
+
+// Option configures optional behaviour of SESMail
+type Option func(s *SESMail)
+
+// WithTopics accepts SNS notifications from the given topic ARNs. Notifications from any other topic are refused.
+func WithTopics(arns []string) Option {
+	return func(s *SESMail) {
+		s.topics = arns
+	}
+}
+
+// WithBucket sets the bucket and key prefix the receipt rule's S3 action stores messages under. This is needed to
+// receive SES lambda events as they don't include the message itself.
+func WithBucket(bucket string, prefix string) Option {
+	return func(s *SESMail) {
+		s.bucket = bucket
+		s.prefix = prefix
+	}
+}
+
+// WithSubaddressSeparator delivers a notification's subaddressed recipients, e.g. "user+detail@example.com", to the
+// inbox of their base address. The receipt rule must already accept them, which it does when it matches the domain.
+func WithSubaddressSeparator(separator string) Option {
+	return func(s *SESMail) {
+		s.subaddressSeparator = separator
+	}
+}
+
+// WithSpamFilter checks each message's raw content with f, whether it was sent in the notification or fetched from S3,
+// storing the score on the message. SES has already accepted the mail by the time it notifies us so mail f says to
+// reject is dropped rather than bounced.
+func WithSpamFilter(f *spam.Filter) Option {
+	return func(s *SESMail) {
+		s.spamFilter = f
+	}
+}
+
+// WithVirusFilter checks each message's raw content with f, storing the verdict on the message. As with
+// WithSpamFilter mail f says to reject is dropped since SES has already accepted it.
+func WithVirusFilter(f *virus.Filter) Option {
+	return func(s *SESMail) {
+		s.virusFilter = f
+	}
+}
+
+// WithSpool acknowledges notifications once their messages are written to sp rather than saved to the database,
+// so SNS doesn't redeliver them while the database is unavailable.
+func WithSpool(sp burner.Spooler) Option {
+	return func(s *SESMail) {
+		s.spool = sp
+	}
+}
+
+// NewMailProvider creates a new SES EmailProvider. AWS credentials and region are taken from the environment.
+func NewMailProvider(opts ...Option) *SESMail {
+	s := &SESMail{
+		s3:  s3.New(session.Must(session.NewSession())),
+		sns: newVerifier(),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Start implements EmailProvider Start()
+func (s *SESMail) Start(websiteAddr string, db burner.Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error {
+	s.deliverer = &inbound.Deliverer{
+		Provider:            "ses",
+		DB:                  db,
+		CheckPolicy:         checkPolicy,
+		SubaddressSeparator: s.subaddressSeparator,
+		SpamFilter:          s.spamFilter,
+		VirusFilter:         s.virusFilter,
+		Spool:               s.spool,
+	}
+	r.HandleFunc("/ses/incoming/", s.sesIncoming).Methods(http.MethodPost)
+	return nil
+}
+
+// Stop implements EmailProvider Stop(). There is nothing to stop, the spool is shared with other providers and stopped
+// by the caller.
+func (s *SESMail) Stop() error {
+	return nil
+}
+
+// RegisterRoute implements RegisterRoute(). Receipt rules match whole domains so there is nothing to register.
+func (s *SESMail) RegisterRoute(i burner.Inbox) (string, error) {
+	return "ses", nil
+}
+
+// DeleteRoute implements DeleteRoute(). No route was registered so there is nothing to delete.
+func (s *SESMail) DeleteRoute(id string) error {
+	return nil
+}
+
+// sesNotification is the message SES publishes to SNS when it receives mail. content is only set when the receipt
+// rule uses an SNS action.
+type sesNotification struct {
+	NotificationType string                    `json:"notificationType"`
+	Mail             events.SimpleEmailMessage `json:"mail"`
+	Receipt          sesReceipt                `json:"receipt"`
+	Content          string                    `json:"content"`
+}
+
+type sesReceipt struct {
+	events.SimpleEmailReceipt
+	Action sesAction `json:"action"`
+}
+
+// sesAction adds the encoding of SNS actions which isn't included in events.SimpleEmailReceiptAction
+type sesAction struct {
+	events.SimpleEmailReceiptAction
+	Encoding string `json:"encoding"`
+}
+
+func (s *SESMail) sesIncoming(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxNotificationSize))
+	if err != nil {
+		log.WithError(err).Error("SESIncoming: failed to read request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var m snsMessage
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		log.WithError(err).Error("SESIncoming: failed to unmarshal notification")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = s.sns.verify(m)
+	if err != nil {
+		log.WithError(err).WithField("topic", m.TopicArn).Info("SESIncoming: failed to verify notification")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !s.topicAllowed(m.TopicArn) {
+		log.WithField("topic", m.TopicArn).Info("SESIncoming: notification from unknown topic")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch m.Type {
+	case snsSubscriptionConfirmation:
+		err = s.sns.confirm(m)
+		if err != nil {
+			log.WithError(err).WithField("topic", m.TopicArn).Error("SESIncoming: failed to confirm subscription")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.WithField("topic", m.TopicArn).Info("SESIncoming: confirmed subscription")
+	case snsUnsubscribeConfirmation:
+		log.WithField("topic", m.TopicArn).Info("SESIncoming: unsubscribed from topic")
+	case snsNotification:
+		err = s.notification(r.Context(), m)
+		if err != nil {
+			log.WithError(err).WithField("id", m.MessageID).Error("SESIncoming: failed to receive message")
+			// SNS retries failed deliveries
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	default:
+		log.WithField("type", m.Type).Info("SESIncoming: unknown notification type")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *SESMail) topicAllowed(arn string) bool {
+	for _, t := range s.topics {
+		if t == arn {
+			return true
+		}
+	}
+	return false
+}
+
+// notification receives the message in an SES notification
+func (s *SESMail) notification(ctx context.Context, m snsMessage) error {
+	var n sesNotification
+	err := json.Unmarshal([]byte(m.Message), &n)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal ses notification: %w", err)
+	}
+
+	// SES also sends a test notification when the rule is created
+	if n.NotificationType != "Received" {
+		log.WithField("type", n.NotificationType).Info("SESIncoming: ignoring notification")
+		return nil
+	}
+
+	var raw []byte
+
+	switch {
+	case n.Receipt.Action.Type == "S3":
+		raw, err = s.getObject(ctx, n.Receipt.Action.BucketName, n.Receipt.Action.ObjectKey)
+		if err != nil {
+			return err
+		}
+	case n.Receipt.Action.Encoding == "BASE64":
+		raw, err = base64.StdEncoding.DecodeString(n.Content)
+		if err != nil {
+			return fmt.Errorf("failed to decode content: %w", err)
+		}
+	default:
+		raw = []byte(n.Content)
+	}
+
+	if len(raw) == 0 {
+		return errors.New("notification doesn't include the message")
+	}
+
+	return s.receive(raw, n.Mail.Source, n.Receipt.Recipients, n.Mail.MessageID)
+}
+
+// getObject returns the message stored in bucket under key
+func (s *SESMail) getObject(ctx context.Context, bucket string, key string) ([]byte, error) {
+	out, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("SES - failed to get message %v from bucket %v: %w", key, bucket, err)
+	}
+	defer out.Body.Close()
+
+	raw, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("SES - failed to read message %v from bucket %v: %w", key, bucket, err)
+	}
+
+	return raw, nil
+}
+
+// receive parses raw and delivers it to each of recipients which has an inbox. An error is only returned if
+// delivery should be retried, mail which is rejected is dropped as SES has already accepted it.
+func (s *SESMail) receive(raw []byte, sender string, recipients []string, id string) error {
+	msg, err := email.ParseMessage(raw)
+	if err != nil {
+		// retrying won't help
+		log.WithError(err).WithField("id", id).Error("SES: failed to parse message")
+		return nil
+	}
+
+	msg.EmailProviderID = id
+	msg.Sender = sender
+
+	return s.deliverer.Deliver(raw, msg, recipients)
+}
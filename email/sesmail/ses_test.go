@@ -0,0 +1,264 @@
+package sesmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/data/inmemory"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = "arn:aws:sns:us-east-1:123456789012:burner-kiwi-inbound"
+
+const testInboxID = "17b79467-f409-4e7d-86a9-0dc79b77f7c3"
+
+// fakeS3 serves objects from memory keyed by bucket and key
+type fakeS3 map[string][]byte
+
+func (f fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	b, ok := f[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func fixture(t *testing.T, name string) []byte {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return b
+}
+
+func newTestSESMail(t *testing.T, s *signer, opts ...Option) *SESMail {
+	m := &SESMail{
+		s3:  fakeS3{"burner-kiwi-inbound/mail/o3vrnil0e2ic28trm7dfhrc2v0cnbeccl4nbp0g1": fixture(t, "message.eml")},
+		sns: s.verifier(),
+	}
+
+	for _, opt := range append([]Option{WithTopics([]string{testTopic})}, opts...) {
+		opt(m)
+	}
+
+	err := m.Start("example.com", inmemory.GetInMemoryDB(), mux.NewRouter(), func(r policy.Request) policy.Decision {
+		return policy.Decision{Allowed: true}
+	})
+	require.NoError(t, err)
+
+	m.deliverer.DB.SaveNewInbox(burner.Inbox{
+		Address:   "bobby@example.com",
+		ID:        testInboxID,
+		CreatedAt: time.Now().Unix(),
+		TTL:       time.Now().Add(1 * time.Hour).Unix(),
+	})
+
+	return m
+}
+
+func post(t *testing.T, m *SESMail, sns snsMessage) *httptest.ResponseRecorder {
+	b, err := json.Marshal(sns)
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ses/incoming/", m.sesIncoming)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ses/incoming/", bytes.NewReader(b)))
+	return w
+}
+
+func assertReceived(t *testing.T, db burner.Database) {
+	msgs, err := db.GetMessagesByInboxID(testInboxID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	msg := msgs[0]
+	assert.Equal(t, "o3vrnil0e2ic28trm7dfhrc2v0cnbeccl4nbp0g1", msg.EmailProviderID)
+	assert.Equal(t, "hayden@example.com", msg.Sender)
+	assert.Equal(t, "hayden@example.com", msg.FromAddress)
+	assert.Equal(t, "Hayden Woodhead", msg.FromName)
+	assert.Equal(t, "bobby@example.com", msg.Recipient)
+	assert.Equal(t, "Gophers!", msg.Subject)
+	assert.Equal(t, "Hello there", msg.BodyPlain)
+	assert.Equal(t, `<html><head></head><body><div dir="ltr"><a href="https://example.com" target="_blank" rel="noopener noreferrer">Hello there</a></div></body></html>`, msg.BodyHTML)
+}
+
+func TestSESMail_SESIncoming(t *testing.T) {
+	s := newSigner(t)
+	m := newTestSESMail(t, s)
+
+	sns := loadSNS(t, "sns_notification.json")
+	s.sign(t, &sns)
+
+	w := post(t, m, sns)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assertReceived(t, m.deliverer.DB)
+}
+
+func TestSESMail_SESIncoming_S3Action(t *testing.T) {
+	s := newSigner(t)
+	m := newTestSESMail(t, s)
+
+	sns := loadSNS(t, "sns_notification_s3.json")
+	s.sign(t, &sns)
+
+	w := post(t, m, sns)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assertReceived(t, m.deliverer.DB)
+
+	// sns retries if the message can't be fetched
+	m.s3 = fakeS3{}
+	w = post(t, m, sns)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestSESMail_SESIncoming_Unverified(t *testing.T) {
+	s := newSigner(t)
+	m := newTestSESMail(t, s)
+
+	sns := loadSNS(t, "sns_notification.json")
+	s.sign(t, &sns)
+	sns.Subject = "tampered"
+
+	w := post(t, m, sns)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	msgs, _ := m.deliverer.DB.GetMessagesByInboxID(testInboxID)
+	assert.Empty(t, msgs)
+}
+
+func TestSESMail_SESIncoming_UnknownTopic(t *testing.T) {
+	s := newSigner(t)
+	m := newTestSESMail(t, s, WithTopics([]string{"arn:aws:sns:us-east-1:123456789012:other"}))
+
+	sns := loadSNS(t, "sns_notification.json")
+	s.sign(t, &sns)
+
+	w := post(t, m, sns)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	msgs, _ := m.deliverer.DB.GetMessagesByInboxID(testInboxID)
+	assert.Empty(t, msgs)
+}
+
+func TestSESMail_SESIncoming_Subscription(t *testing.T) {
+	s := newSigner(t)
+
+	confirmed := false
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("Action") == "ConfirmSubscription" {
+			confirmed = true
+		}
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	m := newTestSESMail(t, s)
+	m.sns.client = srv.Client()
+	m.sns.host = regexp.MustCompile("^(" + regexp.QuoteMeta(u.Host) + "|sns\\.us-east-1\\.amazonaws\\.com)$")
+
+	sns := loadSNS(t, "sns_subscription.json")
+	sns.SubscribeURL = srv.URL + "/?Action=ConfirmSubscription&TopicArn=" + url.QueryEscape(testTopic) + "&Token=" + sns.Token
+	s.sign(t, &sns)
+
+	w := post(t, m, sns)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, confirmed)
+}
+
+func TestSESMail_HandleLambdaEvent_SES(t *testing.T) {
+	s := newSigner(t)
+
+	// without a bucket the message can't be fetched
+	m := newTestSESMail(t, s)
+	handled, err := m.HandleLambdaEvent(context.Background(), fixture(t, "ses_event.json"))
+	assert.True(t, handled)
+	assert.Error(t, err)
+
+	m = newTestSESMail(t, s, WithBucket("burner-kiwi-inbound", "mail/"))
+	handled, err = m.HandleLambdaEvent(context.Background(), fixture(t, "ses_event.json"))
+	assert.True(t, handled)
+	require.NoError(t, err)
+	assertReceived(t, m.deliverer.DB)
+}
+
+func TestSESMail_HandleLambdaEvent_S3(t *testing.T) {
+	s := newSigner(t)
+	m := newTestSESMail(t, s)
+
+	handled, err := m.HandleLambdaEvent(context.Background(), fixture(t, "s3_event.json"))
+	assert.True(t, handled)
+	require.NoError(t, err)
+
+	msgs, err := m.deliverer.DB.GetMessagesByInboxID(testInboxID)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "hayden@example.com", msgs[0].Sender)
+	assert.Equal(t, "mail/o3vrnil0e2ic28trm7dfhrc2v0cnbeccl4nbp0g1", msgs[0].EmailProviderID)
+}
+
+func TestSESMail_HandleLambdaEvent_Other(t *testing.T) {
+	m := newTestSESMail(t, newSigner(t))
+
+	for _, payload := range []string{
+		`{"httpMethod":"GET","path":"/"}`,
+		`{"Records":[{"eventSource":"aws:sqs"}]}`,
+		`not json`,
+	} {
+		handled, err := m.HandleLambdaEvent(context.Background(), []byte(payload))
+		assert.False(t, handled, payload)
+		assert.NoError(t, err, payload)
+	}
+}
+
+func TestEnvelopeFromHeaders(t *testing.T) {
+	raw := []byte("Return-Path: <bounce@example.org>\r\n" +
+		"Delivered-To: bobby@example.com\r\n" +
+		"To: Bobby <bobby@example.com>, alice@example.com\r\n" +
+		"Cc: carol@example.com\r\n" +
+		"\r\n" +
+		"Hi")
+
+	sender, rcpts, err := envelopeFromHeaders(raw)
+	require.NoError(t, err)
+	assert.Equal(t, "bounce@example.org", sender)
+	assert.Equal(t, []string{"bobby@example.com", "alice@example.com", "carol@example.com"}, rcpts)
+}
+
+func TestNewFromSettings_Topics(t *testing.T) {
+	newSettings := func(env map[string]string) burner.Settings {
+		s, err := burner.NewSettings(settings, func(key string) string { return env[key] })
+		require.NoError(t, err)
+		return s
+	}
+
+	_, err := newFromSettings(newSettings(nil), burner.Components{})
+	assert.EqualError(t, err, "env var SES_TOPIC_ARNS cannot be empty unless running on lambda")
+
+	// lambda invocations don't come through the webhook so don't need a topic
+	_, err = newFromSettings(newSettings(nil), burner.Components{Lambda: true})
+	assert.NoError(t, err)
+
+	p, err := newFromSettings(newSettings(map[string]string{"SES_TOPIC_ARNS": testTopic}), burner.Components{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{testTopic}, p.(*SESMail).topics)
+}
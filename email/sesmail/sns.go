@@ -0,0 +1,226 @@
+package sesmail
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SNS message types
+const (
+	snsNotification             = "Notification"
+	snsSubscriptionConfirmation = "SubscriptionConfirmation"
+	snsUnsubscribeConfirmation  = "UnsubscribeConfirmation"
+)
+
+// snsHost matches the hosts SNS signing certificates and subscription urls are served from
+var snsHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// maxCertSize is the largest signing certificate which will be downloaded
+const maxCertSize = 64 * 1024
+
+// snsMessage is a message delivered by SNS over http. Fields are kept as sent as they're needed to check the
+// signature.
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// stringToSign builds the string SNS signs for m. Which fields are included depends on the type of message.
+func (m snsMessage) stringToSign() string {
+	var fields [][2]string
+
+	switch m.Type {
+	case snsNotification:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageID},
+			{"Subject", m.Subject},
+			{"Timestamp", m.Timestamp},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}
+	default:
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageID},
+			{"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp},
+			{"Token", m.Token},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}
+	}
+
+	var b strings.Builder
+	for _, f := range fields {
+		// subject is only signed when present
+		if f[0] == "Subject" && f[1] == "" {
+			continue
+		}
+		b.WriteString(f[0])
+		b.WriteString("\n")
+		b.WriteString(f[1])
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// verifier checks the signatures of SNS messages. Signing certificates are cached by url.
+type verifier struct {
+	client *http.Client
+	host   *regexp.Regexp
+
+	m     sync.Mutex
+	certs map[string]*x509.Certificate
+}
+
+func newVerifier() *verifier {
+	return &verifier{
+		client: &http.Client{Timeout: 10 * time.Second},
+		host:   snsHost,
+		certs:  make(map[string]*x509.Certificate),
+	}
+}
+
+// verify checks that m was signed by SNS
+func (v *verifier) verify(m snsMessage) error {
+	var hash crypto.Hash
+	var digest []byte
+
+	switch m.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(m.stringToSign()))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(m.stringToSign()))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("unsupported signature version %q", m.SignatureVersion)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	cert, err := v.cert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signing certificate doesn't have an rsa key")
+	}
+
+	err = rsa.VerifyPKCS1v15(key, hash, digest, sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	return nil
+}
+
+// checkURL returns an error unless raw is a https url on an SNS host
+func (v *verifier) checkURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	if u.Scheme != "https" || !v.host.MatchString(u.Host) {
+		return nil, fmt.Errorf("url %v isn't an SNS url", raw)
+	}
+
+	return u, nil
+}
+
+// cert returns the certificate at raw downloading it if it isn't cached
+func (v *verifier) cert(raw string) (*x509.Certificate, error) {
+	u, err := v.checkURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	v.m.Lock()
+	cert, ok := v.certs[u.String()]
+	v.m.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	resp, err := v.client.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signing certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get signing certificate: status %v", resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxCertSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing certificate: %w", err)
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("signing certificate isn't pem encoded")
+	}
+
+	cert, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing certificate: %w", err)
+	}
+
+	v.m.Lock()
+	v.certs[u.String()] = cert
+	v.m.Unlock()
+
+	return cert, nil
+}
+
+// confirm confirms a subscription by visiting its subscribe url
+func (v *verifier) confirm(m snsMessage) error {
+	u, err := v.checkURL(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.client.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("failed to confirm subscription: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to confirm subscription: status %v", resp.StatusCode)
+	}
+
+	return nil
+}
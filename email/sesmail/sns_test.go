@@ -0,0 +1,185 @@
+package sesmail
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertURL is the signing certificate url used by the fixtures
+const testCertURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-01d088a6f77103d0fe307c0069e40ed6.pem"
+
+// signer stands in for SNS. The fixtures were recorded without signatures so they are signed by the tests.
+type signer struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newSigner(t *testing.T) *signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &signer{key: key, cert: cert}
+}
+
+// verifier returns a verifier which trusts the signer's certificate for the fixtures' certificate url
+func (s *signer) verifier() *verifier {
+	v := newVerifier()
+	v.certs[testCertURL] = s.cert
+	return v
+}
+
+func (s *signer) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})
+}
+
+func (s *signer) sign(t *testing.T, m *snsMessage) {
+	var sig []byte
+	var err error
+
+	switch m.SignatureVersion {
+	case "2":
+		sum := sha256.Sum256([]byte(m.stringToSign()))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	default:
+		sum := sha1.Sum([]byte(m.stringToSign()))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, sum[:])
+	}
+	require.NoError(t, err)
+
+	m.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+func loadSNS(t *testing.T, name string) snsMessage {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+
+	var m snsMessage
+	require.NoError(t, json.Unmarshal(b, &m))
+	return m
+}
+
+func TestSNSMessage_StringToSign(t *testing.T) {
+	m := snsMessage{
+		Type:         snsNotification,
+		MessageID:    "1",
+		TopicArn:     "arn",
+		Message:      "hello",
+		Timestamp:    "2026-10-19T01:00:00.512Z",
+		SubscribeURL: "ignored",
+	}
+
+	assert.Equal(t, "Message\nhello\nMessageId\n1\nTimestamp\n2026-10-19T01:00:00.512Z\nTopicArn\narn\nType\nNotification\n", m.stringToSign())
+
+	m.Subject = "Hi"
+	assert.Equal(t, "Message\nhello\nMessageId\n1\nSubject\nHi\nTimestamp\n2026-10-19T01:00:00.512Z\nTopicArn\narn\nType\nNotification\n", m.stringToSign())
+
+	m.Type = snsSubscriptionConfirmation
+	m.Token = "tok"
+	assert.Equal(t, "Message\nhello\nMessageId\n1\nSubscribeURL\nignored\nTimestamp\n2026-10-19T01:00:00.512Z\nToken\ntok\nTopicArn\narn\nType\nSubscriptionConfirmation\n", m.stringToSign())
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	s := newSigner(t)
+	v := s.verifier()
+
+	for _, version := range []string{"1", "2"} {
+		m := loadSNS(t, "sns_notification.json")
+		m.SignatureVersion = version
+		s.sign(t, &m)
+		assert.NoError(t, v.verify(m), "version %v", version)
+
+		m.Message = "tampered"
+		assert.Error(t, v.verify(m), "version %v", version)
+	}
+
+	m := loadSNS(t, "sns_notification.json")
+	m.SignatureVersion = "3"
+	s.sign(t, &m)
+	assert.Error(t, v.verify(m))
+
+	// signatures from other keys aren't accepted
+	m = loadSNS(t, "sns_notification.json")
+	newSigner(t).sign(t, &m)
+	assert.Error(t, v.verify(m))
+}
+
+func TestVerifier_CheckURL(t *testing.T) {
+	v := newVerifier()
+
+	for _, u := range []string{
+		"https://sns.us-east-1.amazonaws.com/cert.pem",
+		"https://sns.cn-north-1.amazonaws.com.cn/cert.pem",
+	} {
+		_, err := v.checkURL(u)
+		assert.NoError(t, err, u)
+	}
+
+	for _, u := range []string{
+		"http://sns.us-east-1.amazonaws.com/cert.pem",
+		"https://sns.us-east-1.amazonaws.com.example.com/cert.pem",
+		"https://example.com/sns.us-east-1.amazonaws.com/cert.pem",
+		"https://s3.amazonaws.com/cert.pem",
+	} {
+		_, err := v.checkURL(u)
+		assert.Error(t, err, u)
+	}
+}
+
+func TestVerifier_Cert(t *testing.T) {
+	s := newSigner(t)
+
+	var fetched int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write(s.pem())
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	v := newVerifier()
+	v.client = srv.Client()
+	v.host = regexp.MustCompile("^" + regexp.QuoteMeta(u.Host) + "$")
+
+	m := loadSNS(t, "sns_notification.json")
+	m.SigningCertURL = srv.URL + "/cert.pem"
+	s.sign(t, &m)
+
+	require.NoError(t, v.verify(m))
+	require.NoError(t, v.verify(m))
+	assert.Equal(t, 1, fetched, "the certificate should be cached")
+}
@@ -19,6 +19,11 @@ func (m *MockDatabase) EmailAddressExists(address string) (bool, error) {
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *MockDatabase) GetPatternInbox(address string) (burner.Inbox, bool, error) {
+	args := m.Called(address)
+	return args.Get(0).(burner.Inbox), args.Bool(1), args.Error(2)
+}
+
 func (m *MockDatabase) GetInboxByAddress(address string) (burner.Inbox, error) {
 	args := m.Called(address)
 	return args.Get(0).(burner.Inbox), args.Error(1)
@@ -29,6 +34,21 @@ func (m *MockDatabase) GetInboxByID(id string) (burner.Inbox, error) {
 	return args.Get(0).(burner.Inbox), args.Error(1)
 }
 
+func (m *MockDatabase) SetInboxAllowedSenders(i burner.Inbox) error {
+	args := m.Called(i)
+	return args.Error(0)
+}
+
+func (m *MockDatabase) DeleteAllMessages() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockDatabase) GetInboxesWithMessages() ([]burner.Inbox, error) {
+	args := m.Called()
+	return args.Get(0).([]burner.Inbox), args.Error(1)
+}
+
 func (m *MockDatabase) GetMessageByID(inboxID string, messageID string) (burner.Message, error) {
 	args := m.Called(inboxID, messageID)
 	return args.Get(0).(burner.Message), args.Error(1)
@@ -44,6 +64,11 @@ func (m *MockDatabase) SaveNewInbox(inbox burner.Inbox) error {
 	return args.Error(0)
 }
 
+func (m *MockDatabase) SaveNewMessageOnce(message burner.Message) error {
+	args := m.Called(message)
+	return args.Error(0)
+}
+
 func (m *MockDatabase) SaveNewMessage(message burner.Message) error {
 	args := m.Called(message)
 	return args.Error(0)
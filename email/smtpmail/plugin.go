@@ -0,0 +1,220 @@
+package smtpmail
+
+import (
+	"fmt"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/inbound"
+	"github.com/haydenwoodhead/burner.kiwi/greylist"
+	"github.com/haydenwoodhead/burner.kiwi/proxyproto"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
+	"github.com/haydenwoodhead/burner.kiwi/reputation"
+)
+
+const memoryGreylistStore = "memory"
+const dbGreylistStore = "db"
+
+// settings are shared by the SMTP and LMTP providers
+var settings = []burner.Setting{
+	{Name: "SMTP_PROXY_TRUSTED", Description: "comma separated CIDRs of proxies allowed to send a PROXY protocol header"},
+	{Name: "GREYLIST", Description: "greylist unknown client, sender and recipient triplets", Default: "false"},
+	{Name: "GREYLIST_STORE", Description: "where greylist entries are kept, memory or db", Default: memoryGreylistStore},
+	{Name: "GREYLIST_ALLOW", Description: "comma separated senders which aren't greylisted"},
+	{Name: "GREYLIST_DELAY", Description: "how long a new triplet is refused for", Default: "5m"},
+	{Name: "GREYLIST_WHITELIST", Description: "how long a triplet is accepted for after it is retried", Default: "720h"},
+	{Name: "DNSBL_ZONES", Description: "comma separated DNSBL zones to look up clients in"},
+	{Name: "DNSBL_ACTION", Description: "what to do with listed clients, reject or tag", Default: string(reputation.Reject)},
+	{Name: "FCRDNS_CHECK", Description: "what to do with clients without forward confirmed reverse DNS, reject or tag"},
+	{Name: "HELO_CHECK", Description: "what to do with clients sending a bad HELO, reject or tag"},
+	{Name: "RATE_LIMIT_SMTP_CONN", Description: "connections allowed per client e.g. 10/m"},
+	{Name: "RATE_LIMIT_SMTP_MSG", Description: "messages allowed per client e.g. 100/h"},
+}
+
+func init() {
+	smtpSettings := append([]burner.Setting{{Name: "SMTP_LISTEN", Description: "address to listen for SMTP on", Default: ":25"}}, settings...)
+	burner.RegisterEmailProvider("smtp", inbound.WithSettings(smtpSettings...), func(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+		opts, err := options(s, c)
+		if err != nil {
+			return nil, err
+		}
+		return NewMailProvider(s.String("SMTP_LISTEN"), opts...), nil
+	})
+
+	lmtpSettings := append([]burner.Setting{{Name: "LMTP_LISTEN", Description: "unix socket or tcp address to listen for LMTP on", Default: "unix:/var/run/burnerkiwi/lmtp.sock"}}, settings...)
+	burner.RegisterEmailProvider("lmtp", inbound.WithSettings(lmtpSettings...), func(s burner.Settings, c burner.Components) (burner.EmailProvider, error) {
+		opts, err := options(s, c)
+		if err != nil {
+			return nil, err
+		}
+		return NewLMTPMailProvider(s.String("LMTP_LISTEN"), opts...), nil
+	})
+}
+
+// options returns the options configured by s
+func options(s burner.Settings, c burner.Components) ([]Option, error) {
+	spamFilter, err := inbound.SpamFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	virusFilter, err := inbound.VirusFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithIngestQueue(c.IngestQueue),
+		WithSpool(c.Spool),
+		WithSubaddressSeparator(s.String("SUBADDRESS_SEPARATOR")),
+		WithSpamFilter(spamFilter),
+		WithVirusFilter(virusFilter),
+	}
+
+	if trusted := s.Slice("SMTP_PROXY_TRUSTED"); len(trusted) > 0 {
+		nets, err := proxyproto.ParseCIDRs(trusted)
+		if err != nil {
+			return nil, fmt.Errorf("env var SMTP_PROXY_TRUSTED is invalid: %w", err)
+		}
+		opts = append(opts, WithProxyProtocol(nets))
+	}
+
+	if c.MailTrap {
+		opts = append(opts, WithMailTrap())
+	}
+
+	checker, err := reputationChecker(s)
+	if err != nil {
+		return nil, err
+	}
+	if checker != nil {
+		opts = append(opts, WithReputationChecks(checker))
+	}
+
+	greylisting, err := s.Bool("GREYLIST")
+	if err != nil {
+		return nil, err
+	}
+	if greylisting {
+		g, err := greylister(s, c)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithGreylisting(g))
+	}
+
+	connLimit, err := rateLimit(s, c, "RATE_LIMIT_SMTP_CONN", "smtp_conn")
+	if err != nil {
+		return nil, err
+	}
+
+	msgLimit, err := rateLimit(s, c, "RATE_LIMIT_SMTP_MSG", "smtp_msg")
+	if err != nil {
+		return nil, err
+	}
+
+	if connLimit != nil || msgLimit != nil {
+		opts = append(opts, WithRateLimits(connLimit, msgLimit))
+	}
+
+	return opts, nil
+}
+
+// greylister returns a greylister configured by the GREYLIST_ settings. Keeping entries in the database shares them
+// between instances.
+func greylister(s burner.Settings, c burner.Components) (*greylist.Greylister, error) {
+	var store greylist.Store
+
+	switch storeType := s.String("GREYLIST_STORE"); storeType {
+	case memoryGreylistStore:
+		store = greylist.NewMemoryStore()
+	case dbGreylistStore:
+		dbStore, ok := c.DB.(greylist.Store)
+		if !ok {
+			return nil, fmt.Errorf("env var GREYLIST_STORE is invalid: DB_TYPE %v can't store greylist entries, use %v", c.DBType, memoryGreylistStore)
+		}
+		store = dbStore
+	default:
+		return nil, fmt.Errorf("env var GREYLIST_STORE is invalid: must be one of %v or %v", memoryGreylistStore, dbGreylistStore)
+	}
+
+	allowed, err := burner.ParseSenderList(s.Slice("GREYLIST_ALLOW"))
+	if err != nil {
+		return nil, fmt.Errorf("env var GREYLIST_ALLOW is invalid: %w", err)
+	}
+
+	delay, err := s.Duration("GREYLIST_DELAY")
+	if err != nil {
+		return nil, err
+	}
+
+	whitelist, err := s.Duration("GREYLIST_WHITELIST")
+	if err != nil {
+		return nil, err
+	}
+
+	return greylist.New(greylist.Windows{Delay: delay, Whitelist: whitelist}, store, allowed), nil
+}
+
+// reputationChecker returns a checker running the configured sender reputation checks or nil if none are enabled
+func reputationChecker(s burner.Settings) (*reputation.Checker, error) {
+	var opts []reputation.Option
+
+	if zones := s.Slice("DNSBL_ZONES"); len(zones) > 0 {
+		action, err := reputationAction(s, "DNSBL_ACTION")
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, reputation.WithDNSBL(zones, action))
+	}
+
+	action, err := reputationAction(s, "FCRDNS_CHECK")
+	if err != nil {
+		return nil, err
+	}
+	if action != "" {
+		opts = append(opts, reputation.WithFCrDNS(action))
+	}
+
+	action, err = reputationAction(s, "HELO_CHECK")
+	if err != nil {
+		return nil, err
+	}
+	if action != "" {
+		opts = append(opts, reputation.WithHelo(action))
+	}
+
+	if len(opts) == 0 {
+		return nil, nil
+	}
+
+	return reputation.New(opts...), nil
+}
+
+// reputationAction parses the action for a reputation check. An empty action is returned if the check is disabled.
+func reputationAction(s burner.Settings, name string) (reputation.Action, error) {
+	val := s.String(name)
+	if val == "" {
+		return "", nil
+	}
+
+	action, err := reputation.ParseAction(val)
+	if err != nil {
+		return "", fmt.Errorf("env var %v is invalid: %w", name, err)
+	}
+
+	return action, nil
+}
+
+// rateLimit returns a limiter for the limit in name or nil if it isn't set
+func rateLimit(s burner.Settings, c burner.Components, name string, limiter string) (*ratelimit.Limiter, error) {
+	l, err := ratelimit.ParseLimit(s.String(name))
+	if err != nil {
+		return nil, fmt.Errorf("env var %v is invalid: %w", name, err)
+	}
+
+	if !l.Enabled() {
+		return nil, nil
+	}
+
+	return ratelimit.New(limiter, l, c.RateLimitStore), nil
+}
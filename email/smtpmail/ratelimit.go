@@ -0,0 +1,75 @@
+package smtpmail
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithRateLimits limits how many connections and messages each client ip may make. Either may be nil for no limit.
+// Clients connected over a unix socket aren't limited.
+func WithRateLimits(connections *ratelimit.Limiter, messages *ratelimit.Limiter) Option {
+	return func(s *SMTPMail) {
+		s.connLimiter = connections
+		s.msgLimiter = messages
+	}
+}
+
+var errConnRateLimited = errors.New("connection rate limited")
+
+// rateLimitListener limits connections per client ip. Connections over the limit are sent a 421 in place of the
+// greeting and closed.
+type rateLimitListener struct {
+	net.Listener
+	limiter *ratelimit.Limiter
+}
+
+func (l *rateLimitListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimitConn{Conn: c, limiter: l.limiter}, nil
+}
+
+// rateLimitConn checks the limit when the greeting is written rather than on accept. With PROXY protocol the
+// client's address isn't known until the header is read and a slow client mustn't block the accept loop.
+type rateLimitConn struct {
+	net.Conn
+	limiter *ratelimit.Limiter
+
+	once    sync.Once
+	limited bool
+}
+
+func (c *rateLimitConn) Write(b []byte) (int, error) {
+	c.once.Do(func() {
+		addr, ok := c.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+
+		allowed, _ := c.limiter.Allow(addr.IP.String())
+		if allowed {
+			return
+		}
+
+		c.limited = true
+		log.WithField("remote", addr.String()).Info("SMTP: rejected connection over rate limit")
+
+		_, err := c.Conn.Write([]byte("421 4.7.0 Too many connections, try again later\r\n"))
+		if err != nil {
+			log.WithError(err).Debug("SMTP: failed to write rate limit response")
+		}
+		c.Conn.Close()
+	})
+
+	if c.limited {
+		return 0, errConnRateLimited
+	}
+
+	return c.Conn.Write(b)
+}
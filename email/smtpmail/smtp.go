@@ -1,10 +1,15 @@
 package smtpmail
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/mail"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -12,47 +17,189 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
 	"github.com/haydenwoodhead/burner.kiwi/email"
+	"github.com/haydenwoodhead/burner.kiwi/greylist"
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
 	"github.com/haydenwoodhead/burner.kiwi/metrics"
-	"github.com/haydenwoodhead/parsemail"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/proxyproto"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
+	"github.com/haydenwoodhead/burner.kiwi/reputation"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
 var _ burner.EmailProvider = &SMTPMail{}
+var _ smtp.LMTPSession = &smtpSession{}
 
 type SMTPMail struct {
-	listenAddr string
-	listener   *net.Listener
-	server     *smtp.Server
+	listenAddr          string
+	lmtp                bool
+	trustedProxy        []*net.IPNet
+	subaddressSeparator string
+	mailTrap            bool
+	spamFilter          *spam.Filter
+	virusFilter         *virus.Filter
+	reputation          *reputation.Checker
+	greylist            *greylist.Greylister
+	queue               *ingest.Queue
+	spool               burner.Spooler
+	connLimiter         *ratelimit.Limiter
+	msgLimiter          *ratelimit.Limiter
+	listener            *net.Listener
+	server              *smtp.Server
+}
+
+// Option configures optional behaviour of SMTPMail
+type Option func(s *SMTPMail)
+
+// WithProxyProtocol enables PROXY protocol (v1 and v2) for connections from the trusted networks. This allows the
+// real client address to be restored when running behind a L4 load balancer.
+func WithProxyProtocol(trusted []*net.IPNet) Option {
+	return func(s *SMTPMail) {
+		s.trustedProxy = trusted
+	}
+}
+
+// WithSubaddressSeparator makes RCPT TO accept subaddressed recipients, e.g. "user+detail@example.com", when the
+// base address has an inbox. Their mail is delivered to that inbox with the detail kept on the message.
+func WithSubaddressSeparator(separator string) Option {
+	return func(s *SMTPMail) {
+		s.subaddressSeparator = separator
+	}
 }
 
 type smtpBackend struct {
-	handler             *handler
-	isBlacklistedDomain func(string) bool
+	handler     *handler
+	checkPolicy func(policy.Request) policy.Decision
+	msgLimiter  *ratelimit.Limiter
+	reputation  *reputation.Checker
+	greylist    *greylist.Greylister
 }
 
 type smtpSession struct {
-	conState            *smtp.ConnectionState
-	fromAddress         string
-	handler             *handler
-	isBlacklistedDomain func(string) bool
+	conState    *smtp.ConnectionState
+	fromAddress string
+	recipients  []recipient
+	handler     *handler
+	checkPolicy func(policy.Request) policy.Decision
+	msgLimiter  *ratelimit.Limiter
+	greylist    *greylist.Greylister
+	reputation  *burner.ReputationResult
+}
+
+// recipient is an envelope recipient accepted by Rcpt. raw is kept as given by the client as go-smtp
+// keys LMTP statuses on it. address is the inbox address which differs from original when subaddressing
+// or pattern inboxes are used.
+type recipient struct {
+	raw        string
+	original   string
+	address    string
+	subaddress string
 }
 
 type handler struct {
-	db burner.Database
+	db                  burner.Database
+	subaddressSeparator string
+	mailTrap            bool
+	spam                *spam.Filter
+	virus               *virus.Filter
+	queue               *ingest.Queue
+	spool               burner.Spooler
+	trapMu              sync.Mutex
+}
+
+// WithMailTrap accepts mail for any recipient on any domain. Inboxes are created for recipients on the fly.
+// This is intended for local development and CI.
+func WithMailTrap() Option {
+	return func(s *SMTPMail) {
+		s.mailTrap = true
+	}
 }
 
-func NewMailProvider(listenAddr string) *SMTPMail {
-	return &SMTPMail{
+// WithSpamFilter scores each message with f once its DATA has been read, storing the result on the message. Mail f
+// says to reject is refused with a 550 so the sending server bounces it.
+func WithSpamFilter(f *spam.Filter) Option {
+	return func(s *SMTPMail) {
+		s.spamFilter = f
+	}
+}
+
+// WithVirusFilter scans each message with f once its DATA has been read, storing the verdict on the message. Mail f
+// says to reject is refused with a 550 so the sending server bounces it.
+func WithVirusFilter(f *virus.Filter) Option {
+	return func(s *SMTPMail) {
+		s.virusFilter = f
+	}
+}
+
+// WithReputationChecks checks the reputation of each connecting server with c. Servers failing a check set to
+// reject are refused and failures of checks set to tag are stored on their messages. Clients which aren't connected
+// over tcp, e.g. LMTP over a unix socket, aren't checked.
+func WithReputationChecks(c *reputation.Checker) Option {
+	return func(s *SMTPMail) {
+		s.reputation = c
+	}
+}
+
+// WithGreylisting temporarily refuses recipients of mail from client, sender and recipient triplets g hasn't seen
+// before. Well behaved servers retry after the delay.
+func WithGreylisting(g *greylist.Greylister) Option {
+	return func(s *SMTPMail) {
+		s.greylist = g
+	}
+}
+
+// WithIngestQueue parses and saves accepted messages on q's workers rather than while the client waits. Clients are
+// asked to try again later when q is full. Messages are checked by any spam or virus filters before being queued.
+func WithIngestQueue(q *ingest.Queue) Option {
+	return func(s *SMTPMail) {
+		s.queue = q
+	}
+}
+
+// WithSpool makes DATA succeed once a message is written to sp, which saves it to the database in the background and
+// retries while the database is unavailable.
+func WithSpool(sp burner.Spooler) Option {
+	return func(s *SMTPMail) {
+		s.spool = sp
+	}
+}
+
+func NewMailProvider(listenAddr string, opts ...Option) *SMTPMail {
+	s := &SMTPMail{
 		listenAddr: listenAddr,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// NewLMTPMailProvider returns a provider which speaks LMTP rather than SMTP. This is intended for running
+// behind an existing MTA such as Postfix. listenAddr is either a unix socket given as "unix:/path/to/socket"
+// or a tcp address.
+func NewLMTPMailProvider(listenAddr string, opts ...Option) *SMTPMail {
+	s := NewMailProvider(listenAddr, opts...)
+	s.lmtp = true
+	return s
 }
 
-func (s *SMTPMail) Start(websiteAddr string, db burner.Database, r *mux.Router, isBlacklistedDomain func(string) bool) error {
+func (s *SMTPMail) Start(websiteAddr string, db burner.Database, r *mux.Router, checkPolicy func(policy.Request) policy.Decision) error {
 	h := &handler{
-		db: db,
+		db:                  db,
+		subaddressSeparator: s.subaddressSeparator,
+		mailTrap:            s.mailTrap,
+		spam:                s.spamFilter,
+		virus:               s.virusFilter,
+		queue:               s.queue,
+		spool:               s.spool,
 	}
 
-	be := &smtpBackend{handler: h, isBlacklistedDomain: isBlacklistedDomain}
+	be := &smtpBackend{handler: h, checkPolicy: checkPolicy, msgLimiter: s.msgLimiter, reputation: s.reputation, greylist: s.greylist}
 
 	server := smtp.NewServer(be)
 	server.WriteTimeout = 20 * time.Second
@@ -60,36 +207,86 @@ func (s *SMTPMail) Start(websiteAddr string, db burner.Database, r *mux.Router,
 	server.MaxMessageBytes = 5 * (1024 * 1024)
 	server.Addr = s.listenAddr
 	server.AllowInsecureAuth = true
+	server.LMTP = s.lmtp
 
 	s.server = server
 
-	log.Info("Starting smtp server")
+	if s.listener == nil {
+		l, err := listen(s.listenAddr)
+		if err != nil {
+			return fmt.Errorf("SMTP - failed to listen on %s: %w", s.listenAddr, err)
+		}
+		s.listener = &l
+	}
+
+	if len(s.trustedProxy) > 0 {
+		var l net.Listener = proxyproto.NewListener(*s.listener, s.trustedProxy)
+		s.listener = &l
+	}
+
+	if s.connLimiter != nil {
+		var l net.Listener = &rateLimitListener{Listener: *s.listener, limiter: s.connLimiter}
+		s.listener = &l
+	}
+
+	log.WithField("lmtp", s.lmtp).Info("Starting smtp server")
 	go func() {
-		if s.listener != nil {
-			err := s.server.Serve(*s.listener)
-			if err != nil {
-				log.WithError(err).Fatal("SMTP: failed to start server")
-			}
-		} else {
-			err := s.server.ListenAndServe()
-			if err != nil {
-				log.WithError(err).Fatal("SMTP: failed to start server")
-			}
+		err := s.server.Serve(*s.listener)
+		if err != nil {
+			log.WithError(err).Fatal("SMTP: failed to start server")
 		}
 	}()
 
 	return nil
 }
 
+// listen creates a listener for the given address. Addresses prefixed with "unix:" are treated as unix sockets
+// and any stale socket file left over from a previous run is removed first.
+func listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
 func (b *smtpBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
 	return nil, smtp.ErrAuthUnsupported
 }
 
+// AnonymousLogin is called by go-smtp on the first MAIL command of a connection which is when the client's reputation
+// is checked
 func (b *smtpBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return &smtpSession{conState: state, handler: b.handler, isBlacklistedDomain: b.isBlacklistedDomain}, nil
+	s := &smtpSession{conState: state, handler: b.handler, checkPolicy: b.checkPolicy, msgLimiter: b.msgLimiter, greylist: b.greylist}
+
+	if ip := s.remoteIP(); ip != nil {
+		result, rejected := b.reputation.Check(ip, state.Hostname)
+		if rejected != nil {
+			log.WithFields(log.Fields{"remote": s.remoteAddr(), "helo": state.Hostname, "check": rejected.Check, "reason": rejected.Reason}).Info("SMTP: rejected client by reputation check")
+			metrics.EmailsRejected.With(prometheus.Labels{"provider": "smtp", "reason": rejected.Check}).Inc()
+			return nil, &smtp.SMTPError{
+				Code:         smtpMailBoxNotAvailableCode,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Rejected: " + rejected.Reason,
+			}
+		}
+		s.reputation = result
+	}
+
+	return s, nil
 }
 
 func (s *smtpSession) Reset() {
+	s.fromAddress = ""
+	s.recipients = nil
 }
 
 func (s *smtpSession) Logout() error {
@@ -97,23 +294,107 @@ func (s *smtpSession) Logout() error {
 }
 
 func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
-	if s.isBlacklistedDomain(from) {
-		return &smtp.SMTPError{Code: smtpMailBoxNotAvailableCode, Message: "To prevent abuse. We don't accept mail from you."}
+	if ip := s.remoteIP(); ip != nil {
+		if ok, _ := s.msgLimiter.Allow(ip.String()); !ok {
+			log.WithFields(log.Fields{"from": from, "remote": s.remoteAddr()}).Info("SMTP: rejected message over rate limit")
+			return errMessageRateLimited
+		}
 	}
+
 	s.fromAddress = from
 	return nil
 }
 
 const smtpMailBoxNotAvailableCode = 550
 
+const smtpServiceNotAvailableCode = 421
+
+var errMessageRateLimited = &smtp.SMTPError{
+	Code:         smtpServiceNotAvailableCode,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Too many messages, try again later",
+}
+
+const smtpActionNotTakenCode = 451
+
+// rejectedByPolicy is the metric reason for mail rejected by the sender policy. The rule's own reason is only logged
+// as a rule without one is described by its pattern, which would make a metric series per rule.
+const rejectedByPolicy = "policy"
+
+// rejectedByInbox is the metric reason for mail rejected by an inbox's allowed senders
+const rejectedByInbox = "inbox_allowed_senders"
+
+var errSenderNotAllowed = &smtp.SMTPError{
+	Code:         smtpMailBoxNotAvailableCode,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "The owner of this inbox doesn't accept mail from you",
+}
+
+// rejectedAsSpam is the metric reason for mail rejected by the spam filter
+const rejectedAsSpam = "spam"
+
+var errRejectedAsSpam = &smtp.SMTPError{
+	Code:         smtpMailBoxNotAvailableCode,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected as spam",
+}
+
+var errQueueFull = &smtp.SMTPError{
+	Code:         smtpActionNotTakenCode,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Too busy to accept mail, try again later",
+}
+
+// rejectedAsVirus is the metric reason for mail rejected by the virus filter
+const rejectedAsVirus = "virus"
+
+var errRejectedAsVirus = &smtp.SMTPError{
+	Code:         smtpMailBoxNotAvailableCode,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected as it contains a virus",
+}
+
+// remoteAddr returns the address of the connecting client. If PROXY protocol is in use this is the address given
+// by the proxy rather than of the proxy itself.
+func (s *smtpSession) remoteAddr() string {
+	if s.conState == nil || s.conState.RemoteAddr == nil {
+		return ""
+	}
+	return s.conState.RemoteAddr.String()
+}
+
+// remoteIP returns the ip of the connecting client or nil if it isn't connected over tcp e.g. LMTP over a unix socket
+func (s *smtpSession) remoteIP() net.IP {
+	if s.conState == nil {
+		return nil
+	}
+	if addr, ok := s.conState.RemoteAddr.(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
 func (s *smtpSession) Rcpt(to string) error {
 	parsedTo, err := mail.ParseAddress(to)
 	if err != nil {
-		log.WithError(err).WithField("to", to).Error("SMTP: failed to parse to field")
+		log.WithError(err).WithFields(log.Fields{"to": to, "remote": s.remoteAddr()}).Error("SMTP: failed to parse to field")
 		return err
 	}
 
-	if !s.handler.emailAddressExists(parsedTo.Address) {
+	// check the policy here rather than in Mail as rules may depend on the recipient
+	decision := s.checkPolicy(policy.Request{Sender: s.fromAddress, Recipient: parsedTo.Address, ClientIP: s.remoteIP()})
+	if !decision.Allowed {
+		log.WithFields(log.Fields{"from": s.fromAddress, "to": parsedTo.Address, "remote": s.remoteAddr(), "reason": decision.Reason}).Info("SMTP: rejected mail by policy")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "smtp", "reason": rejectedByPolicy}).Inc()
+		return &smtp.SMTPError{Code: smtpMailBoxNotAvailableCode, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "To prevent abuse. We don't accept mail from you."}
+	}
+
+	rcpt, ok := s.handler.resolveRecipient(parsedTo.Address)
+	if !ok && s.handler.mailTrap {
+		rcpt, ok = s.handler.trapRecipient(parsedTo.Address, s.remoteAddr())
+	}
+
+	if !ok {
 		return &smtp.SMTPError{
 			Code:         smtpMailBoxNotAvailableCode,
 			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
@@ -121,62 +402,306 @@ func (s *smtpSession) Rcpt(to string) error {
 		}
 	}
 
+	// deliver checks this again as the inbox's allowed senders may change before the message is sent
+	if !s.handler.acceptsSender(rcpt.address, s.fromAddress) {
+		log.WithFields(log.Fields{"from": s.fromAddress, "to": parsedTo.Address, "remote": s.remoteAddr()}).Info("SMTP: rejected mail from sender not allowed by inbox")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "smtp", "reason": rejectedByInbox}).Inc()
+		return errSenderNotAllowed
+	}
+
+	// greylist last so that only mail which would otherwise be accepted is delayed
+	if ok, wait := s.greylist.Allow(s.remoteIP(), s.fromAddress, parsedTo.Address); !ok {
+		log.WithFields(log.Fields{"from": s.fromAddress, "to": parsedTo.Address, "remote": s.remoteAddr()}).Info("SMTP: greylisted recipient")
+		return &smtp.SMTPError{
+			Code:         smtpActionNotTakenCode,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      fmt.Sprintf("Greylisted, please try again in %v seconds", math.Ceil(wait.Seconds())),
+		}
+	}
+
+	rcpt.raw = to
+	s.recipients = append(s.recipients, rcpt)
+
 	return nil
 }
 
 func (s *smtpSession) Data(r io.Reader) error {
-	email, err := parsemail.Parse(r)
+	raw, err := io.ReadAll(r)
 	if err != nil {
-		log.WithError(err).Error("SMTP: failed to parse message body")
+		log.WithError(err).Error("SMTP: failed to read message body")
 		return err
 	}
-	return s.handler.handleMessage(s.fromAddress, email)
+	return s.handler.handleMessage(s.envelope(raw))
 }
 
-func (h *handler) handleMessage(from string, parsedEmail parsemail.Email) error {
-	partialMsg := burner.Message{
-		ReceivedAt:      time.Now().Unix(),
-		EmailProviderID: "smtp", // TODO: maybe a better id here? For logging purposes?
-		Sender:          from,
-		FromAddress:     getFirstFrom(parsedEmail.From).Address,
-		FromName:        getFirstFrom(parsedEmail.From).Name,
-		Subject:         parsedEmail.Subject,
+// LMTPData implements smtp.LMTPSession. Unlike Data a status is returned for each recipient so that a failure to
+// deliver to one inbox doesn't cause the MTA to retry the whole message.
+func (s *smtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		log.WithError(err).Error("LMTP: failed to read message body")
+		return err
 	}
 
-	partialMsg.BodyPlain = strings.TrimSpace(parsedEmail.TextBody)
+	env := s.envelope(raw)
 
-	if parsedEmail.HTMLBody != "" {
-		modifiedHTML, err := email.AddTargetBlank(strings.TrimSpace(parsedEmail.HTMLBody))
+	err = s.handler.check(&env)
+	if err != nil {
+		return err
+	}
+
+	// once queued the message is accepted for every recipient
+	if s.handler.queue != nil {
+		err = s.handler.enqueue(env)
+		for _, rcpt := range env.recipients {
+			status.SetStatus(rcpt.raw, err)
+		}
+		return nil
+	}
+
+	msg, err := s.handler.newMessage(env)
+	if err != nil {
+		return err
+	}
+
+	for _, rcpt := range env.recipients {
+		status.SetStatus(rcpt.raw, s.handler.deliver(msg, rcpt))
+	}
+
+	return nil
+}
+
+func (s *smtpSession) envelope(raw []byte) envelope {
+	return envelope{
+		from:       s.fromAddress,
+		recipients: s.recipients,
+		raw:        raw,
+		reputation: s.reputation,
+	}
+}
+
+// envelope is a message received from a client along with the verdicts of the checks run on it
+type envelope struct {
+	from       string
+	recipients []recipient
+	raw        []byte
+	reputation *burner.ReputationResult
+	spam       *burner.SpamResult
+	virus      *burner.VirusResult
+}
+
+// handleMessage checks env and then delivers it to each recipient. If there is an ingest queue delivery happens in
+// the background and only the checks decide the response to the client.
+func (h *handler) handleMessage(env envelope) error {
+	err := h.check(&env)
+	if err != nil {
+		return err
+	}
+
+	if h.queue != nil {
+		return h.enqueue(env)
+	}
+
+	return h.deliverAll(env)
+}
+
+// enqueue queues env for delivery returning errQueueFull if there isn't room for it
+func (h *handler) enqueue(env envelope) error {
+	err := h.queue.Submit(func() {
+		err := h.deliverAll(env)
 		if err != nil {
-			log.WithError(err).Error("SMTP: failed to AddTargetBlank")
-			return err
+			log.WithError(err).WithField("from", env.from).Error("SMTP: failed to deliver queued message")
 		}
-		partialMsg.BodyHTML = modifiedHTML
+	})
+	if err != nil {
+		log.WithError(err).WithField("from", env.from).Info("SMTP: failed to queue message")
+		return errQueueFull
+	}
+
+	return nil
+}
+
+// deliverAll builds the message from env and delivers it to each recipient
+func (h *handler) deliverAll(env envelope) error {
+	msg, err := h.newMessage(env)
+	if err != nil {
+		return err
 	}
 
-	for _, rcpt := range parsedEmail.To {
-		inbox, err := h.db.GetInboxByAddress(rcpt.Address)
+	var errs []error
+	for _, rcpt := range env.recipients {
+		err := h.deliver(msg, rcpt)
 		if err != nil {
-			log.WithError(err).Error("SMTP: failed to retrieve inbox")
-			return err
+			errs = append(errs, err)
 		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// check runs the content filters over the message in env, storing their verdicts on it. The verdicts decide whether
+// the message is accepted so these are run before it is queued.
+func (h *handler) check(env *envelope) error {
+	virusResult, reject := h.virus.Check(env.raw)
+	if reject {
+		log.WithFields(log.Fields{"from": env.from, "signature": virusResult.Signature}).Info("SMTP: rejected message containing a virus")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "smtp", "reason": rejectedAsVirus}).Inc()
+		return errRejectedAsVirus
+	}
+	env.virus = virusResult
+
+	spamResult, reject := h.spam.Check(env.raw)
+	if reject {
+		log.WithFields(log.Fields{"from": env.from, "score": spamResult.Score}).Info("SMTP: rejected message as spam")
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "smtp", "reason": rejectedAsSpam}).Inc()
+		return errRejectedAsSpam
+	}
+	env.spam = spamResult
+
+	return nil
+}
+
+// newMessage parses the message in env and builds the parts of a message which are common to every recipient
+func (h *handler) newMessage(env envelope) (burner.Message, error) {
+	partialMsg, err := email.ParseMessage(env.raw)
+	if err != nil {
+		log.WithError(err).Error("SMTP: failed to parse message")
+		return burner.Message{}, err
+	}
 
-		msg := partialMsg
-		msg.ID = uuid.Must(uuid.NewRandom()).String()
-		msg.InboxID = inbox.ID
-		msg.TTL = inbox.TTL
-		err = h.db.SaveNewMessage(msg)
+	partialMsg.ReceivedAt = time.Now().Unix()
+	partialMsg.EmailProviderID = email.MessageID(env.raw)
+	partialMsg.Sender = env.from
+	partialMsg.Spam = env.spam
+	partialMsg.Virus = env.virus
+	partialMsg.Reputation = env.reputation
+
+	return partialMsg, nil
+}
+
+// deliver saves a copy of msg into the inbox for rcpt
+func (h *handler) deliver(partialMsg burner.Message, rcpt recipient) error {
+	inbox, err := h.db.GetInboxByAddress(rcpt.address)
+	if err != nil {
+		log.WithError(err).Error("SMTP: failed to retrieve inbox")
+		return err
+	}
+
+	if !inbox.AcceptsSender(partialMsg.Sender) {
+		metrics.EmailsRejected.With(prometheus.Labels{"provider": "smtp", "reason": rejectedByInbox}).Inc()
+		return errSenderNotAllowed
+	}
+
+	msg := partialMsg
+	msg.ID = uuid.Must(uuid.NewRandom()).String()
+	msg.InboxID = inbox.ID
+	msg.TTL = inbox.TTL
+	msg.Subaddress = rcpt.subaddress
+	msg.Recipient = rcpt.original
+
+	if h.spool != nil {
+		err = h.spool.Add(msg)
 		if err != nil {
-			log.WithError(err).Error("SMTP: failed to save message to db")
-			return err
+			log.WithError(err).Error("SMTP: failed to spool message")
 		}
+		return err
+	}
 
-		metrics.EmailsReceived.Inc()
+	err = h.db.SaveNewMessageOnce(msg)
+	if errors.Is(err, burner.ErrDuplicateMessage) {
+		// the client retried a message we already accepted, accept it again so it stops
+		log.WithFields(log.Fields{"id": msg.InboxID, "ep_id": msg.EmailProviderID}).Info("SMTP: dropped duplicate message")
+		metrics.EmailsDeduplicated.With(prometheus.Labels{"provider": "smtp"}).Inc()
+		return nil
+	}
+	if err != nil {
+		log.WithError(err).Error("SMTP: failed to save message to db")
+		return err
 	}
 
+	metrics.EmailsReceived.Inc()
+
 	return nil
 }
 
+// resolveRecipient finds the inbox address mail for address should be delivered to. An exact match is preferred,
+// then the base address of a subaddress and finally the pattern inbox with the longest matching prefix.
+func (h *handler) resolveRecipient(address string) (recipient, bool) {
+	rcpt := recipient{original: address}
+
+	if h.emailAddressExists(address) {
+		rcpt.address = address
+		return rcpt, true
+	}
+
+	base, detail := email.SplitSubaddress(address, h.subaddressSeparator)
+	if base != address && h.emailAddressExists(base) {
+		rcpt.address = base
+		rcpt.subaddress = detail
+		return rcpt, true
+	}
+
+	i, ok, err := h.db.GetPatternInbox(address)
+	if err != nil {
+		log.WithError(err).Error("SMTP: failed to get pattern inbox")
+		return recipient{}, false
+	}
+	if ok {
+		rcpt.address = i.Address
+		return rcpt, true
+	}
+
+	return recipient{}, false
+}
+
+// trapRecipient creates an inbox for address so that mail for it can be accepted in mail trap mode
+func (h *handler) trapRecipient(address string, remoteAddr string) (recipient, bool) {
+	address = strings.ToLower(address)
+
+	// serialise creation so that concurrent sessions for a new address don't each create an inbox
+	h.trapMu.Lock()
+	defer h.trapMu.Unlock()
+
+	if h.emailAddressExists(address) {
+		return recipient{original: address, address: address}, true
+	}
+
+	i := burner.NewInbox()
+	i.ID = uuid.Must(uuid.NewRandom()).String()
+	i.Address = address
+	i.CreatedAt = time.Now().Unix()
+	i.CreatedBy = burner.TrapCreatedBy(remoteAddr)
+	i.TTL = time.Now().Add(24 * time.Hour).Unix()
+	i.EmailProviderRouteIDs = burner.RouteIDs{"smtp": "smtp"}
+
+	err := h.db.SaveNewInbox(i)
+	if err != nil {
+		// another session may have created the inbox in the mean time
+		if h.emailAddressExists(address) {
+			return recipient{original: address, address: address}, true
+		}
+
+		log.WithError(err).WithField("address", address).Error("SMTP: failed to create mail trap inbox")
+		return recipient{}, false
+	}
+
+	metrics.InboxesCreated.With(prometheus.Labels{"content_type": "smtp", "style": "trap"}).Inc()
+
+	return recipient{original: address, address: address}, true
+}
+
+// acceptsSender reports whether the inbox with address accepts mail from sender. If the inbox can't be retrieved
+// the mail is accepted for now and deliver decides what to do with it.
+func (h *handler) acceptsSender(address string, sender string) bool {
+	inbox, err := h.db.GetInboxByAddress(address)
+	if err != nil {
+		log.WithError(err).WithField("address", address).Error("SMTP: failed to retrieve inbox to check allowed senders")
+		return true
+	}
+
+	return inbox.AcceptsSender(sender)
+}
+
 func (h *handler) emailAddressExists(address string) bool {
 	exists, err := h.db.EmailAddressExists(address)
 	if err != nil {
@@ -187,6 +712,8 @@ func (h *handler) emailAddressExists(address string) bool {
 	return exists
 }
 
+// Stop closes the server. The ingest queue and spool are shared with other providers so they are left for the caller
+// to stop once every provider has stopped.
 func (s *SMTPMail) Stop() error {
 	return s.server.Close()
 }
@@ -197,11 +724,7 @@ func (s *SMTPMail) RegisterRoute(i burner.Inbox) (string, error) {
 	return "smtp", nil
 }
 
-func getFirstFrom(from []*mail.Address) mail.Address {
-	for _, f := range from {
-		if f != nil {
-			return *f
-		}
-	}
-	return mail.Address{}
+// DeleteRoute implements DeleteRoute(). No route was registered so there is nothing to delete.
+func (s *SMTPMail) DeleteRoute(id string) error {
+	return nil
 }
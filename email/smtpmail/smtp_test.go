@@ -1,19 +1,37 @@
 package smtpmail
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/smtp"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	gosmtp "github.com/emersion/go-smtp"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/greylist"
+	"github.com/haydenwoodhead/burner.kiwi/ingest"
+	"github.com/haydenwoodhead/burner.kiwi/policy"
+	"github.com/haydenwoodhead/burner.kiwi/ratelimit"
+	"github.com/haydenwoodhead/burner.kiwi/reputation"
+	"github.com/haydenwoodhead/burner.kiwi/spam"
+	"github.com/haydenwoodhead/burner.kiwi/spool"
+	"github.com/haydenwoodhead/burner.kiwi/virus"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
-func fakeIsBlackListed(address string) bool {
-	return false
+func fakeAllowAll(r policy.Request) policy.Decision {
+	return policy.Decision{Allowed: true}
 }
 
 func TestSMTPMail_SimpleText(t *testing.T) {
@@ -24,12 +42,12 @@ func TestSMTPMail_SimpleText(t *testing.T) {
 
 	mDB := new(MockDatabase)
 	mDB.On("GetInboxByAddress", "test@example.com").Return(burner.Inbox{
-		Address:              "test@example.com",
-		ID:                   "1234",
-		CreatedBy:            "192.168.1.1",
-		TTL:                  2,
-		EmailProviderRouteID: "smtp",
-		FailedToCreate:       false,
+		Address:               "test@example.com",
+		ID:                    "1234",
+		CreatedBy:             "192.168.1.1",
+		TTL:                   2,
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        false,
 	}, nil)
 	mDB.On("EmailAddressExists", "test@example.com").Return(true, nil)
 
@@ -44,10 +62,10 @@ func TestSMTPMail_SimpleText(t *testing.T) {
 		TTL:         2,
 	}
 
-	mDB.On("SaveNewMessage", mock.MatchedBy(MessageMatcher(msg))).Return(nil)
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(MessageMatcher(msg))).Return(nil)
 
 	go func() {
-		err := s.Start("example.com", mDB, nil, fakeIsBlackListed)
+		err := s.Start("example.com", mDB, nil, fakeAllowAll)
 		require.NoError(t, err)
 	}()
 
@@ -70,6 +88,45 @@ func TestSMTPMail_SimpleText(t *testing.T) {
 	mDB.AssertExpectations(t)
 }
 
+func TestSMTPMail_Duplicate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := SMTPMail{listener: &listener}
+
+	mDB := new(MockDatabase)
+	mDB.On("GetInboxByAddress", "test@example.com").Return(burner.Inbox{
+		Address: "test@example.com",
+		ID:      "1234",
+		TTL:     2,
+	}, nil)
+	mDB.On("EmailAddressExists", "test@example.com").Return(true, nil)
+
+	// the message was saved before the client gave up waiting for our reply
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+		return m.EmailProviderID == "20240101120000.1@example.com"
+	})).Return(burner.ErrDuplicateMessage)
+
+	go func() {
+		err := s.Start("example.com", mDB, nil, fakeAllowAll)
+		require.NoError(t, err)
+	}()
+
+	smtpMsg := []byte("To: test@example.com\r\n" +
+		"From: bob@example.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"Message-ID: <20240101120000.1@example.com>\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	// the retry is accepted so the client stops retrying
+	err = mailHelper(listener.Addr().String(), "bob@example.com", []string{"test@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	mDB.AssertExpectations(t)
+}
+
 func TestSMTPMail_Multipart(t *testing.T) {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
@@ -78,12 +135,12 @@ func TestSMTPMail_Multipart(t *testing.T) {
 
 	mDB := new(MockDatabase)
 	mDB.On("GetInboxByAddress", "test@example.com").Return(burner.Inbox{
-		Address:              "test@example.com",
-		ID:                   "1234",
-		CreatedBy:            "192.168.1.1",
-		TTL:                  2,
-		EmailProviderRouteID: "smtp",
-		FailedToCreate:       false,
+		Address:               "test@example.com",
+		ID:                    "1234",
+		CreatedBy:             "192.168.1.1",
+		TTL:                   2,
+		EmailProviderRouteIDs: burner.RouteIDs{"smtp": "smtp"},
+		FailedToCreate:        false,
 	}, nil)
 	mDB.On("EmailAddressExists", "test@example.com").Return(true, nil)
 
@@ -98,10 +155,10 @@ func TestSMTPMail_Multipart(t *testing.T) {
 		TTL:         2,
 	}
 
-	mDB.On("SaveNewMessage", mock.MatchedBy(MessageMatcher(msg))).Return(nil)
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(MessageMatcher(msg))).Return(nil)
 
 	go func() {
-		err := s.Start("example.com", mDB, nil, fakeIsBlackListed)
+		err := s.Start("example.com", mDB, nil, fakeAllowAll)
 		require.NoError(t, err)
 	}()
 
@@ -134,7 +191,781 @@ func TestSMTPMail_Multipart(t *testing.T) {
 	mDB.AssertExpectations(t)
 }
 
+func TestSMTPMail_LMTP(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "lmtp.sock")
+
+	s := NewLMTPMailProvider("unix:" + sock)
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "test@example.com").Return(true, nil)
+	mDB.On("EmailAddressExists", "gone@example.com").Return(true, nil)
+	mDB.On("GetInboxByAddress", "test@example.com").Return(burner.Inbox{
+		Address: "test@example.com",
+		ID:      "1234",
+		TTL:     2,
+	}, nil)
+	mDB.On("GetInboxByAddress", "gone@example.com").Return(burner.Inbox{}, errors.New("inbox doesn't exist"))
+
+	msg := burner.Message{
+		InboxID:     "1234",
+		Sender:      "bob@example.com",
+		FromAddress: "bob@example.com",
+		Subject:     "discount Gophers!",
+		BodyPlain:   "This is the email body.",
+		TTL:         2,
+	}
+
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(MessageMatcher(msg))).Return(nil)
+
+	err := s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	conn, err := net.Dial("unix", sock)
+	require.NoError(t, err)
+
+	c, err := gosmtp.NewClientLMTP(conn, "localhost")
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Hello("localhost"))
+	require.NoError(t, c.Mail("bob@example.com", nil))
+	require.NoError(t, c.Rcpt("test@example.com"))
+	require.NoError(t, c.Rcpt("gone@example.com"))
+
+	statuses := map[string]*gosmtp.SMTPError{}
+	wc, err := c.LMTPData(func(rcpt string, status *gosmtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	require.NoError(t, err)
+
+	_, err = wc.Write([]byte("To: test@example.com, gone@example.com\r\n" +
+		"From: bob@example.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is the email body."))
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+
+	require.Len(t, statuses, 2)
+	assert.Nil(t, statuses["test@example.com"])
+	assert.NotNil(t, statuses["gone@example.com"])
+
+	mDB.AssertExpectations(t)
+}
+
+func TestSMTPMail_Subaddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := NewMailProvider("", WithSubaddressSeparator("+"))
+	s.listener = &listener
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "abc123+case42@example.com").Return(false, nil)
+	mDB.On("EmailAddressExists", "abc123@example.com").Return(true, nil)
+	mDB.On("EmailAddressExists", "nobody+case42@example.com").Return(false, nil)
+	mDB.On("EmailAddressExists", "nobody@example.com").Return(false, nil)
+	mDB.On("EmailAddressExists", mock.Anything).Return(false, nil) // pattern inbox candidates
+	mDB.On("GetInboxByAddress", "abc123@example.com").Return(burner.Inbox{
+		Address: "abc123@example.com",
+		ID:      "1234",
+		TTL:     2,
+	}, nil)
+
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+		return m.InboxID == "1234" && m.Subaddress == "case42" && m.Subject == "discount Gophers!"
+	})).Return(nil)
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: abc123+case42@example.com\r\n" +
+		"From: bob@example.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = mailHelper(listener.Addr().String(), "bob@example.com", []string{"nobody+case42@example.com"}, smtpMsg)
+	assert.Error(t, err)
+
+	err = mailHelper(listener.Addr().String(), "bob@example.com", []string{"abc123+case42@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	time.Sleep(1 * time.Second)
+
+	mDB.AssertExpectations(t)
+}
+
+func TestSMTPMail_PatternInbox(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &SMTPMail{listener: &listener}
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", mock.Anything).Return(false, nil)
+	mDB.On("GetPatternInbox", "ci-build42@example.com").Return(burner.Inbox{
+		Address: "ci-build*@example.com",
+		ID:      "1234",
+		TTL:     2,
+	}, true, nil)
+	mDB.On("GetPatternInbox", "cd-build42@example.com").Return(burner.Inbox{}, false, nil)
+	mDB.On("GetInboxByAddress", "ci-build*@example.com").Return(burner.Inbox{
+		Address: "ci-build*@example.com",
+		ID:      "1234",
+		TTL:     2,
+	}, nil)
+
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+		return m.InboxID == "1234" && m.Recipient == "ci-build42@example.com"
+	})).Return(nil)
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: ci-build42@example.com\r\n" +
+		"From: bob@example.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = mailHelper(listener.Addr().String(), "bob@example.com", []string{"ci-build42@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	err = mailHelper(listener.Addr().String(), "bob@example.com", []string{"cd-build42@example.com"}, smtpMsg)
+	assert.Error(t, err)
+
+	time.Sleep(1 * time.Second)
+
+	mDB.AssertExpectations(t)
+}
+
 // https://github.com/golang/go/wiki/SendingMail
+func TestSMTPMail_MailTrap(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &SMTPMail{listener: &listener, mailTrap: true}
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", mock.Anything).Return(false, nil)
+	mDB.On("GetPatternInbox", mock.Anything).Return(burner.Inbox{}, false, nil)
+	mDB.On("SaveNewInbox", mock.MatchedBy(func(i burner.Inbox) bool {
+		return i.Address == "anything@elsewhere.test" && i.ID != "" && i.TTL > time.Now().Unix() && i.CreatedByTrap()
+	})).Return(nil)
+	mDB.On("GetInboxByAddress", "anything@elsewhere.test").Return(burner.Inbox{
+		Address: "anything@elsewhere.test",
+		ID:      "1234",
+		TTL:     2,
+	}, nil)
+
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+		return m.InboxID == "1234" && m.Recipient == "anything@elsewhere.test"
+	})).Return(nil)
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: Anything@elsewhere.test\r\n" +
+		"From: bob@example.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = mailHelper(listener.Addr().String(), "bob@example.com", []string{"Anything@elsewhere.test"}, smtpMsg)
+	require.NoError(t, err)
+
+	time.Sleep(1 * time.Second)
+
+	mDB.AssertExpectations(t)
+}
+
+func TestSMTPMail_Policy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &SMTPMail{listener: &listener}
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+
+	var checked []policy.Request
+	p := policy.New(policy.DenySenderDomains([]string{"ail.com"}, "blacklisted")...)
+	checkPolicy := func(r policy.Request) policy.Decision {
+		checked = append(checked, r)
+		return p.Check(r)
+	}
+
+	err = s.Start("example.com", mDB, nil, checkPolicy)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: bobby@example.com\r\n" +
+		"From: bob@ail.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = mailHelper(listener.Addr().String(), "bob@ail.com", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "550")
+
+	require.Len(t, checked, 1)
+	assert.Equal(t, "bob@ail.com", checked[0].Sender)
+	assert.Equal(t, "bobby@example.com", checked[0].Recipient)
+	assert.Equal(t, "127.0.0.1", checked[0].ClientIP.String())
+
+	mDB.AssertNotCalled(t, "SaveNewMessageOnce", mock.Anything)
+}
+
+func TestSMTPMail_AllowedSenders(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &SMTPMail{listener: &listener}
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+	mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{
+		Address:        "bobby@example.com",
+		ID:             "1234",
+		TTL:            2,
+		AllowedSenders: burner.SenderList{"ci.example.com", "alice@example.org"},
+	}, nil)
+
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+		return m.InboxID == "1234" && m.Sender == "builds@ci.example.com"
+	})).Return(nil).Once()
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: bobby@example.com\r\n" +
+		"Subject: discount Gophers!\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = mailHelper(listener.Addr().String(), "builds@ci.example.com", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	err = mailHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "550")
+
+	time.Sleep(1 * time.Second)
+
+	mDB.AssertExpectations(t)
+}
+
+func TestSMTPMail_RateLimits(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	store := ratelimit.NewMemoryStore()
+	s := &SMTPMail{
+		listener:    &listener,
+		connLimiter: ratelimit.New("smtp_conn", ratelimit.Limit{Count: 2, Period: time.Minute}, store),
+		msgLimiter:  ratelimit.New("smtp_msg", ratelimit.Limit{Count: 1, Period: time.Minute}, store),
+	}
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+	mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+	mDB.On("SaveNewMessageOnce", mock.AnythingOfType("burner.Message")).Return(nil).Once()
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: bobby@example.com\r\n" +
+		"From: bob@example.org\r\n" +
+		"Subject: Gophers!\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = mailHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	// the second connection is allowed but the message isn't
+	err = mailHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "421")
+
+	// the third connection isn't allowed at all
+	err = mailHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "421")
+	assert.Contains(t, err.Error(), "Too many connections")
+
+	time.Sleep(1 * time.Second)
+	mDB.AssertExpectations(t)
+}
+
+// fakeSpamd scores every message with score, reading the message so the client doesn't block
+func fakeSpamd(t *testing.T, score float64) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			var length int
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+				fmt.Sscanf(line, "Content-length: %d", &length)
+			}
+			io.CopyN(io.Discard, r, int64(length))
+
+			fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: True ; %.1f / 5.0\r\n\r\nHTML_MESSAGE,URIBL_BLOCKED", score)
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestSMTPMail_Spam(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Score         float64
+		ExpectedSaved bool
+	}{
+		{Name: "accepted", Score: 6.5, ExpectedSaved: true},
+		{Name: "rejected", Score: 12.5, ExpectedSaved: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			s := &SMTPMail{
+				listener:   &listener,
+				spamFilter: spam.NewFilter(spam.NewSpamd(fakeSpamd(t, test.Score)), spam.WithRejectScore(10)),
+			}
+
+			mDB := new(MockDatabase)
+			mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+			mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+			if test.ExpectedSaved {
+				mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+					return m.Spam != nil && m.Spam.Score == test.Score && m.Spam.Threshold == 5 &&
+						assert.ObjectsAreEqual([]string{"HTML_MESSAGE", "URIBL_BLOCKED"}, m.Spam.Rules)
+				})).Return(nil).Once()
+			}
+
+			err = s.Start("example.com", mDB, nil, fakeAllowAll)
+			require.NoError(t, err)
+			defer s.Stop()
+
+			smtpMsg := []byte("To: bobby@example.com\r\n" +
+				"From: bob@example.org\r\n" +
+				"Subject: Gophers!\r\n" +
+				"\r\n" +
+				"This is the email body.")
+
+			err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+			if test.ExpectedSaved {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "550")
+			}
+
+			mDB.AssertExpectations(t)
+			if !test.ExpectedSaved {
+				mDB.AssertNotCalled(t, "SaveNewMessageOnce", mock.Anything)
+			}
+		})
+	}
+}
+
+// fakeClamd listens for clamd INSTREAM requests and reports messages containing "EICAR" as infected
+func fakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			r.ReadString('\x00')
+
+			var msg bytes.Buffer
+			for {
+				var length uint32
+				err := binary.Read(r, binary.BigEndian, &length)
+				if err != nil || length == 0 {
+					break
+				}
+				io.CopyN(&msg, r, int64(length))
+			}
+
+			if bytes.Contains(msg.Bytes(), []byte("EICAR")) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestSMTPMail_Virus(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Body          string
+		Action        virus.Action
+		ExpectedSaved bool
+		ExpectedVirus burner.VirusResult
+	}{
+		{Name: "clean", Body: "This is the email body.", Action: virus.Reject, ExpectedSaved: true, ExpectedVirus: burner.VirusResult{Infected: false}},
+		{Name: "rejected", Body: "EICAR-STANDARD-ANTIVIRUS-TEST-FILE", Action: virus.Reject, ExpectedSaved: false},
+		{Name: "flagged", Body: "EICAR-STANDARD-ANTIVIRUS-TEST-FILE", Action: virus.Flag, ExpectedSaved: true, ExpectedVirus: burner.VirusResult{Infected: true, Signature: "Eicar-Test-Signature"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			s := &SMTPMail{
+				listener:    &listener,
+				virusFilter: virus.NewFilter(virus.NewClamd(fakeClamd(t)), test.Action),
+			}
+
+			mDB := new(MockDatabase)
+			mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+			mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+			if test.ExpectedSaved {
+				mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+					return m.Virus != nil && *m.Virus == test.ExpectedVirus
+				})).Return(nil).Once()
+			}
+
+			err = s.Start("example.com", mDB, nil, fakeAllowAll)
+			require.NoError(t, err)
+			defer s.Stop()
+
+			smtpMsg := []byte("To: bobby@example.com\r\n" +
+				"From: bob@example.org\r\n" +
+				"Subject: Gophers!\r\n" +
+				"\r\n" +
+				test.Body)
+
+			err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+			if test.ExpectedSaved {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "550")
+			}
+
+			mDB.AssertExpectations(t)
+			if !test.ExpectedSaved {
+				mDB.AssertNotCalled(t, "SaveNewMessageOnce", mock.Anything)
+			}
+		})
+	}
+}
+
+// fakeResolver resolves nothing other than 127.0.0.1 on the zen.example.com blocklist
+type fakeResolver struct{}
+
+func (fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if host == "1.0.0.127.zen.example.com" {
+		return []string{"127.0.0.2"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestSMTPMail_Reputation(t *testing.T) {
+	tests := []struct {
+		Name               string
+		Checker            *reputation.Checker
+		ExpectedSaved      bool
+		ExpectedReputation *burner.ReputationResult
+	}{
+		{
+			Name:          "rejected",
+			Checker:       reputation.New(reputation.WithResolver(fakeResolver{}), reputation.WithHelo(reputation.Reject)),
+			ExpectedSaved: false,
+		},
+		{
+			Name:          "tagged",
+			Checker:       reputation.New(reputation.WithResolver(fakeResolver{}), reputation.WithFCrDNS(reputation.Tag), reputation.WithDNSBL([]string{"zen.example.com"}, reputation.Tag)),
+			ExpectedSaved: true,
+			ExpectedReputation: &burner.ReputationResult{Failures: []burner.ReputationFailure{
+				{Check: reputation.CheckFCrDNS, Reason: "127.0.0.1 has no reverse dns"},
+				{Check: reputation.CheckDNSBL, Reason: "127.0.0.1 is listed on zen.example.com"},
+			}},
+		},
+		{
+			Name:          "passed",
+			Checker:       reputation.New(reputation.WithResolver(fakeResolver{}), reputation.WithDNSBL([]string{"other.example.com"}, reputation.Reject)),
+			ExpectedSaved: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			s := &SMTPMail{
+				listener:   &listener,
+				reputation: test.Checker,
+			}
+
+			mDB := new(MockDatabase)
+			if test.ExpectedSaved {
+				mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+				mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+				mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+					return assert.ObjectsAreEqual(test.ExpectedReputation, m.Reputation)
+				})).Return(nil).Once()
+			}
+
+			err = s.Start("example.com", mDB, nil, fakeAllowAll)
+			require.NoError(t, err)
+			defer s.Stop()
+
+			smtpMsg := []byte("To: bobby@example.com\r\n" +
+				"From: bob@example.org\r\n" +
+				"Subject: Gophers!\r\n" +
+				"\r\n" +
+				"This is the email body.")
+
+			// net/smtp says HELO localhost
+			err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+			if test.ExpectedSaved {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "550")
+				assert.Contains(t, err.Error(), "HELO localhost isn't a fully qualified domain name")
+			}
+
+			mDB.AssertExpectations(t)
+			if !test.ExpectedSaved {
+				mDB.AssertNotCalled(t, "SaveNewMessageOnce", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestSMTPMail_Greylisting(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &SMTPMail{
+		listener: &listener,
+		greylist: greylist.New(greylist.Windows{Delay: 100 * time.Millisecond, Whitelist: time.Hour}, greylist.NewMemoryStore(), burner.SenderList{"ci.example.net"}),
+	}
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+	mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+	mDB.On("SaveNewMessageOnce", mock.AnythingOfType("burner.Message")).Return(nil).Times(3)
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	smtpMsg := []byte("To: bobby@example.com\r\n" +
+		"From: bob@example.org\r\n" +
+		"Subject: Gophers!\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "451")
+
+	// retrying too soon is still refused
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+
+	// allowed senders aren't delayed
+	err = sendHelper(listener.Addr().String(), "ci@ci.example.net", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	// and once passed the triplet is remembered
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	mDB.AssertExpectations(t)
+}
+
+func TestSMTPMail_IngestQueue(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &SMTPMail{
+		listener: &listener,
+		queue:    ingest.New(1, 1),
+	}
+
+	saving := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+	mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+	mDB.On("SaveNewMessageOnce", mock.MatchedBy(func(m burner.Message) bool {
+		return m.Subject == "Gophers!" && m.InboxID == "1234"
+	})).Run(func(args mock.Arguments) {
+		saving <- struct{}{}
+		<-release
+	}).Return(nil).Twice()
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+
+	smtpMsg := []byte("To: bobby@example.com\r\n" +
+		"From: bob@example.org\r\n" +
+		"Subject: Gophers!\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	// accepted without waiting for the database
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+	<-saving
+
+	// waits in the queue while the only worker is busy
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "451")
+
+	close(release)
+	require.NoError(t, s.Stop())
+	s.queue.Stop()
+
+	mDB.AssertExpectations(t)
+}
+
+func TestSMTPMail_Spool(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	mDB := new(MockDatabase)
+	mDB.On("EmailAddressExists", "bobby@example.com").Return(true, nil)
+	mDB.On("GetInboxByAddress", "bobby@example.com").Return(burner.Inbox{Address: "bobby@example.com", ID: "1234", TTL: 2}, nil)
+	mDB.On("GetMessageByID", "1234", mock.Anything).Return(burner.Message{}, burner.ErrMessageDoesntExist).Once()
+
+	isGophers := mock.MatchedBy(func(m burner.Message) bool {
+		return m.Subject == "Gophers!" && m.InboxID == "1234" && m.Recipient == "bobby@example.com"
+	})
+	mDB.On("SaveNewMessageOnce", isGophers).Return(errors.New("database unavailable")).Once()
+	saved := make(chan struct{})
+	mDB.On("SaveNewMessageOnce", isGophers).Run(func(args mock.Arguments) {
+		close(saved)
+	}).Return(nil).Once()
+
+	sp, err := spool.Open(t.TempDir(), mDB)
+	require.NoError(t, err)
+
+	s := &SMTPMail{
+		listener: &listener,
+		spool:    sp,
+	}
+
+	err = s.Start("example.com", mDB, nil, fakeAllowAll)
+	require.NoError(t, err)
+
+	smtpMsg := []byte("To: bobby@example.com\r\n" +
+		"From: bob@example.org\r\n" +
+		"Subject: Gophers!\r\n" +
+		"\r\n" +
+		"This is the email body.")
+
+	// accepted even though the database is unavailable
+	err = sendHelper(listener.Addr().String(), "bob@example.org", []string{"bobby@example.com"}, smtpMsg)
+	require.NoError(t, err)
+
+	select {
+	case <-saved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spooled message wasn't retried")
+	}
+
+	require.NoError(t, s.Stop())
+	sp.Stop()
+
+	mDB.AssertExpectations(t)
+}
+
+// sendHelper is like mailHelper but waits for the server to accept the message so that its response can be checked
+func sendHelper(addr, from string, rcpts []string, body []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+
+	for _, rcpt := range rcpts {
+		err := c.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = wc.Write(body)
+	if err != nil {
+		return err
+	}
+
+	return wc.Close()
+}
+
 func mailHelper(addr, from string, rcpts []string, body []byte) error {
 	c, err := smtp.Dial(addr)
 	if err != nil {
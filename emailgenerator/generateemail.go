@@ -64,8 +64,39 @@ func (eg *EmailGenerator) NewFromUserAndHost(user string, host string) (string,
 	return fmt.Sprintf("%s@%s", user, host), nil
 }
 
+// NewPatternFromPrefixAndHost generates the address of a pattern inbox matching every address on host beginning
+// with prefix. It is the callers responsibility to check for uniqueness
+func (eg *EmailGenerator) NewPatternFromPrefixAndHost(prefix string, host string) (string, error) {
+	prefix = strings.ToLower(prefix)
+	host = strings.ToLower(host)
+
+	if err := eg.verifyPrefix(prefix); err != nil {
+		return "", err
+	}
+	if err := eg.verifyHost(host); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s*@%s", prefix, host), nil
+}
+
 var isAlphaNumeric = regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString
 
+var isPrefix = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`).MatchString
+
+// verifyPrefix verifies the prefix of a pattern inbox is between 4 and 32 characters so that one inbox can't collect
+// mail for a large part of the domain. Unlike routes prefixes may contain ".", "_" and "-" so that they read naturally
+// e.g. "ci-build-"
+func (eg *EmailGenerator) verifyPrefix(p string) error {
+	if len(p) < 4 {
+		return fmt.Errorf("prefix must be at least four characters: %s", p)
+	} else if len(p) > 32 {
+		return fmt.Errorf("prefix must be fewer than 32 characters: %s", p)
+	} else if !isPrefix(p) {
+		return fmt.Errorf("prefix may only contain letters (a-z), numbers (0-9), '.', '_' and '-' and must start with a letter or number: %s", p)
+	}
+	return nil
+}
+
 // VerifyUser verifies the local part of an email address is between 3 and 64 alphanumeric characters
 func (eg *EmailGenerator) verifyUser(r string) error {
 	if len(r) < 3 {
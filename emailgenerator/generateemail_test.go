@@ -111,3 +111,31 @@ func inArray(n string, h []string) bool {
 
 	return false
 }
+
+func TestEmailGenerator_NewPatternFromPrefixAndHost(t *testing.T) {
+	g := New([]string{"example.com"}, 8)
+
+	tests := []struct {
+		Prefix    string
+		Host      string
+		Expected  string
+		ExpectErr bool
+	}{
+		{Prefix: "ci-build-", Host: "example.com", Expected: "ci-build-*@example.com"},
+		{Prefix: "Team.QA_", Host: "Example.com", Expected: "team.qa_*@example.com"},
+		{Prefix: "ci-", Host: "example.com", ExpectErr: true},
+		{Prefix: "-ci", Host: "example.com", ExpectErr: true},
+		{Prefix: "ci*", Host: "example.com", ExpectErr: true},
+		{Prefix: "ci-build-", Host: "example.org", ExpectErr: true},
+	}
+
+	for _, test := range tests {
+		out, err := g.NewPatternFromPrefixAndHost(test.Prefix, test.Host)
+		if test.ExpectErr {
+			assert.Error(t, err, test.Prefix)
+			continue
+		}
+		assert.NoError(t, err, test.Prefix)
+		assert.Equal(t, test.Expected, out)
+	}
+}
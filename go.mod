@@ -4,6 +4,7 @@ go 1.24
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
+	github.com/aws/aws-lambda-go v1.13.0
 	github.com/aws/aws-sdk-go v1.34.0
 	github.com/emersion/go-smtp v0.15.0
 	github.com/google/uuid v1.1.1
@@ -29,7 +30,6 @@ require (
 	github.com/Microsoft/go-winio v0.5.2 // indirect
 	github.com/Nvveen/Gotty v0.0.0-20120604004816-cd527374f1e5 // indirect
 	github.com/andybalholm/cascadia v1.0.0 // indirect
-	github.com/aws/aws-lambda-go v1.13.0 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
@@ -0,0 +1,118 @@
+// Package greylist temporarily refuses mail from unfamiliar senders. Legitimate servers retry after the delay while
+// most spam bots never do. Like ratelimit its state may be kept in memory or shared between instances through a
+// database.
+package greylist
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryWindow is how long after first being seen a triplet may be retried. Triplets which aren't retried in time
+// start over.
+const RetryWindow = 24 * time.Hour
+
+// Windows configures how long mail is delayed for and how long triplets which have passed are remembered
+type Windows struct {
+	// Delay is how long after first being seen a triplet is accepted
+	Delay time.Duration
+	// Whitelist is how long a triplet which has passed is accepted without delay. It is extended each time mail is
+	// accepted.
+	Whitelist time.Duration
+}
+
+// Entry is the state of a single client, sender and recipient triplet
+type Entry struct {
+	FirstSeen time.Time
+	// Passed is when mail for the triplet was last accepted. It is zero until the triplet is retried after the delay.
+	Passed time.Time
+}
+
+// Check records an attempt to deliver mail at now. It returns whether the mail should be accepted and, if not, how
+// long until it will be.
+func (e *Entry) Check(w Windows, now time.Time) (bool, time.Duration) {
+	if e.FirstSeen.IsZero() || !now.Before(e.ExpiresAt(w)) {
+		*e = Entry{FirstSeen: now}
+	}
+
+	if !e.Passed.IsZero() || now.Sub(e.FirstSeen) >= w.Delay {
+		e.Passed = now
+		return true, 0
+	}
+
+	return false, w.Delay - now.Sub(e.FirstSeen)
+}
+
+// ExpiresAt returns when the entry will be forgotten. After this the entry is the same as a new one and can be
+// discarded.
+func (e *Entry) ExpiresAt(w Windows) time.Time {
+	if !e.Passed.IsZero() {
+		return e.Passed.Add(w.Whitelist)
+	}
+	return e.FirstSeen.Add(RetryWindow)
+}
+
+// Store keeps greylist entries. Implementations must check entries atomically so that they can be shared between
+// instances.
+type Store interface {
+	CheckGreylist(key string, w Windows, now time.Time) (bool, time.Duration, error)
+}
+
+// Greylister greylists client, sender and recipient triplets
+type Greylister struct {
+	windows Windows
+	store   Store
+	allowed burner.SenderList
+	now     func() time.Time
+}
+
+// New returns a greylister which applies w using store. Mail from senders on allowed, given as addresses or domains
+// which include their subdomains, is never delayed.
+func New(w Windows, store Store, allowed burner.SenderList) *Greylister {
+	return &Greylister{
+		windows: w,
+		store:   store,
+		allowed: allowed,
+		now:     time.Now,
+	}
+}
+
+// Allow checks the triplet of ip, sender and recipient. If the mail should be delayed it returns false and how long
+// until it will be accepted. Mail from clients without an ip, e.g. over a unix socket, is always accepted as is mail
+// from allowed senders. If the store fails the mail is accepted rather than delaying everyone. A nil greylister
+// accepts everything.
+func (g *Greylister) Allow(ip net.IP, sender string, recipient string) (bool, time.Duration) {
+	if g == nil || ip == nil || g.allowed.Contains(sender) {
+		return true, 0
+	}
+
+	ok, wait, err := g.store.CheckGreylist(Key(ip, sender, recipient), g.windows, g.now())
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"ip": ip, "sender": sender, "recipient": recipient}).Error("Greylist: failed to check triplet")
+		return true, 0
+	}
+
+	if !ok {
+		metrics.Greylisted.Inc()
+	}
+
+	return ok, wait
+}
+
+// Key returns the store key for a triplet. Clients are grouped by /24 for IPv4 and /64 for IPv6 as large senders
+// often retry from a different server in the same network.
+func Key(ip net.IP, sender string, recipient string) string {
+	var network net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		network = ip4.Mask(net.CIDRMask(24, 32))
+	} else {
+		network = ip.Mask(net.CIDRMask(64, 128))
+	}
+
+	return strings.Join([]string{network.String(), strings.ToLower(sender), strings.ToLower(recipient)}, "/")
+}
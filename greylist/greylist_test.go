@@ -0,0 +1,113 @@
+package greylist
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+)
+
+var windows = Windows{Delay: 5 * time.Minute, Whitelist: 7 * 24 * time.Hour}
+
+func TestEntry_Check(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var e Entry
+
+	ok, wait := e.Check(windows, now)
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Minute, wait)
+
+	ok, wait = e.Check(windows, now.Add(4*time.Minute))
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, wait)
+
+	ok, _ = e.Check(windows, now.Add(5*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(5*time.Minute).Add(windows.Whitelist), e.ExpiresAt(windows))
+
+	// accepting mail extends the whitelist
+	ok, _ = e.Check(windows, now.Add(6*24*time.Hour))
+	assert.True(t, ok)
+	ok, _ = e.Check(windows, now.Add(12*24*time.Hour))
+	assert.True(t, ok)
+
+	// once the whitelist expires the triplet starts over
+	ok, wait = e.Check(windows, now.Add(20*24*time.Hour))
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Minute, wait)
+}
+
+func TestEntry_Check_RetryWindow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var e Entry
+
+	ok, _ := e.Check(windows, now)
+	assert.False(t, ok)
+
+	// not retried within the retry window so it starts over
+	ok, wait := e.Check(windows, now.Add(RetryWindow))
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Minute, wait)
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "192.0.2.0/bob@example.org/bobby@example.com", Key(net.ParseIP("192.0.2.10"), "Bob@example.org", "bobby@Example.com"))
+	assert.Equal(t, Key(net.ParseIP("192.0.2.10"), "bob@example.org", "bobby@example.com"), Key(net.ParseIP("192.0.2.200"), "bob@example.org", "bobby@example.com"))
+	assert.Equal(t, "2001:db8:0:1::/bob@example.org/bobby@example.com", Key(net.ParseIP("2001:db8:0:1::25"), "bob@example.org", "bobby@example.com"))
+}
+
+type failingStore struct{}
+
+func (failingStore) CheckGreylist(key string, w Windows, now time.Time) (bool, time.Duration, error) {
+	return false, 0, errors.New("unavailable")
+}
+
+func TestGreylister_Allow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	g := New(windows, NewMemoryStore(), burner.SenderList{"ci@example.net", "example.org"})
+	g.now = func() time.Time { return now }
+
+	ip := net.ParseIP("192.0.2.10")
+
+	ok, wait := g.Allow(ip, "alice@example.com", "bobby@example.com")
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Minute, wait)
+
+	// allowed senders and their subdomains are never delayed
+	ok, _ = g.Allow(ip, "ci@example.net", "bobby@example.com")
+	assert.True(t, ok)
+	ok, _ = g.Allow(ip, "bob@mail.example.org", "bobby@example.com")
+	assert.True(t, ok)
+
+	// clients without an ip aren't greylisted
+	ok, _ = g.Allow(nil, "alice@example.com", "bobby@example.com")
+	assert.True(t, ok)
+
+	now = now.Add(5 * time.Minute)
+	ok, _ = g.Allow(net.ParseIP("192.0.2.11"), "alice@example.com", "bobby@example.com")
+	assert.True(t, ok, "retries from the same network should be accepted")
+
+	// store failures accept the mail
+	ok, _ = New(windows, failingStore{}, nil).Allow(ip, "alice@example.com", "bobby@example.com")
+	assert.True(t, ok)
+
+	var nilGreylister *Greylister
+	ok, _ = nilGreylister.Allow(ip, "alice@example.com", "bobby@example.com")
+	assert.True(t, ok)
+}
+
+func TestMemoryStore_RemoveExpired(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Unix(1600000000, 0)
+
+	s.CheckGreylist("a", windows, now)
+	s.CheckGreylist("b", windows, now.Add(RetryWindow-time.Minute))
+	assert.Len(t, s.entries, 2)
+
+	s.CheckGreylist("c", windows, now.Add(RetryWindow))
+	assert.Len(t, s.entries, 2)
+	assert.NotContains(t, s.entries, "a")
+}
@@ -0,0 +1,64 @@
+package greylist
+
+import (
+	"sync"
+	"time"
+)
+
+var _ Store = &MemoryStore{}
+
+// MemoryStore keeps entries in memory so they are only shared within a single process. It is the default store.
+type MemoryStore struct {
+	m       sync.Mutex
+	entries map[string]*memoryEntry
+	sweep   time.Time
+}
+
+type memoryEntry struct {
+	Entry
+	expiresAt time.Time
+}
+
+// sweepInterval is how often expired entries are removed from memory
+const sweepInterval = time.Minute
+
+// NewMemoryStore returns an empty in memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: make(map[string]*memoryEntry),
+	}
+}
+
+// CheckGreylist checks the entry for key
+func (s *MemoryStore) CheckGreylist(key string, w Windows, now time.Time) (bool, time.Duration, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.removeExpired(now)
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &memoryEntry{}
+		s.entries[key] = e
+	}
+
+	allowed, wait := e.Check(w, now)
+	e.expiresAt = e.ExpiresAt(w)
+
+	return allowed, wait, nil
+}
+
+// removeExpired drops entries which have expired as they're no different from new ones. Must be called with the
+// lock held.
+func (s *MemoryStore) removeExpired(now time.Time) {
+	if now.Sub(s.sweep) < sweepInterval {
+		return
+	}
+	s.sweep = now
+
+	for k, e := range s.entries {
+		if !e.expiresAt.After(now) {
+			delete(s.entries, k)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package ingest runs the slow parts of receiving mail, such as parsing, rewriting and saving messages, on a bounded
+// pool of workers so that providers can respond to senders without waiting on the database. When the queue is full
+// providers should ask senders to try again later.
+package ingest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrQueueFull is returned by Submit when there is no room in the queue
+var ErrQueueFull = errors.New("ingest queue is full")
+
+// ErrStopped is returned by Submit once the queue has been stopped
+var ErrStopped = errors.New("ingest queue is stopped")
+
+// Job is a unit of work such as saving a message
+type Job func()
+
+type queuedJob struct {
+	job    Job
+	queued time.Time
+}
+
+// Queue runs jobs on a fixed number of workers. Jobs wait in a buffer of fixed depth until a worker is free.
+type Queue struct {
+	jobs    chan queuedJob
+	m       sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// New starts a queue with the given number of workers which holds up to depth jobs waiting for a worker
+func New(workers int, depth int) *Queue {
+	q := &Queue{
+		jobs: make(chan queuedJob, depth),
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+// Submit queues job to be run by a worker. It returns ErrQueueFull rather than waiting if the queue is full. A nil
+// queue runs the job before returning.
+func (q *Queue) Submit(job Job) error {
+	if q == nil {
+		job()
+		return nil
+	}
+
+	q.m.RLock()
+	defer q.m.RUnlock()
+
+	if q.stopped {
+		return ErrStopped
+	}
+
+	select {
+	case q.jobs <- queuedJob{job: job, queued: time.Now()}:
+		metrics.IngestQueueDepth.Inc()
+		return nil
+	default:
+		metrics.IngestQueueFull.Inc()
+		return ErrQueueFull
+	}
+}
+
+// Stop stops accepting jobs and waits for those already queued to finish. It is safe to call more than once.
+func (q *Queue) Stop() {
+	if q == nil {
+		return
+	}
+
+	q.m.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.jobs)
+	}
+	q.m.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for j := range q.jobs {
+		metrics.IngestQueueDepth.Dec()
+		metrics.IngestQueueLatency.Observe(time.Since(j.queued).Seconds())
+
+		start := time.Now()
+		run(j.job)
+		metrics.IngestDuration.Observe(time.Since(start).Seconds())
+	}
+}
+
+// run runs job recovering from any panic so that a bad message can't take down a worker
+func run(job Job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Error("Ingest: job panicked")
+		}
+	}()
+
+	job()
+}
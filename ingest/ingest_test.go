@@ -0,0 +1,73 @@
+package ingest
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueue_Submit(t *testing.T) {
+	q := New(4, 10)
+
+	var ran int32
+	for i := 0; i < 10; i++ {
+		err := q.Submit(func() { atomic.AddInt32(&ran, 1) })
+		require.NoError(t, err)
+	}
+
+	q.Stop()
+	assert.Equal(t, int32(10), atomic.LoadInt32(&ran))
+
+	err := q.Submit(func() {})
+	assert.ErrorIs(t, err, ErrStopped)
+
+	// stopping again is a no-op
+	q.Stop()
+}
+
+func TestQueue_Full(t *testing.T) {
+	q := New(1, 1)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// occupy the only worker
+	require.NoError(t, q.Submit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+
+	// fill the queue
+	require.NoError(t, q.Submit(func() {}))
+
+	err := q.Submit(func() {})
+	assert.ErrorIs(t, err, ErrQueueFull)
+
+	close(release)
+	q.Stop()
+}
+
+func TestQueue_Panic(t *testing.T) {
+	q := New(1, 2)
+
+	var ran int32
+	require.NoError(t, q.Submit(func() { panic("bad message") }))
+	require.NoError(t, q.Submit(func() { atomic.AddInt32(&ran, 1) }))
+
+	q.Stop()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ran), "the worker should survive a panicking job")
+}
+
+func TestQueue_Nil(t *testing.T) {
+	var q *Queue
+
+	ran := false
+	err := q.Submit(func() { ran = true })
+	require.NoError(t, err)
+	assert.True(t, ran, "a nil queue should run jobs synchronously")
+
+	q.Stop()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/gateway"
+)
+
+var _ lambda.Handler = &lambdaHandler{}
+
+// lambdaHandler passes events an email provider receives mail from to it and serves everything else as API Gateway
+// requests
+type lambdaHandler struct {
+	h     http.Handler
+	email burner.EmailProviders
+}
+
+func (l *lambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	for _, e := range l.email {
+		if eh, ok := e.Provider.(burner.LambdaEventHandler); ok {
+			handled, err := eh.HandleLambdaEvent(ctx, payload)
+			if handled {
+				return []byte("null"), err
+			}
+		}
+	}
+
+	var e events.APIGatewayProxyRequest
+	err := json.Unmarshal(payload, &e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal api gateway request: %w", err)
+	}
+
+	r, err := gateway.NewRequest(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+
+	w := gateway.NewResponse()
+	l.h.ServeHTTP(w, r)
+
+	return json.Marshal(w.End())
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	stdcontext "context"
+	"errors"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
-	"github.com/haydenwoodhead/gateway"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,7 +28,8 @@ func main() {
 
 	log.Info("Starting burner.kiwi")
 	if cfg.UsingLambda {
-		log.Fatal(gateway.ListenAndServe("", context.ClearHandler(s.Router))) // wrap mux in ClearHandler as per docs to prevent leaking memory
+		// wrap mux in ClearHandler as per docs to prevent leaking memory
+		lambda.StartHandler(&lambdaHandler{h: context.ClearHandler(s.Router), email: email})
 		return
 	}
 
@@ -34,5 +41,35 @@ func main() {
 		}()
 	}
 
-	log.Fatal(http.ListenAndServe(listenAddr, context.ClearHandler(s.Router)))
+	srv := &http.Server{Addr: listenAddr, Handler: context.ClearHandler(s.Router)}
+	shutdown := make(chan struct{})
+
+	go func() {
+		defer close(shutdown)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+
+		log.Info("Stopping burner.kiwi")
+		ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 30*time.Second)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.WithError(err).Error("Failed to shutdown http server")
+		}
+	}()
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdown
+
+	// stop the email providers once webhooks have finished so the mail they accepted is saved
+	err = s.Stop()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to stop email providers")
+	}
 }
@@ -16,3 +16,65 @@ var InboxesCreated = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: namespace,
 	Name:      "inboxes_created",
 }, []string{"content_type", "style"})
+
+var EmailsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "emails_rejected",
+}, []string{"provider", "reason"})
+
+var RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "rate_limited",
+}, []string{"limit"})
+
+var Greylisted = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "greylisted",
+})
+
+var IngestQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "ingest_queue_depth",
+})
+
+var IngestQueueFull = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "ingest_queue_full",
+})
+
+var IngestQueueLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "ingest_queue_latency_seconds",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+})
+
+var IngestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "ingest_duration_seconds",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+})
+
+var SpoolMessages = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "spool_messages",
+})
+
+var SpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "spool_bytes",
+})
+
+var SpoolOldestAge = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "spool_oldest_age_seconds",
+})
+
+var SpoolDeliveryFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "spool_delivery_failures",
+})
+
+var EmailsDeduplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "emails_deduplicated",
+}, []string{"provider"})
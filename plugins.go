@@ -0,0 +1,16 @@
+package main
+
+// The databases and email providers burner.kiwi is built with. Each registers itself with burner when imported so a
+// private one can be added by importing its package here.
+import (
+	_ "github.com/haydenwoodhead/burner.kiwi/data/dynamodb"
+	_ "github.com/haydenwoodhead/burner.kiwi/data/inmemory"
+	_ "github.com/haydenwoodhead/burner.kiwi/data/postgresql"
+	_ "github.com/haydenwoodhead/burner.kiwi/data/sqlite3"
+	_ "github.com/haydenwoodhead/burner.kiwi/email/httpmail"
+	_ "github.com/haydenwoodhead/burner.kiwi/email/mailgunmail"
+	_ "github.com/haydenwoodhead/burner.kiwi/email/postmarkmail"
+	_ "github.com/haydenwoodhead/burner.kiwi/email/sendgridmail"
+	_ "github.com/haydenwoodhead/burner.kiwi/email/sesmail"
+	_ "github.com/haydenwoodhead/burner.kiwi/email/smtpmail"
+)
@@ -0,0 +1,116 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReloadInterval is how often a policy file is checked for changes
+const DefaultReloadInterval = 10 * time.Second
+
+// File is a policy loaded from a file which is reloaded whenever the file changes. If a reload fails the previous
+// policy stays in place.
+type File struct {
+	path  string
+	extra []Rule
+
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// LoadFile loads the policy at path and checks it for changes every interval. extra rules are evaluated after the
+// rules in the file but before its default.
+func LoadFile(path string, interval time.Duration, extra ...Rule) (*File, error) {
+	f := &File{
+		path:  path,
+		extra: extra,
+		stop:  make(chan struct{}),
+	}
+
+	_, err := f.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go f.watch(interval)
+
+	return f, nil
+}
+
+// Check checks the request against the current policy
+func (f *File) Check(req Request) Decision {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.policy.Check(req)
+}
+
+// Close stops watching the file for changes
+func (f *File) Close() {
+	f.once.Do(func() {
+		close(f.stop)
+	})
+}
+
+func (f *File) watch(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-t.C:
+			reloaded, err := f.reload()
+			if err != nil {
+				log.WithError(err).WithField("path", f.path).Error("Policy: failed to reload policy, keeping previous")
+				continue
+			}
+			if reloaded {
+				log.WithField("path", f.path).Info("Policy: reloaded policy")
+			}
+		}
+	}
+}
+
+// reload loads the policy from disk if the file has been modified since it was last loaded
+func (f *File) reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat policy file: %w", err)
+	}
+
+	f.mu.RLock()
+	unchanged := f.policy != nil && info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open policy file: %w", err)
+	}
+	defer file.Close()
+
+	p, err := Parse(file)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse policy file %v: %w", f.path, err)
+	}
+
+	p.Rules = append(p.Rules, f.extra...)
+
+	f.mu.Lock()
+	f.policy = p
+	f.modTime = info.ModTime()
+	f.mu.Unlock()
+
+	return true, nil
+}
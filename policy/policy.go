@@ -0,0 +1,302 @@
+// Package policy decides whether incoming mail should be accepted based on allow and deny rules keyed on the
+// sender, the recipient domain and the client IP.
+//
+// Rules are written one per line:
+//
+//	<allow|deny> <sender|recipient_domain|ip> <exact|subdomain|glob|regex|cidr> <pattern> [reason...]
+//	default <allow|deny>
+//
+// Blank lines and lines beginning with # are ignored. Rules are evaluated in order and the first match wins. If no
+// rule matches the default action is used, which is allow unless set otherwise.
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidRule is returned when a rule can't be parsed
+var ErrInvalidRule = errors.New("invalid policy rule")
+
+// Action is what to do with mail that matches a rule
+type Action string
+
+// Actions a rule may take
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Field is the part of the incoming mail a rule is matched against
+type Field string
+
+// Fields a rule may match against
+const (
+	Sender          Field = "sender"
+	RecipientDomain Field = "recipient_domain"
+	ClientIP        Field = "ip"
+)
+
+// Match is how a rule's pattern is compared to the field
+type Match string
+
+// Ways a pattern may be matched
+const (
+	// Exact matches the whole value. For sender rules this may be either the full address or its domain.
+	Exact Match = "exact"
+	// Subdomain matches a domain and any of its subdomains, so "example.com" matches "mail.example.com" but not
+	// "badexample.com".
+	Subdomain Match = "subdomain"
+	// Glob matches shell style patterns e.g. "*@*.example.com"
+	Glob Match = "glob"
+	// Regex matches a regular expression. Patterns are not anchored unless they include ^ and $.
+	Regex Match = "regex"
+	// CIDR matches client IPs within a network e.g. "203.0.113.0/24"
+	CIDR Match = "cidr"
+)
+
+// Request describes the mail being checked. Empty fields never match a rule.
+type Request struct {
+	Sender    string
+	Recipient string
+	ClientIP  net.IP
+}
+
+// Decision is the result of checking a request against a policy
+type Decision struct {
+	Allowed bool
+	// Reason explains why the decision was made. Rules without a reason are described by their pattern so it may
+	// have as many values as there are rules.
+	Reason string
+}
+
+// Checker checks requests against a policy
+type Checker interface {
+	Check(r Request) Decision
+}
+
+// Rule is a single allow or deny rule
+type Rule struct {
+	Action  Action
+	Field   Field
+	Match   Match
+	Pattern string
+	Reason  string
+
+	re  *regexp.Regexp
+	net *net.IPNet
+}
+
+// NewRule validates and compiles a rule
+func NewRule(action Action, field Field, match Match, pattern string, reason string) (Rule, error) {
+	r := Rule{
+		Action:  action,
+		Field:   field,
+		Match:   match,
+		Pattern: pattern,
+		Reason:  reason,
+	}
+
+	if action != Allow && action != Deny {
+		return Rule{}, fmt.Errorf("%w: unknown action %q", ErrInvalidRule, action)
+	}
+
+	switch field {
+	case Sender, RecipientDomain, ClientIP:
+	default:
+		return Rule{}, fmt.Errorf("%w: unknown field %q", ErrInvalidRule, field)
+	}
+
+	switch match {
+	case Exact:
+		r.Pattern = strings.ToLower(pattern)
+		if field == ClientIP && net.ParseIP(pattern) == nil {
+			return Rule{}, fmt.Errorf("%w: bad ip %q", ErrInvalidRule, pattern)
+		}
+	case Glob:
+		r.Pattern = strings.ToLower(pattern)
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return Rule{}, fmt.Errorf("%w: bad glob %q: %v", ErrInvalidRule, pattern, err)
+		}
+	case Subdomain:
+		if field == ClientIP {
+			return Rule{}, fmt.Errorf("%w: subdomain can't be used with ip", ErrInvalidRule)
+		}
+		r.Pattern = strings.TrimPrefix(strings.ToLower(pattern), ".")
+	case Regex:
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return Rule{}, fmt.Errorf("%w: bad regex %q: %v", ErrInvalidRule, pattern, err)
+		}
+		r.re = re
+	case CIDR:
+		if field != ClientIP {
+			return Rule{}, fmt.Errorf("%w: cidr can only be used with ip", ErrInvalidRule)
+		}
+		_, n, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return Rule{}, fmt.Errorf("%w: bad cidr %q: %v", ErrInvalidRule, pattern, err)
+		}
+		r.net = n
+	default:
+		return Rule{}, fmt.Errorf("%w: unknown match %q", ErrInvalidRule, match)
+	}
+
+	if r.Reason == "" {
+		r.Reason = fmt.Sprintf("%v %v %v %v", action, field, match, pattern)
+	}
+
+	return r, nil
+}
+
+// Matches reports whether the rule matches the request
+func (r Rule) Matches(req Request) bool {
+	switch r.Field {
+	case Sender:
+		sender := strings.ToLower(req.Sender)
+		if sender == "" {
+			return false
+		}
+		switch r.Match {
+		case Exact:
+			return sender == r.Pattern || domain(sender) == r.Pattern
+		case Subdomain:
+			return r.match(domain(sender))
+		}
+		return r.match(sender)
+	case RecipientDomain:
+		d := domain(strings.ToLower(req.Recipient))
+		if d == "" {
+			return false
+		}
+		return r.match(d)
+	case ClientIP:
+		if req.ClientIP == nil {
+			return false
+		}
+		switch r.Match {
+		case CIDR:
+			return r.net.Contains(req.ClientIP)
+		case Exact:
+			return req.ClientIP.Equal(net.ParseIP(r.Pattern))
+		}
+		return r.match(req.ClientIP.String())
+	}
+
+	return false
+}
+
+func (r Rule) match(value string) bool {
+	switch r.Match {
+	case Exact:
+		return value == r.Pattern
+	case Subdomain:
+		return value == r.Pattern || strings.HasSuffix(value, "."+r.Pattern)
+	case Glob:
+		ok, _ := path.Match(r.Pattern, value)
+		return ok
+	case Regex:
+		return r.re.MatchString(value)
+	}
+	return false
+}
+
+// domain returns the domain of an address, or the value itself if it has no @
+func domain(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address
+	}
+	return address[at+1:]
+}
+
+// Policy is an ordered list of rules and a default action
+type Policy struct {
+	Rules   []Rule
+	Default Action
+}
+
+// New returns a policy made up of the given rules which allows anything they don't match
+func New(rules ...Rule) *Policy {
+	return &Policy{
+		Rules:   rules,
+		Default: Allow,
+	}
+}
+
+// Check returns the decision of the first rule to match the request or the default if none do
+func (p *Policy) Check(req Request) Decision {
+	for _, r := range p.Rules {
+		if r.Matches(req) {
+			return Decision{Allowed: r.Action == Allow, Reason: r.Reason}
+		}
+	}
+
+	return Decision{Allowed: p.Default != Deny, Reason: "default"}
+}
+
+// DenySenderDomains returns rules which deny mail from each domain and its subdomains
+func DenySenderDomains(domains []string, reason string) []Rule {
+	rules := make([]Rule, 0, len(domains))
+	for _, d := range domains {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		rules = append(rules, Rule{
+			Action:  Deny,
+			Field:   Sender,
+			Match:   Subdomain,
+			Pattern: strings.TrimPrefix(strings.ToLower(d), "."),
+			Reason:  reason,
+		})
+	}
+	return rules
+}
+
+// Parse reads a policy in the format described in the package docs
+func Parse(rd io.Reader) (*Policy, error) {
+	p := New()
+
+	s := bufio.NewScanner(rd)
+	line := 0
+	for s.Scan() {
+		line++
+
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "default" {
+			if len(fields) != 2 || (fields[1] != string(Allow) && fields[1] != string(Deny)) {
+				return nil, fmt.Errorf("line %v: %w: default must be allow or deny", line, ErrInvalidRule)
+			}
+			p.Default = Action(fields[1])
+			continue
+		}
+
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %v: %w: expected <action> <field> <match> <pattern> [reason]", line, ErrInvalidRule)
+		}
+
+		r, err := NewRule(Action(fields[0]), Field(fields[1]), Match(fields[2]), fields[3], strings.Join(fields[4:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+
+		p.Rules = append(p.Rules, r)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+
+	return p, nil
+}
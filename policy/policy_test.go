@@ -0,0 +1,272 @@
+package policy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRule_Matches(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Field    Field
+		Match    Match
+		Pattern  string
+		Request  Request
+		Expected bool
+	}{
+		{
+			Name:     "sender exact address",
+			Field:    Sender,
+			Match:    Exact,
+			Pattern:  "Bob@Example.com",
+			Request:  Request{Sender: "bob@example.com"},
+			Expected: true,
+		},
+		{
+			Name:     "sender exact domain",
+			Field:    Sender,
+			Match:    Exact,
+			Pattern:  "example.com",
+			Request:  Request{Sender: "bob@example.com"},
+			Expected: true,
+		},
+		{
+			Name:     "sender exact doesn't match subdomain",
+			Field:    Sender,
+			Match:    Exact,
+			Pattern:  "example.com",
+			Request:  Request{Sender: "bob@mail.example.com"},
+			Expected: false,
+		},
+		{
+			Name:     "sender subdomain",
+			Field:    Sender,
+			Match:    Subdomain,
+			Pattern:  "example.com",
+			Request:  Request{Sender: "bob@mail.example.com"},
+			Expected: true,
+		},
+		{
+			Name:     "sender subdomain doesn't match suffix",
+			Field:    Sender,
+			Match:    Subdomain,
+			Pattern:  "ail.com",
+			Request:  Request{Sender: "bob@gmail.com"},
+			Expected: false,
+		},
+		{
+			Name:     "sender glob",
+			Field:    Sender,
+			Match:    Glob,
+			Pattern:  "noreply-*@*.example.com",
+			Request:  Request{Sender: "noreply-42@mail.example.com"},
+			Expected: true,
+		},
+		{
+			Name:     "sender regex",
+			Field:    Sender,
+			Match:    Regex,
+			Pattern:  `^[0-9]+@example\.com$`,
+			Request:  Request{Sender: "1234@EXAMPLE.com"},
+			Expected: true,
+		},
+		{
+			Name:     "empty sender never matches",
+			Field:    Sender,
+			Match:    Glob,
+			Pattern:  "*",
+			Request:  Request{},
+			Expected: false,
+		},
+		{
+			Name:     "recipient domain subdomain",
+			Field:    RecipientDomain,
+			Match:    Subdomain,
+			Pattern:  "example.com",
+			Request:  Request{Recipient: "abc@internal.example.com"},
+			Expected: true,
+		},
+		{
+			Name:     "recipient domain exact",
+			Field:    RecipientDomain,
+			Match:    Exact,
+			Pattern:  "example.com",
+			Request:  Request{Recipient: "abc@example.org"},
+			Expected: false,
+		},
+		{
+			Name:     "ip exact",
+			Field:    ClientIP,
+			Match:    Exact,
+			Pattern:  "2001:DB8::1",
+			Request:  Request{ClientIP: net.ParseIP("2001:db8::1")},
+			Expected: true,
+		},
+		{
+			Name:     "ip cidr",
+			Field:    ClientIP,
+			Match:    CIDR,
+			Pattern:  "203.0.113.0/24",
+			Request:  Request{ClientIP: net.ParseIP("203.0.113.7")},
+			Expected: true,
+		},
+		{
+			Name:     "ip outside cidr",
+			Field:    ClientIP,
+			Match:    CIDR,
+			Pattern:  "203.0.113.0/24",
+			Request:  Request{ClientIP: net.ParseIP("198.51.100.7")},
+			Expected: false,
+		},
+		{
+			Name:     "ip glob",
+			Field:    ClientIP,
+			Match:    Glob,
+			Pattern:  "10.*",
+			Request:  Request{ClientIP: net.ParseIP("10.1.2.3")},
+			Expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r, err := NewRule(Deny, test.Field, test.Match, test.Pattern, "")
+			require.NoError(t, err)
+			assert.Equal(t, test.Expected, r.Matches(test.Request))
+		})
+	}
+}
+
+func TestNewRule_Invalid(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Action  Action
+		Field   Field
+		Match   Match
+		Pattern string
+	}{
+		{Name: "bad action", Action: "maybe", Field: Sender, Match: Exact, Pattern: "example.com"},
+		{Name: "bad field", Action: Deny, Field: "subject", Match: Exact, Pattern: "example.com"},
+		{Name: "bad match", Action: Deny, Field: Sender, Match: "fuzzy", Pattern: "example.com"},
+		{Name: "bad regex", Action: Deny, Field: Sender, Match: Regex, Pattern: "(["},
+		{Name: "bad glob", Action: Deny, Field: Sender, Match: Glob, Pattern: "[a-"},
+		{Name: "cidr on sender", Action: Deny, Field: Sender, Match: CIDR, Pattern: "10.0.0.0/8"},
+		{Name: "subdomain on ip", Action: Deny, Field: ClientIP, Match: Subdomain, Pattern: "example.com"},
+		{Name: "bad ip", Action: Deny, Field: ClientIP, Match: Exact, Pattern: "example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := NewRule(test.Action, test.Field, test.Match, test.Pattern, "")
+			assert.ErrorIs(t, err, ErrInvalidRule)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse(strings.NewReader(`
+# allow our partner even though they're on a shared host
+allow sender exact partner@shared.example
+deny sender subdomain shared.example shared host
+deny ip cidr 203.0.113.0/24
+allow recipient_domain exact example.com
+default deny
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name     string
+		Request  Request
+		Expected Decision
+	}{
+		{
+			Name:     "allowed sender before deny",
+			Request:  Request{Sender: "partner@shared.example", Recipient: "abc@example.com"},
+			Expected: Decision{Allowed: true, Reason: "allow sender exact partner@shared.example"},
+		},
+		{
+			Name:     "denied sender with reason",
+			Request:  Request{Sender: "spam@mx.shared.example", Recipient: "abc@example.com"},
+			Expected: Decision{Allowed: false, Reason: "shared host"},
+		},
+		{
+			Name:     "denied ip",
+			Request:  Request{Sender: "bob@example.org", Recipient: "abc@example.com", ClientIP: net.ParseIP("203.0.113.9")},
+			Expected: Decision{Allowed: false, Reason: "deny ip cidr 203.0.113.0/24"},
+		},
+		{
+			Name:     "allowed recipient domain",
+			Request:  Request{Sender: "bob@example.org", Recipient: "abc@example.com"},
+			Expected: Decision{Allowed: true, Reason: "allow recipient_domain exact example.com"},
+		},
+		{
+			Name:     "default",
+			Request:  Request{Sender: "bob@example.org", Recipient: "abc@example.net"},
+			Expected: Decision{Allowed: false, Reason: "default"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Expected, p.Check(test.Request))
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	_, err := Parse(strings.NewReader("allow sender exact example.com\ndeny sender\n"))
+	assert.ErrorIs(t, err, ErrInvalidRule)
+	assert.Contains(t, err.Error(), "line 2")
+
+	_, err = Parse(strings.NewReader("default maybe\n"))
+	assert.ErrorIs(t, err, ErrInvalidRule)
+}
+
+func TestDenySenderDomains(t *testing.T) {
+	p := New(DenySenderDomains([]string{"ail.com", " example.org "}, "blacklisted")...)
+
+	assert.Equal(t, Decision{Allowed: false, Reason: "blacklisted"}, p.Check(Request{Sender: "bob@ail.com"}))
+	assert.Equal(t, Decision{Allowed: false, Reason: "blacklisted"}, p.Check(Request{Sender: "bob@mx.example.org"}))
+	assert.Equal(t, Decision{Allowed: true, Reason: "default"}, p.Check(Request{Sender: "bob@gmail.com"}))
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy")
+	require.NoError(t, os.WriteFile(path, []byte("deny sender exact example.org\n"), 0600))
+
+	f, err := LoadFile(path, 10*time.Millisecond, DenySenderDomains([]string{"example.net"}, "blacklisted")...)
+	require.NoError(t, err)
+	defer f.Close()
+
+	assert.False(t, f.Check(Request{Sender: "bob@example.org"}).Allowed)
+	assert.True(t, f.Check(Request{Sender: "bob@example.com"}).Allowed)
+	assert.Equal(t, "blacklisted", f.Check(Request{Sender: "bob@example.net"}).Reason)
+
+	// make sure the modification time changes on file systems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.WriteFile(path, []byte("deny sender exact example.com\n"), 0600))
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	assert.Eventually(t, func() bool {
+		return !f.Check(Request{Sender: "bob@example.com"}).Allowed
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, f.Check(Request{Sender: "bob@example.org"}).Allowed)
+
+	// a bad policy leaves the previous one in place
+	later = later.Add(time.Minute)
+	require.NoError(t, os.WriteFile(path, []byte("deny sender\n"), 0600))
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, f.Check(Request{Sender: "bob@example.com"}).Allowed)
+
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing"), time.Second)
+	assert.Error(t, err)
+}
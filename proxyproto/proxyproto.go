@@ -0,0 +1,254 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidHeader is returned when a trusted peer sends a malformed or missing PROXY protocol header
+var ErrInvalidHeader = errors.New("invalid proxy protocol header")
+
+// v2Signature is the fixed 12 byte prefix of every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the maximum length of a version 1 header including the trailing CRLF
+const v1MaxLength = 107
+
+// Listener wraps a net.Listener and restores the real client address from PROXY protocol (v1 or v2) headers
+// sent by trusted peers. Connections from untrusted peers are passed through untouched.
+type Listener struct {
+	net.Listener
+	Trusted       []*net.IPNet
+	HeaderTimeout time.Duration
+}
+
+// NewListener returns a Listener which accepts PROXY protocol headers from the trusted networks
+func NewListener(l net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{
+		Listener:      l,
+		Trusted:       trusted,
+		HeaderTimeout: 5 * time.Second,
+	}
+}
+
+// Accept waits for and returns the next connection. The header is read lazily on the first call to Read or
+// RemoteAddr so that a slow peer can't block the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	return &Conn{Conn: c, r: bufio.NewReader(c), headerTimeout: l.HeaderTimeout}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, n := range l.Trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Conn is a connection from a trusted proxy
+type Conn struct {
+	net.Conn
+	r             *bufio.Reader
+	headerTimeout time.Duration
+
+	once       sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+}
+
+// Read reads from the connection after the PROXY header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address given in the PROXY header. If the header was for a local connection
+// (e.g. a health check) or failed to parse the address of the proxy itself is returned.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.headerTimeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		defer func() {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}()
+	}
+
+	c.remoteAddr, c.headerErr = ReadHeader(c.r)
+}
+
+// ReadHeader reads a version 1 or 2 PROXY protocol header from r and returns the source address it contains.
+// A nil address with a nil error means the header was valid but carried no address (UNKNOWN or LOCAL).
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(sig, v2Signature) {
+		return readV2(r)
+	}
+
+	sig, err = r.Peek(6)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+
+	if string(sig) == "PROXY " {
+		return readV1(r)
+	}
+
+	return nil, ErrInvalidHeader
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrInvalidHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("%w: bad source address", ErrInvalidHeader)
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad source port", ErrInvalidHeader)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+
+	verCmd := hdr[12]
+	fam := hdr[13]
+	length := binary.BigEndian.Uint16(hdr[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version", ErrInvalidHeader)
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown command", ErrInvalidHeader)
+	}
+
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short ipv4 address block", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short ipv6 address block", ErrInvalidHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+
+	// AF_UNSPEC and AF_UNIX carry nothing useful for us
+	return nil, nil
+}
+
+// ParseCIDRs parses a list of CIDRs. Bare IP addresses are treated as a single host.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
@@ -0,0 +1,179 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func v2Header(cmd byte, fam byte, body []byte) []byte {
+	var b bytes.Buffer
+	b.Write(v2Signature)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam)
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(body)))
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4Body := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x30, 0x39, 0, 25}
+
+	ipv6Body := make([]byte, 36)
+	copy(ipv6Body, net.ParseIP("2001:db8::1"))
+	copy(ipv6Body[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6Body[32:], 4321)
+	binary.BigEndian.PutUint16(ipv6Body[34:], 25)
+
+	tests := []struct {
+		Name         string
+		In           []byte
+		ExpectedAddr string
+		ExpectedErr  bool
+	}{
+		{
+			Name:         "v1 tcp4",
+			In:           []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 25\r\n"),
+			ExpectedAddr: "203.0.113.7:12345",
+		},
+		{
+			Name:         "v1 tcp6",
+			In:           []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4321 25\r\n"),
+			ExpectedAddr: "[2001:db8::1]:4321",
+		},
+		{
+			Name: "v1 unknown",
+			In:   []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			Name:        "v1 missing crlf",
+			In:          []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 25" + strings.Repeat(" ", 100)),
+			ExpectedErr: true,
+		},
+		{
+			Name:        "v1 bad address",
+			In:          []byte("PROXY TCP4 not-an-ip 10.0.0.1 12345 25\r\n"),
+			ExpectedErr: true,
+		},
+		{
+			Name:         "v2 ipv4",
+			In:           v2Header(0x1, 0x11, ipv4Body),
+			ExpectedAddr: "203.0.113.7:12345",
+		},
+		{
+			Name:         "v2 ipv6",
+			In:           v2Header(0x1, 0x21, ipv6Body),
+			ExpectedAddr: "[2001:db8::1]:4321",
+		},
+		{
+			Name: "v2 local",
+			In:   v2Header(0x0, 0x00, nil),
+		},
+		{
+			Name:        "v2 truncated",
+			In:          v2Header(0x1, 0x11, ipv4Body)[:20],
+			ExpectedErr: true,
+		},
+		{
+			Name:        "no header",
+			In:          []byte("EHLO example.com\r\n"),
+			ExpectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			addr, err := ReadHeader(bufio.NewReader(bytes.NewReader(test.In)))
+			if test.ExpectedErr {
+				assert.ErrorIs(t, err, ErrInvalidHeader)
+				return
+			}
+
+			require.NoError(t, err)
+			if test.ExpectedAddr == "" {
+				assert.Nil(t, addr)
+				return
+			}
+			assert.Equal(t, test.ExpectedAddr, addr.String())
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		Name             string
+		Trusted          []string
+		Send             string
+		ExpectedRemoteIP string
+		ExpectedData     string
+	}{
+		{
+			Name:             "trusted",
+			Trusted:          []string{"127.0.0.0/8"},
+			Send:             "PROXY TCP4 203.0.113.7 10.0.0.1 12345 25\r\nEHLO example.com\r\n",
+			ExpectedRemoteIP: "203.0.113.7",
+			ExpectedData:     "EHLO example.com\r\n",
+		},
+		{
+			Name:             "untrusted",
+			Trusted:          []string{"192.0.2.1"},
+			Send:             "PROXY TCP4 203.0.113.7 10.0.0.1 12345 25\r\n",
+			ExpectedRemoteIP: "127.0.0.1",
+			ExpectedData:     "PROXY TCP4 203.0.113.7 10.0.0.1 12345 25\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			trusted, err := ParseCIDRs(test.Trusted)
+			require.NoError(t, err)
+
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			l := NewListener(inner, trusted)
+			defer l.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				_, _ = c.Write([]byte(test.Send))
+			}()
+
+			c, err := l.Accept()
+			require.NoError(t, err)
+			defer c.Close()
+
+			assert.Equal(t, test.ExpectedRemoteIP, c.RemoteAddr().(*net.TCPAddr).IP.String())
+
+			data := make([]byte, len(test.ExpectedData))
+			_, err = io.ReadFull(c, data)
+			require.NoError(t, err)
+			assert.Equal(t, test.ExpectedData, string(data))
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	require.NoError(t, err)
+	require.Len(t, nets, 3)
+
+	assert.True(t, nets[0].Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, nets[1].Contains(net.ParseIP("192.0.2.1")))
+	assert.False(t, nets[1].Contains(net.ParseIP("192.0.2.2")))
+	assert.True(t, nets[2].Contains(net.ParseIP("2001:db8::5")))
+
+	_, err = ParseCIDRs([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+var _ Store = &MemoryStore{}
+
+// MemoryStore keeps buckets in memory so they are only shared within a single process. It is the default store.
+type MemoryStore struct {
+	m       sync.Mutex
+	buckets map[string]*memoryBucket
+	sweep   time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	fullAt time.Time
+}
+
+// sweepInterval is how often full buckets are removed from memory
+const sweepInterval = time.Minute
+
+// NewMemoryStore returns an empty in memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+// TakeToken takes a token from the bucket for key
+func (s *MemoryStore) TakeToken(key string, l Limit, now time.Time) (bool, time.Duration, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.removeFull(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+
+	allowed, wait := b.Take(l, now)
+	b.fullAt = b.FullAt(l)
+
+	return allowed, wait, nil
+}
+
+// removeFull drops buckets which have refilled as they're no different from new ones. Must be called with the lock
+// held.
+func (s *MemoryStore) removeFull(now time.Time) {
+	if now.Sub(s.sweep) < sweepInterval {
+		return
+	}
+	s.sweep = now
+
+	for k, b := range s.buckets {
+		if !b.fullAt.After(now) {
+			delete(s.buckets, k)
+		}
+	}
+}
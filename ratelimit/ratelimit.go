@@ -0,0 +1,145 @@
+// Package ratelimit implements token bucket rate limiting with pluggable storage so that buckets may be kept in
+// memory or shared between instances through a database.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidLimit is returned by ParseLimit when a limit can't be parsed
+var ErrInvalidLimit = errors.New("invalid rate limit")
+
+// Limit allows Count events per Period. Up to Count events may happen at once after which they are allowed at an
+// even rate.
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// ParseLimit parses limits of the form "count/period" e.g. "10/1m" or "100/h". An empty string returns the zero
+// limit which disables limiting.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" {
+		return Limit{}, nil
+	}
+
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("%w: %q must be of the form count/period", ErrInvalidLimit, s)
+	}
+
+	c, err := strconv.Atoi(count)
+	if err != nil || c <= 0 {
+		return Limit{}, fmt.Errorf("%w: %q count must be a positive integer", ErrInvalidLimit, s)
+	}
+
+	// allow the 1 to be left off e.g. 10/m
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+
+	p, err := time.ParseDuration(period)
+	if err != nil || p <= 0 {
+		return Limit{}, fmt.Errorf("%w: %q period must be a positive duration", ErrInvalidLimit, s)
+	}
+
+	return Limit{Count: c, Period: p}, nil
+}
+
+// Enabled reports whether the limit restricts anything
+func (l Limit) Enabled() bool {
+	return l.Count > 0 && l.Period > 0
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%v/%v", l.Count, l.Period)
+}
+
+// Bucket is the state of a single token bucket
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills the bucket for the time elapsed since it was last updated and then takes a token if there is one. It
+// returns whether a token was taken and, if not, how long until one is available.
+func (b *Bucket) Take(l Limit, now time.Time) (bool, time.Duration) {
+	rate := float64(l.Count) / l.Period.Seconds() // tokens per second
+
+	if b.Updated.IsZero() {
+		b.Tokens = float64(l.Count)
+	} else if elapsed := now.Sub(b.Updated).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(l.Count), b.Tokens+elapsed*rate)
+	}
+	b.Updated = now
+
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.Tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// FullAt returns when the bucket will have refilled completely. After this the bucket is the same as a new one and
+// can be discarded.
+func (b *Bucket) FullAt(l Limit) time.Time {
+	rate := float64(l.Count) / l.Period.Seconds()
+	missing := float64(l.Count) - b.Tokens
+	return b.Updated.Add(time.Duration(missing / rate * float64(time.Second)))
+}
+
+// Store keeps token buckets. Implementations must take tokens atomically so that they can be shared between
+// instances.
+type Store interface {
+	TakeToken(key string, l Limit, now time.Time) (bool, time.Duration, error)
+}
+
+// Limiter applies a limit to keys such as client IPs
+type Limiter struct {
+	name  string
+	limit Limit
+	store Store
+	now   func() time.Time
+}
+
+// New returns a limiter named name which applies l using store. The name is used to separate buckets for different
+// limits in the same store and in metrics. A nil limiter or one with a disabled limit allows everything.
+func New(name string, l Limit, store Store) *Limiter {
+	return &Limiter{
+		name:  name,
+		limit: l,
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// Allow takes a token for key. If none are available it returns false and how long until one will be. If the store
+// fails the request is allowed rather than locking everyone out.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil || !l.limit.Enabled() || key == "" {
+		return true, 0
+	}
+
+	ok, wait, err := l.store.TakeToken(l.name+":"+key, l.limit, l.now())
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"limit": l.name, "key": key}).Error("RateLimit: failed to take token")
+		return true, 0
+	}
+
+	if !ok {
+		metrics.RateLimited.With(prometheus.Labels{"limit": l.name}).Inc()
+	}
+
+	return ok, wait
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		In       string
+		Expected Limit
+	}{
+		{In: "", Expected: Limit{}},
+		{In: "10/1m", Expected: Limit{Count: 10, Period: time.Minute}},
+		{In: "100/h", Expected: Limit{Count: 100, Period: time.Hour}},
+		{In: "5/30s", Expected: Limit{Count: 5, Period: 30 * time.Second}},
+	}
+
+	for _, test := range tests {
+		l, err := ParseLimit(test.In)
+		require.NoError(t, err, test.In)
+		assert.Equal(t, test.Expected, l, test.In)
+	}
+
+	for _, in := range []string{"10", "ten/m", "0/m", "-1/m", "10/", "10/fortnight", "10/-1m"} {
+		_, err := ParseLimit(in)
+		assert.ErrorIs(t, err, ErrInvalidLimit, in)
+	}
+}
+
+func TestBucket_Take(t *testing.T) {
+	l := Limit{Count: 2, Period: 10 * time.Second}
+	now := time.Now()
+
+	var b Bucket
+
+	ok, _ := b.Take(l, now)
+	assert.True(t, ok)
+	ok, _ = b.Take(l, now)
+	assert.True(t, ok)
+
+	ok, wait := b.Take(l, now)
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Second, wait)
+
+	// half a token has refilled
+	ok, wait = b.Take(l, now.Add(2500*time.Millisecond))
+	assert.False(t, ok)
+	assert.Equal(t, 2500*time.Millisecond, wait)
+
+	ok, _ = b.Take(l, now.Add(5*time.Second))
+	assert.True(t, ok)
+
+	// the bucket never holds more than count tokens
+	ok, _ = b.Take(l, now.Add(time.Hour))
+	assert.True(t, ok)
+	ok, _ = b.Take(l, now.Add(time.Hour))
+	assert.True(t, ok)
+	ok, _ = b.Take(l, now.Add(time.Hour))
+	assert.False(t, ok)
+
+	assert.Equal(t, now.Add(time.Hour+10*time.Second), b.FullAt(l))
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	l := Limit{Count: 1, Period: time.Minute}
+	now := time.Now()
+
+	ok, _, err := s.TakeToken("a", l, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, wait, err := s.TakeToken("a", l, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, wait)
+
+	ok, _, err = s.TakeToken("b", l, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// full buckets are swept away
+	_, _, err = s.TakeToken("c", l, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, s.buckets, 1)
+}
+
+type failingStore struct{}
+
+func (failingStore) TakeToken(string, Limit, time.Time) (bool, time.Duration, error) {
+	return false, 0, errors.New("unavailable")
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	l := New("test", Limit{Count: 1, Period: time.Minute}, NewMemoryStore())
+
+	ok, _ := l.Allow("192.0.2.1")
+	assert.True(t, ok)
+	ok, wait := l.Allow("192.0.2.1")
+	assert.False(t, ok)
+	assert.NotZero(t, wait)
+
+	// clients without a key aren't limited
+	ok, _ = l.Allow("")
+	assert.True(t, ok)
+	ok, _ = l.Allow("")
+	assert.True(t, ok)
+
+	var nilLimiter *Limiter
+	ok, _ = nilLimiter.Allow("192.0.2.1")
+	assert.True(t, ok)
+
+	disabled := New("test", Limit{}, NewMemoryStore())
+	ok, _ = disabled.Allow("192.0.2.1")
+	assert.True(t, ok)
+
+	// a broken store fails open
+	failing := New("test", Limit{Count: 1, Period: time.Minute}, failingStore{})
+	ok, _ = failing.Allow("192.0.2.1")
+	assert.True(t, ok)
+}
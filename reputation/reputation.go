@@ -0,0 +1,302 @@
+// Package reputation checks the reputation of servers sending mail using DNS blocklists, forward-confirmed reverse
+// DNS and the name given in HELO.
+package reputation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long all of the checks for a client may take
+const DefaultTimeout = 10 * time.Second
+
+// maxPTRNames is the most reverse DNS names checked for a forward match
+const maxPTRNames = 10
+
+// The names of the checks as recorded on failures
+const (
+	CheckDNSBL  = "dnsbl"
+	CheckFCrDNS = "fcrdns"
+	CheckHelo   = "helo"
+)
+
+// Resolver performs the DNS lookups needed by the checks. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Action is what is done with mail from a server which fails a check
+type Action string
+
+const (
+	// Reject refuses mail from the server
+	Reject Action = "reject"
+	// Tag accepts mail from the server and records the failure on each message
+	Tag Action = "tag"
+)
+
+// ParseAction parses an action from configuration
+func ParseAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case Reject, Tag:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown action %q: must be one of %v or %v", s, Reject, Tag)
+	}
+}
+
+// Checker checks the reputation of sending servers. Only the checks enabled by options are run.
+type Checker struct {
+	resolver     Resolver
+	timeout      time.Duration
+	dnsblZones   []string
+	dnsblAction  Action
+	fcrdnsAction Action
+	heloAction   Action
+}
+
+// Option configures a Checker
+type Option func(c *Checker)
+
+// WithResolver makes the checker use r for DNS lookups rather than the system resolver
+func WithResolver(r Resolver) Option {
+	return func(c *Checker) {
+		c.resolver = r
+	}
+}
+
+// WithTimeout sets how long all of the checks for a client may take
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = d
+	}
+}
+
+// WithDNSBL looks up clients in each of the DNS blocklist zones, e.g. "zen.spamhaus.org"
+func WithDNSBL(zones []string, action Action) Option {
+	return func(c *Checker) {
+		c.dnsblZones = zones
+		c.dnsblAction = action
+	}
+}
+
+// WithFCrDNS requires that a client's reverse DNS name resolves back to its address
+func WithFCrDNS(action Action) Option {
+	return func(c *Checker) {
+		c.fcrdnsAction = action
+	}
+}
+
+// WithHelo requires that the name a client gives in HELO is a resolvable fully qualified domain name or an address
+// literal matching its address
+func WithHelo(action Action) Option {
+	return func(c *Checker) {
+		c.heloAction = action
+	}
+}
+
+// New returns a checker running the checks enabled by opts
+func New(opts ...Option) *Checker {
+	c := &Checker{
+		resolver: net.DefaultResolver,
+		timeout:  DefaultTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Check runs the enabled checks against the client with ip which gave helo. Failures of checks set to tag are
+// returned in the result which is nil if there are none. If a check set to reject fails the remaining checks are
+// skipped and its failure is returned as the second value. Lookups which fail for reasons other than the name not
+// existing count as passes so that an outage of DNS doesn't lose mail. A nil checker passes everything.
+func (c *Checker) Check(ip net.IP, helo string) (*burner.ReputationResult, *burner.ReputationFailure) {
+	if c == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var failures []burner.ReputationFailure
+
+	checks := []struct {
+		action Action
+		check  func() *burner.ReputationFailure
+	}{
+		{action: c.heloAction, check: func() *burner.ReputationFailure { return c.checkHelo(ctx, ip, helo) }},
+		{action: c.fcrdnsAction, check: func() *burner.ReputationFailure { return c.checkFCrDNS(ctx, ip) }},
+		{action: c.dnsblAction, check: func() *burner.ReputationFailure { return c.checkDNSBL(ctx, ip) }},
+	}
+
+	for _, check := range checks {
+		if check.action == "" {
+			continue
+		}
+
+		failure := check.check()
+		if failure == nil {
+			continue
+		}
+
+		if check.action == Reject {
+			return nil, failure
+		}
+		failures = append(failures, *failure)
+	}
+
+	if len(failures) == 0 {
+		return nil, nil
+	}
+
+	return &burner.ReputationResult{Failures: failures}, nil
+}
+
+// checkDNSBL looks ip up in each zone returning a failure for the first zone it is listed in
+func (c *Checker) checkDNSBL(ctx context.Context, ip net.IP) *burner.ReputationFailure {
+	if len(c.dnsblZones) == 0 {
+		return nil
+	}
+
+	reversed := reverseIP(ip)
+
+	for _, zone := range c.dnsblZones {
+		addrs, err := c.resolver.LookupHost(ctx, reversed+"."+zone)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"ip": ip, "zone": zone}).Error("Reputation: failed to query dnsbl")
+			continue
+		}
+
+		for _, addr := range addrs {
+			if listed(addr) {
+				return &burner.ReputationFailure{Check: CheckDNSBL, Reason: fmt.Sprintf("%v is listed on %v", ip, zone)}
+			}
+		}
+
+		// zones answer outside of 127.0.0.0/8, or with 127.255.255.0/24 as spamhaus does, when they refuse to answer
+		log.WithFields(log.Fields{"ip": ip, "zone": zone, "answer": addrs}).Error("Reputation: dnsbl refused query")
+	}
+
+	return nil
+}
+
+// checkFCrDNS checks that one of the reverse DNS names of ip resolves back to ip
+func (c *Checker) checkFCrDNS(ctx context.Context, ip net.IP) *burner.ReputationFailure {
+	names, err := c.resolver.LookupAddr(ctx, ip.String())
+	if err != nil && !isNotFound(err) {
+		log.WithError(err).WithField("ip", ip).Error("Reputation: failed to lookup reverse dns")
+		return nil
+	}
+
+	if len(names) == 0 {
+		return &burner.ReputationFailure{Check: CheckFCrDNS, Reason: fmt.Sprintf("%v has no reverse dns", ip)}
+	}
+
+	if len(names) > maxPTRNames {
+		names = names[:maxPTRNames]
+	}
+
+	for _, name := range names {
+		addrs, err := c.resolver.LookupHost(ctx, name)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"ip": ip, "name": name}).Error("Reputation: failed to lookup reverse dns name")
+			return nil
+		}
+
+		if containsIP(addrs, ip) {
+			return nil
+		}
+	}
+
+	return &burner.ReputationFailure{Check: CheckFCrDNS, Reason: fmt.Sprintf("reverse dns of %v doesn't resolve back to it", ip)}
+}
+
+// checkHelo checks that helo is a fully qualified domain name which resolves, or an address literal of ip
+func (c *Checker) checkHelo(ctx context.Context, ip net.IP, helo string) *burner.ReputationFailure {
+	fail := func(reason string) *burner.ReputationFailure {
+		return &burner.ReputationFailure{Check: CheckHelo, Reason: reason}
+	}
+
+	if helo == "" {
+		return fail("no HELO given")
+	}
+
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := strings.TrimPrefix(strings.Trim(helo, "[]"), "IPv6:")
+		if !ip.Equal(net.ParseIP(literal)) {
+			return fail(fmt.Sprintf("HELO %v doesn't match the client address", helo))
+		}
+		return nil
+	}
+
+	if net.ParseIP(helo) != nil {
+		return fail(fmt.Sprintf("HELO %v is an address which isn't enclosed in brackets", helo))
+	}
+
+	if !strings.Contains(strings.TrimSuffix(helo, "."), ".") {
+		return fail(fmt.Sprintf("HELO %v isn't a fully qualified domain name", helo))
+	}
+
+	_, err := c.resolver.LookupHost(ctx, helo)
+	if isNotFound(err) {
+		return fail(fmt.Sprintf("HELO %v doesn't resolve", helo))
+	}
+	if err != nil {
+		log.WithError(err).WithField("helo", helo).Error("Reputation: failed to lookup helo")
+	}
+
+	return nil
+}
+
+// reverseIP returns the name ip is looked up as in a DNS blocklist zone. IPv4 addresses have their octets reversed
+// and IPv6 addresses their nibbles.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip16 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0x0f), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+
+	return strings.Join(nibbles, ".")
+}
+
+// listed reports whether a DNS blocklist answer means the address is listed
+func listed(addr string) bool {
+	ip := net.ParseIP(addr).To4()
+	return ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255)
+}
+
+func containsIP(addrs []string, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ip.Equal(net.ParseIP(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
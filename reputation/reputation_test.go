@@ -0,0 +1,173 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers lookups from its maps. Names missing from them don't exist.
+type fakeResolver struct {
+	hosts map[string][]string
+	addrs map[string][]string
+	err   error
+}
+
+func (f fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if addrs, ok := f.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if names, ok := f.addrs[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+var resolver = fakeResolver{
+	hosts: map[string][]string{
+		"mail.example.org.":              {"192.0.2.10"},
+		"mail.example.org":               {"192.0.2.10"},
+		"dynamic.example.net.":           {"198.51.100.99"},
+		"20.2.0.192.zen.example.com":     {"127.0.0.4"},
+		"30.2.0.192.refused.example.com": {"127.255.255.254"},
+		"30.2.0.192.zen.example.com":     {"127.0.0.2", "127.0.0.11"},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.com": {"127.0.0.3"},
+	},
+	addrs: map[string][]string{
+		"192.0.2.10": {"mail.example.org."},
+		"192.0.2.20": {"dynamic.example.net."},
+	},
+}
+
+func TestChecker_DNSBL(t *testing.T) {
+	c := New(WithResolver(resolver), WithDNSBL([]string{"refused.example.com", "zen.example.com"}, Tag))
+
+	tests := []struct {
+		Name     string
+		IP       string
+		Expected *burner.ReputationResult
+	}{
+		{Name: "not listed", IP: "192.0.2.10", Expected: nil},
+		{Name: "listed", IP: "192.0.2.20", Expected: &burner.ReputationResult{Failures: []burner.ReputationFailure{{Check: CheckDNSBL, Reason: "192.0.2.20 is listed on zen.example.com"}}}},
+		{Name: "refused then listed", IP: "192.0.2.30", Expected: &burner.ReputationResult{Failures: []burner.ReputationFailure{{Check: CheckDNSBL, Reason: "192.0.2.30 is listed on zen.example.com"}}}},
+		{Name: "ipv6", IP: "2001:db8::1", Expected: &burner.ReputationResult{Failures: []burner.ReputationFailure{{Check: CheckDNSBL, Reason: "2001:db8::1 is listed on zen.example.com"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			res, rejected := c.Check(net.ParseIP(test.IP), "mail.example.org")
+			assert.Equal(t, test.Expected, res)
+			assert.Nil(t, rejected)
+		})
+	}
+}
+
+func TestChecker_FCrDNS(t *testing.T) {
+	c := New(WithResolver(resolver), WithFCrDNS(Reject))
+
+	_, rejected := c.Check(net.ParseIP("192.0.2.10"), "mail.example.org")
+	assert.Nil(t, rejected)
+
+	_, rejected = c.Check(net.ParseIP("192.0.2.20"), "mail.example.org")
+	assert.Equal(t, &burner.ReputationFailure{Check: CheckFCrDNS, Reason: "reverse dns of 192.0.2.20 doesn't resolve back to it"}, rejected)
+
+	_, rejected = c.Check(net.ParseIP("192.0.2.40"), "mail.example.org")
+	assert.Equal(t, &burner.ReputationFailure{Check: CheckFCrDNS, Reason: "192.0.2.40 has no reverse dns"}, rejected)
+}
+
+func TestChecker_Helo(t *testing.T) {
+	c := New(WithResolver(resolver), WithHelo(Reject))
+
+	tests := []struct {
+		Helo     string
+		Rejected bool
+	}{
+		{Helo: "mail.example.org", Rejected: false},
+		{Helo: "mail.example.org.", Rejected: false},
+		{Helo: "[192.0.2.10]", Rejected: false},
+		{Helo: "[192.0.2.11]", Rejected: true},
+		{Helo: "192.0.2.10", Rejected: true},
+		{Helo: "localhost", Rejected: true},
+		{Helo: "doesntexist.example.org", Rejected: true},
+		{Helo: "", Rejected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Helo, func(t *testing.T) {
+			_, rejected := c.Check(net.ParseIP("192.0.2.10"), test.Helo)
+			if test.Rejected {
+				require.NotNil(t, rejected)
+				assert.Equal(t, CheckHelo, rejected.Check)
+			} else {
+				assert.Nil(t, rejected)
+			}
+		})
+	}
+
+	_, rejected := c.Check(net.ParseIP("2001:db8::1"), "[IPv6:2001:db8::1]")
+	assert.Nil(t, rejected)
+}
+
+func TestChecker_Actions(t *testing.T) {
+	// fails every check
+	ip := net.ParseIP("192.0.2.20")
+
+	res, rejected := New(WithResolver(resolver), WithHelo(Tag), WithFCrDNS(Tag), WithDNSBL([]string{"zen.example.com"}, Tag)).Check(ip, "localhost")
+	assert.Nil(t, rejected)
+	require.NotNil(t, res)
+	require.Len(t, res.Failures, 3)
+	assert.Equal(t, CheckHelo, res.Failures[0].Check)
+	assert.Equal(t, CheckFCrDNS, res.Failures[1].Check)
+	assert.Equal(t, CheckDNSBL, res.Failures[2].Check)
+
+	res, rejected = New(WithResolver(resolver), WithHelo(Tag), WithFCrDNS(Reject), WithDNSBL([]string{"zen.example.com"}, Reject)).Check(ip, "localhost")
+	assert.Nil(t, res)
+	require.NotNil(t, rejected)
+	assert.Equal(t, CheckFCrDNS, rejected.Check)
+
+	// no checks are enabled
+	res, rejected = New(WithResolver(resolver)).Check(ip, "localhost")
+	assert.Nil(t, res)
+	assert.Nil(t, rejected)
+
+	var c *Checker
+	res, rejected = c.Check(ip, "localhost")
+	assert.Nil(t, res)
+	assert.Nil(t, rejected)
+}
+
+func TestChecker_FailOpen(t *testing.T) {
+	c := New(WithResolver(fakeResolver{err: errors.New("server misbehaving")}), WithHelo(Reject), WithFCrDNS(Reject), WithDNSBL([]string{"zen.example.com"}, Reject))
+
+	res, rejected := c.Check(net.ParseIP("192.0.2.20"), "mail.example.org")
+	assert.Nil(t, res)
+	assert.Nil(t, rejected)
+}
+
+func TestParseAction(t *testing.T) {
+	a, err := ParseAction("reject")
+	require.NoError(t, err)
+	assert.Equal(t, Reject, a)
+
+	a, err = ParseAction("tag")
+	require.NoError(t, err)
+	assert.Equal(t, Tag, a)
+
+	_, err = ParseAction("flag")
+	assert.Error(t, err)
+}
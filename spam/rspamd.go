@@ -0,0 +1,85 @@
+package spam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+)
+
+var _ Checker = &Rspamd{}
+
+// Rspamd checks messages with rspamd's HTTP protocol
+type Rspamd struct {
+	url      string
+	password string
+	client   *http.Client
+}
+
+// NewRspamd returns a checker for the rspamd worker at url e.g. http://localhost:11333. password is only needed if
+// the worker requires one.
+func NewRspamd(url string, password string) *Rspamd {
+	return &Rspamd{
+		url:      strings.TrimSuffix(url, "/"),
+		password: password,
+		client:   &http.Client{},
+	}
+}
+
+type rspamdResponse struct {
+	Score         *float64                   `json:"score"`
+	RequiredScore float64                    `json:"required_score"`
+	Symbols       map[string]json.RawMessage `json:"symbols"`
+}
+
+// Check implements Checker
+func (r *Rspamd) Check(ctx context.Context, raw []byte) (burner.SpamResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+"/checkv2", bytes.NewReader(raw))
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("rspamd - failed to create request: %w", err)
+	}
+
+	if r.password != "" {
+		req.Header.Set("Password", r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("rspamd - failed to check message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return burner.SpamResult{}, fmt.Errorf("rspamd - check failed with status %v: %s", resp.StatusCode, body)
+	}
+
+	var out rspamdResponse
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("%w: rspamd: %v", ErrBadResponse, err)
+	}
+
+	if out.Score == nil {
+		return burner.SpamResult{}, fmt.Errorf("%w: rspamd didn't return a score", ErrBadResponse)
+	}
+
+	res := burner.SpamResult{
+		Score:     *out.Score,
+		Threshold: out.RequiredScore,
+		Rules:     make([]string, 0, len(out.Symbols)),
+	}
+
+	for name := range out.Symbols {
+		res.Rules = append(res.Rules, name)
+	}
+	sort.Strings(res.Rules)
+
+	return res, nil
+}
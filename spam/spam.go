@@ -0,0 +1,81 @@
+// Package spam scores incoming mail with an external spam filter such as SpamAssassin's spamd or rspamd.
+package spam
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long a checker waits for a message to be scored
+const DefaultTimeout = 10 * time.Second
+
+// ErrBadResponse is returned when a spam filter's response can't be understood
+var ErrBadResponse = errors.New("bad response from spam filter")
+
+// Checker scores a raw RFC 5322 message
+type Checker interface {
+	Check(ctx context.Context, raw []byte) (burner.SpamResult, error)
+}
+
+// Filter scores messages with a Checker and decides whether they should be rejected
+type Filter struct {
+	checker     Checker
+	timeout     time.Duration
+	reject      bool
+	rejectScore float64
+}
+
+// FilterOption configures optional behaviour of a Filter
+type FilterOption func(f *Filter)
+
+// WithRejectScore rejects messages scoring score or more
+func WithRejectScore(score float64) FilterOption {
+	return func(f *Filter) {
+		f.reject = true
+		f.rejectScore = score
+	}
+}
+
+// WithTimeout sets how long to wait for a message to be scored
+func WithTimeout(timeout time.Duration) FilterOption {
+	return func(f *Filter) {
+		f.timeout = timeout
+	}
+}
+
+// NewFilter returns a filter which scores messages with checker. By default messages are never rejected.
+func NewFilter(checker Checker, opts ...FilterOption) *Filter {
+	f := &Filter{
+		checker: checker,
+		timeout: DefaultTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+// Check scores raw and reports whether it should be rejected. If the message can't be scored the result is nil and
+// the message is accepted so that an outage of the spam filter doesn't lose mail. A nil filter accepts everything.
+func (f *Filter) Check(raw []byte) (*burner.SpamResult, bool) {
+	if f == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	res, err := f.checker.Check(ctx, raw)
+	if err != nil {
+		log.WithError(err).Error("Spam: failed to check message")
+		return nil, false
+	}
+
+	return &res, f.reject && res.Score >= f.rejectScore
+}
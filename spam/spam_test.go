@@ -0,0 +1,234 @@
+package spam
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMessage = "From: bob@example.org\r\nTo: bobby@example.com\r\nSubject: Gophers!\r\n\r\nThis is the email body.\r\n"
+
+// fakeSpamd serves a single canned response for each connection and records the messages it was sent
+type fakeSpamd struct {
+	listener net.Listener
+	response string
+	received chan string
+}
+
+func newFakeSpamd(t *testing.T, response string) *fakeSpamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeSpamd{listener: l, response: response, received: make(chan string, 10)}
+	go f.serve()
+	t.Cleanup(func() { l.Close() })
+
+	return f
+}
+
+func (f *fakeSpamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSpamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString('\n')
+	if err != nil || command != "SYMBOLS SPAMC/1.5\r\n" {
+		fmt.Fprintf(conn, "SPAMD/1.5 76 Bad header line: %v\r\n", strings.TrimSpace(command))
+		return
+	}
+
+	var length int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if name, value, _ := strings.Cut(line, ":"); strings.EqualFold(name, "Content-length") {
+			length, _ = strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+
+	msg := make([]byte, length)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return
+	}
+	f.received <- string(msg)
+
+	conn.Write([]byte(f.response))
+}
+
+func (f *fakeSpamd) addr() string {
+	return f.listener.Addr().String()
+}
+
+func TestSpamd_Check(t *testing.T) {
+	f := newFakeSpamd(t, "SPAMD/1.1 0 EX_OK\r\nContent-length: 27\r\nSpam: True ; 15.2 / 5.0\r\n\r\nHTML_MESSAGE,URIBL_BLOCKED\r\n")
+
+	res, err := NewSpamd(f.addr()).Check(context.Background(), []byte(testMessage))
+	require.NoError(t, err)
+
+	assert.Equal(t, burner.SpamResult{Score: 15.2, Threshold: 5, Rules: []string{"HTML_MESSAGE", "URIBL_BLOCKED"}}, res)
+	assert.True(t, res.IsSpam())
+	assert.Equal(t, testMessage, <-f.received)
+}
+
+func TestSpamd_Check_NoRules(t *testing.T) {
+	f := newFakeSpamd(t, "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: False ; -0.1 / 5.0\r\n\r\n")
+
+	res, err := NewSpamd(f.addr()).Check(context.Background(), []byte(testMessage))
+	require.NoError(t, err)
+
+	assert.Equal(t, burner.SpamResult{Score: -0.1, Threshold: 5, Rules: []string{}}, res)
+	assert.False(t, res.IsSpam())
+}
+
+func TestSpamd_Check_Errors(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Response string
+	}{
+		{Name: "error status", Response: "SPAMD/1.1 74 EX_NOTFOUND\r\n\r\n"},
+		{Name: "not spamd", Response: "HTTP/1.1 400 Bad Request\r\n\r\n"},
+		{Name: "missing score", Response: "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\n\r\n"},
+		{Name: "bad score", Response: "SPAMD/1.1 0 EX_OK\r\nSpam: True ; lots / 5.0\r\n\r\n"},
+		{Name: "truncated", Response: "SPAMD/1.1 0 EX_OK\r\nSpam: True"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			f := newFakeSpamd(t, test.Response)
+
+			_, err := NewSpamd(f.addr()).Check(context.Background(), []byte(testMessage))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSpamd_Check_Timeout(t *testing.T) {
+	// accept connections but never respond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = NewSpamd(l.Addr().String()).Check(ctx, []byte(testMessage))
+	assert.Error(t, err)
+}
+
+func TestRspamd_Check(t *testing.T) {
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/checkv2", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("Password"))
+		b, _ := io.ReadAll(r.Body)
+		received = string(b)
+
+		w.Write([]byte(`{"is_skipped":false,"score":7.5,"required_score":15.0,"action":"add header","symbols":{"R_SPF_FAIL":{"name":"R_SPF_FAIL","score":1.0},"FORGED_SENDER":{"name":"FORGED_SENDER","score":6.5}}}`))
+	}))
+	defer ts.Close()
+
+	res, err := NewRspamd(ts.URL+"/", "secret").Check(context.Background(), []byte(testMessage))
+	require.NoError(t, err)
+
+	assert.Equal(t, burner.SpamResult{Score: 7.5, Threshold: 15, Rules: []string{"FORGED_SENDER", "R_SPF_FAIL"}}, res)
+	assert.Equal(t, testMessage, received)
+}
+
+func TestRspamd_Check_Errors(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Status int
+		Body   string
+	}{
+		{Name: "error status", Status: http.StatusInternalServerError, Body: `{"error":"oops"}`},
+		{Name: "bad json", Status: http.StatusOK, Body: `{"score":`},
+		{Name: "missing score", Status: http.StatusOK, Body: `{"error":"skipped"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.Status)
+				w.Write([]byte(test.Body))
+			}))
+			defer ts.Close()
+
+			_, err := NewRspamd(ts.URL, "").Check(context.Background(), []byte(testMessage))
+			assert.Error(t, err)
+		})
+	}
+}
+
+type fakeChecker struct {
+	res burner.SpamResult
+	err error
+}
+
+func (f fakeChecker) Check(ctx context.Context, raw []byte) (burner.SpamResult, error) {
+	return f.res, f.err
+}
+
+func TestFilter_Check(t *testing.T) {
+	spammy := fakeChecker{res: burner.SpamResult{Score: 8, Threshold: 5, Rules: []string{"HTML_MESSAGE"}}}
+
+	res, reject := NewFilter(spammy).Check([]byte(testMessage))
+	assert.Equal(t, &spammy.res, res)
+	assert.False(t, reject)
+
+	res, reject = NewFilter(spammy, WithRejectScore(10)).Check([]byte(testMessage))
+	assert.Equal(t, &spammy.res, res)
+	assert.False(t, reject)
+
+	res, reject = NewFilter(spammy, WithRejectScore(8)).Check([]byte(testMessage))
+	assert.Equal(t, &spammy.res, res)
+	assert.True(t, reject)
+
+	// failures accept the message without a result
+	res, reject = NewFilter(fakeChecker{err: errors.New("unavailable")}, WithRejectScore(0)).Check([]byte(testMessage))
+	assert.Nil(t, res)
+	assert.False(t, reject)
+
+	var f *Filter
+	res, reject = f.Check([]byte(testMessage))
+	assert.Nil(t, res)
+	assert.False(t, reject)
+}
@@ -0,0 +1,150 @@
+package spam
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+)
+
+var _ Checker = &Spamd{}
+
+// Spamd checks messages with SpamAssassin's spamd using the SYMBOLS command of the spamc protocol
+type Spamd struct {
+	network string
+	addr    string
+}
+
+// NewSpamd returns a checker for the spamd listening on addr. addr is either a tcp address or a unix socket given
+// as "unix:/path/to/socket".
+func NewSpamd(addr string) *Spamd {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return &Spamd{network: "unix", addr: path}
+	}
+	return &Spamd{network: "tcp", addr: addr}
+}
+
+// Check implements Checker
+func (s *Spamd) Check(ctx context.Context, raw []byte) (burner.SpamResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("spamd - failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return burner.SpamResult{}, fmt.Errorf("spamd - failed to set deadline: %w", err)
+		}
+	}
+
+	_, err = fmt.Fprintf(conn, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(raw))
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("spamd - failed to write request: %w", err)
+	}
+
+	_, err = conn.Write(raw)
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("spamd - failed to write message: %w", err)
+	}
+
+	return readSpamdResponse(bufio.NewReader(conn))
+}
+
+// readSpamdResponse parses a response to SYMBOLS which looks like:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 27
+//	Spam: True ; 15.0 / 5.0
+//
+//	HTML_MESSAGE,URIBL_BLOCKED
+func readSpamdResponse(r *bufio.Reader) (burner.SpamResult, error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("spamd - failed to read status: %w", err)
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return burner.SpamResult{}, fmt.Errorf("%w: spamd status %q", ErrBadResponse, strings.TrimSpace(status))
+	}
+	if fields[1] != "0" {
+		return burner.SpamResult{}, fmt.Errorf("spamd - check failed: %v", strings.Join(fields[1:], " "))
+	}
+
+	var res burner.SpamResult
+	var foundSpam bool
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return burner.SpamResult{}, fmt.Errorf("spamd - failed to read headers: %w", err)
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Spam") {
+			continue
+		}
+
+		res.Score, res.Threshold, err = parseSpamHeader(value)
+		if err != nil {
+			return burner.SpamResult{}, err
+		}
+		foundSpam = true
+	}
+
+	if !foundSpam {
+		return burner.SpamResult{}, fmt.Errorf("%w: spamd didn't return a score", ErrBadResponse)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return burner.SpamResult{}, fmt.Errorf("spamd - failed to read symbols: %w", err)
+	}
+
+	res.Rules = []string{}
+	for _, rule := range strings.Split(string(body), ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			res.Rules = append(res.Rules, rule)
+		}
+	}
+
+	return res, nil
+}
+
+// parseSpamHeader parses the value of a Spam header e.g. "True ; 15.0 / 5.0"
+func parseSpamHeader(value string) (float64, float64, error) {
+	_, scores, ok := strings.Cut(value, ";")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: spamd Spam header %q", ErrBadResponse, value)
+	}
+
+	score, threshold, ok := strings.Cut(scores, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: spamd Spam header %q", ErrBadResponse, value)
+	}
+
+	s, err := strconv.ParseFloat(strings.TrimSpace(score), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: spamd score %q", ErrBadResponse, score)
+	}
+
+	t, err := strconv.ParseFloat(strings.TrimSpace(threshold), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: spamd threshold %q", ErrBadResponse, threshold)
+	}
+
+	return s, t, nil
+}
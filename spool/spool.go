@@ -0,0 +1,346 @@
+// Package spool keeps accepted messages on disk until they have been saved to the database. If the database is
+// unavailable delivery is retried in the background and messages left over from a previous run are delivered when
+// the spool is opened again.
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMaxAge is how long delivery of a message is retried before it is given up on
+const DefaultMaxAge = 24 * time.Hour
+
+const (
+	// scanInterval is how often the spool is checked for messages due a retry
+	scanInterval = time.Second
+	// minBackoff and maxBackoff bound the wait between attempts to deliver a message
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// ext is the extension of spooled messages. Messages are written under tmpDir first and renamed into place so that
+// partially written files are never delivered.
+const ext = ".json"
+
+// tmpDir holds messages being written and failedDir those which couldn't be delivered before the max age
+const (
+	tmpDir    = "tmp"
+	failedDir = "failed"
+)
+
+// Spool is a directory of messages waiting to be saved to a database
+type Spool struct {
+	dir    string
+	db     burner.Database
+	maxAge time.Duration
+
+	m       sync.Mutex
+	retries map[string]retry
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// record is a spooled message. Fields which aren't part of a message's json are stored alongside it.
+type record struct {
+	InboxID         string         `json:"inbox_id"`
+	EmailProviderID string         `json:"ep_id"`
+	Message         burner.Message `json:"message"`
+}
+
+type retry struct {
+	attempts int
+	next     time.Time
+}
+
+// Option configures a Spool
+type Option func(s *Spool)
+
+// WithMaxAge sets how long delivery of a message is retried before it is moved to the failed directory
+func WithMaxAge(d time.Duration) Option {
+	return func(s *Spool) {
+		s.maxAge = d
+	}
+}
+
+// Open opens the spool in dir, creating it if needed, and starts delivering messages in it to db including any left
+// over from a previous run
+func Open(dir string, db burner.Database, opts ...Option) (*Spool, error) {
+	s := &Spool{
+		dir:     dir,
+		db:      db,
+		maxAge:  DefaultMaxAge,
+		retries: make(map[string]retry),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	for _, d := range []string{dir, filepath.Join(dir, tmpDir), filepath.Join(dir, failedDir)} {
+		err := os.MkdirAll(d, 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("Spool - failed to create %v: %w", d, err)
+		}
+	}
+
+	// anything in tmp was never accepted
+	tmp, err := os.ReadDir(filepath.Join(dir, tmpDir))
+	if err != nil {
+		return nil, fmt.Errorf("Spool - failed to read tmp dir: %w", err)
+	}
+	for _, e := range tmp {
+		err = os.Remove(filepath.Join(dir, tmpDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Spool - failed to remove partially written message: %w", err)
+		}
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Add writes msg to the spool. Once it returns msg will be delivered even if the process restarts.
+func (s *Spool) Add(msg burner.Message) error {
+	b, err := json.Marshal(record{InboxID: msg.InboxID, EmailProviderID: msg.EmailProviderID, Message: msg})
+	if err != nil {
+		return fmt.Errorf("Spool - failed to marshal message: %w", err)
+	}
+
+	name := msg.ID + ext
+	tmp := filepath.Join(s.dir, tmpDir, name)
+
+	err = writeFileSync(tmp, b)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Spool - failed to write message: %w", err)
+	}
+
+	err = os.Rename(tmp, filepath.Join(s.dir, name))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Spool - failed to move message into spool: %w", err)
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Stop stops delivering messages. Messages still in the spool are delivered when it is next opened. It is safe to
+// call more than once.
+func (s *Spool) Stop() {
+	if s == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+func (s *Spool) run() {
+	defer close(s.done)
+
+	t := time.NewTicker(scanInterval)
+	defer t.Stop()
+
+	for {
+		s.deliverDue(time.Now())
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// deliverDue attempts to deliver each message which isn't waiting for a retry and updates the spool metrics
+func (s *Spool) deliverDue(now time.Time) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.WithError(err).Error("Spool: failed to read spool dir")
+		return
+	}
+
+	var count int
+	var size int64
+	var oldest time.Time
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ext) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			// delivered or moved since the dir was read
+			continue
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if s.deliverFile(e.Name(), info.ModTime(), now) {
+			continue
+		}
+
+		count++
+		size += info.Size()
+		if oldest.IsZero() || info.ModTime().Before(oldest) {
+			oldest = info.ModTime()
+		}
+	}
+
+	metrics.SpoolMessages.Set(float64(count))
+	metrics.SpoolBytes.Set(float64(size))
+	if oldest.IsZero() {
+		metrics.SpoolOldestAge.Set(0)
+	} else {
+		metrics.SpoolOldestAge.Set(now.Sub(oldest).Seconds())
+	}
+}
+
+// deliverFile delivers the spooled message in name if it is due. It returns whether the message has left the spool.
+func (s *Spool) deliverFile(name string, spooledAt time.Time, now time.Time) bool {
+	s.m.Lock()
+	r := s.retries[name]
+	s.m.Unlock()
+
+	if now.Before(r.next) {
+		return false
+	}
+
+	path := filepath.Join(s.dir, name)
+
+	err := s.deliver(path)
+	if err == nil {
+		err = os.Remove(path)
+		if err != nil {
+			log.WithError(err).WithField("file", name).Error("Spool: failed to remove delivered message")
+			return false
+		}
+
+		s.m.Lock()
+		delete(s.retries, name)
+		s.m.Unlock()
+		return true
+	}
+
+	metrics.SpoolDeliveryFailures.Inc()
+
+	if now.Sub(spooledAt) >= s.maxAge {
+		log.WithError(err).WithField("file", name).Error("Spool: giving up on message")
+
+		err = os.Rename(path, filepath.Join(s.dir, failedDir, name))
+		if err != nil {
+			log.WithError(err).WithField("file", name).Error("Spool: failed to move message to failed dir")
+			return false
+		}
+
+		s.m.Lock()
+		delete(s.retries, name)
+		s.m.Unlock()
+		return true
+	}
+
+	r.attempts++
+	r.next = now.Add(backoff(r.attempts))
+	log.WithError(err).WithFields(log.Fields{"file": name, "attempts": r.attempts, "next": r.next}).Error("Spool: failed to deliver message")
+
+	s.m.Lock()
+	s.retries[name] = r
+	s.m.Unlock()
+
+	return false
+}
+
+// deliver saves the message in path to the database. A message which was saved by an earlier attempt that failed
+// to remove it from the spool isn't saved again, nor is a duplicate of another message the database already has.
+func (s *Spool) deliver(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+
+	var rec record
+	err = json.Unmarshal(b, &rec)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+
+	msg := rec.Message
+	msg.InboxID = rec.InboxID
+	msg.EmailProviderID = rec.EmailProviderID
+
+	err = s.db.SaveNewMessageOnce(msg)
+	if err == nil {
+		metrics.EmailsReceived.Inc()
+		return nil
+	}
+
+	if _, getErr := s.db.GetMessageByID(msg.InboxID, msg.ID); getErr == nil {
+		return nil
+	}
+
+	if errors.Is(err, burner.ErrDuplicateMessage) {
+		log.WithFields(log.Fields{"id": msg.InboxID, "ep_id": msg.EmailProviderID}).Info("Spool: dropped duplicate message")
+		metrics.EmailsDeduplicated.With(prometheus.Labels{"provider": "spool"}).Inc()
+		return nil
+	}
+
+	return err
+}
+
+// backoff returns how long to wait before the given attempt, doubling each time up to maxBackoff
+func backoff(attempts int) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	return errors.Join(err, f.Close())
+}
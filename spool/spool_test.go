@@ -0,0 +1,235 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+// fakeDB saves messages in memory failing the first failures attempts. Like a real database it refuses duplicates.
+type fakeDB struct {
+	burner.Database
+
+	m        sync.Mutex
+	failures int
+	saved    map[string]burner.Message
+}
+
+func newFakeDB(failures int) *fakeDB {
+	return &fakeDB{failures: failures, saved: make(map[string]burner.Message)}
+}
+
+func (db *fakeDB) SaveNewMessageOnce(m burner.Message) error {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	if db.failures > 0 {
+		db.failures--
+		return errUnavailable
+	}
+
+	for _, saved := range db.saved {
+		if saved.InboxID == m.InboxID && saved.EmailProviderID == m.EmailProviderID {
+			return burner.ErrDuplicateMessage
+		}
+	}
+
+	db.saved[m.ID] = m
+	return nil
+}
+
+func (db *fakeDB) GetMessageByID(inboxID, messageID string) (burner.Message, error) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	m, ok := db.saved[messageID]
+	if !ok {
+		return burner.Message{}, burner.ErrMessageDoesntExist
+	}
+	return m, nil
+}
+
+func (db *fakeDB) get(id string) (burner.Message, bool) {
+	db.m.Lock()
+	defer db.m.Unlock()
+
+	m, ok := db.saved[id]
+	return m, ok
+}
+
+// newStoppedSpool returns a spool without a running worker so tests can drive delivery themselves
+func newStoppedSpool(t *testing.T, db burner.Database) *Spool {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, tmpDir), 0o700))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, failedDir), 0o700))
+
+	return &Spool{
+		dir:     dir,
+		db:      db,
+		maxAge:  time.Hour,
+		retries: make(map[string]retry),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+func testMessage(id string) burner.Message {
+	return burner.Message{
+		ID:              id,
+		InboxID:         "1234",
+		Sender:          "bob@example.com",
+		Subject:         "Hello",
+		BodyHTML:        "<p>Hi</p>",
+		TTL:             1600000000,
+		EmailProviderID: "mg-" + id,
+	}
+}
+
+func spooled(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestSpool_Add(t *testing.T) {
+	db := newFakeDB(0)
+	s, err := Open(t.TempDir(), db)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	msg := testMessage("abc")
+	require.NoError(t, s.Add(msg))
+
+	require.Eventually(t, func() bool {
+		_, ok := db.get("abc")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	saved, _ := db.get("abc")
+	assert.Equal(t, msg, saved)
+
+	require.Eventually(t, func() bool {
+		return len(spooled(t, s.dir)) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// stopping again is a no-op
+	s.Stop()
+}
+
+func TestSpool_Retry(t *testing.T) {
+	db := newFakeDB(2)
+	s := newStoppedSpool(t, db)
+	now := time.Now()
+
+	require.NoError(t, s.Add(testMessage("abc")))
+
+	s.deliverDue(now)
+	assert.Equal(t, []string{"abc.json"}, spooled(t, s.dir))
+	assert.Equal(t, 1, s.retries["abc.json"].attempts)
+
+	// not due yet
+	s.deliverDue(now.Add(500 * time.Millisecond))
+	assert.Equal(t, 1, s.retries["abc.json"].attempts)
+
+	s.deliverDue(now.Add(time.Second))
+	assert.Equal(t, 2, s.retries["abc.json"].attempts)
+	assert.Equal(t, now.Add(3*time.Second), s.retries["abc.json"].next)
+
+	s.deliverDue(now.Add(3 * time.Second))
+	_, ok := db.get("abc")
+	assert.True(t, ok)
+	assert.Empty(t, spooled(t, s.dir))
+	assert.Empty(t, s.retries)
+}
+
+func TestSpool_AlreadySaved(t *testing.T) {
+	db := newFakeDB(1)
+	db.saved["abc"] = testMessage("abc")
+	s := newStoppedSpool(t, db)
+
+	// a previous attempt saved the message but didn't remove it
+	require.NoError(t, s.Add(testMessage("abc")))
+
+	s.deliverDue(time.Now())
+	assert.Empty(t, spooled(t, s.dir))
+}
+
+func TestSpool_Duplicate(t *testing.T) {
+	db := newFakeDB(0)
+	db.saved["abc"] = testMessage("abc")
+	s := newStoppedSpool(t, db)
+
+	// the provider redelivered a message which was saved
+	dup := testMessage("def")
+	dup.EmailProviderID = "mg-abc"
+	require.NoError(t, s.Add(dup))
+
+	s.deliverDue(time.Now())
+	assert.Empty(t, spooled(t, s.dir))
+	assert.Empty(t, s.retries)
+
+	_, ok := db.get("def")
+	assert.False(t, ok)
+}
+
+func TestSpool_MaxAge(t *testing.T) {
+	db := newFakeDB(1)
+	s := newStoppedSpool(t, db)
+
+	require.NoError(t, s.Add(testMessage("abc")))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(s.dir, "abc.json"), old, old))
+
+	s.deliverDue(time.Now())
+	assert.Empty(t, spooled(t, s.dir))
+	assert.Equal(t, []string{"abc.json"}, spooled(t, filepath.Join(s.dir, failedDir)))
+}
+
+func TestOpen_Recover(t *testing.T) {
+	// leave messages behind from a previous run
+	prev := newStoppedSpool(t, newFakeDB(0))
+	require.NoError(t, prev.Add(testMessage("abc")))
+	require.NoError(t, prev.Add(testMessage("def")))
+	require.NoError(t, os.WriteFile(filepath.Join(prev.dir, tmpDir, "ghi.json"), []byte("{"), 0o600))
+
+	db := newFakeDB(0)
+	s, err := Open(prev.dir, db)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	assert.Empty(t, spooled(t, filepath.Join(s.dir, tmpDir)), "partially written messages should be removed")
+
+	require.Eventually(t, func() bool {
+		_, abc := db.get("abc")
+		_, def := db.get("def")
+		return abc && def
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, backoff(1))
+	assert.Equal(t, 2*time.Second, backoff(2))
+	assert.Equal(t, 4*time.Second, backoff(3))
+	assert.Equal(t, maxBackoff, backoff(20))
+}
+
+func TestSpool_StopNil(t *testing.T) {
+	var s *Spool
+	s.Stop()
+}
@@ -0,0 +1,115 @@
+package virus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+)
+
+var _ Scanner = &Clamd{}
+
+// chunkSize is the most sent to clamd in one INSTREAM chunk
+const chunkSize = 64 * 1024
+
+// Clamd scans messages with clamd using the INSTREAM command
+type Clamd struct {
+	network string
+	addr    string
+}
+
+// NewClamd returns a scanner for the clamd listening on addr. addr is either a tcp address or a unix socket given
+// as "unix:/path/to/socket".
+func NewClamd(addr string) *Clamd {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return &Clamd{network: "unix", addr: path}
+	}
+	return &Clamd{network: "tcp", addr: addr}
+}
+
+// Scan implements Scanner
+func (c *Clamd) Scan(ctx context.Context, raw []byte) (burner.VirusResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return burner.VirusResult{}, fmt.Errorf("clamd - failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return burner.VirusResult{}, fmt.Errorf("clamd - failed to set deadline: %w", err)
+		}
+	}
+
+	w := bufio.NewWriter(conn)
+
+	// the z prefix means the command and response are null terminated
+	_, err = w.WriteString("zINSTREAM\x00")
+	if err != nil {
+		return burner.VirusResult{}, fmt.Errorf("clamd - failed to write command: %w", err)
+	}
+
+	// the message is sent in length prefixed chunks ending with an empty chunk
+	for len(raw) > 0 {
+		n := min(len(raw), chunkSize)
+		err = writeChunk(w, raw[:n])
+		if err != nil {
+			return burner.VirusResult{}, fmt.Errorf("clamd - failed to write message: %w", err)
+		}
+		raw = raw[n:]
+	}
+
+	err = writeChunk(w, nil)
+	if err != nil {
+		return burner.VirusResult{}, fmt.Errorf("clamd - failed to write message: %w", err)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return burner.VirusResult{}, fmt.Errorf("clamd - failed to write message: %w", err)
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil {
+		return burner.VirusResult{}, fmt.Errorf("clamd - failed to read response: %w", err)
+	}
+
+	return parseClamdResponse(strings.TrimSuffix(resp, "\x00"))
+}
+
+func writeChunk(w *bufio.Writer, chunk []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(chunk)))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(chunk)
+	return err
+}
+
+// parseClamdResponse parses responses such as "stream: OK" and "stream: Eicar-Test-Signature FOUND"
+func parseClamdResponse(resp string) (burner.VirusResult, error) {
+	// errors such as "INSTREAM size limit exceeded. ERROR" may not be prefixed with the stream name
+	if strings.HasSuffix(resp, " ERROR") {
+		return burner.VirusResult{}, fmt.Errorf("clamd - scan failed: %v", strings.TrimSuffix(resp, " ERROR"))
+	}
+
+	_, result, ok := strings.Cut(resp, ": ")
+	if !ok {
+		return burner.VirusResult{}, fmt.Errorf("%w: clamd response %q", ErrBadResponse, resp)
+	}
+
+	switch {
+	case result == "OK":
+		return burner.VirusResult{Infected: false}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return burner.VirusResult{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return burner.VirusResult{}, fmt.Errorf("%w: clamd response %q", ErrBadResponse, resp)
+	}
+}
@@ -0,0 +1,78 @@
+// Package virus scans incoming mail for malware with an external scanner such as clamd.
+package virus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long a scanner waits for a message to be scanned
+const DefaultTimeout = 30 * time.Second
+
+// ErrBadResponse is returned when a scanner's response can't be understood
+var ErrBadResponse = errors.New("bad response from virus scanner")
+
+// Scanner scans a raw RFC 5322 message
+type Scanner interface {
+	Scan(ctx context.Context, raw []byte) (burner.VirusResult, error)
+}
+
+// Action is what is done with infected mail
+type Action string
+
+const (
+	// Reject refuses infected mail
+	Reject Action = "reject"
+	// Flag stores infected mail with its content withheld
+	Flag Action = "flag"
+)
+
+// ParseAction parses an action from configuration
+func ParseAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case Reject, Flag:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown action %q: must be one of %v or %v", s, Reject, Flag)
+	}
+}
+
+// Filter scans messages with a Scanner and decides whether they should be rejected
+type Filter struct {
+	scanner Scanner
+	action  Action
+	timeout time.Duration
+}
+
+// NewFilter returns a filter which scans messages with scanner and applies action to infected ones
+func NewFilter(scanner Scanner, action Action) *Filter {
+	return &Filter{
+		scanner: scanner,
+		action:  action,
+		timeout: DefaultTimeout,
+	}
+}
+
+// Check scans raw and reports whether it should be rejected. If the message can't be scanned the result is nil and
+// the message is accepted so that an outage of the scanner doesn't lose mail. A nil filter accepts everything.
+func (f *Filter) Check(raw []byte) (*burner.VirusResult, bool) {
+	if f == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	res, err := f.scanner.Scan(ctx, raw)
+	if err != nil {
+		log.WithError(err).Error("Virus: failed to scan message")
+		return nil, false
+	}
+
+	return &res, res.Infected && f.action == Reject
+}
@@ -0,0 +1,180 @@
+package virus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eicar is the standard anti-virus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// maxStreamLength mirrors clamd's StreamMaxLength option
+const maxStreamLength = 1024 * 1024
+
+// fakeClamd speaks enough of the INSTREAM protocol to flag messages containing the EICAR test string
+type fakeClamd struct {
+	listener net.Listener
+	received chan string
+}
+
+func newFakeClamd(t *testing.T) *fakeClamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeClamd{listener: l, received: make(chan string, 10)}
+	go f.serve()
+	t.Cleanup(func() { l.Close() })
+
+	return f
+}
+
+func (f *fakeClamd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	command, err := r.ReadString('\x00')
+	if err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var msg strings.Builder
+	for {
+		var length uint32
+		err := binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+		if length == 0 {
+			break
+		}
+		if msg.Len()+int(length) > maxStreamLength {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+
+		_, err = io.CopyN(&msg, r, int64(length))
+		if err != nil {
+			return
+		}
+	}
+	f.received <- msg.String()
+
+	if strings.Contains(msg.String(), eicar) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamd_Scan(t *testing.T) {
+	f := newFakeClamd(t)
+	c := NewClamd(f.listener.Addr().String())
+
+	clean := "From: bob@example.org\r\nSubject: Gophers!\r\n\r\nThis is the email body.\r\n"
+	res, err := c.Scan(context.Background(), []byte(clean))
+	require.NoError(t, err)
+	assert.Equal(t, burner.VirusResult{Infected: false}, res)
+	assert.Equal(t, clean, <-f.received)
+
+	infected := "From: bob@example.org\r\nSubject: Gophers!\r\n\r\n" + eicar + "\r\n"
+	res, err = c.Scan(context.Background(), []byte(infected))
+	require.NoError(t, err)
+	assert.Equal(t, burner.VirusResult{Infected: true, Signature: "Eicar-Test-Signature"}, res)
+	<-f.received
+
+	// large messages are split over several chunks
+	large := strings.Repeat("a", 3*chunkSize+10) + eicar
+	res, err = c.Scan(context.Background(), []byte(large))
+	require.NoError(t, err)
+	assert.True(t, res.Infected)
+	assert.Equal(t, large, <-f.received)
+
+	_, err = c.Scan(context.Background(), []byte(strings.Repeat("a", 2*1024*1024)))
+	assert.Error(t, err)
+}
+
+func TestParseClamdResponse(t *testing.T) {
+	res, err := parseClamdResponse("stream: OK")
+	require.NoError(t, err)
+	assert.False(t, res.Infected)
+
+	res, err = parseClamdResponse("stream: Win.Test.EICAR_HDB-1 FOUND")
+	require.NoError(t, err)
+	assert.Equal(t, burner.VirusResult{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}, res)
+
+	_, err = parseClamdResponse("stream: Can't allocate memory ERROR")
+	assert.Error(t, err)
+
+	_, err = parseClamdResponse("UNKNOWN COMMAND")
+	assert.ErrorIs(t, err, ErrBadResponse)
+}
+
+type fakeScanner struct {
+	res burner.VirusResult
+	err error
+}
+
+func (f fakeScanner) Scan(ctx context.Context, raw []byte) (burner.VirusResult, error) {
+	return f.res, f.err
+}
+
+func TestFilter_Check(t *testing.T) {
+	infected := fakeScanner{res: burner.VirusResult{Infected: true, Signature: "Eicar-Test-Signature"}}
+	clean := fakeScanner{res: burner.VirusResult{Infected: false}}
+
+	res, reject := NewFilter(infected, Reject).Check([]byte(eicar))
+	assert.Equal(t, &infected.res, res)
+	assert.True(t, reject)
+
+	res, reject = NewFilter(infected, Flag).Check([]byte(eicar))
+	assert.Equal(t, &infected.res, res)
+	assert.False(t, reject)
+
+	res, reject = NewFilter(clean, Reject).Check([]byte("hello"))
+	assert.Equal(t, &clean.res, res)
+	assert.False(t, reject)
+
+	// failures accept the message without a verdict
+	res, reject = NewFilter(fakeScanner{err: errors.New("unavailable")}, Reject).Check([]byte(eicar))
+	assert.Nil(t, res)
+	assert.False(t, reject)
+
+	var f *Filter
+	res, reject = f.Check([]byte(eicar))
+	assert.Nil(t, res)
+	assert.False(t, reject)
+}
+
+func TestParseAction(t *testing.T) {
+	a, err := ParseAction("reject")
+	require.NoError(t, err)
+	assert.Equal(t, Reject, a)
+
+	a, err = ParseAction("flag")
+	require.NoError(t, err)
+	assert.Equal(t, Flag, a)
+
+	_, err = ParseAction("quarantine")
+	assert.Error(t, err)
+}